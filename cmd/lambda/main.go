@@ -0,0 +1,25 @@
+// Command lambda is the function's entry point. It runs as a Lambda handler,
+// or, with RUN_MODE=serve, as a container service polling SQS.
+package main
+
+import (
+ "log"
+ "os"
+
+ "github.com/aws/aws-lambda-go/lambda"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/transfer"
+)
+
+func main() {
+ b := transfer.CurrentBuild()
+ log.Printf("Build %s (commit %s, built %s, %s)", b.Version, b.Commit, b.BuildDate, b.GoVersion)
+ transfer.Prewarm()
+ if os.Getenv("RUN_MODE") == transfer.RunModeServe {
+  if err := transfer.Serve(); err != nil {
+   log.Fatalf("Serve failed: %v", err)
+  }
+  return
+ }
+ lambda.Start(transfer.HandleInvocation)
+}
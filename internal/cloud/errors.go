@@ -0,0 +1,16 @@
+package cloud
+
+import (
+ "errors"
+
+ "github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// codeOf returns the AWS error code of err, or "" when it carries none.
+func codeOf(err error) string {
+ var aerr awserr.Error
+ if errors.As(err, &aerr) {
+  return aerr.Code()
+ }
+ return ""
+}
@@ -0,0 +1,23 @@
+package cloud
+
+import (
+ "context"
+
+ "github.com/aws/aws-sdk-go/aws"
+ awslambda "github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// InvokeAsync starts an asynchronous invocation of the Lambda function
+// functionARN with payload, returning its request ID.
+func (s *Session) InvokeAsync(ctx context.Context, functionARN string, payload []byte) (string, error) {
+ req, _ := awslambda.New(s.sess).InvokeRequest(&awslambda.InvokeInput{
+  FunctionName:   aws.String(functionARN),
+  InvocationType: aws.String(awslambda.InvocationTypeEvent),
+  Payload:        payload,
+ })
+ req.SetContext(ctx)
+ if err := req.Send(); err != nil {
+  return "", err
+ }
+ return req.RequestID, nil
+}
@@ -0,0 +1,35 @@
+package cloud
+
+import (
+ "github.com/aws/aws-sdk-go/aws"
+ "github.com/aws/aws-sdk-go/service/ses"
+ "github.com/aws/aws-sdk-go/service/sns"
+)
+
+// Publish sends a notification to the SNS topic topicARN.
+func (s *Session) Publish(topicARN, subject, message string) error {
+ _, err := sns.New(s.sess).Publish(&sns.PublishInput{
+  TopicArn: aws.String(topicARN),
+  Subject:  aws.String(subject),
+  Message:  aws.String(message),
+ })
+ return err
+}
+
+// SendRawEmail sends the MIME message raw from from to the recipients to
+// through SES.
+func (s *Session) SendRawEmail(from string, to []string, raw []byte) error {
+ _, err := ses.New(s.sess).SendRawEmail(&ses.SendRawEmailInput{
+  Source:       aws.String(from),
+  Destinations: aws.StringSlice(to),
+  RawMessage:   &ses.RawMessage{Data: raw},
+ })
+ return err
+}
+
+// IsEmailRejected reports whether SES refused a message for its sender or
+// recipients, as it does for unverified identities and in the SES sandbox.
+func IsEmailRejected(err error) bool {
+ code := codeOf(err)
+ return code == ses.ErrCodeMessageRejected || code == ses.ErrCodeMailFromDomainNotVerifiedException
+}
@@ -0,0 +1,51 @@
+package cloud
+
+import (
+ "github.com/aws/aws-sdk-go/aws"
+ "github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// Parameters reads and writes SSM parameters.
+type Parameters struct {
+ svc *ssm.SSM
+}
+
+// Parameters returns an SSM client of s.
+func (s *Session) Parameters() *Parameters {
+ return &Parameters{svc: ssm.New(s.sess)}
+}
+
+// Get returns the value of the string parameter name, with found false
+// when there is no such parameter.
+func (p *Parameters) Get(name string) (value string, found bool, err error) {
+ out, err := p.svc.GetParameter(&ssm.GetParameterInput{Name: aws.String(name)})
+ if err != nil {
+  if codeOf(err) == ssm.ErrCodeParameterNotFound {
+   return "", false, nil
+  }
+  return "", false, err
+ }
+ return aws.StringValue(out.Parameter.Value), true, nil
+}
+
+// Put stores value in the string parameter name. Without overwrite it fails
+// with an error IsParameterExists reports on when the parameter exists.
+func (p *Parameters) Put(name, value, description string, overwrite bool) error {
+ in := &ssm.PutParameterInput{
+  Name:      aws.String(name),
+  Value:     aws.String(value),
+  Type:      aws.String(ssm.ParameterTypeString),
+  Overwrite: aws.Bool(overwrite),
+ }
+ if description != "" {
+  in.Description = aws.String(description)
+ }
+ _, err := p.svc.PutParameter(in)
+ return err
+}
+
+// IsParameterExists reports whether err is Put refusing to overwrite a
+// parameter.
+func IsParameterExists(err error) bool {
+ return codeOf(err) == ssm.ErrCodeParameterAlreadyExists
+}
@@ -0,0 +1,77 @@
+package cloud
+
+import (
+ "context"
+ "time"
+
+ "github.com/aws/aws-sdk-go/aws"
+ "github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Queue is an SQS queue messages are received from.
+type Queue struct {
+ svc *sqs.SQS
+ url string
+}
+
+// Message is a message received from a Queue.
+type Message struct {
+ ID            string
+ Body          string
+ ReceiptHandle string
+ // Attributes holds the string message attributes asked for.
+ Attributes map[string]string
+}
+
+// Queue returns the queue at url.
+func (s *Session) Queue(url string) *Queue {
+ return &Queue{svc: sqs.New(s.sess), url: url}
+}
+
+// Receive long-polls for up to wait for a single message, hiding it for
+// visibility once received, with the string message attributes named.
+func (q *Queue) Receive(ctx context.Context, attributes []string, wait, visibility time.Duration) ([]Message, error) {
+ out, err := q.svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+  QueueUrl:              aws.String(q.url),
+  MaxNumberOfMessages:   aws.Int64(1),
+  MessageAttributeNames: aws.StringSlice(attributes),
+  WaitTimeSeconds:       aws.Int64(int64(wait / time.Second)),
+  VisibilityTimeout:     aws.Int64(int64(visibility / time.Second)),
+ })
+ if err != nil {
+  return nil, err
+ }
+ msgs := make([]Message, 0, len(out.Messages))
+ for _, m := range out.Messages {
+  msg := Message{
+   ID:            aws.StringValue(m.MessageId),
+   Body:          aws.StringValue(m.Body),
+   ReceiptHandle: aws.StringValue(m.ReceiptHandle),
+   Attributes:    make(map[string]string, len(m.MessageAttributes)),
+  }
+  for name, a := range m.MessageAttributes {
+   if a != nil && a.StringValue != nil {
+    msg.Attributes[name] = *a.StringValue
+   }
+  }
+  msgs = append(msgs, msg)
+ }
+ return msgs, nil
+}
+
+// Delete removes a received message from the queue.
+func (q *Queue) Delete(msg Message) error {
+ _, err := q.svc.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: aws.String(q.url), ReceiptHandle: aws.String(msg.ReceiptHandle)})
+ return err
+}
+
+// SetVisibility hides a received message for d from now; zero makes it
+// visible again at once.
+func (q *Queue) SetVisibility(msg Message, d time.Duration) error {
+ _, err := q.svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+  QueueUrl:          aws.String(q.url),
+  ReceiptHandle:     aws.String(msg.ReceiptHandle),
+  VisibilityTimeout: aws.Int64(int64(d / time.Second)),
+ })
+ return err
+}
@@ -0,0 +1,46 @@
+package cloud
+
+import (
+ "github.com/aws/aws-sdk-go/aws"
+ "github.com/aws/aws-sdk-go/service/secretsmanager"
+ "github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+// SecretsManagerOverride, when set, is used in place of every Secrets
+// Manager client, so tests can serve secrets from memory.
+var SecretsManagerOverride secretsmanageriface.SecretsManagerAPI
+
+// Secret is the current value of a Secrets Manager secret.
+type Secret struct {
+ Value   string
+ Version string
+}
+
+// GetSecret returns the current value of the named secret, calling
+// endpoint when it is set, as SECRETSMANAGER_ENDPOINT_URL may ask.
+func (s *Session) GetSecret(endpoint, name string) (*Secret, error) {
+ svc := SecretsManagerOverride
+ switch {
+ case svc != nil:
+ case endpoint == "":
+  svc = secretsmanager.New(s.sess)
+ default:
+  svc = secretsmanager.New(s.sess, &aws.Config{Endpoint: aws.String(endpoint)})
+ }
+ out, err := svc.GetSecretValue(&secretsmanager.GetSecretValueInput{
+  SecretId: aws.String(name),
+ })
+ if err != nil {
+  return nil, err
+ }
+ return &Secret{Value: aws.StringValue(out.SecretString), Version: aws.StringValue(out.VersionId)}, nil
+}
+
+// SecretsManagerEndpoint returns the endpoint GetSecret calls given
+// endpoint, for logs and errors.
+func (s *Session) SecretsManagerEndpoint(endpoint string) string {
+ if endpoint != "" {
+  return endpoint
+ }
+ return s.Endpoint(secretsmanager.EndpointsID)
+}
@@ -0,0 +1,89 @@
+// Package cloud holds the AWS plumbing of the function other than S3: the
+// session its clients are created from, the credentials the source bucket
+// is read with, and the handful of calls made to Secrets Manager, SSM, SNS,
+// SES, Lambda, SQS and AWS Transfer Family. Callers deal in plain values;
+// SDK types stay inside this package and internal/source.
+package cloud
+
+import (
+ "sync"
+
+ "github.com/aws/aws-sdk-go/aws"
+ "github.com/aws/aws-sdk-go/aws/credentials"
+ "github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+ "github.com/aws/aws-sdk-go/aws/endpoints"
+ "github.com/aws/aws-sdk-go/aws/session"
+ "github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Region is the region the function and its bucket are deployed in.
+const Region = "ap-southeast-1"
+
+// Session is an AWS session the function's clients are created from.
+type Session struct {
+ sess *session.Session
+}
+
+// sessionCache holds the session of each FIPS_MODE setting, created once
+// per execution environment, usually during the init phase.
+var sessionCache = struct {
+ mu       sync.Mutex
+ sessions map[bool]*Session
+}{sessions: make(map[bool]*Session)}
+
+// NewSession returns the session the function's own clients are created
+// from, using FIPS endpoints when fips is set.
+func NewSession(fips bool) (*Session, error) {
+ sessionCache.mu.Lock()
+ defer sessionCache.mu.Unlock()
+ if s := sessionCache.sessions[fips]; s != nil {
+  return s, nil
+ }
+ awsConfig := &aws.Config{
+  Region: aws.String(Region),
+ }
+ if fips {
+  awsConfig.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+ }
+ sess, err := session.NewSession(awsConfig)
+ if err != nil {
+  return nil, err
+ }
+ s := &Session{sess: sess}
+ sessionCache.sessions[fips] = s
+ return s, nil
+}
+
+// AWS returns the SDK session, for internal/source.
+func (s *Session) AWS() *session.Session {
+ return s.sess
+}
+
+// Endpoint returns the endpoint the session's clients of service call, for
+// logs.
+func (s *Session) Endpoint(service string) string {
+ return s.sess.ClientConfig(service).Endpoint
+}
+
+// WithStaticCredentials returns a copy of s signing with the given keys.
+func (s *Session) WithStaticCredentials(accessKeyID, secretAccessKey, sessionToken string) *Session {
+ creds := credentials.NewStaticCredentials(accessKeyID, secretAccessKey, sessionToken)
+ return &Session{sess: s.sess.Copy(&aws.Config{Credentials: creds})}
+}
+
+// AssumeRole returns a copy of s signing as roleARN, assumed through STS at
+// stsEndpoint, or the default endpoint when it is "". A non-empty externalID
+// is passed to AssumeRole.
+func (s *Session) AssumeRole(stsEndpoint, roleARN, externalID, sessionName string) *Session {
+ svc := sts.New(s.sess)
+ if stsEndpoint != "" {
+  svc = sts.New(s.sess, &aws.Config{Endpoint: aws.String(stsEndpoint)})
+ }
+ creds := stscreds.NewCredentialsWithClient(svc, roleARN, func(o *stscreds.AssumeRoleProvider) {
+  if externalID != "" {
+   o.ExternalID = aws.String(externalID)
+  }
+  o.RoleSessionName = sessionName
+ })
+ return &Session{sess: s.sess.Copy(&aws.Config{Credentials: creds})}
+}
@@ -0,0 +1,74 @@
+package cloud
+
+import (
+ "github.com/aws/aws-sdk-go/aws"
+ "github.com/aws/aws-sdk-go/service/ec2"
+ "github.com/aws/aws-sdk-go/service/transfer"
+)
+
+// TransferServer is what the function needs to know of an AWS Transfer
+// Family server to connect to it.
+type TransferServer struct {
+ Protocols    []string
+ State        string
+ EndpointType string
+ // Internal is set for VPC servers without Elastic IPs, reached only
+ // through VPCEndpointID.
+ Internal      bool
+ VPCEndpointID string
+ // HostKeyFingerprint is as the API reports it, without the SHA256:
+ // prefix SSH tooling prints.
+ HostKeyFingerprint string
+}
+
+// States and protocols of Transfer Family servers.
+const (
+ ProtocolSFTP = transfer.ProtocolSftp
+ StateOnline  = transfer.StateOnline
+)
+
+// DescribeTransferServer describes the Transfer Family server id.
+func (s *Session) DescribeTransferServer(id string) (*TransferServer, error) {
+ out, err := transfer.New(s.sess).DescribeServer(&transfer.DescribeServerInput{ServerId: aws.String(id)})
+ if err != nil {
+  return nil, err
+ }
+ srv := out.Server
+ ts := &TransferServer{
+  Protocols:          aws.StringValueSlice(srv.Protocols),
+  State:              aws.StringValue(srv.State),
+  EndpointType:       aws.StringValue(srv.EndpointType),
+  HostKeyFingerprint: aws.StringValue(srv.HostKeyFingerprint),
+ }
+ details := srv.EndpointDetails
+ if ts.EndpointType != transfer.EndpointTypePublic && details != nil && len(details.AddressAllocationIds) == 0 {
+  ts.Internal = true
+  ts.VPCEndpointID = aws.StringValue(details.VpcEndpointId)
+ }
+ return ts, nil
+}
+
+// VPCEndpointDNSName returns the first DNS name of the VPC endpoint id, or
+// "" when it has none.
+func (s *Session) VPCEndpointDNSName(id string) (string, error) {
+ eps, err := ec2.New(s.sess).DescribeVpcEndpoints(&ec2.DescribeVpcEndpointsInput{VpcEndpointIds: []*string{aws.String(id)}})
+ if err != nil {
+  return "", err
+ }
+ if len(eps.VpcEndpoints) == 0 || len(eps.VpcEndpoints[0].DnsEntries) == 0 {
+  return "", nil
+ }
+ return aws.StringValue(eps.VpcEndpoints[0].DnsEntries[0].DnsName), nil
+}
+
+// IsPermanentTransferError reports whether err from DescribeTransferServer
+// or VPCEndpointDNSName is one no retry can fix: missing permissions or an
+// unknown server or endpoint.
+func IsPermanentTransferError(err error) bool {
+ switch codeOf(err) {
+ case transfer.ErrCodeAccessDeniedException, "UnauthorizedOperation",
+  transfer.ErrCodeResourceNotFoundException, "InvalidVpcEndpointId.NotFound":
+  return true
+ }
+ return false
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+ "fmt"
+ "net"
+ "strconv"
+ "strings"
+)
+
+const defaultSFTPPort = "22"
+
+// validate checks the settings decoded from the secret before anything is
+// dialed, normalizing the host and port fields. Every problem is reported in
+// a single error naming the secret and the fields at fault; values are never
+// included.
+func (c *SFTPConfig) validate() error {
+ var problems []string
+ if strings.TrimSpace(c.SFTPHost) == "" {
+  if c.TransferServerID == "" {
+   problems = append(problems, "sftpHost is empty")
+  }
+ } else if c.TransferServerID != "" {
+  problems = append(problems, "sftpHost and transferFamilyServerId are both set")
+ } else if err := c.normalizeAddress(); err != nil {
+  problems = append(problems, err.Error())
+ }
+ if c.TransferServerID != "" && !transferServerIDPattern.MatchString(c.TransferServerID) {
+  problems = append(problems, "transferFamilyServerId is not a Transfer Family server ID")
+ }
+ if c.SFTPUsername == "" {
+  problems = append(problems, "sftpUsername is empty")
+ }
+ if c.SFTPPassword == "" && c.SFTPPrivateKey == "" {
+  problems = append(problems, "neither sftpPassword nor sftpPrivateKey is set")
+ }
+ if len(problems) > 0 {
+  return fmt.Errorf("secret %s is invalid: %s", c.SecretName, strings.Join(problems, "; "))
+ }
+ return nil
+}
+
+// normalizeAddress validates the host and port fields read from the secret.
+// The port defaults to 22. A port embedded in a host, as in "host:2222" or
+// "[2406:da18::1]:2222", is moved to SFTPPort, provided it agrees with the
+// port given there and with the other hosts. Bare IPv6 literals are kept as
+// they are; the dial address is built with net.JoinHostPort.
+func (c *SFTPConfig) normalizeAddress() error {
+ port := strings.TrimSpace(c.SFTPPort)
+ hosts := append([]string{c.SFTPHost}, c.SFTPFallbackHosts...)
+ for i, h := range hosts {
+  field := "sftpHost"
+  if i > 0 {
+   field = fmt.Sprintf("sftpFallbackHosts[%d]", i-1)
+  }
+  host, embedded, err := splitHostField(h)
+  if err != nil {
+   return fmt.Errorf("%s: %w", field, err)
+  }
+  if embedded != "" {
+   if port != "" && embedded != port {
+    return fmt.Errorf("%s has a port that conflicts with sftpPort; remove it from the host or make them match", field)
+   }
+   port = embedded
+  }
+  hosts[i] = host
+ }
+ if port == "" {
+  port = defaultSFTPPort
+ }
+ if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+  return fmt.Errorf("sftpPort must be a number from 1 to 65535")
+ }
+ c.SFTPHost, c.SFTPFallbackHosts, c.SFTPPort = hosts[0], hosts[1:], port
+ return nil
+}
+
+// splitHostField splits a host field into the host and the port embedded in
+// it, if any.
+func splitHostField(h string) (string, string, error) {
+ h = strings.TrimSpace(h)
+ if h == "" {
+  return "", "", fmt.Errorf("empty host")
+ }
+ if net.ParseIP(h) != nil {
+  return h, "", nil
+ }
+ if strings.HasPrefix(h, "[") && strings.HasSuffix(h, "]") {
+  if ip := net.ParseIP(h[1 : len(h)-1]); ip != nil {
+   return h[1 : len(h)-1], "", nil
+  }
+  return "", "", fmt.Errorf("not an IP address in brackets")
+ }
+ if !strings.Contains(h, ":") {
+  return h, "", nil
+ }
+ host, port, err := net.SplitHostPort(h)
+ if err != nil {
+  return "", "", fmt.Errorf("expected a host name, an IP address or host:port")
+ }
+ if host == "" {
+  return "", "", fmt.Errorf("no host before the port")
+ }
+ return host, port, nil
+}
+
+// Hosts returns the primary host followed by the fallback hosts.
+func (c *SFTPConfig) Hosts() []string {
+ return append([]string{c.SFTPHost}, c.SFTPFallbackHosts...)
+}
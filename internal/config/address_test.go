@@ -0,0 +1,150 @@
+package config
+
+import (
+ "net"
+ "reflect"
+ "strings"
+ "testing"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+ tests := []struct {
+  name      string
+  host      string
+  port      string
+  fallbacks []string
+  wantHost  string
+  wantPort  string
+  wantFalls []string
+  wantErr   string
+ }{
+  {name: "hostname", host: "sftp.example.com", port: "2222", wantHost: "sftp.example.com", wantPort: "2222"},
+  {name: "ipv4", host: "10.0.0.5", port: "22", wantHost: "10.0.0.5", wantPort: "22"},
+  {name: "ipv6", host: "2406:da18::1", port: "2222", wantHost: "2406:da18::1", wantPort: "2222"},
+  {name: "bracketed ipv6", host: "[2406:da18::1]", wantHost: "2406:da18::1", wantPort: "22"},
+  {name: "surrounding space", host: " sftp.example.com ", port: " 2222 ", wantHost: "sftp.example.com", wantPort: "2222"},
+
+  {name: "empty port", host: "sftp.example.com", wantHost: "sftp.example.com", wantPort: "22"},
+  {name: "empty embedded port", host: "sftp.example.com:", wantHost: "sftp.example.com", wantPort: "22"},
+
+  {name: "embedded port", host: "sftp.example.com:2222", wantHost: "sftp.example.com", wantPort: "2222"},
+  {name: "embedded port matching", host: "sftp.example.com:2222", port: "2222", wantHost: "sftp.example.com", wantPort: "2222"},
+  {name: "embedded ipv4 port", host: "10.0.0.5:2222", wantHost: "10.0.0.5", wantPort: "2222"},
+  {name: "embedded ipv6 port", host: "[2406:da18::1]:2222", wantHost: "2406:da18::1", wantPort: "2222"},
+  {name: "embedded port conflicting", host: "sftp.example.com:2222", port: "22", wantErr: "sftpHost has a port that conflicts with sftpPort"},
+
+  {
+   name: "fallbacks", host: "primary.example.com:2222", fallbacks: []string{"[2406:da18::2]:2222", "10.0.0.6"},
+   wantHost: "primary.example.com", wantPort: "2222", wantFalls: []string{"2406:da18::2", "10.0.0.6"},
+  },
+  {name: "fallback port conflicting", host: "primary.example.com:2222", fallbacks: []string{"backup.example.com:22"}, wantErr: "sftpFallbackHosts[0] has a port that conflicts"},
+  {name: "empty fallback", host: "primary.example.com", fallbacks: []string{" "}, wantErr: "sftpFallbackHosts[0]: empty host"},
+
+  {name: "port not a number", host: "sftp.example.com", port: "ssh", wantErr: "sftpPort must be a number from 1 to 65535"},
+  {name: "port zero", host: "sftp.example.com", port: "0", wantErr: "sftpPort must be a number from 1 to 65535"},
+  {name: "port too high", host: "sftp.example.com:70000", wantErr: "sftpPort must be a number from 1 to 65535"},
+  {name: "host missing before port", host: ":2222", wantErr: "sftpHost: no host before the port"},
+  {name: "bad brackets", host: "[sftp.example.com]", wantErr: "sftpHost: not an IP address in brackets"},
+  {name: "too many colons", host: "sftp.example.com:22:22", wantErr: "sftpHost: expected a host name"},
+ }
+ for _, tt := range tests {
+  t.Run(tt.name, func(t *testing.T) {
+   c := &SFTPConfig{SFTPHost: tt.host, SFTPPort: tt.port, SFTPFallbackHosts: tt.fallbacks}
+   err := c.normalizeAddress()
+   if tt.wantErr != "" {
+    if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+     t.Fatalf("error = %v, want %q", err, tt.wantErr)
+    }
+    return
+   }
+   if err != nil {
+    t.Fatal(err)
+   }
+   if c.SFTPHost != tt.wantHost || c.SFTPPort != tt.wantPort || len(c.SFTPFallbackHosts) != len(tt.wantFalls) ||
+    len(tt.wantFalls) > 0 && !reflect.DeepEqual(c.SFTPFallbackHosts, tt.wantFalls) {
+    t.Errorf("got host %q, port %q, fallbacks %q, want %q, %q, %q", c.SFTPHost, c.SFTPPort, c.SFTPFallbackHosts, tt.wantHost, tt.wantPort, tt.wantFalls)
+   }
+   // The dial address of an IPv6 host is bracketed exactly once.
+   if addr := net.JoinHostPort(c.SFTPHost, c.SFTPPort); strings.Count(addr, "[") > 1 || strings.Count(addr, ":"+c.SFTPPort) != 1 {
+    t.Errorf("dial address %q", addr)
+   }
+  })
+ }
+}
+
+func TestValidateNeverIncludesValues(t *testing.T) {
+ c := &SFTPConfig{SecretName: "sftp-partner", SFTPHost: "sftp.example.com:22", SFTPPort: "2222", SFTPUsername: "partner", SFTPPassword: "hunter2"}
+ err := c.validate()
+ if err == nil {
+  t.Fatal("validate accepted a conflicting port")
+ }
+ for _, value := range []string{"sftp.example.com", "hunter2"} {
+  if strings.Contains(err.Error(), value) {
+   t.Errorf("error %q includes %q", err, value)
+  }
+ }
+ if !strings.Contains(err.Error(), "secret sftp-partner is invalid") {
+  t.Errorf("error %q does not name the secret", err)
+ }
+}
+
+func TestValidateSecret(t *testing.T) {
+ valid := func() SFTPConfig {
+  return SFTPConfig{SecretName: "sftp-partner", SFTPHost: "sftp.example.com", SFTPUsername: "partner", SFTPPassword: "hunter2"}
+ }
+ tests := []struct {
+  name     string
+  edit     func(c *SFTPConfig)
+  problems []string
+ }{
+  {"password", func(c *SFTPConfig) {}, nil},
+  {"private key only", func(c *SFTPConfig) { c.SFTPPassword, c.SFTPPrivateKey = "", "key" }, nil},
+  {"numeric port", func(c *SFTPConfig) { c.SFTPPort = "2222" }, nil},
+  {"transfer family server", func(c *SFTPConfig) { c.SFTPHost, c.TransferServerID = "", "s-0123456789abcdef0" }, nil},
+  {"empty host", func(c *SFTPConfig) { c.SFTPHost = " " }, []string{"sftpHost is empty"}},
+  {"port not numeric", func(c *SFTPConfig) { c.SFTPPort = "ssh" }, []string{"sftpPort must be a number"}},
+  {"port out of range", func(c *SFTPConfig) { c.SFTPPort = "70000" }, []string{"sftpPort must be a number"}},
+  {"empty username", func(c *SFTPConfig) { c.SFTPUsername = "" }, []string{"sftpUsername is empty"}},
+  {"no credentials", func(c *SFTPConfig) { c.SFTPPassword = "" }, []string{"neither sftpPassword nor sftpPrivateKey is set"}},
+  {"host and server", func(c *SFTPConfig) { c.TransferServerID = "s-0123456789abcdef0" }, []string{"sftpHost and transferFamilyServerId are both set"}},
+  {"bad server id", func(c *SFTPConfig) { c.SFTPHost, c.TransferServerID = "", "server-1" }, []string{"transferFamilyServerId is not a Transfer Family server ID"}},
+  {"empty secret", func(c *SFTPConfig) { *c = SFTPConfig{SecretName: c.SecretName} }, []string{
+   "sftpHost is empty", "sftpUsername is empty", "neither sftpPassword nor sftpPrivateKey is set",
+  }},
+  {"bad port and no user", func(c *SFTPConfig) { c.SFTPPort, c.SFTPUsername = "x", "" }, []string{
+   "sftpPort must be a number", "sftpUsername is empty",
+  }},
+ }
+ for _, tt := range tests {
+  t.Run(tt.name, func(t *testing.T) {
+   c := valid()
+   tt.edit(&c)
+   err := c.validate()
+   if len(tt.problems) == 0 {
+    if err != nil {
+     t.Fatalf("validate: %v", err)
+    }
+    return
+   }
+   if err == nil {
+    t.Fatal("validate accepted the secret")
+   }
+   msg := err.Error()
+   if !strings.HasPrefix(msg, "secret sftp-partner is invalid: ") {
+    t.Errorf("error %q does not name the secret", msg)
+   }
+   // Every problem is listed once, in one error.
+   if got := strings.Count(msg, ";") + 1; got != len(tt.problems) {
+    t.Errorf("error %q lists %d problem(s), want %d", msg, got, len(tt.problems))
+   }
+   for _, p := range tt.problems {
+    if !strings.Contains(msg, p) {
+     t.Errorf("error %q does not say %q", msg, p)
+    }
+   }
+   if strings.Contains(msg, "hunter2") {
+    t.Errorf("error %q includes the password", msg)
+   }
+  })
+ }
+}
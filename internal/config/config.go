@@ -0,0 +1,1671 @@
+// Package config resolves what a run is configured with: the environment
+// variables read at start-up, the invocation payload overriding them and the
+// Secrets Manager secret of each SFTP destination. Everything is validated
+// before a transfer starts; errors of invalid settings carry the "config"
+// category.
+package config
+
+import (
+ "bytes"
+ "encoding/json"
+ "fmt"
+ "log"
+ "net"
+ "net/url"
+ "path"
+ "path/filepath"
+ "regexp"
+ "strconv"
+ "strings"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// S3Bucket is the bucket the function delivers from and keeps its state in,
+// S3FolderPrefix the prefix it delivers by default, and SecretName the secret
+// holding the default SFTP config.
+const (
+ S3Bucket       = "test-sftp-poc-buc"
+ S3FolderPrefix = "test-poc"
+ SecretName     = "sftp-poc"
+)
+
+// Config holds the settings that can be tuned per deployment through
+// environment variables.
+type Config struct {
+ // ConnMaxLifetime bounds how long a cached SFTP connection is reused
+ // across warm invocations before it is closed and re-dialed.
+ ConnMaxLifetime time.Duration
+ // ConnMaxIdle closes a cached SFTP connection that has not been used
+ // for this long, ahead of servers that reap idle sessions. Zero
+ // disables the check.
+ ConnMaxIdle time.Duration
+ // PoolSize is the number of SFTP connections, one per secret, kept
+ // open between warm invocations.
+ PoolSize int
+ // Debug enables debug level logging (LOG_LEVEL=debug).
+ Debug bool
+ // LogSampleThreshold is the object count above which per-file logs
+ // are demoted to debug, with a progress line every LogProgressEvery
+ // files instead; zero keeps every per-file log.
+ LogSampleThreshold int
+ LogProgressEvery   int
+ // SecretCacheTTL is how long the SFTP secret, and any private key it
+ // references, is cached between warm invocations. Zero disables caching.
+ SecretCacheTTL time.Duration
+ // TransferServerID, set from the payload, replaces the destination
+ // with the AWS Transfer Family server it names, whose endpoint is
+ // cached for TransferServerCacheTTL.
+ TransferServerID       string
+ TransferServerCacheTTL time.Duration
+ // PrewarmSecret fetches the SFTP secret into the cache during the
+ // init phase, and PrewarmConnection also dials the server and leaves
+ // the connection in the pool, so the first invocation of a
+ // provisioned environment pays for neither.
+ PrewarmSecret     bool
+ PrewarmConnection bool
+ // SecretJSONPath, a dotted key path such as "partners.acme", selects
+ // the object holding the SFTP settings within a nested secret. Empty
+ // reads them from the top level.
+ SecretJSONPath string
+ // SecretFieldNames maps SFTPConfig fields to the names secrets created
+ // under another convention use for them.
+ SecretFieldNames map[string]string
+ // AuthOrder is the order in which SSH auth methods are offered when the
+ // secret holds more than one credential.
+ AuthOrder []string
+
+ // SourcePrefix is the prefix of the source bucket that is delivered
+ // and SecretName the Secrets Manager secret holding the SFTP config.
+ // Both default to the built-in values and may be overridden per
+ // invocation.
+ SourcePrefix string
+ SecretName   string
+
+ // RemoteDir is the remote directory files are delivered to. A relative
+ // RemoteDir, or any remote path when RemotePathRelativeToHome is set, is
+ // resolved against the session's initial working directory, for chrooted
+ // servers where "/uploads" is not where the user lands.
+ RemoteDir                string
+ RemotePathRelativeToHome bool
+ // CreateRemoteDirs creates remote directories before writing to them.
+ // Turn it off for servers that forbid mkdir.
+ CreateRemoteDirs bool
+ // CreateEmptyDirs turns zero-byte folder-marker objects below the
+ // source prefix into directories under RemoteDir, so the partner
+ // sees the folder skeleton before files arrive. A directory that
+ // cannot be created only logs a warning unless EmptyDirsFatal is set.
+ CreateEmptyDirs bool
+ EmptyDirsFatal  bool
+ // OverwritePolicy decides what happens when the remote file already
+ // exists: "overwrite" replaces it, "skip" leaves it in place and
+ // skips the object, and "suffix" delivers under a new name in the
+ // CollisionSuffix style. "suffix" also renames files whose names
+ // collide within the run.
+ OverwritePolicy string
+ CollisionSuffix string
+ // RemoteListingCache answers the existence checks of the skip and
+ // suffix policies from one listing of each remote directory, taken
+ // no more than RemoteListingMaxAge before the check.
+ RemoteListingCache  bool
+ RemoteListingMaxAge time.Duration
+ // RemoteLayout is "flatten", delivering each object under its base
+ // name, or "preserve", keeping its path below the source prefix.
+ // PathCollisions "fail" refuses to start a run in which two objects
+ // route to the same remote path, unless OverwritePolicy is "suffix";
+ // "allow" lets the later one overwrite the earlier.
+ RemoteLayout   string
+ PathCollisions string
+ // RemoteFilenameEncoding is the encoding remote paths are sent in,
+ // "utf8" or "latin1" for legacy servers. RemoteFilenameUnrepresentable
+ // decides what happens to runes it cannot represent: "replace" writes
+ // "_", "strip" drops them and "fail" fails the file.
+ RemoteFilenameEncoding        string
+ RemoteFilenameUnrepresentable string
+ // AtomicUpload writes each file under a temporary name and renames it
+ // into place, so the partner never picks up a partial file.
+ // AtomicRenameFallback decides what happens on servers that do not
+ // support rename.
+ AtomicUpload         bool
+ AtomicRenameFallback string
+ // StagingDir, when set, has each file uploaded below it and then
+ // renamed into its directory under RemoteDir, for partners whose
+ // poller picks up anything that appears there. Files older than
+ // StagingOrphanAge left in it by failed runs are removed at the
+ // start of each run.
+ StagingDir       string
+ StagingOrphanAge time.Duration
+ // SpoolDir is a local directory, typically an EFS mount, that files
+ // spooled during the run are written below instead of the
+ // ephemeral /tmp. Run directories older than SpoolStaleAge are
+ // removed at the start of each run.
+ SpoolDir      string
+ SpoolStaleAge time.Duration
+ // RemoteFsync syncs every written file to the server's disk before it
+ // is reported as delivered. RemoteFsyncStrict fails the file instead of
+ // continuing unsynced when the server lacks the fsync extension.
+ RemoteFsync       bool
+ RemoteFsyncStrict bool
+ // RemoteUID and RemoteGID, when not -1, are the owner delivered files
+ // are given after upload, and with RemoteChownDirs the directories
+ // created for them. RemoteChownStrict fails a file the server will
+ // not chown instead of warning.
+ RemoteUID         int
+ RemoteGID         int
+ RemoteChownDirs   bool
+ RemoteChownStrict bool
+ // RemoteSpaceCheck defers files that would not fit in the free space
+ // the server reports at the start of the run, re-queried before files
+ // of at least RemoteSpaceRecheckBytes when that is positive.
+ RemoteSpaceCheck        bool
+ RemoteSpaceRecheckBytes int64
+ // Preflight checks the remote directory before any object is read and
+ // aborts the run if it is not writable. PreflightProbe writes and
+ // removes a zero-byte probe file as part of it; turn it off for
+ // partners who alert on unknown files.
+ Preflight      bool
+ PreflightProbe bool
+ // StallTimeout aborts a file when no bytes have moved for this long;
+ // zero disables stall detection.
+ StallTimeout time.Duration
+ // VerifyContentLength fails a file whose S3 body ends before or after
+ // its ContentLength, which a dropped connection can cause without an
+ // error. Such files are retried up to ShortReadRetries times.
+ VerifyContentLength bool
+ ShortReadRetries    int
+ // VerifyS3Checksum asks S3 for the ChecksumSHA256 stored with each
+ // object and fails a file whose bytes do not hash to it. Objects
+ // uploaded without one, or with a multipart composite one, are not
+ // checked.
+ VerifyS3Checksum bool
+ // QuarantinePrefix, when set, receives objects that still fail
+ // checksum or size verification after their retries, so they stop
+ // blocking later runs; QuarantineTopicARN is alerted for each.
+ // ReplayQuarantine, set from the payload, moves them back first.
+ QuarantinePrefix   string
+ QuarantineTopicARN string
+ ReplayQuarantine   bool
+ // ValidateNonEmpty, ValidateContentType and ValidateNamePattern reject
+ // empty files, files whose first bytes do not fit their extension and
+ // files whose name does not match before anything is sent.
+ // ValidateQuarantine moves rejected files under QuarantinePrefix.
+ ValidateNonEmpty    bool
+ ValidateContentType bool
+ ValidateNamePattern *regexp.Regexp
+ ValidateQuarantine  bool
+ // SSHKeepaliveInterval is how often keepalive requests are sent on an
+ // open connection; zero disables them. The connection is closed after
+ // SSHKeepaliveMaxMissed consecutive requests go unanswered.
+ SSHKeepaliveInterval  time.Duration
+ SSHKeepaliveMaxMissed int
+ // SSHCompression is SSH_COMPRESSION, asking for zlib transport
+ // compression. golang.org/x/crypto/ssh only negotiates "none", so it
+ // changes nothing on the wire and is only logged as unsupported;
+ // ARCHIVE_MODE=tar.gz compresses the files before they are sent.
+ SSHCompression bool
+
+ // SFTPMaxPacket is the SFTP packet payload size. Small values suit
+ // appliances that reject long packets; OpenSSH is fastest at 256KB.
+ SFTPMaxPacket int
+
+ // ResumeStatePrefix enables resuming files of at least ResumeMinBytes
+ // across invocations. Their progress is saved under this prefix of the
+ // source bucket when the invocation is within ResumeDeadlineMargin of
+ // its deadline, and abandoned after ResumeStateTTL.
+ ResumeStatePrefix    string
+ ResumeMinBytes       int64
+ ResumeDeadlineMargin time.Duration
+ ResumeStateTTL       time.Duration
+
+ // FIPSMode resolves FIPS endpoints for AWS services and restricts SSH
+ // to FIPS-approved algorithms. SSHCiphers, SSHKeyExchanges and SSHMACs
+ // override the SSH algorithm lists.
+ FIPSMode        bool
+ SSHCiphers      []string
+ SSHKeyExchanges []string
+ SSHMACs         []string
+ // AllowLegacySSH also offers the insecure SHA-1 based ssh-rsa host
+ // key and signature algorithms, for servers offering nothing newer.
+ AllowLegacySSH bool
+ // HostKeyPolicy decides how hosts without a pinned sftpHostKeys entry
+ // are verified: insecure, strict or tofu. Keys trusted on first use
+ // are stored under HostKeyParameterPrefix in SSM.
+ HostKeyPolicy          string
+ HostKeyParameterPrefix string
+
+ // SecretsManagerEndpoint and STSEndpoint point the respective clients
+ // at VPC interface endpoints when private DNS is disabled.
+ SecretsManagerEndpoint string
+ STSEndpoint            string
+ // AllowPayloadCredentials accepts static source credentials in the
+ // invocation payload. Roles to assume are always accepted.
+ AllowPayloadCredentials bool
+ // TenantSecrets maps the first path segment of a source key to the
+ // SFTP secret of that tenant. When set, each tenant's files are
+ // delivered with its own secret and connection. Tenant, from the
+ // payload or the tenant attribute of an SQS message, names the tenant
+ // of every file of the run instead.
+ TenantSecrets map[string]string
+ Tenant        string
+ // TenantWorkers bounds the batches of files delivered at once across
+ // all tenants; with 1 the tenants are delivered one after another.
+ // TenantLimits holds the limits of the tenants that set their own.
+ TenantWorkers int
+ TenantLimits  map[string]TenantLimits
+ // InlineMaxBytes bounds the combined decoded size of the payload's
+ // inline files.
+ InlineMaxBytes int64
+ // SourceAddress binds outbound SFTP connections to a local address,
+ // DialTimeout bounds the TCP connect and TCPKeepAlive sets the OS
+ // keepalive period. Zero values keep the Go defaults.
+ SourceAddress net.IP
+ DialTimeout   time.Duration
+ TCPKeepAlive  time.Duration
+ // ShuffleAddresses dials the addresses a host name resolves to in
+ // random order instead of the resolver's.
+ ShuffleAddresses bool
+ // MetadataRouting lets an object's sftp-destination metadata choose its
+ // remote directory, provided it lies under RemoteAllowedRoot.
+ MetadataRouting   bool
+ RemoteAllowedRoot string
+ // ExtensionRoutes maps lower-cased file extensions, including compound
+ // ones such as ".csv.gz", to remote directories.
+ ExtensionRoutes map[string]string
+ // UnmappedExtension is what happens to files matching no extension
+ // route: "default" delivers to RemoteDir, "skip" or "fail".
+ UnmappedExtension string
+ // SplitSizeBytes, when positive, splits objects larger than it into
+ // numbered remote parts of at most that size.
+ SplitSizeBytes int64
+ // ArchiveMode, when set to "tar.gz" or "zip", bundles every object into
+ // one archive named by the ArchiveName template.
+ ArchiveMode string
+ ArchiveName string
+ // Concatenate appends every object, in ConcatenateOrder ("key" or
+ // "lastModified"), to one remote file named by the ConcatenateName
+ // template, separated by ConcatenateDelimiter. What has been appended
+ // is saved under ConcatenateStatePrefix of the source bucket, so a
+ // failed run is continued without duplicating or leaving partial data.
+ Concatenate            bool
+ ConcatenateName        string
+ ConcatenateOrder       string
+ ConcatenateDelimiter   string
+ ConcatenateStatePrefix string
+ // ExplodeArchives unpacks .zip, .tar and .tar.gz objects and delivers
+ // their members as individual files.
+ ExplodeArchives bool
+ // FailFast stops after the first failed archive member instead of
+ // attempting the rest.
+ FailFast bool
+ // ChecksumSidecar, when "sha256" or "md5", writes a coreutils style
+ // digest file next to each delivered file.
+ ChecksumSidecar string
+ // TextConvert, when "crlf", rewrites the line endings of files ending
+ // in one of TextConvertExtensions to CRLF while they are copied.
+ // Converted files are not resumed across invocations.
+ TextConvert           string
+ TextConvertExtensions []string
+ // ControlFileSuffixes identify control files, such as ".ctl", which
+ // are delivered after every data file and only once the data files
+ // they announce were delivered: those sharing their base name under
+ // ControlFileScope "name", or the whole batch under "batch".
+ ControlFileSuffixes []string
+ ControlFileScope    string
+ // GroupByFolder tracks files by their first path segment under
+ // SourcePrefix and, once every file of a group is delivered, writes
+ // GroupMarker into the group's remote directory. It requires
+ // REMOTE_LAYOUT=preserve, which gives each group its own directory.
+ GroupByFolder bool
+ GroupMarker   string
+ // MetadataSidecar writes a <name>.meta.json describing the source of
+ // each delivered file, with field names renamed by SidecarFieldNames.
+ MetadataSidecar   bool
+ SidecarFieldNames map[string]string
+
+ // PostUploadCommand and PostBatchCommand are remote command templates
+ // run over SSH after each file and after the whole batch respectively.
+ PostUploadCommand string
+ PostBatchCommand  string
+ // HookFailureMode decides whether a failing hook is a "warn" or "fail".
+ HookFailureMode string
+ HookTimeout     time.Duration
+
+ // WebhookURL receives a signed JSON summary at the end of every run.
+ // WebhookSecretName names the Secrets Manager secret holding the HMAC
+ // signing key.
+ WebhookURL        string
+ WebhookSecretName string
+ WebhookMaxBytes   int
+
+ // SlackWebhookSecretName names the secret holding the Slack incoming
+ // webhook URL; SlackNotify is "always" or "failure".
+ SlackWebhookSecretName string
+ SlackNotify            string
+ // HTTPTriggerSecretName names the secret holding the shared secret
+ // that Function URL and API Gateway requests must send in the
+ // HTTPTriggerHeader header; HTTP requests are refused when it is
+ // unset. Synchronous HTTP runs listing more than HTTPSyncMaxObjects
+ // objects or HTTPSyncMaxBytes bytes are refused; zero is unlimited.
+ HTTPTriggerSecretName string
+ HTTPTriggerHeader     string
+ HTTPSyncMaxObjects    int
+ HTTPSyncMaxBytes      int64
+ // DestinationName is the human readable name of the partner used in
+ // notifications.
+ DestinationName string
+ // MetricDestinations are the destination names metrics may carry as
+ // their Destination dimension; any other is reported as "other" to
+ // keep the dimension's cardinality bounded. It defaults to
+ // DESTINATION_NAME and the TENANT_SECRETS tenants.
+ MetricDestinations map[string]bool
+
+ // ReportEmailTo and ReportEmailFrom enable SES report emails;
+ // ReportEmailDailyOnly restricts them to runs flagged as the daily batch.
+ ReportEmailTo        []string
+ ReportEmailFrom      string
+ ReportEmailDailyOnly bool
+
+ // ProcessedPrefix holds already delivered objects. When
+ // ProcessedRetentionDays is positive, objects under it older than that
+ // are deleted at the end of each successful run, at most
+ // CleanupMaxDeletes per run.
+ ProcessedPrefix        string
+ ProcessedRetentionDays int
+ CleanupDryRun          bool
+ CleanupMaxDeletes      int
+ // ArchivedObjectPolicy decides what happens to objects listed in the
+ // GLACIER or DEEP_ARCHIVE storage class: "fail" fails them, "skip"
+ // skips them and "restore" requests a restore with RestoreTier for
+ // RestoreDays and delivers them on a later run.
+ ArchivedObjectPolicy string
+ RestoreTier          string
+ RestoreDays          int
+ // RestoreStatePrefix holds the state object tracking restores that
+ // are pending delivery.
+ RestoreStatePrefix string
+ // ObjectLockStrict fails the cleanup when an expired object is under
+ // Object Lock instead of retaining it in place.
+ ObjectLockStrict bool
+
+ // S3MaxAttempts, S3RetryMode and S3RequestTimeout configure the S3
+ // client's own retries, separately from per-file handling.
+ S3MaxAttempts    int
+ S3RetryMode      string
+ S3RequestTimeout time.Duration
+ // RetryBudgetAttempts and RetryBudgetBackoff cap the retries and the
+ // time spent backing off before them across the whole run; zero is
+ // unlimited.
+ RetryBudgetAttempts int
+ RetryBudgetBackoff  time.Duration
+ // BreakerThreshold, when positive, reconnects after connection-level
+ // failures and gives up on a destination for the rest of the run after
+ // this many in a row. Zero stops at the first failure.
+ BreakerThreshold int
+ // StrictFailures returns an error from the handler for runs that
+ // failed after delivering some files, instead of their result with
+ // status "partial".
+ StrictFailures bool
+
+ // ListSharding splits the source listing into concurrently listed key
+ // ranges ("char") or sub-prefixes ("delimiter"); ListConcurrency bounds
+ // the number of listing requests in flight.
+ ListSharding    string
+ ListConcurrency int
+ // Recursive lists every key under the source prefix. When false only
+ // the objects directly under it are delivered: it is listed as a
+ // folder with a "/" delimiter and its sub-folders are ignored.
+ Recursive bool
+ // MaxDepth, when positive, ignores keys with more path segments below
+ // the source prefix, the file name included: 1 keeps only the
+ // objects directly under it.
+ MaxDepth int
+
+ // PullMode reverses the direction of the transfer: files in
+ // PullRemoteDir on the SFTP server are copied to the bucket under
+ // PullPrefix. FollowSymlinks pulls the targets of symlinks found
+ // there, provided they stay under PullRemoteDir, instead of skipping
+ // them.
+ PullMode       bool
+ PullRemoteDir  string
+ PullPrefix     string
+ FollowSymlinks bool
+ // PullMaxDepth bounds how many directory levels are read, 1 being
+ // PullRemoteDir alone and 0 no limit, and PullMaxEntries the number of
+ // remote entries examined in one run. PreservePaths keeps each file's
+ // path relative to PullRemoteDir in its key instead of only its name.
+ PullMaxDepth   int
+ PullMaxEntries int
+ PreservePaths  bool
+ // PullInclude and PullExclude select the remote files to pull by the
+ // glob patterns of PULL_INCLUDE and PULL_EXCLUDE; with neither, every
+ // file is pulled.
+ PullInclude []string
+ PullExclude []string
+ // PullDetectContentType sets the Content-Type of pulled objects from
+ // their file extension, looked up in PullContentTypes before the
+ // system MIME table. Files with an unknown extension are sniffed from
+ // their first 512 bytes unless PullSniffContentType is off.
+ PullDetectContentType bool
+ PullContentTypes      map[string]string
+ PullSniffContentType  bool
+ // PullKeyTemplate, when set, is expanded per file into the key it is
+ // uploaded to, with dates from the pull time or the remote mtime as
+ // PullKeyTime says.
+ PullKeyTemplate string
+ PullKeyTime     string
+ // PullPartSize and PullUploadConcurrency configure the multipart
+ // upload of pulled files.
+ PullPartSize          int64
+ PullUploadConcurrency int
+ // PullMemoryBudget is the most memory pulled file uploads may hold,
+ // half the function's memory when running in Lambda and unlimited
+ // otherwise. PullPartSize times PullUploadConcurrency must fit in it.
+ PullMemoryBudget int64
+ // MaxInflightBytes, when positive, caps the bytes buffered at once
+ // across the run: SFTP copy requests, archive and conversion buffers
+ // and pulled parts. The configured features must fit in it.
+ MaxInflightBytes int64
+ // PullMinAge leaves remote files modified less than this long ago for
+ // a later run, as they may still be being written. PullClockSkew is
+ // added to it to allow for the server's clock running ahead.
+ PullMinAge    time.Duration
+ PullClockSkew time.Duration
+ // MinObjectAge leaves source objects modified less than this long ago
+ // for a later run, as a producer may still be overwriting them.
+ // ObjectClockSkew is added to it to allow for the Lambda's clock
+ // running ahead of S3's.
+ MinObjectAge    time.Duration
+ ObjectClockSkew time.Duration
+ // PullStabilityWait, when positive, stats every candidate file
+ // again after this long and leaves those whose size changed for a
+ // later run. It is capped at maxPullStabilityWait.
+ PullStabilityWait time.Duration
+
+ // CheckpointPrefix enables the listing checkpoint, stored in the source
+ // bucket under this prefix. CheckpointFullRelist is how often the
+ // checkpoint is ignored to catch objects added behind it; zero never
+ // re-lists in full.
+ CheckpointPrefix     string
+ CheckpointFullRelist time.Duration
+
+ // Fanout makes the run a coordinator that lists and filters, then
+ // hands the keys to asynchronous invocations of the function,
+ // FanoutChunkSize keys each and at most FanoutMaxChildren per run.
+ Fanout            bool
+ FanoutChunkSize   int
+ FanoutMaxChildren int
+ // InventoryManifest, set from the payload, replaces the listing with
+ // the S3 Inventory report it describes and reconciles the server
+ // against it. InventoryGapPrefix, which may hold date placeholders,
+ // is listed for objects newer than the report, and
+ // InventoryDiscrepancies lists the differences in the report.
+ InventoryManifest      string
+ InventoryGapPrefix     string
+ InventoryDiscrepancies bool
+
+ // DryRun routes the listed objects without connecting and writes the
+ // plan under PlanPrefix instead of delivering them. ExecutePlan, set
+ // only by the invocation payload, is the s3:// URI of a plan to
+ // deliver instead of listing the source prefix.
+ DryRun      bool
+ PlanPrefix  string
+ ExecutePlan string
+
+ // Profile, set only by the invocation payload, writes CPU and heap
+ // profiles of the run under ProfilePrefix of ProfileBucket, which
+ // defaults to REPORT_BUCKET and then to the source bucket.
+ Profile       bool
+ ProfileBucket string
+ ProfilePrefix string
+
+ // ThroughputMinBytes is the size below which files are excluded from
+ // throughput percentiles.
+ ThroughputMinBytes int64
+
+ // EmptyRunAlertAfter is the number of consecutive runs finding no
+ // files after which the run is flagged; zero disables tracking. The
+ // count is kept in the EmptyRunParameter SSM parameter.
+ EmptyRunAlertAfter int
+ EmptyRunParameter  string
+ EmptyRunTopicARN   string
+ EmptyRunFail       bool
+
+ // MaxBytesPerRun stops the run from starting new files once the bytes
+ // already sent plus the next file's listing size would exceed it; zero
+ // disables the cap. A file is never cut off once started, so the total
+ // can overshoot when actual bytes exceed listing sizes, as they do when
+ // archives are exploded.
+ MaxBytesPerRun int64
+
+ // AuditBucket, when set, receives an append-only JSONL audit log of
+ // every file outcome under AuditPrefix. It may be a separate bucket
+ // with Object Lock enabled.
+ AuditBucket string
+ AuditPrefix string
+
+ // knobs records each environment variable read and the value used,
+ // for the effective configuration record.
+ knobs map[string]Knob
+}
+
+const (
+ defaultRemoteDir       = "/uploads"
+ defaultConnMaxLifetime = 30 * time.Minute
+ defaultConnMaxIdle     = 5 * time.Minute
+ defaultPoolSize        = 1
+ defaultTenantWorkers   = 1
+ defaultSecretCacheTTL  = 5 * time.Minute
+ defaultHookTimeout     = time.Minute
+ defaultProcessedPrefix = "processed/"
+
+ DefaultCleanupMaxDeletes     = 10000
+ defaultS3MaxAttempts         = 3
+ defaultS3RequestTimeout      = 30 * time.Second
+ defaultListConcurrency       = 4
+ defaultCheckpointFullRelist  = 24 * time.Hour
+ defaultThroughputMinBytes    = 1 << 20
+ defaultStallTimeout          = 120 * time.Second
+ defaultShortReadRetries      = 2
+ defaultSSHKeepaliveInterval  = 30 * time.Second
+ defaultSSHKeepaliveMaxMissed = 3
+ defaultSFTPMaxPacket         = 32 << 10
+ minSFTPMaxPacket             = 1 << 10
+ maxSFTPMaxPacket             = 256 << 10
+ defaultResumeMinBytes        = 1 << 30
+ defaultResumeDeadlineMargin  = 30 * time.Second
+ defaultResumeStateTTL        = 7 * 24 * time.Hour
+ defaultInlineMaxBytes        = 256 << 10
+ defaultRestoreDays           = 7
+ defaultPullMaxEntries        = 10000
+ defaultPullPartSize          = 64 << 20
+ defaultPullUploadConcurrency = 4
+ defaultPullClockSkew         = 30 * time.Second
+ defaultObjectClockSkew       = 30 * time.Second
+ maxPullStabilityWait         = time.Minute
+)
+
+func readConfig() (*Config, error) {
+ cfg := &Config{}
+ var err error
+ if cfg.ConnMaxLifetime, err = EnvDuration("CONN_MAX_LIFETIME", defaultConnMaxLifetime); err != nil {
+  return nil, err
+ }
+ if cfg.ConnMaxIdle, err = EnvDuration("CONN_MAX_IDLE", defaultConnMaxIdle); err != nil {
+  return nil, err
+ }
+ if cfg.PoolSize, err = EnvInt("POOL_SIZE", defaultPoolSize); err != nil {
+  return nil, err
+ }
+ if cfg.PoolSize < 1 {
+  return nil, fmt.Errorf("invalid POOL_SIZE %d: must be at least 1", cfg.PoolSize)
+ }
+ switch level := EnvString("LOG_LEVEL", "info"); level {
+ case "info":
+ case "debug":
+  cfg.Debug = true
+ default:
+  return nil, fmt.Errorf("invalid LOG_LEVEL %q: must be info or debug", level)
+ }
+ if cfg.LogSampleThreshold, err = EnvInt("LOG_SAMPLE_THRESHOLD", defaultLogSampleThreshold); err != nil {
+  return nil, err
+ }
+ if cfg.LogProgressEvery, err = EnvInt("LOG_PROGRESS_EVERY", defaultLogProgressEvery); err != nil {
+  return nil, err
+ }
+ if cfg.LogProgressEvery < 1 {
+  return nil, fmt.Errorf("invalid LOG_PROGRESS_EVERY %d: must be at least 1", cfg.LogProgressEvery)
+ }
+ if cfg.SecretCacheTTL, err = EnvDuration("SECRET_CACHE_TTL", defaultSecretCacheTTL); err != nil {
+  return nil, err
+ }
+ if cfg.TransferServerCacheTTL, err = EnvDuration("TRANSFER_SERVER_CACHE_TTL", defaultTransferServerCacheTTL); err != nil {
+  return nil, err
+ }
+ if cfg.PrewarmSecret, err = envBool("PREWARM_SECRET", false); err != nil {
+  return nil, err
+ }
+ if cfg.PrewarmConnection, err = envBool("PREWARM_CONNECTION", false); err != nil {
+  return nil, err
+ }
+ if cfg.PrewarmConnection {
+  cfg.PrewarmSecret = true
+ }
+ if cfg.PrewarmSecret && cfg.SecretCacheTTL == 0 {
+  return nil, fmt.Errorf("PREWARM_SECRET and PREWARM_CONNECTION need SECRET_CACHE_TTL above zero, or the prewarmed secret is never used")
+ }
+ if cfg.SecretFieldNames, err = parseSecretFieldNames(getenv("SECRET_FIELD_NAMES")); err != nil {
+  return nil, err
+ }
+ cfg.SecretJSONPath = getenv("SECRET_JSON_PATH")
+ for _, segment := range strings.Split(cfg.SecretJSONPath, ".") {
+  if cfg.SecretJSONPath != "" && segment == "" {
+   return nil, fmt.Errorf("invalid SECRET_JSON_PATH %q: empty segment", cfg.SecretJSONPath)
+  }
+ }
+ if cfg.AuthOrder, err = ParseAuthOrder(getenv("AUTH_ORDER")); err != nil {
+  return nil, err
+ }
+ cfg.SourcePrefix = S3FolderPrefix
+ cfg.SecretName = SecretName
+ cfg.RemoteDir = NormalizeRemotePath(EnvString("REMOTE_DIR", defaultRemoteDir))
+ if cfg.RemotePathRelativeToHome, err = envBool("REMOTE_PATH_RELATIVE_TO_HOME", false); err != nil {
+  return nil, err
+ }
+ if cfg.CreateRemoteDirs, err = envBool("CREATE_REMOTE_DIRS", true); err != nil {
+  return nil, err
+ }
+ if cfg.SFTPMaxPacket, err = EnvInt("SFTP_MAX_PACKET_BYTES", defaultSFTPMaxPacket); err != nil {
+  return nil, err
+ }
+ if cfg.SFTPMaxPacket < minSFTPMaxPacket || cfg.SFTPMaxPacket > maxSFTPMaxPacket {
+  return nil, fmt.Errorf("invalid SFTP_MAX_PACKET_BYTES %d: must be between %d and %d", cfg.SFTPMaxPacket, minSFTPMaxPacket, maxSFTPMaxPacket)
+ }
+ cfg.ResumeStatePrefix = EnvString("RESUME_STATE_PREFIX", "")
+ if cfg.ResumeMinBytes, err = envInt64("RESUME_MIN_BYTES", defaultResumeMinBytes); err != nil {
+  return nil, err
+ }
+ if cfg.ResumeDeadlineMargin, err = EnvDuration("RESUME_DEADLINE_MARGIN", defaultResumeDeadlineMargin); err != nil {
+  return nil, err
+ }
+ if cfg.ResumeStateTTL, err = EnvDuration("RESUME_STATE_TTL", defaultResumeStateTTL); err != nil {
+  return nil, err
+ }
+ if cfg.SecretsManagerEndpoint, err = parseEndpointURL("SECRETSMANAGER_ENDPOINT_URL", getenv("SECRETSMANAGER_ENDPOINT_URL")); err != nil {
+  return nil, err
+ }
+ if cfg.STSEndpoint, err = parseEndpointURL("STS_ENDPOINT_URL", getenv("STS_ENDPOINT_URL")); err != nil {
+  return nil, err
+ }
+ if cfg.InlineMaxBytes, err = envInt64("INLINE_MAX_BYTES", defaultInlineMaxBytes); err != nil {
+  return nil, err
+ }
+ cfg.AuditBucket = getenv("AUDIT_BUCKET")
+ cfg.AuditPrefix = EnvString("AUDIT_PREFIX", defaultAuditPrefix)
+ if cfg.TenantSecrets, cfg.TenantLimits, err = parseTenantSecrets(getenv("TENANT_SECRETS")); err != nil {
+  return nil, err
+ }
+ if cfg.TenantWorkers, err = EnvInt("TENANT_WORKERS", defaultTenantWorkers); err != nil {
+  return nil, err
+ }
+ if cfg.TenantWorkers < 1 {
+  return nil, fmt.Errorf("invalid TENANT_WORKERS %d: must be at least 1", cfg.TenantWorkers)
+ }
+ if cfg.AllowPayloadCredentials, err = envBool("ALLOW_PAYLOAD_CREDENTIALS", false); err != nil {
+  return nil, err
+ }
+ if cfg.FIPSMode, err = envBool("FIPS_MODE", false); err != nil {
+  return nil, err
+ }
+ if err = cfg.resolveSSHAlgorithms(); err != nil {
+  return nil, err
+ }
+ if cfg.AllowLegacySSH, err = envBool("ALLOW_LEGACY_SSH_ALGORITHMS", false); err != nil {
+  return nil, err
+ }
+ if cfg.AllowLegacySSH && cfg.FIPSMode {
+  return nil, fmt.Errorf("ALLOW_LEGACY_SSH_ALGORITHMS cannot be combined with FIPS_MODE")
+ }
+ if cfg.SourceAddress, err = parseSourceAddress(getenv("SFTP_SOURCE_ADDRESS")); err != nil {
+  return nil, err
+ }
+ if cfg.DialTimeout, err = EnvDuration("SFTP_DIAL_TIMEOUT", 0); err != nil {
+  return nil, err
+ }
+ if cfg.ShuffleAddresses, err = envBool("SFTP_SHUFFLE_ADDRESSES", false); err != nil {
+  return nil, err
+ }
+ if cfg.TCPKeepAlive, err = EnvDuration("TCP_KEEPALIVE", 0); err != nil {
+  return nil, err
+ }
+ if cfg.SSHKeepaliveInterval, err = EnvDuration("SSH_KEEPALIVE_INTERVAL", defaultSSHKeepaliveInterval); err != nil {
+  return nil, err
+ }
+ if cfg.SSHKeepaliveMaxMissed, err = EnvInt("SSH_KEEPALIVE_MAX_MISSED", defaultSSHKeepaliveMaxMissed); err != nil {
+  return nil, err
+ }
+ if cfg.SSHKeepaliveMaxMissed < 1 {
+  return nil, fmt.Errorf("invalid SSH_KEEPALIVE_MAX_MISSED %d: must be at least 1", cfg.SSHKeepaliveMaxMissed)
+ }
+ if cfg.SSHCompression, err = envBool("SSH_COMPRESSION", false); err != nil {
+  return nil, err
+ }
+ cfg.HostKeyPolicy = strings.ToLower(EnvString("HOST_KEY_POLICY", hostKeyInsecure))
+ switch cfg.HostKeyPolicy {
+ case hostKeyInsecure, HostKeyStrict, HostKeyTOFU:
+ default:
+  return nil, fmt.Errorf("invalid HOST_KEY_POLICY %q: must be insecure, strict or tofu", cfg.HostKeyPolicy)
+ }
+ cfg.HostKeyParameterPrefix = EnvString("HOST_KEY_PARAMETER_PREFIX", defaultHostKeyParameterPrefix)
+ if !strings.HasPrefix(cfg.HostKeyParameterPrefix, "/") || !strings.HasSuffix(cfg.HostKeyParameterPrefix, "/") {
+  return nil, fmt.Errorf("invalid HOST_KEY_PARAMETER_PREFIX %q: must start and end with /", cfg.HostKeyParameterPrefix)
+ }
+ if cfg.StallTimeout, err = EnvDuration("STALL_TIMEOUT", defaultStallTimeout); err != nil {
+  return nil, err
+ }
+ if cfg.VerifyContentLength, err = envBool("VERIFY_CONTENT_LENGTH", true); err != nil {
+  return nil, err
+ }
+ if cfg.VerifyS3Checksum, err = envBool("VERIFY_S3_CHECKSUM", false); err != nil {
+  return nil, err
+ }
+ if cfg.ShortReadRetries, err = EnvInt("SHORT_READ_RETRIES", defaultShortReadRetries); err != nil {
+  return nil, err
+ }
+ if cfg.ShortReadRetries < 0 {
+  return nil, fmt.Errorf("invalid SHORT_READ_RETRIES %d: must not be negative", cfg.ShortReadRetries)
+ }
+ cfg.QuarantinePrefix = EnvString("QUARANTINE_PREFIX", "")
+ cfg.QuarantineTopicARN = EnvString("QUARANTINE_TOPIC_ARN", "")
+ if cfg.ValidateNonEmpty, err = envBool("VALIDATE_NON_EMPTY", false); err != nil {
+  return nil, err
+ }
+ if cfg.ValidateContentType, err = envBool("VALIDATE_CONTENT_TYPE", false); err != nil {
+  return nil, err
+ }
+ if v := getenv("VALIDATE_NAME_PATTERN"); v != "" {
+  if cfg.ValidateNamePattern, err = regexp.Compile(v); err != nil {
+   return nil, fmt.Errorf("invalid VALIDATE_NAME_PATTERN %q: %w", v, err)
+  }
+ }
+ if cfg.ValidateQuarantine, err = envBool("VALIDATE_QUARANTINE", false); err != nil {
+  return nil, err
+ }
+ if cfg.ValidateQuarantine && cfg.QuarantinePrefix == "" {
+  return nil, fmt.Errorf("VALIDATE_QUARANTINE needs QUARANTINE_PREFIX")
+ }
+ if cfg.RemoteFsync, err = envBool("REMOTE_FSYNC", false); err != nil {
+  return nil, err
+ }
+ if cfg.RemoteFsyncStrict, err = envBool("REMOTE_FSYNC_STRICT", false); err != nil {
+  return nil, err
+ }
+ if cfg.RemoteUID, err = envOwnerID("REMOTE_UID"); err != nil {
+  return nil, err
+ }
+ if cfg.RemoteGID, err = envOwnerID("REMOTE_GID"); err != nil {
+  return nil, err
+ }
+ if cfg.RemoteChownDirs, err = envBool("REMOTE_CHOWN_DIRS", false); err != nil {
+  return nil, err
+ }
+ if cfg.RemoteChownStrict, err = envBool("REMOTE_CHOWN_STRICT", false); err != nil {
+  return nil, err
+ }
+ if cfg.RemoteSpaceCheck, err = envBool("REMOTE_SPACE_CHECK", true); err != nil {
+  return nil, err
+ }
+ if cfg.RemoteSpaceRecheckBytes, err = envInt64("REMOTE_SPACE_RECHECK_BYTES", 0); err != nil {
+  return nil, err
+ }
+ if cfg.Preflight, err = envBool("PREFLIGHT", false); err != nil {
+  return nil, err
+ }
+ if cfg.PreflightProbe, err = envBool("PREFLIGHT_PROBE", true); err != nil {
+  return nil, err
+ }
+ if cfg.AtomicUpload, err = envBool("ATOMIC_UPLOAD", false); err != nil {
+  return nil, err
+ }
+ cfg.AtomicRenameFallback = EnvString("ATOMIC_RENAME_FALLBACK", renameFallbackReupload)
+ switch cfg.AtomicRenameFallback {
+ case renameFallbackReupload, RenameFallbackDowngrade:
+ default:
+  return nil, fmt.Errorf("invalid ATOMIC_RENAME_FALLBACK %q: must be reupload or downgrade", cfg.AtomicRenameFallback)
+ }
+ cfg.OverwritePolicy = EnvString("OVERWRITE_POLICY", OverwriteReplace)
+ switch cfg.OverwritePolicy {
+ case OverwriteReplace, OverwriteSkip, OverwriteSuffix:
+ default:
+  return nil, fmt.Errorf("invalid OVERWRITE_POLICY %q: must be overwrite, skip or suffix", cfg.OverwritePolicy)
+ }
+ if cfg.RemoteListingCache, err = envBool("REMOTE_LISTING_CACHE", true); err != nil {
+  return nil, err
+ }
+ if cfg.RemoteListingMaxAge, err = EnvDuration("REMOTE_LISTING_MAX_AGE", defaultRemoteListingMaxAge); err != nil {
+  return nil, err
+ }
+ if cfg.RemoteListingCache && cfg.RemoteListingMaxAge <= 0 {
+  return nil, fmt.Errorf("invalid REMOTE_LISTING_MAX_AGE %s: must be positive", cfg.RemoteListingMaxAge)
+ }
+ cfg.CollisionSuffix = EnvString("COLLISION_SUFFIX", suffixSequence)
+ switch cfg.CollisionSuffix {
+ case suffixSequence, SuffixTimestamp:
+ default:
+  return nil, fmt.Errorf("invalid COLLISION_SUFFIX %q: must be sequence or timestamp", cfg.CollisionSuffix)
+ }
+ cfg.RemoteLayout = EnvString("REMOTE_LAYOUT", layoutFlatten)
+ switch cfg.RemoteLayout {
+ case layoutFlatten, LayoutPreserve:
+ default:
+  return nil, fmt.Errorf("invalid REMOTE_LAYOUT %q: must be flatten or preserve", cfg.RemoteLayout)
+ }
+ cfg.PathCollisions = EnvString("PATH_COLLISIONS", collisionsFail)
+ switch cfg.PathCollisions {
+ case collisionsFail, CollisionsAllow:
+ default:
+  return nil, fmt.Errorf("invalid PATH_COLLISIONS %q: must be fail or allow", cfg.PathCollisions)
+ }
+ cfg.RemoteFilenameEncoding = EnvString("REMOTE_FILENAME_ENCODING", EncodingUTF8)
+ switch cfg.RemoteFilenameEncoding {
+ case EncodingUTF8, EncodingLatin1:
+ default:
+  return nil, fmt.Errorf("invalid REMOTE_FILENAME_ENCODING %q: must be utf8 or latin1", cfg.RemoteFilenameEncoding)
+ }
+ cfg.RemoteFilenameUnrepresentable = EnvString("REMOTE_FILENAME_UNREPRESENTABLE", UnrepresentableReplace)
+ switch cfg.RemoteFilenameUnrepresentable {
+ case UnrepresentableReplace, unrepresentableStrip, UnrepresentableFail:
+ default:
+  return nil, fmt.Errorf("invalid REMOTE_FILENAME_UNREPRESENTABLE %q: must be replace, strip or fail", cfg.RemoteFilenameUnrepresentable)
+ }
+ if cfg.MetadataRouting, err = envBool("METADATA_ROUTING", false); err != nil {
+  return nil, err
+ }
+ cfg.RemoteAllowedRoot = EnvString("REMOTE_ALLOWED_ROOT", cfg.RemoteDir)
+ if cfg.ExtensionRoutes, err = parseExtensionRoutes(getenv("EXTENSION_ROUTES")); err != nil {
+  return nil, err
+ }
+ cfg.UnmappedExtension = EnvString("UNMAPPED_EXTENSION", UnmappedDefault)
+ switch cfg.UnmappedExtension {
+ case UnmappedDefault, UnmappedSkip, UnmappedFail:
+ default:
+  return nil, fmt.Errorf("invalid UNMAPPED_EXTENSION %q: must be default, skip or fail", cfg.UnmappedExtension)
+ }
+ if cfg.SplitSizeBytes, err = envInt64("SPLIT_SIZE_BYTES", 0); err != nil {
+  return nil, err
+ }
+ cfg.ArchiveMode = getenv("ARCHIVE_MODE")
+ switch cfg.ArchiveMode {
+ case "", ArchiveTarGz, ArchiveZip:
+ default:
+  return nil, fmt.Errorf("invalid ARCHIVE_MODE %q: must be tar.gz or zip", cfg.ArchiveMode)
+ }
+ if len(cfg.TenantSecrets) > 0 && cfg.ArchiveMode != "" {
+  return nil, fmt.Errorf("TENANT_SECRETS cannot be combined with ARCHIVE_MODE")
+ }
+ cfg.ArchiveName = EnvString("ARCHIVE_NAME", "archive_{yyyymmdd}."+cfg.ArchiveMode)
+ if cfg.Concatenate, err = envBool("CONCATENATE", false); err != nil {
+  return nil, err
+ }
+ cfg.ConcatenateName = EnvString("CONCATENATE_NAME", "concat_{yyyymmdd}.txt")
+ cfg.ConcatenateOrder = EnvString("CONCATENATE_ORDER", concatOrderKey)
+ switch cfg.ConcatenateOrder {
+ case concatOrderKey, ConcatOrderLastModified:
+ default:
+  return nil, fmt.Errorf("invalid CONCATENATE_ORDER %q: must be key or lastModified", cfg.ConcatenateOrder)
+ }
+ if v := getenv("CONCATENATE_DELIMITER"); v != "" {
+  // Escapes such as \n are accepted so newlines can be set.
+  if cfg.ConcatenateDelimiter, err = strconv.Unquote(`"` + v + `"`); err != nil {
+   return nil, fmt.Errorf("invalid CONCATENATE_DELIMITER %q: %v", v, err)
+  }
+ }
+ cfg.ConcatenateStatePrefix = EnvString("CONCATENATE_STATE_PREFIX", defaultConcatStatePrefix)
+ if cfg.CreateEmptyDirs, err = envBool("CREATE_EMPTY_DIRS", false); err != nil {
+  return nil, err
+ }
+ if cfg.EmptyDirsFatal, err = envBool("EMPTY_DIRS_FATAL", false); err != nil {
+  return nil, err
+ }
+ if cfg.CreateEmptyDirs && (cfg.RemoteLayout != LayoutPreserve || !cfg.CreateRemoteDirs || cfg.ArchiveMode != "") {
+  return nil, fmt.Errorf("CREATE_EMPTY_DIRS requires REMOTE_LAYOUT=preserve and CREATE_REMOTE_DIRS, and cannot be combined with ARCHIVE_MODE")
+ }
+ if cfg.ExplodeArchives, err = envBool("EXPLODE_ARCHIVES", false); err != nil {
+  return nil, err
+ }
+ if cfg.FailFast, err = envBool("FAIL_FAST", false); err != nil {
+  return nil, err
+ }
+ cfg.TextConvert = strings.ToLower(getenv("TEXT_CONVERT"))
+ if cfg.TextConvert != "" && cfg.TextConvert != TextConvertCRLF {
+  return nil, fmt.Errorf("invalid TEXT_CONVERT %q: must be crlf", cfg.TextConvert)
+ }
+ for _, ext := range strings.Split(EnvString("TEXT_CONVERT_EXTENSIONS", defaultTextConvertExtensions), ",") {
+  if ext = strings.ToLower(strings.TrimSpace(ext)); ext == "" {
+   continue
+  }
+  if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+   return nil, fmt.Errorf("invalid TEXT_CONVERT_EXTENSIONS entry %q: must start with \".\"", ext)
+  }
+  cfg.TextConvertExtensions = append(cfg.TextConvertExtensions, ext)
+ }
+ for _, suffix := range envList("CONTROL_FILE_SUFFIXES") {
+  cfg.ControlFileSuffixes = append(cfg.ControlFileSuffixes, strings.ToLower(suffix))
+ }
+ if cfg.GroupByFolder, err = envBool("GROUP_BY_FOLDER", false); err != nil {
+  return nil, err
+ }
+ cfg.GroupMarker = EnvString("GROUP_MARKER", defaultGroupMarker)
+ if strings.Contains(cfg.GroupMarker, "/") {
+  return nil, fmt.Errorf("invalid GROUP_MARKER %q: must be a file name", cfg.GroupMarker)
+ }
+ if cfg.GroupByFolder && (cfg.RemoteLayout != LayoutPreserve || cfg.ArchiveMode != "" || cfg.Concatenate) {
+  return nil, fmt.Errorf("GROUP_BY_FOLDER requires REMOTE_LAYOUT=preserve, and cannot be combined with ARCHIVE_MODE or CONCATENATE")
+ }
+ cfg.ControlFileScope = EnvString("CONTROL_FILE_SCOPE", controlScopeName)
+ switch cfg.ControlFileScope {
+ case controlScopeName, ControlScopeBatch:
+ default:
+  return nil, fmt.Errorf("invalid CONTROL_FILE_SCOPE %q: must be name or batch", cfg.ControlFileScope)
+ }
+ cfg.ChecksumSidecar = strings.ToLower(getenv("CHECKSUM_SIDECAR"))
+ switch cfg.ChecksumSidecar {
+ case "", ChecksumSHA256, ChecksumMD5:
+ default:
+  return nil, fmt.Errorf("invalid CHECKSUM_SIDECAR %q: must be sha256 or md5", cfg.ChecksumSidecar)
+ }
+ if cfg.MetadataSidecar, err = envBool("METADATA_SIDECAR", false); err != nil {
+  return nil, err
+ }
+ if cfg.SidecarFieldNames, err = ParseSidecarFields(getenv("METADATA_SIDECAR_FIELDS")); err != nil {
+  return nil, err
+ }
+ cfg.PostUploadCommand = getenv("POST_UPLOAD_COMMAND")
+ if err = ValidateCommandTemplate("POST_UPLOAD_COMMAND", cfg.PostUploadCommand, FileHookPlaceholders); err != nil {
+  return nil, err
+ }
+ cfg.PostBatchCommand = getenv("POST_BATCH_COMMAND")
+ if err = ValidateCommandTemplate("POST_BATCH_COMMAND", cfg.PostBatchCommand, BatchHookPlaceholders); err != nil {
+  return nil, err
+ }
+ cfg.HookFailureMode = EnvString("HOOK_FAILURE_MODE", HookFailureWarn)
+ if cfg.HookFailureMode != HookFailureWarn && cfg.HookFailureMode != HookFailureFail {
+  return nil, fmt.Errorf("invalid HOOK_FAILURE_MODE %q: must be warn or fail", cfg.HookFailureMode)
+ }
+ if cfg.HookTimeout, err = EnvDuration("HOOK_TIMEOUT", defaultHookTimeout); err != nil {
+  return nil, err
+ }
+ cfg.WebhookURL = getenv("WEBHOOK_URL")
+ cfg.WebhookSecretName = getenv("WEBHOOK_SECRET_NAME")
+ maxBytes, err := envInt64("WEBHOOK_MAX_BYTES", DefaultWebhookBytes)
+ if err != nil {
+  return nil, err
+ }
+ cfg.WebhookMaxBytes = int(maxBytes)
+ cfg.SlackWebhookSecretName = getenv("SLACK_WEBHOOK_SECRET_NAME")
+ cfg.SlackNotify = EnvString("SLACK_NOTIFY", slackNotifyAlways)
+ if cfg.SlackNotify != slackNotifyAlways && cfg.SlackNotify != SlackNotifyFailure {
+  return nil, fmt.Errorf("invalid SLACK_NOTIFY %q: must be always or failure", cfg.SlackNotify)
+ }
+ cfg.HTTPTriggerSecretName = getenv("HTTP_TRIGGER_SECRET_NAME")
+ cfg.HTTPTriggerHeader = EnvString("HTTP_TRIGGER_HEADER", defaultHTTPTriggerHeader)
+ if cfg.HTTPSyncMaxObjects, err = EnvInt("HTTP_SYNC_MAX_OBJECTS", defaultHTTPSyncMaxObjects); err != nil {
+  return nil, err
+ }
+ if cfg.HTTPSyncMaxBytes, err = envInt64("HTTP_SYNC_MAX_BYTES", 0); err != nil {
+  return nil, err
+ }
+ cfg.DestinationName = EnvString("DESTINATION_NAME", SecretName)
+ if cfg.MetricDestinations, err = parseMetricDestinations(envList("METRIC_DESTINATIONS"), cfg.DestinationName, cfg.TenantSecrets); err != nil {
+  return nil, err
+ }
+ cfg.ReportEmailTo = envList("REPORT_EMAIL_TO")
+ cfg.ReportEmailFrom = getenv("REPORT_EMAIL_FROM")
+ if len(cfg.ReportEmailTo) > 0 && cfg.ReportEmailFrom == "" {
+  return nil, fmt.Errorf("REPORT_EMAIL_FROM is required when REPORT_EMAIL_TO is set")
+ }
+ if cfg.ReportEmailDailyOnly, err = envBool("REPORT_EMAIL_DAILY_ONLY", false); err != nil {
+  return nil, err
+ }
+ cfg.ProcessedPrefix = EnvString("PROCESSED_PREFIX", defaultProcessedPrefix)
+ if cfg.ProcessedRetentionDays, err = EnvInt("PROCESSED_RETENTION_DAYS", 0); err != nil {
+  return nil, err
+ }
+ if cfg.CleanupDryRun, err = envBool("CLEANUP_DRY_RUN", false); err != nil {
+  return nil, err
+ }
+ cfg.ArchivedObjectPolicy = EnvString("ARCHIVED_OBJECT_POLICY", archivedFail)
+ switch cfg.ArchivedObjectPolicy {
+ case archivedFail, ArchivedSkip, ArchivedRestore:
+ default:
+  return nil, fmt.Errorf("invalid ARCHIVED_OBJECT_POLICY %q: must be fail, skip or restore", cfg.ArchivedObjectPolicy)
+ }
+ cfg.RestoreTier = EnvString("RESTORE_TIER", source.TierStandard)
+ switch cfg.RestoreTier {
+ case source.TierStandard, source.TierBulk, source.TierExpedited:
+ default:
+  return nil, fmt.Errorf("invalid RESTORE_TIER %q: must be Standard, Bulk or Expedited", cfg.RestoreTier)
+ }
+ if cfg.RestoreDays, err = EnvInt("RESTORE_DAYS", defaultRestoreDays); err != nil {
+  return nil, err
+ }
+ if cfg.RestoreDays < 1 {
+  return nil, fmt.Errorf("invalid RESTORE_DAYS %d: must be at least 1", cfg.RestoreDays)
+ }
+ cfg.RestoreStatePrefix = EnvString("RESTORE_STATE_PREFIX", defaultRestoreStatePrefix)
+ if cfg.ObjectLockStrict, err = envBool("OBJECT_LOCK_STRICT", false); err != nil {
+  return nil, err
+ }
+ if cfg.CleanupMaxDeletes, err = EnvInt("CLEANUP_MAX_DELETES", DefaultCleanupMaxDeletes); err != nil {
+  return nil, err
+ }
+ if cfg.S3MaxAttempts, err = EnvInt("S3_MAX_ATTEMPTS", defaultS3MaxAttempts); err != nil {
+  return nil, err
+ }
+ if cfg.S3MaxAttempts < 1 {
+  return nil, fmt.Errorf("invalid S3_MAX_ATTEMPTS %d: must be at least 1", cfg.S3MaxAttempts)
+ }
+ if cfg.RetryBudgetAttempts, err = EnvInt("RETRY_BUDGET_ATTEMPTS", 0); err != nil {
+  return nil, err
+ }
+ if cfg.RetryBudgetBackoff, err = EnvDuration("RETRY_BUDGET_BACKOFF", 0); err != nil {
+  return nil, err
+ }
+ if cfg.BreakerThreshold, err = EnvInt("CIRCUIT_BREAKER_THRESHOLD", 0); err != nil {
+  return nil, err
+ }
+ if cfg.BreakerThreshold < 0 {
+  return nil, fmt.Errorf("invalid CIRCUIT_BREAKER_THRESHOLD %d: must not be negative", cfg.BreakerThreshold)
+ }
+ if cfg.StrictFailures, err = envBool("STRICT_FAILURES", false); err != nil {
+  return nil, err
+ }
+ if cfg.RetryBudgetAttempts < 0 || cfg.RetryBudgetBackoff < 0 {
+  return nil, fmt.Errorf("invalid RETRY_BUDGET_ATTEMPTS or RETRY_BUDGET_BACKOFF: must not be negative")
+ }
+ cfg.S3RetryMode = EnvString("S3_RETRY_MODE", retryModeStandard)
+ if err = validateS3RetryMode(cfg.S3RetryMode); err != nil {
+  return nil, err
+ }
+ if cfg.S3RequestTimeout, err = EnvDuration("S3_REQUEST_TIMEOUT", defaultS3RequestTimeout); err != nil {
+  return nil, err
+ }
+ cfg.ListSharding = EnvString("LIST_SHARDING", ShardingOff)
+ switch cfg.ListSharding {
+ case ShardingOff, ShardingChar, ShardingDelimiter:
+ default:
+  return nil, fmt.Errorf("invalid LIST_SHARDING %q: must be off, char or delimiter", cfg.ListSharding)
+ }
+ if cfg.Recursive, err = envBool("RECURSIVE", true); err != nil {
+  return nil, err
+ }
+ if len(cfg.TenantSecrets) > 0 && !cfg.Recursive {
+  return nil, fmt.Errorf("TENANT_SECRETS cannot be combined with RECURSIVE=false")
+ }
+ if cfg.PullMode, err = envBool("PULL_MODE", false); err != nil {
+  return nil, err
+ }
+ cfg.PullRemoteDir = NormalizeRemotePath(EnvString("PULL_REMOTE_DIR", cfg.RemoteDir))
+ cfg.PullPrefix = EnvString("PULL_PREFIX", DefaultPullPrefix)
+ if cfg.FollowSymlinks, err = envBool("FOLLOW_SYMLINKS", false); err != nil {
+  return nil, err
+ }
+ if cfg.PullMaxDepth, err = EnvInt("PULL_MAX_DEPTH", 1); err != nil {
+  return nil, err
+ }
+ if cfg.PullMaxDepth < 0 {
+  return nil, fmt.Errorf("invalid PULL_MAX_DEPTH %d: must not be negative", cfg.PullMaxDepth)
+ }
+ if cfg.PullMaxEntries, err = EnvInt("PULL_MAX_ENTRIES", defaultPullMaxEntries); err != nil {
+  return nil, err
+ }
+ if cfg.PullMaxEntries < 1 {
+  return nil, fmt.Errorf("invalid PULL_MAX_ENTRIES %d: must be at least 1", cfg.PullMaxEntries)
+ }
+ if cfg.PreservePaths, err = envBool("PRESERVE_PATHS", false); err != nil {
+  return nil, err
+ }
+ cfg.PullInclude, cfg.PullExclude = envList("PULL_INCLUDE"), envList("PULL_EXCLUDE")
+ if err = checkPatterns("PULL_INCLUDE", cfg.PullInclude); err != nil {
+  return nil, err
+ }
+ if err = checkPatterns("PULL_EXCLUDE", cfg.PullExclude); err != nil {
+  return nil, err
+ }
+ if cfg.PullPartSize, err = envInt64("PULL_PART_SIZE", defaultPullPartSize); err != nil {
+  return nil, err
+ }
+ if cfg.PullPartSize < source.MinUploadPartSize {
+  return nil, fmt.Errorf("invalid PULL_PART_SIZE %d: must be at least %d", cfg.PullPartSize, source.MinUploadPartSize)
+ }
+ if cfg.PullUploadConcurrency, err = EnvInt("PULL_UPLOAD_CONCURRENCY", defaultPullUploadConcurrency); err != nil {
+  return nil, err
+ }
+ if cfg.PullUploadConcurrency < 1 {
+  return nil, fmt.Errorf("invalid PULL_UPLOAD_CONCURRENCY %d: must be at least 1", cfg.PullUploadConcurrency)
+ }
+ if mb, err := envInt64("AWS_LAMBDA_FUNCTION_MEMORY_SIZE", 0); err == nil && mb > 0 {
+  cfg.PullMemoryBudget = mb << 20 / 2
+ }
+ if envelope := cfg.PullPartSize * int64(cfg.PullUploadConcurrency); cfg.PullMode && cfg.PullMemoryBudget > 0 && envelope > cfg.PullMemoryBudget {
+  return nil, fmt.Errorf("PULL_PART_SIZE %d x PULL_UPLOAD_CONCURRENCY %d = %d bytes exceeds the pull memory budget of %d bytes (half the function memory)",
+   cfg.PullPartSize, cfg.PullUploadConcurrency, envelope, cfg.PullMemoryBudget)
+ }
+ if cfg.MaxInflightBytes, err = envInt64("MAX_INFLIGHT_BYTES", 0); err != nil {
+  return nil, err
+ }
+ if err := cfg.CheckInflightBytes(); err != nil {
+  return nil, err
+ }
+ if cfg.PullMinAge, err = EnvDuration("PULL_MIN_AGE", 0); err != nil {
+  return nil, err
+ }
+ if cfg.PullClockSkew, err = EnvDuration("PULL_CLOCK_SKEW", defaultPullClockSkew); err != nil {
+  return nil, err
+ }
+ if cfg.MinObjectAge, err = EnvDuration("MIN_OBJECT_AGE", 0); err != nil {
+  return nil, err
+ }
+ if cfg.ObjectClockSkew, err = EnvDuration("OBJECT_CLOCK_SKEW", defaultObjectClockSkew); err != nil {
+  return nil, err
+ }
+ if cfg.PullStabilityWait, err = EnvDuration("PULL_STABILITY_WAIT", 0); err != nil {
+  return nil, err
+ }
+ if cfg.PullStabilityWait > maxPullStabilityWait {
+  return nil, fmt.Errorf("invalid PULL_STABILITY_WAIT %s: must be at most %s", cfg.PullStabilityWait, maxPullStabilityWait)
+ }
+ cfg.PullKeyTemplate = getenv("PULL_KEY_TEMPLATE")
+ if cfg.PullKeyTemplate != "" {
+  if err := validatePullKeyTemplate(cfg.PullKeyTemplate); err != nil {
+   return nil, err
+  }
+ }
+ cfg.PullKeyTime = EnvString("PULL_KEY_TIME", pullKeyTimePull)
+ switch cfg.PullKeyTime {
+ case pullKeyTimePull, PullKeyTimeMtime:
+ default:
+  return nil, fmt.Errorf("invalid PULL_KEY_TIME %q: must be pull or mtime", cfg.PullKeyTime)
+ }
+ if cfg.PullDetectContentType, err = envBool("PULL_DETECT_CONTENT_TYPE", false); err != nil {
+  return nil, err
+ }
+ if cfg.PullContentTypes, err = parseContentTypes(getenv("PULL_CONTENT_TYPES")); err != nil {
+  return nil, err
+ }
+ if cfg.PullSniffContentType, err = envBool("PULL_SNIFF_CONTENT_TYPE", true); err != nil {
+  return nil, err
+ }
+ if cfg.PullMode && (cfg.ArchiveMode != "" || len(cfg.TenantSecrets) > 0) {
+  return nil, fmt.Errorf("PULL_MODE cannot be combined with ARCHIVE_MODE or TENANT_SECRETS")
+ }
+ if cfg.Concatenate && (cfg.PullMode || cfg.ArchiveMode != "" || cfg.ExplodeArchives || cfg.CreateEmptyDirs || len(cfg.TenantSecrets) > 0) {
+  return nil, fmt.Errorf("CONCATENATE cannot be combined with PULL_MODE, ARCHIVE_MODE, EXPLODE_ARCHIVES, CREATE_EMPTY_DIRS or TENANT_SECRETS")
+ }
+ if v := getenv("STAGING_DIR"); v != "" {
+  cfg.StagingDir = NormalizeRemotePath(v)
+  switch {
+  case cfg.StagingDir == cfg.RemoteDir || strings.HasPrefix(cfg.StagingDir, strings.TrimSuffix(cfg.RemoteDir, "/")+"/"):
+   return nil, fmt.Errorf("invalid STAGING_DIR %q: must not be REMOTE_DIR or below it", cfg.StagingDir)
+  case strings.HasPrefix(cfg.RemoteDir, strings.TrimSuffix(cfg.StagingDir, "/")+"/"):
+   return nil, fmt.Errorf("invalid STAGING_DIR %q: must not contain REMOTE_DIR", cfg.StagingDir)
+  }
+  if cfg.PullMode || cfg.ArchiveMode != "" || cfg.Concatenate || cfg.SplitSizeBytes > 0 || cfg.ResumeStatePrefix != "" {
+   return nil, fmt.Errorf("STAGING_DIR cannot be combined with PULL_MODE, ARCHIVE_MODE, CONCATENATE, SPLIT_SIZE_BYTES or RESUME_STATE_PREFIX")
+  }
+ }
+ if cfg.StagingOrphanAge, err = EnvDuration("STAGING_ORPHAN_AGE", defaultStagingOrphanAge); err != nil {
+  return nil, err
+ }
+ if cfg.StagingOrphanAge <= 0 {
+  return nil, fmt.Errorf("invalid STAGING_ORPHAN_AGE %s: must be positive, or files still being uploaded by another run are removed", cfg.StagingOrphanAge)
+ }
+ if cfg.SpoolDir = EnvString("SPOOL_DIR", ""); cfg.SpoolDir != "" && !filepath.IsAbs(cfg.SpoolDir) {
+  return nil, fmt.Errorf("invalid SPOOL_DIR %q: must be an absolute path", cfg.SpoolDir)
+ }
+ if cfg.SpoolStaleAge, err = EnvDuration("SPOOL_STALE_AGE", defaultSpoolStaleAge); err != nil {
+  return nil, err
+ }
+ if cfg.SpoolStaleAge <= 0 {
+  return nil, fmt.Errorf("invalid SPOOL_STALE_AGE %s: must be positive, or the directories of running invocations are removed", cfg.SpoolStaleAge)
+ }
+ if cfg.MaxDepth, err = EnvInt("MAX_DEPTH", 0); err != nil {
+  return nil, err
+ }
+ if cfg.MaxDepth < 0 {
+  return nil, fmt.Errorf("invalid MAX_DEPTH %d: must not be negative", cfg.MaxDepth)
+ }
+ if !cfg.Recursive && cfg.ListSharding != ShardingOff {
+  return nil, fmt.Errorf("LIST_SHARDING cannot be combined with RECURSIVE=false")
+ }
+ if cfg.ListConcurrency, err = EnvInt("LIST_CONCURRENCY", defaultListConcurrency); err != nil {
+  return nil, err
+ }
+ if cfg.ListConcurrency < 1 {
+  return nil, fmt.Errorf("invalid LIST_CONCURRENCY %d: must be at least 1", cfg.ListConcurrency)
+ }
+ if cfg.ThroughputMinBytes, err = envInt64("THROUGHPUT_MIN_BYTES", defaultThroughputMinBytes); err != nil {
+  return nil, err
+ }
+ if cfg.EmptyRunAlertAfter, err = EnvInt("EMPTY_RUN_ALERT_AFTER", 0); err != nil {
+  return nil, err
+ }
+ cfg.EmptyRunParameter = EnvString("EMPTY_RUN_PARAMETER", "")
+ cfg.EmptyRunTopicARN = EnvString("EMPTY_RUN_TOPIC_ARN", "")
+ if cfg.EmptyRunFail, err = envBool("EMPTY_RUN_FAIL", false); err != nil {
+  return nil, err
+ }
+ if cfg.EmptyRunAlertAfter < 0 {
+  return nil, fmt.Errorf("invalid EMPTY_RUN_ALERT_AFTER %d: must not be negative", cfg.EmptyRunAlertAfter)
+ }
+ if cfg.EmptyRunAlertAfter > 0 && cfg.EmptyRunParameter == "" {
+  return nil, fmt.Errorf("EMPTY_RUN_PARAMETER is required when EMPTY_RUN_ALERT_AFTER is set")
+ }
+ if cfg.MaxBytesPerRun, err = envInt64("MAX_BYTES_PER_RUN", 0); err != nil {
+  return nil, err
+ }
+ cfg.CheckpointPrefix = EnvString("CHECKPOINT_PREFIX", "")
+ if cfg.Fanout, err = envBool("FANOUT", false); err != nil {
+  return nil, err
+ }
+ if cfg.FanoutChunkSize, err = EnvInt("FANOUT_CHUNK_SIZE", defaultFanoutChunkSize); err != nil {
+  return nil, err
+ }
+ if cfg.FanoutChunkSize < 1 {
+  return nil, fmt.Errorf("invalid FANOUT_CHUNK_SIZE %d: must be at least 1", cfg.FanoutChunkSize)
+ }
+ if cfg.FanoutMaxChildren, err = EnvInt("FANOUT_MAX_CHILDREN", defaultFanoutMaxChildren); err != nil {
+  return nil, err
+ }
+ if cfg.FanoutMaxChildren < 1 {
+  return nil, fmt.Errorf("invalid FANOUT_MAX_CHILDREN %d: must be at least 1", cfg.FanoutMaxChildren)
+ }
+ cfg.InventoryGapPrefix = EnvString("INVENTORY_GAP_PREFIX", "")
+ if cfg.InventoryGapPrefix != "" && !strings.HasPrefix(cfg.InventoryGapPrefix, cfg.SourcePrefix) {
+  return nil, fmt.Errorf("invalid INVENTORY_GAP_PREFIX %q: must be under the source prefix %q", cfg.InventoryGapPrefix, cfg.SourcePrefix)
+ }
+ if cfg.InventoryDiscrepancies, err = envBool("INVENTORY_DISCREPANCIES", false); err != nil {
+  return nil, err
+ }
+ if cfg.Fanout && (cfg.PullMode || cfg.ArchiveMode != "" || cfg.Concatenate || cfg.GroupByFolder || cfg.CheckpointPrefix != "") {
+  return nil, fmt.Errorf("FANOUT cannot be combined with PULL_MODE, ARCHIVE_MODE, CONCATENATE, GROUP_BY_FOLDER or CHECKPOINT_PREFIX")
+ }
+ // Batches delivered side by side cannot share what these keep for the
+ // whole run.
+ if cfg.TenantWorkers > 1 && (cfg.GroupByFolder || len(cfg.ControlFileSuffixes) > 0 || cfg.CreateEmptyDirs ||
+  cfg.PostBatchCommand != "" || cfg.StagingDir != "" || cfg.CheckpointPrefix != "" || cfg.MaxBytesPerRun > 0 ||
+  cfg.BreakerThreshold > 0 || cfg.OverwritePolicy == OverwriteSuffix || cfg.ArchivedObjectPolicy == ArchivedRestore) {
+  return nil, fmt.Errorf("TENANT_WORKERS above 1 cannot be combined with GROUP_BY_FOLDER, CONTROL_FILE_SUFFIXES, CREATE_EMPTY_DIRS, POST_BATCH_COMMAND, STAGING_DIR, CHECKPOINT_PREFIX, MAX_BYTES_PER_RUN, CIRCUIT_BREAKER_THRESHOLD, OVERWRITE_POLICY=suffix or ARCHIVED_OBJECT_POLICY=restore")
+ }
+ if cfg.DryRun, err = envBool("DRY_RUN", false); err != nil {
+  return nil, err
+ }
+ cfg.PlanPrefix = EnvString("PLAN_PREFIX", defaultPlanPrefix)
+ cfg.ProfileBucket = EnvString("PROFILE_BUCKET", getenv("REPORT_BUCKET"))
+ cfg.ProfilePrefix = EnvString("PROFILE_PREFIX", defaultProfilePrefix)
+ if cfg.CheckpointFullRelist, err = EnvDuration("CHECKPOINT_FULL_RELIST", defaultCheckpointFullRelist); err != nil {
+  return nil, err
+ }
+ if err := cfg.checkPrefixes(); err != nil {
+  return nil, err
+ }
+ return cfg, nil
+}
+
+// checkPrefixes rejects prefixes that overlap the source prefix. It runs
+// again after per-invocation overrides change SourcePrefix.
+func (cfg *Config) checkPrefixes() error {
+ if cfg.CheckpointPrefix != "" && strings.HasPrefix(cfg.CheckpointPrefix, cfg.SourcePrefix) {
+  return fmt.Errorf("invalid CHECKPOINT_PREFIX %q: checkpoints would be listed as source objects under %q", cfg.CheckpointPrefix, cfg.SourcePrefix)
+ }
+ if cfg.ResumeStatePrefix != "" && strings.HasPrefix(cfg.ResumeStatePrefix, cfg.SourcePrefix) {
+  return fmt.Errorf("invalid RESUME_STATE_PREFIX %q: resume state would be listed as source objects under %q", cfg.ResumeStatePrefix, cfg.SourcePrefix)
+ }
+ if cfg.Concatenate && strings.HasPrefix(cfg.ConcatenateStatePrefix, cfg.SourcePrefix) {
+  return fmt.Errorf("invalid CONCATENATE_STATE_PREFIX %q: concatenate state would be listed as source objects under %q", cfg.ConcatenateStatePrefix, cfg.SourcePrefix)
+ }
+ if cfg.ArchivedObjectPolicy == ArchivedRestore && strings.HasPrefix(cfg.RestoreStatePrefix, cfg.SourcePrefix) {
+  return fmt.Errorf("invalid RESTORE_STATE_PREFIX %q: restore state would be listed as source objects under %q", cfg.RestoreStatePrefix, cfg.SourcePrefix)
+ }
+ if cfg.Profile && (cfg.ProfileBucket == "" || cfg.ProfileBucket == S3Bucket) && strings.HasPrefix(cfg.ProfilePrefix, cfg.SourcePrefix) {
+  return fmt.Errorf("invalid PROFILE_PREFIX %q: profiles would be listed as source objects under %q", cfg.ProfilePrefix, cfg.SourcePrefix)
+ }
+ if cfg.DryRun && strings.HasPrefix(cfg.PlanPrefix, cfg.SourcePrefix) {
+  return fmt.Errorf("invalid PLAN_PREFIX %q: plans would be listed as source objects under %q", cfg.PlanPrefix, cfg.SourcePrefix)
+ }
+ if cfg.QuarantinePrefix != "" && strings.HasPrefix(cfg.QuarantinePrefix, cfg.SourcePrefix) {
+  return fmt.Errorf("invalid QUARANTINE_PREFIX %q: quarantined objects would be listed as source objects under %q", cfg.QuarantinePrefix, cfg.SourcePrefix)
+ }
+ if cfg.ProcessedRetentionDays > 0 && strings.HasPrefix(cfg.SourcePrefix, cfg.ProcessedPrefix) {
+  return fmt.Errorf("invalid PROCESSED_PREFIX %q: cleanup would delete objects under the source prefix %q", cfg.ProcessedPrefix, cfg.SourcePrefix)
+ }
+ return nil
+}
+
+// maxMetricDestinations bounds METRIC_DESTINATIONS, each of which becomes a
+// CloudWatch metric per metric emitted.
+const maxMetricDestinations = 20
+
+// metricDestinationOther stands in for destinations outside
+// METRIC_DESTINATIONS.
+const metricDestinationOther = "other"
+
+var metricDestinationPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// parseMetricDestinations validates METRIC_DESTINATIONS, defaulting it to the
+// destination name and the tenants.
+func parseMetricDestinations(names []string, destination string, tenants map[string]string) (map[string]bool, error) {
+ if len(names) == 0 {
+  names = append(names, destination)
+  for tenant := range tenants {
+   names = append(names, tenant)
+  }
+ }
+ if len(names) > maxMetricDestinations {
+  return nil, fmt.Errorf("invalid METRIC_DESTINATIONS: %d names, at most %d are allowed", len(names), maxMetricDestinations)
+ }
+ set := make(map[string]bool, len(names))
+ for _, name := range names {
+  if !metricDestinationPattern.MatchString(name) {
+   return nil, fmt.Errorf("invalid metric destination %q: must be 1 to 64 letters, digits, '.', '_' or '-'; set METRIC_DESTINATIONS", name)
+  }
+  set[name] = true
+ }
+ return set, nil
+}
+
+// MetricDestination returns the Destination dimension for name.
+func (cfg *Config) MetricDestination(name string) string {
+ if cfg.MetricDestinations[name] {
+  return name
+ }
+ return metricDestinationOther
+}
+
+// parseTenantSecrets parses TENANT_SECRETS, a JSON object mapping tenant
+// names to secret names or to objects such as
+// {"secretName":"sftp-a","maxConcurrency":8,"maxConnections":2}, and returns
+// the secrets and the limits of the tenants setting any.
+func parseTenantSecrets(v string) (map[string]string, map[string]TenantLimits, error) {
+ if v == "" {
+  return nil, nil, nil
+ }
+ var entries map[string]json.RawMessage
+ if err := json.Unmarshal([]byte(v), &entries); err != nil {
+  return nil, nil, fmt.Errorf("invalid TENANT_SECRETS: %w", err)
+ }
+ tenants := make(map[string]string, len(entries))
+ var limits map[string]TenantLimits
+ for tenant, raw := range entries {
+  var entry struct {
+   SecretName string `json:"secretName"`
+   TenantLimits
+  }
+  if err := json.Unmarshal(raw, &entry.SecretName); err != nil {
+   dec := json.NewDecoder(bytes.NewReader(raw))
+   dec.DisallowUnknownFields()
+   if err := dec.Decode(&entry); err != nil {
+    return nil, nil, fmt.Errorf("invalid TENANT_SECRETS entry %q: %w", tenant, err)
+   }
+  }
+  if tenant == "" || strings.Contains(tenant, "/") || entry.SecretName == "" {
+   return nil, nil, fmt.Errorf("invalid TENANT_SECRETS entry %q: %s", tenant, raw)
+  }
+  if entry.MaxConcurrency < 0 || entry.MaxConnections < 0 {
+   return nil, nil, fmt.Errorf("invalid TENANT_SECRETS entry %q: maxConcurrency and maxConnections must not be negative", tenant)
+  }
+  tenants[tenant] = entry.SecretName
+  if entry.TenantLimits != (TenantLimits{}) {
+   if limits == nil {
+    limits = make(map[string]TenantLimits)
+   }
+   limits[tenant] = entry.TenantLimits
+  }
+ }
+ return tenants, limits, nil
+}
+
+// parseSourceAddress parses SFTP_SOURCE_ADDRESS and checks that it belongs
+// to one of the local interfaces, listing them when it does not.
+func parseSourceAddress(v string) (net.IP, error) {
+ if v == "" {
+  return nil, nil
+ }
+ ip := net.ParseIP(v)
+ if ip == nil {
+  return nil, fmt.Errorf("invalid SFTP_SOURCE_ADDRESS %q: not an IP address", v)
+ }
+ addrs, err := net.InterfaceAddrs()
+ if err != nil {
+  return nil, fmt.Errorf("failed to list interface addresses for SFTP_SOURCE_ADDRESS: %w", err)
+ }
+ var available []string
+ for _, a := range addrs {
+  ipnet, ok := a.(*net.IPNet)
+  if !ok {
+   continue
+  }
+  if ipnet.IP.Equal(ip) {
+   return ip, nil
+  }
+  available = append(available, ipnet.IP.String())
+ }
+ return nil, fmt.Errorf("invalid SFTP_SOURCE_ADDRESS %q: not assigned to any interface (available: %s)", v, strings.Join(available, ", "))
+}
+
+// ParseAuthOrder parses a comma separated AUTH_ORDER such as
+// "password,publickey". An empty value yields the default order.
+func ParseAuthOrder(v string) ([]string, error) {
+ if v == "" {
+  return []string{AuthPublicKey, AuthPassword}, nil
+ }
+ var order []string
+ seen := map[string]bool{}
+ for _, method := range strings.Split(v, ",") {
+  method = strings.TrimSpace(method)
+  if method != AuthPublicKey && method != AuthPassword {
+   return nil, fmt.Errorf("invalid AUTH_ORDER %q: unknown method %q", v, method)
+  }
+  if seen[method] {
+   return nil, fmt.Errorf("invalid AUTH_ORDER %q: %q listed twice", v, method)
+  }
+  seen[method] = true
+  order = append(order, method)
+ }
+ return order, nil
+}
+
+// parseExtensionRoutes parses EXTENSION_ROUTES, a JSON object such as
+// {".csv": "/uploads/data", ".pdf": "/uploads/docs"}.
+func parseExtensionRoutes(v string) (map[string]string, error) {
+ if v == "" {
+  return nil, nil
+ }
+ var raw map[string]string
+ if err := json.Unmarshal([]byte(v), &raw); err != nil {
+  return nil, fmt.Errorf("invalid EXTENSION_ROUTES: %w", err)
+ }
+ routes := make(map[string]string, len(raw))
+ for ext, dir := range raw {
+  ext = strings.ToLower(ext)
+  if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+   return nil, fmt.Errorf("invalid EXTENSION_ROUTES key %q: must start with \".\"", ext)
+  }
+  if dir == "" {
+   return nil, fmt.Errorf("invalid EXTENSION_ROUTES entry for %q: empty directory", ext)
+  }
+  routes[ext] = dir
+ }
+ return routes, nil
+}
+
+// parseContentTypes parses PULL_CONTENT_TYPES, a JSON object mapping file
+// extensions to Content-Types, e.g. {".csv":"text/csv"}. Compound
+// extensions such as ".csv.gz" take precedence over their last part.
+func parseContentTypes(v string) (map[string]string, error) {
+ if v == "" {
+  return nil, nil
+ }
+ var raw map[string]string
+ if err := json.Unmarshal([]byte(v), &raw); err != nil {
+  return nil, fmt.Errorf("invalid PULL_CONTENT_TYPES: %w", err)
+ }
+ types := make(map[string]string, len(raw))
+ for ext, ct := range raw {
+  ext = strings.ToLower(ext)
+  if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+   return nil, fmt.Errorf("invalid PULL_CONTENT_TYPES key %q: must start with \".\"", ext)
+  }
+  if ct == "" {
+   return nil, fmt.Errorf("invalid PULL_CONTENT_TYPES entry for %q: empty Content-Type", ext)
+  }
+  types[ext] = ct
+ }
+ return types, nil
+}
+
+// checkPatterns validates glob patterns in path.Match syntax, naming the
+// variable they came from in errors.
+func checkPatterns(name string, patterns []string) error {
+ for _, p := range patterns {
+  if _, err := path.Match(p, ""); err != nil {
+   return fmt.Errorf("invalid %s pattern %q: %w", name, p, err)
+  }
+ }
+ return nil
+}
+
+// EnvString returns the named environment variable, or def when it is unset.
+func EnvString(name, def string) string {
+ if v := lookupEnv(name, def); v != "" {
+  return v
+ }
+ return def
+}
+
+// envList splits a comma separated environment variable, dropping empty
+// entries.
+func envList(name string) []string {
+ var list []string
+ for _, v := range strings.Split(lookupEnv(name, []string(nil)), ",") {
+  if v = strings.TrimSpace(v); v != "" {
+   list = append(list, v)
+  }
+ }
+ return list
+}
+
+// envBool parses a boolean ("true", "false", "1", "0", ...) from the named
+// environment variable, returning def when it is unset.
+func envBool(name string, def bool) (bool, error) {
+ v := lookupEnv(name, def)
+ if v == "" {
+  return def, nil
+ }
+ b, err := strconv.ParseBool(v)
+ if err != nil {
+  return false, fmt.Errorf("invalid %s %q: must be true or false", name, v)
+ }
+ return b, nil
+}
+
+// EnvInt parses a non-negative integer from the named environment variable,
+// returning def when it is unset.
+func EnvInt(name string, def int) (int, error) {
+ n, err := envInt64(name, int64(def))
+ return int(n), err
+}
+
+// envInt64 parses a non-negative integer from the named environment variable,
+// returning def when it is unset.
+func envInt64(name string, def int64) (int64, error) {
+ v := lookupEnv(name, def)
+ if v == "" {
+  return def, nil
+ }
+ n, err := strconv.ParseInt(v, 10, 64)
+ if err != nil || n < 0 {
+  return 0, fmt.Errorf("invalid %s %q: must be a non-negative integer", name, v)
+ }
+ return n, nil
+}
+
+// envOwnerID parses a remote user or group ID from the named environment
+// variable. It defaults to -1, which leaves ownership unchanged and may also
+// be given explicitly.
+func envOwnerID(name string) (int, error) {
+ v := lookupEnv(name, -1)
+ if v == "" {
+  return -1, nil
+ }
+ n, err := strconv.ParseInt(v, 10, 64)
+ if err != nil || n < -1 || n > 1<<32-1 {
+  return 0, fmt.Errorf("invalid %s %q: must be a non-negative ID, or -1 to leave ownership unchanged", name, v)
+ }
+ return int(n), nil
+}
+
+// EnvDuration parses a Go duration such as "90s" or "10m" from the named
+// environment variable, returning def when it is unset.
+func EnvDuration(name string, def time.Duration) (time.Duration, error) {
+ v := lookupEnv(name, def)
+ if v == "" {
+  return def, nil
+ }
+ d, err := time.ParseDuration(v)
+ if err != nil {
+  return 0, fmt.Errorf("invalid %s %q: %w", name, v, err)
+ }
+ if d < 0 {
+  return 0, fmt.Errorf("invalid %s %q: must not be negative", name, v)
+ }
+ return d, nil
+}
+
+// checkInventoryMode rejects what cannot be combined with an inventory run.
+// payloadFiles is set when the payload also names the files to deliver.
+func (cfg *Config) checkInventoryMode(payloadFiles bool) error {
+ if _, _, err := ParsePlanURI(cfg.InventoryManifest); err != nil {
+  return fmt.Errorf("invalid inventoryManifest: %w", err)
+ }
+ if payloadFiles || cfg.DryRun || cfg.ExecutePlan != "" {
+  return fmt.Errorf("inventoryManifest cannot be combined with keys, presignedUrls, inlineFiles, dryRun or executePlan")
+ }
+ if cfg.PullMode || cfg.ArchiveMode != "" || cfg.Concatenate || cfg.Fanout || len(cfg.TenantSecrets) > 0 || cfg.CheckpointPrefix != "" {
+  return fmt.Errorf("inventoryManifest cannot be used with PULL_MODE, ARCHIVE_MODE, CONCATENATE, FANOUT, TENANT_SECRETS or CHECKPOINT_PREFIX")
+ }
+ return nil
+}
+
+// ChownEnabled reports whether REMOTE_UID or REMOTE_GID is set.
+func (cfg *Config) ChownEnabled() bool {
+ return cfg.RemoteUID >= 0 || cfg.RemoteGID >= 0
+}
+
+// checkPlanMode rejects DRY_RUN and executePlan where a plan could not
+// describe the run exactly.
+func (cfg *Config) checkPlanMode() error {
+ if !cfg.DryRun && cfg.ExecutePlan == "" {
+  return nil
+ }
+ if cfg.DryRun && cfg.ExecutePlan != "" {
+  return fmt.Errorf("dryRun and executePlan cannot be combined")
+ }
+ if cfg.PullMode || cfg.ArchiveMode != "" || cfg.Concatenate || cfg.ExplodeArchives || len(cfg.TenantSecrets) > 0 {
+  return fmt.Errorf("plans cannot be used with PULL_MODE, ARCHIVE_MODE, CONCATENATE, EXPLODE_ARCHIVES or TENANT_SECRETS")
+ }
+ if cfg.ExecutePlan != "" {
+  if _, _, err := ParsePlanURI(cfg.ExecutePlan); err != nil {
+   return err
+  }
+ }
+ return nil
+}
+
+// ParsePlanURI splits an s3://bucket/key URI into its bucket and key.
+func ParsePlanURI(uri string) (string, string, error) {
+ u, err := url.Parse(uri)
+ if err != nil || u.Scheme != "s3" || u.Host == "" || strings.TrimPrefix(u.Path, "/") == "" {
+  return "", "", fmt.Errorf("invalid executePlan %q: expected s3://bucket/key", uri)
+ }
+ return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// QuarantineKey returns where key is moved under QUARANTINE_PREFIX. Keeping
+// the whole key makes the move reversible, and since QUARANTINE_PREFIX is
+// outside the source prefix, the object drops out of later listings.
+func (cfg *Config) QuarantineKey(key string) string {
+ return cfg.QuarantinePrefix + key
+}
+
+// Debugf logs only when LOG_LEVEL is debug.
+func (cfg *Config) Debugf(format string, args ...any) {
+ if cfg.Debug {
+  log.Printf(format, args...)
+ }
+}
+
+// ValidationEnabled reports whether any pre-transfer check is on.
+func (cfg *Config) ValidationEnabled() bool {
+ return cfg.ValidateNonEmpty || cfg.ValidateContentType || cfg.ValidateNamePattern != nil
+}
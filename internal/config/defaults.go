@@ -0,0 +1,50 @@
+package config
+
+import "time"
+
+const defaultAuditPrefix = "audit/"
+
+const defaultConcatStatePrefix = "concat-state/"
+
+const (
+ defaultFanoutChunkSize   = 100
+ defaultFanoutMaxChildren = 100
+)
+
+const defaultGroupMarker = ".done"
+
+const defaultHostKeyParameterPrefix = "/s3-sftp-lambda/host-keys/"
+
+const (
+ defaultHTTPTriggerHeader  = "x-trigger-token"
+ defaultHTTPSyncMaxObjects = 100
+)
+
+const (
+ defaultLogSampleThreshold = 1000
+ defaultLogProgressEvery   = 1000
+)
+
+const defaultPlanPrefix = "plans/"
+
+const defaultProfilePrefix = "profiles/"
+
+// DefaultPullPrefix is where PULL_MODE stores pulled files unless
+// PULL_PREFIX is set.
+const DefaultPullPrefix = "pulled/"
+
+const defaultRemoteListingMaxAge = 5 * time.Minute
+
+const defaultRestoreStatePrefix = "restore-state/"
+
+const defaultSpoolStaleAge = 24 * time.Hour
+
+const defaultStagingOrphanAge = 24 * time.Hour
+
+// defaultTextConvertExtensions are the files TEXT_CONVERT applies to when
+// TEXT_CONVERT_EXTENSIONS is unset.
+const defaultTextConvertExtensions = ".csv,.txt"
+
+// DefaultWebhookBytes bounds the webhook body unless WEBHOOK_MAX_BYTES is
+// set.
+const DefaultWebhookBytes = 256 << 10
@@ -0,0 +1,184 @@
+package config
+
+import (
+ "encoding/json"
+ "fmt"
+ "net/url"
+ "os"
+ "strings"
+ "sync"
+ "time"
+
+ "golang.org/x/crypto/ssh"
+)
+
+// Sources of a configuration knob in the effective configuration record.
+const (
+ SourceDefault = "default"
+ SourceEnv     = "env"
+ SourcePayload = "payload"
+ SourceSecret  = "secret"
+)
+
+// Redacted replaces sensitive values in the effective configuration.
+const Redacted = "***"
+
+// Knob is one setting of the effective configuration and where its
+// value came from.
+type Knob struct {
+ Value  any    `json:"value"`
+ Source string `json:"source"`
+}
+
+// envRecorder collects the environment variables Load reads. It is
+// only active, with knobs set, while Load runs.
+var envRecorder struct {
+ mu    sync.Mutex
+ knobs map[string]Knob
+}
+
+// Load reads the configuration from the environment, recording each
+// variable read, and the value it fell back to when unset, for
+// Config.EnvKnobs.
+func Load() (*Config, error) {
+ envRecorder.mu.Lock()
+ defer envRecorder.mu.Unlock()
+ envRecorder.knobs = make(map[string]Knob)
+ defer func() { envRecorder.knobs = nil }()
+ cfg, err := readConfig()
+ if err != nil {
+  return nil, err
+ }
+ cfg.knobs = envRecorder.knobs
+ return cfg, nil
+}
+
+// EnvKnobs returns the environment variables Load read and the values
+// they had or fell back to.
+func (cfg *Config) EnvKnobs() map[string]Knob {
+ return cfg.knobs
+}
+
+// lookupEnv returns the named environment variable, recording it with def
+// as the value used when it is unset.
+func lookupEnv(name string, def any) string {
+ v := getenv(name)
+ if envRecorder.knobs != nil && v == "" {
+  if d, ok := def.(time.Duration); ok {
+   def = d.String()
+  }
+  envRecorder.knobs[name] = Knob{Value: def, Source: SourceDefault}
+ }
+ return v
+}
+
+// getenv returns the named environment variable, recording it when set.
+func getenv(name string) string {
+ v := os.Getenv(name)
+ if envRecorder.knobs != nil {
+  if v != "" {
+   envRecorder.knobs[name] = Knob{Value: redactEnv(name, v), Source: SourceEnv}
+  } else if _, ok := envRecorder.knobs[name]; !ok {
+   envRecorder.knobs[name] = Knob{Value: "", Source: SourceDefault}
+  }
+ }
+ return v
+}
+
+// sensitiveEnvMarkers are the parts of an environment variable name that
+// mark its value as sensitive.
+var sensitiveEnvMarkers = []string{"PASSWORD", "PASSPHRASE", "TOKEN", "PRIVATE_KEY", "SECRET_ACCESS_KEY"}
+
+// redactEnv hides the value of sensitive variables. Webhook URLs keep their
+// scheme and host, since the path and query often carry the credential.
+func redactEnv(name, v string) string {
+ if name == "WEBHOOK_URL" {
+  return redactWebhookURL(v)
+ }
+ if strings.HasSuffix(name, "_SECRET") {
+  return Redacted
+ }
+ for _, m := range sensitiveEnvMarkers {
+  if strings.Contains(name, m) {
+   return Redacted
+  }
+ }
+ return v
+}
+
+func redactWebhookURL(v string) string {
+ u, err := url.Parse(v)
+ if err != nil || u.Host == "" {
+  return Redacted
+ }
+ return u.Scheme + "://" + u.Host + "/" + Redacted
+}
+
+// Knobs returns the payload fields given for the run. Credentials are
+// redacted, and file lists, whose URLs carry signatures, are reduced to
+// their length.
+func (p *Payload) Knobs() map[string]Knob {
+ knobs := make(map[string]Knob, len(p.fields))
+ for _, name := range p.fields {
+  var v any = json.RawMessage(p.raw[name])
+  switch name {
+  case "secretAccessKey", "sessionToken":
+   v = Redacted
+  case "presignedUrls":
+   v = fmt.Sprintf("%d URL(s)", len(p.PresignedURLs))
+  case "inlineFiles":
+   v = fmt.Sprintf("%d file(s)", len(p.InlineFiles))
+  case "keys":
+   v = fmt.Sprintf("%d key(s)", len(p.Keys))
+  }
+  knobs["payload."+name] = Knob{Value: v, Source: SourcePayload}
+ }
+ return knobs
+}
+
+// SecretKnobs returns the fields of the SFTP secret, with the password and
+// passphrase redacted and an inline private key replaced by the
+// fingerprint of its public key.
+func SecretKnobs(c *SFTPConfig) map[string]Knob {
+ key := c.SFTPPrivateKey
+ switch {
+ case key == "":
+ case strings.HasPrefix(key, "s3://"):
+ case c.Signer != nil:
+  key = ssh.FingerprintSHA256(c.Signer.PublicKey())
+ default:
+  key = Redacted
+ }
+ secret := func(v string) string {
+  if v == "" {
+   return ""
+  }
+  return Redacted
+ }
+ values := map[string]any{
+  "sftpHost":                  c.SFTPHost,
+  "sftpFallbackHosts":         c.SFTPFallbackHosts,
+  "sftpHostKeys":              c.SFTPHostKeys,
+  "sftpPort":                  c.SFTPPort,
+  "sftpUsername":              c.SFTPUsername,
+  "sftpPassword":              secret(c.SFTPPassword),
+  "sftpPrivateKey":            key,
+  "sftpPrivateKeyPassphrase":  secret(c.SFTPPrivateKeyPassphrase),
+  "sftpAllowLegacyAlgorithms": c.SFTPAllowLegacyAlgorithms,
+  "transferFamilyServerId":    c.TransferServerID,
+ }
+ knobs := make(map[string]Knob, len(values))
+ for name, v := range values {
+  knobs["secret."+name] = Knob{Value: v, Source: SourceSecret}
+ }
+ return knobs
+}
+
+// EffectiveConfigRecord is the single line logged once a run's configuration
+// is resolved, listing every knob and its source.
+type EffectiveConfigRecord struct {
+ Type      string          `json:"type"`
+ RequestID string          `json:"requestId"`
+ Secret    string          `json:"secret,omitempty"`
+ Knobs     map[string]Knob `json:"knobs"`
+}
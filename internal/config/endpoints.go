@@ -0,0 +1,19 @@
+package config
+
+import (
+ "fmt"
+ "net/url"
+)
+
+// parseEndpointURL validates an endpoint override from the named variable.
+// Overrides point at VPC interface endpoints, which are always HTTPS.
+func parseEndpointURL(name, v string) (string, error) {
+ if v == "" {
+  return "", nil
+ }
+ u, err := url.Parse(v)
+ if err != nil || u.Scheme != "https" || u.Host == "" {
+  return "", fmt.Errorf("invalid %s %q: must be an https:// URL", name, v)
+ }
+ return v, nil
+}
@@ -0,0 +1,22 @@
+package config
+
+// Category is the category of a configuration error in reports.
+const Category = "config"
+
+// invalidError is a configuration error: a setting, payload or secret that
+// no retry can fix.
+type invalidError struct {
+ err error
+}
+
+func (e *invalidError) Error() string { return e.err.Error() }
+
+func (e *invalidError) Unwrap() error { return e.err }
+
+// Category returns the category reports give e.
+func (e *invalidError) Category() string { return Category }
+
+// Invalid marks err as a configuration error.
+func Invalid(err error) error {
+ return &invalidError{err: err}
+}
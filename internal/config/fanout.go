@@ -0,0 +1,17 @@
+package config
+
+import (
+ "fmt"
+ "strings"
+)
+
+// checkPayloadKeys validates the explicit key list of a fan-out child: every
+// key must lie under the source prefix.
+func checkPayloadKeys(keys []string, prefix string) error {
+ for _, key := range keys {
+  if key == "" || !strings.HasPrefix(key, prefix) {
+   return Invalid(fmt.Errorf("invalid keys entry %q: must be under the source prefix %q", key, prefix))
+  }
+ }
+ return nil
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+ "fmt"
+ "strings"
+
+ "golang.org/x/crypto/ssh"
+)
+
+// FIPS-approved SSH algorithms allowed when FIPS_MODE is set.
+var (
+ fipsCiphers = []string{
+  "aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+  "aes128-ctr", "aes192-ctr", "aes256-ctr",
+ }
+ fipsKeyExchanges = []string{
+  "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+  "diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+ }
+ fipsMACs = []string{
+  "hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+  "hmac-sha2-256", "hmac-sha2-512",
+ }
+ fipsHostKeyAlgorithms = []string{
+  "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521",
+  "rsa-sha2-256", "rsa-sha2-512",
+ }
+)
+
+// resolveSSHAlgorithms settles the SSH algorithm lists from SSH_CIPHERS,
+// SSH_KEX and SSH_MACS. In FIPS mode unset lists default to the approved
+// subset and any configured algorithm outside it is an error. Outside FIPS
+// mode unset lists keep the library defaults.
+func (cfg *Config) resolveSSHAlgorithms() error {
+ for _, l := range []struct {
+  env      string
+  list     *[]string
+  approved []string
+ }{
+  {"SSH_CIPHERS", &cfg.SSHCiphers, fipsCiphers},
+  {"SSH_KEX", &cfg.SSHKeyExchanges, fipsKeyExchanges},
+  {"SSH_MACS", &cfg.SSHMACs, fipsMACs},
+ } {
+  *l.list = envList(l.env)
+  if !cfg.FIPSMode {
+   continue
+  }
+  if len(*l.list) == 0 {
+   *l.list = l.approved
+   continue
+  }
+  for _, alg := range *l.list {
+   if !contains(l.approved, alg) {
+    return fmt.Errorf("invalid %s: %s is not FIPS approved and FIPS_MODE is set (allowed: %s)",
+     l.env, alg, strings.Join(l.approved, ", "))
+   }
+  }
+ }
+ return nil
+}
+
+// ApplySSHAlgorithms sets the configured algorithm lists on an SSH client
+// config.
+func (cfg *Config) ApplySSHAlgorithms(c *ssh.ClientConfig) {
+ c.Ciphers = cfg.SSHCiphers
+ c.KeyExchanges = cfg.SSHKeyExchanges
+ c.MACs = cfg.SSHMACs
+ if cfg.FIPSMode {
+  c.HostKeyAlgorithms = fipsHostKeyAlgorithms
+ }
+}
+
+func contains(list []string, s string) bool {
+ for _, v := range list {
+  if v == s {
+   return true
+  }
+ }
+ return false
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+ "fmt"
+ "regexp"
+ "strings"
+)
+
+// Placeholders each hook template may use. Anything else is rejected when the
+// configuration is loaded.
+var (
+ FileHookPlaceholders  = []string{"filename", "remote_path", "remote_dir", "size", "key"}
+ BatchHookPlaceholders = []string{"count", "remote_dir", "date"}
+)
+
+var PlaceholderPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// ValidateCommandTemplate checks that tmpl only uses the allowed placeholders.
+func ValidateCommandTemplate(name, tmpl string, allowed []string) error {
+ for _, m := range PlaceholderPattern.FindAllStringSubmatch(tmpl, -1) {
+  ok := false
+  for _, a := range allowed {
+   if m[1] == a {
+    ok = true
+    break
+   }
+  }
+  if !ok {
+   return fmt.Errorf("invalid %s: unknown placeholder {%s}, allowed: {%s}",
+    name, m[1], strings.Join(allowed, "}, {"))
+  }
+ }
+ return nil
+}
@@ -0,0 +1,38 @@
+package config
+
+import (
+ "encoding/base64"
+ "fmt"
+ "strings"
+)
+
+// InlineFile is one entry of the payload's inlineFiles: a small control
+// file carried in the invocation itself rather than staged in S3.
+type InlineFile struct {
+ Name          string `json:"name"`
+ ContentBase64 string `json:"contentBase64"`
+
+ Data []byte `json:"-"`
+}
+
+// decodeInlineFiles decodes the inline files and enforces INLINE_MAX_BYTES
+// over their combined size, so the mode is not used for data files.
+func decodeInlineFiles(files []InlineFile, limit int64) error {
+ var total int64
+ for i := range files {
+  f := &files[i]
+  if f.Name == "" || strings.Contains(f.Name, "/") || f.Name == "." || f.Name == ".." {
+   return fmt.Errorf("invalid inline file name %q: must be a plain file name", f.Name)
+  }
+  data, err := base64.StdEncoding.DecodeString(f.ContentBase64)
+  if err != nil {
+   return fmt.Errorf("invalid inline file %s: contentBase64 does not decode: %w", f.Name, err)
+  }
+  total += int64(len(data))
+  if total > limit {
+   return fmt.Errorf("inline files exceed INLINE_MAX_BYTES of %d bytes", limit)
+  }
+  f.Data = data
+ }
+ return nil
+}
@@ -0,0 +1,26 @@
+package config
+
+import "golang.org/x/crypto/ssh"
+
+// LegacySSHAllowed reports whether connections to the destination of
+// sftpConfig may use the SHA-1 based ssh-rsa host key and signature
+// algorithms, through ALLOW_LEGACY_SSH_ALGORITHMS or the secret's
+// sftpAllowLegacyAlgorithms.
+func (cfg *Config) LegacySSHAllowed(sftpConfig *SFTPConfig) bool {
+ return cfg.AllowLegacySSH || sftpConfig.SFTPAllowLegacyAlgorithms
+}
+
+// legacySigner lets an RSA key sign with ssh-rsa (SHA-1) for servers that
+// accept nothing else, after the SHA-2 variants. Other keys are returned as
+// they are.
+func legacySigner(signer ssh.Signer) ssh.Signer {
+ as, ok := signer.(ssh.AlgorithmSigner)
+ if !ok || signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+  return signer
+ }
+ legacy, err := ssh.NewSignerWithAlgorithms(as, []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA})
+ if err != nil {
+  return signer
+ }
+ return legacy
+}
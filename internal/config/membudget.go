@@ -0,0 +1,53 @@
+package config
+
+import (
+ "fmt"
+ "strings"
+)
+
+// SFTPConcurrentRequests is the number of requests the SFTP client keeps in
+// flight per file, each holding up to SFTP_MAX_PACKET_BYTES.
+const SFTPConcurrentRequests = 64
+
+// Fixed buffers held while a file is copied.
+const (
+ ArchiveBufferBytes = 256 << 10
+ TextBufferBytes    = 32 << 10
+)
+
+// CopyBufferBytes is what copying one file to the server may buffer: the
+// SFTP client's in-flight requests.
+func (cfg *Config) CopyBufferBytes() int64 {
+ return SFTPConcurrentRequests * int64(cfg.SFTPMaxPacket)
+}
+
+// CheckInflightBytes rejects a MAX_INFLIGHT_BYTES too small for the buffers
+// the configured features hold at once, spelling out the sum.
+func (cfg *Config) CheckInflightBytes() error {
+ if cfg.MaxInflightBytes <= 0 {
+  return nil
+ }
+ var terms []string
+ var total int64
+ add := func(what string, n int64) {
+  terms = append(terms, fmt.Sprintf("%s %d", what, n))
+  total += n
+ }
+ if cfg.PullMode {
+  add(fmt.Sprintf("pull parts (PULL_PART_SIZE %d x PULL_UPLOAD_CONCURRENCY %d)", cfg.PullPartSize, cfg.PullUploadConcurrency),
+   cfg.PullPartSize*int64(cfg.PullUploadConcurrency))
+ } else {
+  add(fmt.Sprintf("SFTP copy (%d requests x SFTP_MAX_PACKET_BYTES %d)", SFTPConcurrentRequests, cfg.SFTPMaxPacket), cfg.CopyBufferBytes())
+  if cfg.ArchiveMode != "" {
+   add("archive buffer", ArchiveBufferBytes)
+  }
+  if cfg.TextConvert != "" {
+   add("text conversion buffer", TextBufferBytes)
+  }
+ }
+ if total > cfg.MaxInflightBytes {
+  return fmt.Errorf("MAX_INFLIGHT_BYTES %d is too small for the configured features: %s = %d bytes",
+   cfg.MaxInflightBytes, strings.Join(terms, " + "), total)
+ }
+ return nil
+}
@@ -0,0 +1,247 @@
+package config
+
+import (
+ "encoding/json"
+ "fmt"
+ "log"
+ "os"
+ "path"
+ "sort"
+ "strings"
+)
+
+// Payload is the per-invocation override set. It is either the
+// whole invocation event, for manual invocations and EventBridge rules with
+// constant input, or the detail of a scheduled EventBridge event.
+type Payload struct {
+ // DailyBatch tags the run as the daily batch, the only run that is
+ // emailed when REPORT_EMAIL_DAILY_ONLY is set.
+ DailyBatch bool `json:"dailyBatch"`
+ // Prefix, RemoteDir and SecretName override the source prefix, the
+ // remote directory and the SFTP secret for this run.
+ Prefix     string `json:"prefix"`
+ RemoteDir  string `json:"remoteDir"`
+ SecretName string `json:"secretName"`
+ // Tenant delivers every file of the run as this tenant's, with the
+ // secret TENANT_SECRETS maps it to, instead of taking each file's
+ // tenant from its key.
+ Tenant string `json:"tenant,omitempty"`
+ // SourceRoleARN is assumed, with ExternalID, to read the source
+ // bucket for this run only. Static keys are only accepted when
+ // ALLOW_PAYLOAD_CREDENTIALS is set.
+ SourceRoleARN   string `json:"sourceRoleArn"`
+ ExternalID      string `json:"externalId"`
+ AccessKeyID     string `json:"accessKeyId"`
+ SecretAccessKey string `json:"secretAccessKey"`
+ SessionToken    string `json:"sessionToken"`
+ // PresignedURLs and InlineFiles replace the S3 listing with the
+ // given URLs and small files carried in the payload.
+ PresignedURLs []PresignedSource `json:"presignedUrls"`
+ InlineFiles   []InlineFile      `json:"inlineFiles"`
+ // DryRun writes a plan instead of delivering, and ExecutePlan delivers
+ // the plan at the given s3:// URI.
+ DryRun      bool   `json:"dryRun"`
+ ExecutePlan string `json:"executePlan"`
+ // Profile captures CPU and heap profiles of the run under
+ // PROFILE_PREFIX.
+ Profile bool `json:"profile"`
+ // Mode "version" returns the build metadata instead of running.
+ Mode string `json:"mode"`
+ // Keys replaces the listing with the given keys. It is how a FANOUT
+ // coordinator hands a chunk to a child, which it names by its
+ // request ID in FanoutParent; a run with either never fans out.
+ Keys         []string `json:"keys,omitempty"`
+ FanoutParent string   `json:"fanoutParent,omitempty"`
+ // InventoryManifest is the s3:// URI of the manifest.json of an S3
+ // Inventory report to reconcile the server against instead of
+ // listing the bucket.
+ InventoryManifest string `json:"inventoryManifest,omitempty"`
+ // TransferServerID delivers to the AWS Transfer Family server with
+ // this ID instead of the host in the secret.
+ TransferServerID string `json:"transferFamilyServerId,omitempty"`
+ // ReplayQuarantine moves the objects quarantined from the prefix
+ // back before listing, so they are delivered again.
+ ReplayQuarantine bool `json:"replayQuarantine,omitempty"`
+
+ // source describes what supplied the payload, for logging. fields
+ // are the known fields it set, in order, and raw their JSON values.
+ source string
+ fields []string
+ raw    map[string]json.RawMessage
+}
+
+// payloadFields are the fields of Payload. Anything else is
+// logged and ignored so rules can be updated ahead of the code.
+var payloadFields = map[string]bool{
+ "dailyBatch": true,
+ "prefix":     true,
+ "remoteDir":  true,
+ "secretName": true,
+ "tenant":     true,
+
+ "sourceRoleArn":   true,
+ "externalId":      true,
+ "accessKeyId":     true,
+ "secretAccessKey": true,
+ "sessionToken":    true,
+ "presignedUrls":   true,
+ "inlineFiles":     true,
+ "dryRun":          true,
+ "executePlan":     true,
+ "profile":         true,
+ "mode":            true,
+ "keys":            true,
+ "fanoutParent":    true,
+
+ "inventoryManifest":      true,
+ "transferFamilyServerId": true,
+ "replayQuarantine":       true,
+}
+
+// PayloadModeVersion is the mode that asks for the build metadata.
+const PayloadModeVersion = "version"
+
+// scheduledEvent is the envelope EventBridge delivers when a rule has no
+// constant input.
+type scheduledEvent struct {
+ Source     string          `json:"source"`
+ DetailType string          `json:"detail-type"`
+ Resources  []string        `json:"resources"`
+ Detail     json.RawMessage `json:"detail"`
+}
+
+// ParsePayload extracts the override set from the invocation event.
+func ParsePayload(raw json.RawMessage) (*Payload, error) {
+ p := &Payload{source: "invocation payload"}
+ if len(raw) == 0 || string(raw) == "null" {
+  return p, nil
+ }
+
+ var event scheduledEvent
+ if err := json.Unmarshal(raw, &event); err == nil && event.Source == "aws.events" {
+  p.source = "EventBridge " + event.DetailType
+  if len(event.Resources) > 0 {
+   p.source += " from " + strings.Join(event.Resources, ", ")
+  }
+  raw = event.Detail
+  if len(raw) == 0 || string(raw) == "null" {
+   return p, nil
+  }
+ }
+
+ var fields map[string]json.RawMessage
+ if err := json.Unmarshal(raw, &fields); err != nil {
+  return nil, fmt.Errorf("invalid invocation payload: %w", err)
+ }
+ var unknown []string
+ for name := range fields {
+  if !payloadFields[name] {
+   unknown = append(unknown, name)
+  } else {
+   p.fields = append(p.fields, name)
+  }
+ }
+ sort.Strings(p.fields)
+ p.raw = fields
+ if len(unknown) > 0 {
+  sort.Strings(unknown)
+  log.Printf("WARNING: ignoring unknown payload field(s) %s", strings.Join(unknown, ", "))
+ }
+ if err := json.Unmarshal(raw, p); err != nil {
+  return nil, fmt.Errorf("invalid invocation payload: %w", err)
+ }
+ return p, nil
+}
+
+// Apply validates the overrides and applies them to cfg.
+func (p *Payload) Apply(cfg *Config) error {
+ if p.Prefix != "" {
+  if strings.HasPrefix(p.Prefix, "/") {
+   return fmt.Errorf("invalid prefix override %q: must not start with /", p.Prefix)
+  }
+  cfg.SourcePrefix = p.Prefix
+ }
+ if p.RemoteDir != "" {
+  if !path.IsAbs(p.RemoteDir) || path.Clean(p.RemoteDir) != p.RemoteDir {
+   return fmt.Errorf("invalid remoteDir override %q: must be a clean absolute path", p.RemoteDir)
+  }
+  // An allowed root defaulted from REMOTE_DIR follows the override.
+  if os.Getenv("REMOTE_ALLOWED_ROOT") == "" {
+   cfg.RemoteAllowedRoot = p.RemoteDir
+  }
+  cfg.RemoteDir = p.RemoteDir
+ }
+ if p.SecretName != "" {
+  cfg.SecretName = p.SecretName
+  if os.Getenv("DESTINATION_NAME") == "" {
+   cfg.DestinationName = p.SecretName
+  }
+ }
+ if p.Tenant != "" {
+  if len(cfg.TenantSecrets) == 0 {
+   return fmt.Errorf("tenant %q needs TENANT_SECRETS", p.Tenant)
+  }
+  if p.SecretName != "" {
+   return fmt.Errorf("tenant cannot be combined with secretName")
+  }
+  cfg.Tenant = p.Tenant
+ }
+ if err := decodeInlineFiles(p.InlineFiles, cfg.InlineMaxBytes); err != nil {
+  return err
+ }
+ if p.DryRun {
+  cfg.DryRun = true
+ }
+ cfg.ExecutePlan = p.ExecutePlan
+ cfg.Profile = p.Profile
+ if p.Mode != "" {
+  return fmt.Errorf("invalid mode %q: only %q is supported, and only on direct invocations", p.Mode, PayloadModeVersion)
+ }
+ if (cfg.DryRun || cfg.ExecutePlan != "") && (len(p.PresignedURLs) > 0 || len(p.InlineFiles) > 0) {
+  return fmt.Errorf("dryRun and executePlan cannot be combined with presignedUrls or inlineFiles")
+ }
+ if len(p.Keys) > 0 || p.FanoutParent != "" {
+  if cfg.Fanout && p.FanoutParent != "" {
+   log.Printf("Run is a fan-out child of %s, not fanning out again", p.FanoutParent)
+  }
+  cfg.Fanout = false
+ }
+ if len(p.Keys) > 0 {
+  if cfg.DryRun || cfg.ExecutePlan != "" || len(p.PresignedURLs) > 0 || len(p.InlineFiles) > 0 {
+   return fmt.Errorf("keys cannot be combined with dryRun, executePlan, presignedUrls or inlineFiles")
+  }
+  if err := checkPayloadKeys(p.Keys, cfg.SourcePrefix); err != nil {
+   return err
+  }
+ }
+ if p.InventoryManifest != "" {
+  cfg.InventoryManifest = p.InventoryManifest
+  if err := cfg.checkInventoryMode(len(p.Keys) > 0 || len(p.PresignedURLs) > 0 || len(p.InlineFiles) > 0); err != nil {
+   return err
+  }
+ }
+ if p.ReplayQuarantine {
+  if cfg.QuarantinePrefix == "" {
+   return fmt.Errorf("replayQuarantine needs QUARANTINE_PREFIX")
+  }
+  if cfg.DryRun || cfg.ExecutePlan != "" || len(p.Keys) > 0 || len(p.PresignedURLs) > 0 || len(p.InlineFiles) > 0 {
+   return fmt.Errorf("replayQuarantine cannot be combined with dryRun, executePlan, keys, presignedUrls or inlineFiles")
+  }
+  cfg.ReplayQuarantine = true
+ }
+ if p.TransferServerID != "" {
+  if !transferServerIDPattern.MatchString(p.TransferServerID) {
+   return fmt.Errorf("invalid transferFamilyServerId %q: must be s- followed by 17 hex digits", p.TransferServerID)
+  }
+  cfg.TransferServerID = p.TransferServerID
+ }
+ if err := cfg.checkPlanMode(); err != nil {
+  return err
+ }
+ if err := cfg.checkPrefixes(); err != nil {
+  return err
+ }
+ log.Printf("Run configured by %s: prefix=%q remote_dir=%q secret=%q",
+  p.source, cfg.SourcePrefix, cfg.RemoteDir, cfg.SecretName)
+ return nil
+}
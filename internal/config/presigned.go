@@ -0,0 +1,7 @@
+package config
+
+// PresignedSource is one entry of the payload's presignedUrls.
+type PresignedSource struct {
+ URL        string `json:"url"`
+ RemoteName string `json:"remoteName"`
+}
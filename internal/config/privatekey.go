@@ -0,0 +1,87 @@
+package config
+
+import (
+ "errors"
+ "fmt"
+ "io"
+ "log"
+ "net/url"
+ "strings"
+
+ "golang.org/x/crypto/ssh"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// maxPrivateKeyBytes caps how much of an S3 key object is read; real keys are
+// a few KB, so anything larger is a misconfigured URI.
+const maxPrivateKeyBytes = 64 << 10
+
+// resolvePrivateKey parses the private key configured in the secret into a
+// signer. sftpPrivateKey is either the PEM itself or an s3://bucket/key URI
+// pointing at an object holding it; SSE-KMS encrypted objects are decrypted
+// transparently by S3 given kms:Decrypt on the key. The key material is only
+// ever held in memory and is never included in errors or logs.
+func resolvePrivateKey(sess *cloud.Session, sftpConfig *SFTPConfig) (ssh.Signer, error) {
+ pemBytes := []byte(sftpConfig.SFTPPrivateKey)
+ origin := "secret"
+ if strings.HasPrefix(sftpConfig.SFTPPrivateKey, "s3://") {
+  origin = sftpConfig.SFTPPrivateKey
+  var err error
+  pemBytes, err = downloadPrivateKey(source.Default(sess), sftpConfig.SFTPPrivateKey)
+  if err != nil {
+   return nil, err
+  }
+ }
+ defer zero(pemBytes)
+
+ var signer ssh.Signer
+ var err error
+ if sftpConfig.SFTPPrivateKeyPassphrase != "" {
+  signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(sftpConfig.SFTPPrivateKeyPassphrase))
+ } else {
+  signer, err = ssh.ParsePrivateKey(pemBytes)
+ }
+ if err != nil {
+  var missing *ssh.PassphraseMissingError
+  if errors.As(err, &missing) {
+   return nil, fmt.Errorf("private key from %s is encrypted but no sftpPrivateKeyPassphrase is set", origin)
+  }
+  return nil, fmt.Errorf("failed to parse private key from %s: %w", origin, err)
+ }
+ log.Printf("Loaded %s private key from %s", signer.PublicKey().Type(), origin)
+ return signer, nil
+}
+
+func downloadPrivateKey(svc source.Store, uri string) ([]byte, error) {
+ u, err := url.Parse(uri)
+ if err != nil || u.Host == "" || strings.TrimPrefix(u.Path, "/") == "" {
+  return nil, fmt.Errorf("invalid private key URI %q: expected s3://bucket/key", uri)
+ }
+
+ log.Printf("Downloading private key from %s", uri)
+ out, err := svc.Get(source.GetInput{Bucket: u.Host, Key: strings.TrimPrefix(u.Path, "/")})
+ if err != nil {
+  return nil, fmt.Errorf("failed to download private key from %s: %w", uri, err)
+ }
+ defer out.Body.Close()
+
+ data, err := io.ReadAll(io.LimitReader(out.Body, maxPrivateKeyBytes+1))
+ if err != nil {
+  zero(data)
+  return nil, fmt.Errorf("failed to read private key from %s: %w", uri, err)
+ }
+ if len(data) > maxPrivateKeyBytes {
+  zero(data)
+  return nil, fmt.Errorf("private key object %s exceeds %d bytes", uri, maxPrivateKeyBytes)
+ }
+ return data, nil
+}
+
+// zero overwrites b so key material doesn't linger in memory after parsing.
+func zero(b []byte) {
+ for i := range b {
+  b[i] = 0
+ }
+}
@@ -0,0 +1,25 @@
+package config
+
+import (
+ "fmt"
+ "strings"
+)
+
+// pullKeyPlaceholders are the placeholders allowed in PULL_KEY_TEMPLATE.
+var pullKeyPlaceholders = []string{"{yyyymmdd}", "{yyyy}", "{mm}", "{dd}", "{hhmmss}", "{remote_path}", "{filename}"}
+
+// validatePullKeyTemplate rejects templates with unknown placeholders and
+// templates that would give every file the same key.
+func validatePullKeyTemplate(tmpl string) error {
+ rest := tmpl
+ for _, p := range pullKeyPlaceholders {
+  rest = strings.ReplaceAll(rest, p, "")
+ }
+ if strings.ContainsAny(rest, "{}") {
+  return fmt.Errorf("invalid PULL_KEY_TEMPLATE %q: unknown placeholder; allowed are %s", tmpl, strings.Join(pullKeyPlaceholders, ", "))
+ }
+ if !strings.Contains(tmpl, "{filename}") && !strings.Contains(tmpl, "{remote_path}") {
+  return fmt.Errorf("invalid PULL_KEY_TEMPLATE %q: must contain {filename} or {remote_path}", tmpl)
+ }
+ return nil
+}
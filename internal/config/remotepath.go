@@ -0,0 +1,29 @@
+package config
+
+import "strings"
+
+// Remote paths are always handled with forward slashes, whatever the server
+// runs on. Windows servers (OpenSSH for Windows, Bitvise, Cerberus and the
+// like) accept "/" as a separator but tend to report paths with "\" and
+// drive letters, either as "C:\dir" or "/C:/dir".
+
+// NormalizeRemotePath converts a server-reported or configured path to
+// forward slashes. A drive letter root such as "C:\dir" becomes "/C:/dir",
+// the form Windows servers accept in SFTP requests.
+func NormalizeRemotePath(p string) string {
+ p = strings.ReplaceAll(p, `\`, "/")
+ if HasDriveLetter(p) {
+  p = "/" + p
+ }
+ return p
+}
+
+// HasDriveLetter reports whether p starts with a Windows drive letter such
+// as "C:" or "C:/".
+func HasDriveLetter(p string) bool {
+ if len(p) < 2 || p[1] != ':' {
+  return false
+ }
+ c := p[0]
+ return (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') && (len(p) == 2 || p[2] == '/')
+}
@@ -0,0 +1,25 @@
+package config
+
+import "testing"
+
+func TestNormalizeRemotePath(t *testing.T) {
+ tests := []struct{ in, want string }{
+  {"/uploads/inbound", "/uploads/inbound"},
+  {"uploads/inbound", "uploads/inbound"},
+  {`uploads\inbound`, "uploads/inbound"},
+  {`C:\inetpub\ftproot`, "/C:/inetpub/ftproot"},
+  {"C:/inetpub/ftproot", "/C:/inetpub/ftproot"},
+  {"/C:/inetpub/ftproot", "/C:/inetpub/ftproot"},
+  {`d:\`, "/d:/"},
+  {"C:", "/C:"},
+  // Not drive letters.
+  {"C:inetpub", "C:inetpub"},
+  {"1:/x", "1:/x"},
+  {"/uploads/C:/x", "/uploads/C:/x"},
+ }
+ for _, tt := range tests {
+  if got := NormalizeRemotePath(tt.in); got != tt.want {
+   t.Errorf("normalizeRemotePath(%q) = %q, want %q", tt.in, got, tt.want)
+  }
+ }
+}
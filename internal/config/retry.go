@@ -0,0 +1,10 @@
+package config
+
+import "fmt"
+
+func validateS3RetryMode(mode string) error {
+ if mode != retryModeStandard && mode != RetryModeAdaptive {
+  return fmt.Errorf("invalid S3_RETRY_MODE %q: must be standard or adaptive", mode)
+ }
+ return nil
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+ "encoding/json"
+ "fmt"
+
+ "golang.org/x/crypto/ssh"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+)
+
+// SFTPConfig is an SFTP destination, as stored in its Secrets Manager secret.
+type SFTPConfig struct {
+ SFTPHost string `json:"sftpHost"`
+ // SFTPFallbackHosts are tried in order when SFTPHost cannot be reached.
+ SFTPFallbackHosts []string `json:"sftpFallbackHosts"`
+ // SFTPHostKeys pins the expected host key per host, either as an
+ // authorized_keys line or a SHA256: fingerprint.
+ SFTPHostKeys map[string]string `json:"sftpHostKeys"`
+ SFTPPort     string            `json:"sftpPort"`
+ SFTPUsername string            `json:"sftpUsername"`
+ SFTPPassword string            `json:"sftpPassword"`
+ // SFTPPrivateKey is a PEM encoded private key, or an s3:// URI of an
+ // object containing one.
+ SFTPPrivateKey           string `json:"sftpPrivateKey"`
+ SFTPPrivateKeyPassphrase string `json:"sftpPrivateKeyPassphrase"`
+ // SFTPAllowLegacyAlgorithms allows the insecure ssh-rsa (SHA-1) host
+ // key and signature algorithms for this destination only.
+ SFTPAllowLegacyAlgorithms bool `json:"sftpAllowLegacyAlgorithms"`
+ // TransferServerID names an AWS Transfer Family server whose
+ // endpoint, and host key where it reports one, stand in for
+ // SFTPHost.
+ TransferServerID string `json:"transferFamilyServerId"`
+
+ // SecretName and Version identify the Secrets Manager secret and
+ // version the config was read from.
+ SecretName string `json:"-"`
+ Version    string `json:"-"`
+ // Signer is the parsed SFTPPrivateKey, if one is configured.
+ Signer ssh.Signer `json:"-"`
+ // Parameters stores host keys trusted on first use.
+ Parameters *cloud.Parameters `json:"-"`
+}
+
+// LoadSFTPConfig reads the SFTP config from the named secret and resolves
+// its private key.
+func LoadSFTPConfig(sess *cloud.Session, cfg *Config, name string) (*SFTPConfig, error) {
+ result, err := sess.GetSecret(cfg.SecretsManagerEndpoint, name)
+ if err != nil {
+  return nil, fmt.Errorf("failed to retrieve secret from %s: %w", sess.SecretsManagerEndpoint(cfg.SecretsManagerEndpoint), err)
+ }
+
+ var sftpConfig SFTPConfig
+ selected, err := selectSecretPath([]byte(result.Value), cfg.SecretJSONPath)
+ if err == nil {
+  selected, err = renameSecretFields(selected, cfg.SecretFieldNames)
+ }
+ if err == nil {
+  err = json.Unmarshal(selected, &sftpConfig)
+ }
+ if err != nil {
+  return nil, fmt.Errorf("failed to unmarshal secret: %w", err)
+ }
+ sftpConfig.Version = result.Version
+ sftpConfig.SecretName = name
+ sftpConfig.Parameters = sess.Parameters()
+ if err := sftpConfig.validate(); err != nil {
+  return nil, Invalid(err)
+ }
+ if sftpConfig.SFTPAllowLegacyAlgorithms && cfg.FIPSMode {
+  return nil, Invalid(fmt.Errorf("secret %s sets sftpAllowLegacyAlgorithms, which cannot be used with FIPS_MODE", name))
+ }
+
+ if sftpConfig.SFTPPrivateKey != "" {
+  sftpConfig.Signer, err = resolvePrivateKey(sess, &sftpConfig)
+  if err != nil {
+   return nil, err
+  }
+  if cfg.LegacySSHAllowed(&sftpConfig) {
+   sftpConfig.Signer = legacySigner(sftpConfig.Signer)
+  }
+ }
+ return &sftpConfig, nil
+}
+
+// SecretString returns the string value of a Secrets Manager secret.
+func SecretString(sess *cloud.Session, cfg *Config, name string) (string, error) {
+ result, err := sess.GetSecret(cfg.SecretsManagerEndpoint, name)
+ if err != nil {
+  return "", fmt.Errorf("failed to retrieve secret %s from %s: %w", name, sess.SecretsManagerEndpoint(cfg.SecretsManagerEndpoint), err)
+ }
+ return result.Value, nil
+}
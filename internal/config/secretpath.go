@@ -0,0 +1,108 @@
+package config
+
+import (
+ "encoding/json"
+ "fmt"
+ "log"
+ "sort"
+ "strings"
+)
+
+// selectSecretPath returns the subtree of the JSON secret raw at path, a
+// dotted key path such as "partners.acme". An empty path selects the whole
+// secret. Errors name the segment that was not found and the keys available
+// at that level, never their values.
+func selectSecretPath(raw []byte, path string) ([]byte, error) {
+ if path == "" {
+  return raw, nil
+ }
+ var node interface{}
+ if err := json.Unmarshal(raw, &node); err != nil {
+  return nil, err
+ }
+ at := "the secret"
+ for _, segment := range strings.Split(path, ".") {
+  obj, ok := node.(map[string]interface{})
+  if !ok {
+   return nil, fmt.Errorf("SECRET_JSON_PATH %q: %s is not a JSON object", path, at)
+  }
+  if node, ok = obj[segment]; !ok {
+   keys := make([]string, 0, len(obj))
+   for k := range obj {
+    keys = append(keys, k)
+   }
+   sort.Strings(keys)
+   return nil, fmt.Errorf("SECRET_JSON_PATH %q: no key %q in %s, available keys: %s",
+    path, segment, at, strings.Join(keys, ", "))
+  }
+  at = fmt.Sprintf("%q", segment)
+ }
+ if _, ok := node.(map[string]interface{}); !ok {
+  return nil, fmt.Errorf("SECRET_JSON_PATH %q: %s is not a JSON object", path, at)
+ }
+ return json.Marshal(node)
+}
+
+// secretFields are the fields of SFTPConfig read from the secret.
+var secretFields = []string{
+ "sftpHost", "sftpFallbackHosts", "sftpHostKeys", "sftpPort",
+ "sftpUsername", "sftpPassword", "sftpPrivateKey", "sftpPrivateKeyPassphrase",
+ "sftpAllowLegacyAlgorithms", "transferFamilyServerId",
+}
+
+// parseSecretFieldNames parses SECRET_FIELD_NAMES, a JSON object mapping
+// secret fields to the names a secret actually uses, e.g.
+// {"sftpHost":"host","sftpUsername":"user"}. Fields not listed keep their
+// own name.
+func parseSecretFieldNames(v string) (map[string]string, error) {
+ if v == "" {
+  return nil, nil
+ }
+ var raw map[string]string
+ if err := json.Unmarshal([]byte(v), &raw); err != nil {
+  return nil, fmt.Errorf("invalid SECRET_FIELD_NAMES: %w", err)
+ }
+ known := make(map[string]bool, len(secretFields))
+ for _, f := range secretFields {
+  known[f] = true
+ }
+ for field, name := range raw {
+  if !known[field] {
+   return nil, fmt.Errorf("invalid SECRET_FIELD_NAMES key %q: must be one of %s", field, strings.Join(secretFields, ", "))
+  }
+  if name == "" {
+   return nil, fmt.Errorf("invalid SECRET_FIELD_NAMES entry for %q: empty name", field)
+  }
+ }
+ return raw, nil
+}
+
+// renameSecretFields rewrites the fields of the secret object raw named by
+// SECRET_FIELD_NAMES to the names SFTPConfig decodes. A mapped field wins
+// over one already using the default name. A numeric port is accepted as
+// well as a string one.
+func renameSecretFields(raw []byte, names map[string]string) ([]byte, error) {
+ var obj map[string]json.RawMessage
+ if err := json.Unmarshal(raw, &obj); err != nil {
+  return nil, err
+ }
+ var applied []string
+ for field, name := range names {
+  if v, ok := obj[name]; ok {
+   delete(obj, name)
+   obj[field] = v
+   applied = append(applied, field+"<-"+name)
+  }
+ }
+ if len(names) > 0 {
+  sort.Strings(applied)
+  log.Printf("Secret field mapping applied: %s (of %d configured)", strings.Join(applied, ", "), len(names))
+ }
+ if port, ok := obj["sftpPort"]; ok {
+  var n json.Number
+  if json.Unmarshal(port, &n) == nil {
+   obj["sftpPort"], _ = json.Marshal(n.String())
+  }
+ }
+ return json.Marshal(obj)
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+ "encoding/json"
+ "fmt"
+ "strings"
+)
+
+// Fields written to metadata sidecars, under these names unless
+// METADATA_SIDECAR_FIELDS renames them.
+const (
+ SidecarSourceBucket = "sourceBucket"
+ SidecarSourceKey    = "sourceKey"
+ SidecarMember       = "member"
+ SidecarETag         = "etag"
+ SidecarSize         = "size"
+ SidecarSHA256       = "sha256"
+ SidecarExportedAt   = "exportedAt"
+)
+
+var sidecarFields = []string{SidecarSourceBucket, SidecarSourceKey, SidecarMember, SidecarETag, SidecarSize, SidecarSHA256, SidecarExportedAt}
+
+// ParseSidecarFields parses METADATA_SIDECAR_FIELDS, a JSON object mapping
+// sidecar field names to the names the partner expects, e.g.
+// {"sourceKey":"object_key","exportedAt":"exported"}. Fields not listed keep
+// their own name.
+func ParseSidecarFields(v string) (map[string]string, error) {
+ names := make(map[string]string, len(sidecarFields))
+ for _, f := range sidecarFields {
+  names[f] = f
+ }
+ if v == "" {
+  return names, nil
+ }
+ var raw map[string]string
+ if err := json.Unmarshal([]byte(v), &raw); err != nil {
+  return nil, fmt.Errorf("invalid METADATA_SIDECAR_FIELDS: %w", err)
+ }
+ for field, name := range raw {
+  if _, ok := names[field]; !ok {
+   return nil, fmt.Errorf("invalid METADATA_SIDECAR_FIELDS key %q: must be one of %s", field, strings.Join(sidecarFields, ", "))
+  }
+  if name == "" {
+   return nil, fmt.Errorf("invalid METADATA_SIDECAR_FIELDS entry for %q: empty name", field)
+  }
+  names[field] = name
+ }
+ return names, nil
+}
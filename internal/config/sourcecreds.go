@@ -0,0 +1,40 @@
+package config
+
+import (
+ "fmt"
+ "log"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+)
+
+// SourceSession returns the session used to read the source bucket for this
+// invocation. It is sess unless the payload names a role to assume or, when
+// ALLOW_PAYLOAD_CREDENTIALS is set, supplies static keys. The credentials
+// live only as long as the invocation's session copy and are never logged.
+func (p *Payload) SourceSession(sess *cloud.Session, cfg *Config) (*cloud.Session, error) {
+ static := p.AccessKeyID != "" || p.SecretAccessKey != "" || p.SessionToken != ""
+ switch {
+ case static && p.SourceRoleARN != "":
+  return nil, fmt.Errorf("invalid invocation payload: sourceRoleArn and static credentials are mutually exclusive")
+ case static && !cfg.AllowPayloadCredentials:
+  return nil, fmt.Errorf("invalid invocation payload: static credentials are not accepted unless ALLOW_PAYLOAD_CREDENTIALS is set")
+ case static:
+  if p.AccessKeyID == "" || p.SecretAccessKey == "" {
+   return nil, fmt.Errorf("invalid invocation payload: accessKeyId and secretAccessKey are both required")
+  }
+  log.Printf("Reading the source bucket with payload-supplied credentials for access key %s", maskAccessKey(p.AccessKeyID))
+  return sess.WithStaticCredentials(p.AccessKeyID, p.SecretAccessKey, p.SessionToken), nil
+ case p.SourceRoleARN != "":
+  log.Printf("Reading the source bucket as role %s", p.SourceRoleARN)
+  return sess.AssumeRole(cfg.STSEndpoint, p.SourceRoleARN, p.ExternalID, "s3-sftp-transfer"), nil
+ }
+ return sess, nil
+}
+
+// maskAccessKey keeps only the last four characters of an access key ID.
+func maskAccessKey(id string) string {
+ if len(id) <= 4 {
+  return "****"
+ }
+ return "****" + id[len(id)-4:]
+}
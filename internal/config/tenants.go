@@ -0,0 +1,24 @@
+package config
+
+// TenantLimits caps the deliveries to one tenant. MaxConcurrency is the most
+// of its batches delivered at once and MaxConnections the most SFTP
+// connections those batches share; zero leaves either to TENANT_WORKERS.
+type TenantLimits struct {
+ MaxConcurrency int `json:"maxConcurrency"`
+ MaxConnections int `json:"maxConnections"`
+}
+
+// Limits returns the batches tenant may have running at once and the
+// connections they may share, both bounded by TENANT_WORKERS.
+func (cfg *Config) Limits(tenant string) (concurrency, connections int) {
+ l := cfg.TenantLimits[tenant]
+ concurrency = cfg.TenantWorkers
+ if l.MaxConcurrency > 0 {
+  concurrency = min(l.MaxConcurrency, concurrency)
+ }
+ connections = concurrency
+ if l.MaxConnections > 0 {
+  connections = min(l.MaxConnections, connections)
+ }
+ return concurrency, connections
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+ "reflect"
+ "testing"
+)
+
+func TestParseTenantSecrets(t *testing.T) {
+ tests := []struct {
+  in      string
+  secrets map[string]string
+  limits  map[string]TenantLimits
+  wantErr bool
+ }{
+  {in: ``},
+  {in: `{"a":"sftp-a"}`, secrets: map[string]string{"a": "sftp-a"}},
+  {
+   in:      `{"a":{"secretName":"sftp-a","maxConcurrency":8,"maxConnections":2},"b":"sftp-b"}`,
+   secrets: map[string]string{"a": "sftp-a", "b": "sftp-b"},
+   limits:  map[string]TenantLimits{"a": {MaxConcurrency: 8, MaxConnections: 2}},
+  },
+  {in: `{"a":{"secretName":"sftp-a"}}`, secrets: map[string]string{"a": "sftp-a"}},
+  {in: `{"a":{"maxConcurrency":2}}`, wantErr: true},
+  {in: `{"a":{"secretName":"sftp-a","maxConcurrency":-1}}`, wantErr: true},
+  {in: `{"a":{"secretName":"sftp-a","maxStreams":2}}`, wantErr: true},
+  {in: `{"a":{"secretName":"sftp-a","maxConcurrency":"8"}}`, wantErr: true},
+  {in: `{"a/b":"sftp-a"}`, wantErr: true},
+  {in: `{"a":""}`, wantErr: true},
+  {in: `{"a":1}`, wantErr: true},
+  {in: `["a"]`, wantErr: true},
+ }
+ for _, tt := range tests {
+  secrets, limits, err := parseTenantSecrets(tt.in)
+  if tt.wantErr {
+   if err == nil {
+    t.Errorf("parseTenantSecrets(%s) = %v, %v, want an error", tt.in, secrets, limits)
+   }
+   continue
+  }
+  if err != nil || !reflect.DeepEqual(secrets, tt.secrets) || !reflect.DeepEqual(limits, tt.limits) {
+   t.Errorf("parseTenantSecrets(%s) = %v, %v, %v, want %v, %v", tt.in, secrets, limits, err, tt.secrets, tt.limits)
+  }
+ }
+}
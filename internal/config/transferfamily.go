@@ -0,0 +1,126 @@
+package config
+
+import (
+ "fmt"
+ "log"
+ "regexp"
+ "strings"
+ "sync"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+)
+
+const defaultTransferServerCacheTTL = 5 * time.Minute
+
+// transferServerCache holds the endpoint each AWS Transfer Family server ID
+// resolved to, for TRANSFER_SERVER_CACHE_TTL.
+var transferServerCache = struct {
+ mu      sync.Mutex
+ entries map[string]*transferEndpoint
+}{entries: make(map[string]*transferEndpoint)}
+
+// transferEndpoint is where a Transfer Family server can be reached, and the
+// SHA256 fingerprint of its host key when the API reports one.
+type transferEndpoint struct {
+ host        string
+ fingerprint string
+ resolvedAt  time.Time
+}
+
+// transferServerIDPattern matches a Transfer Family server ID.
+var transferServerIDPattern = regexp.MustCompile(`^s-[0-9a-f]{17}$`)
+
+// WithTransferServer returns c pointed at the Transfer Family server named
+// by the payload's transferFamilyServerId or, failing that, the secret's. It
+// is resolved on every call, so the endpoint follows the server within
+// TRANSFER_SERVER_CACHE_TTL however long the secret stays cached, and goes
+// into a copy, leaving the cached config as read. The host joins the copy's
+// version so pooled connections are only reused for the same endpoint.
+func WithTransferServer(sess *cloud.Session, cfg *Config, c *SFTPConfig) (*SFTPConfig, error) {
+ id := cfg.TransferServerID
+ if id == "" {
+  id = c.TransferServerID
+ }
+ if id == "" {
+  return c, nil
+ }
+ ep, err := resolveTransferServer(sess, cfg, id)
+ if err != nil {
+  return nil, err
+ }
+ resolved := *c
+ resolved.TransferServerID = id
+ resolved.SFTPHost = ep.host
+ resolved.SFTPFallbackHosts = nil
+ if err := resolved.normalizeAddress(); err != nil {
+  return nil, Invalid(fmt.Errorf("Transfer Family server %s: %w", id, err))
+ }
+ resolved.Version = c.Version + "+" + ep.host
+ if _, pinned := c.SFTPHostKeys[ep.host]; ep.fingerprint != "" && !pinned {
+  resolved.SFTPHostKeys = make(map[string]string, len(c.SFTPHostKeys)+1)
+  for h, k := range c.SFTPHostKeys {
+   resolved.SFTPHostKeys[h] = k
+  }
+  resolved.SFTPHostKeys[ep.host] = ep.fingerprint
+ }
+ return &resolved, nil
+}
+
+// resolveTransferServer returns the endpoint of Transfer Family server id,
+// from transferServerCache when it was resolved recently. Public servers and
+// internet-facing VPC servers are reached at their server hostname; internal
+// VPC servers at the DNS name of their VPC endpoint. Errors from the API
+// that no retry can fix, such as missing permissions or an unknown server,
+// are configuration errors.
+func resolveTransferServer(sess *cloud.Session, cfg *Config, id string) (*transferEndpoint, error) {
+ transferServerCache.mu.Lock()
+ defer transferServerCache.mu.Unlock()
+ if e := transferServerCache.entries[id]; e != nil && time.Since(e.resolvedAt) < cfg.TransferServerCacheTTL {
+  return e, nil
+ }
+
+ srv, err := sess.DescribeTransferServer(id)
+ if err != nil {
+  return nil, classifyTransferError(fmt.Errorf("failed to describe Transfer Family server %s: %w", id, err))
+ }
+ if !contains(srv.Protocols, cloud.ProtocolSFTP) {
+  return nil, Invalid(fmt.Errorf("Transfer Family server %s does not offer SFTP", id))
+ }
+ if srv.State != cloud.StateOnline {
+  log.Printf("WARNING: Transfer Family server %s is %s, connecting may fail", id, srv.State)
+ }
+ ep := &transferEndpoint{resolvedAt: time.Now()}
+ if !srv.Internal {
+  ep.host = fmt.Sprintf("%s.server.transfer.%s.amazonaws.com", id, cloud.Region)
+ } else {
+  vpce := srv.VPCEndpointID
+  host, err := sess.VPCEndpointDNSName(vpce)
+  if err != nil {
+   return nil, classifyTransferError(fmt.Errorf("failed to describe VPC endpoint %s of Transfer Family server %s: %w", vpce, id, err))
+  }
+  if host == "" {
+   return nil, Invalid(fmt.Errorf("VPC endpoint %s of Transfer Family server %s has no DNS name", vpce, id))
+  }
+  ep.host = host
+ }
+ if fp := strings.TrimRight(srv.HostKeyFingerprint, "="); fp != "" {
+  if !strings.HasPrefix(fp, "SHA256:") {
+   fp = "SHA256:" + fp
+  }
+  ep.fingerprint = fp
+ }
+ log.Printf("Resolved Transfer Family server %s to %s (endpoint type %s, host key %s)",
+  id, ep.host, srv.EndpointType, ep.fingerprint)
+ transferServerCache.entries[id] = ep
+ return ep, nil
+}
+
+// classifyTransferError marks permission and unknown-resource errors from
+// the Transfer Family and EC2 APIs as configuration errors.
+func classifyTransferError(err error) error {
+ if cloud.IsPermanentTransferError(err) {
+  return Invalid(err)
+ }
+ return err
+}
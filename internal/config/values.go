@@ -0,0 +1,144 @@
+package config
+
+// Values accepted for ARCHIVE_MODE.
+const (
+ ArchiveTarGz = "tar.gz"
+ ArchiveZip   = "zip"
+)
+
+// Values accepted for ARCHIVED_OBJECT_POLICY.
+const (
+ archivedFail    = "fail"
+ ArchivedSkip    = "skip"
+ ArchivedRestore = "restore"
+)
+
+// Values accepted for ATOMIC_RENAME_FALLBACK.
+const (
+ // renameFallbackReupload copies the uploaded temporary file to its
+ // final name and uploads directly for the rest of the connection.
+ renameFallbackReupload = "reupload"
+ // RenameFallbackDowngrade does the same for the current file and
+ // turns atomic uploads off for the rest of the run.
+ RenameFallbackDowngrade = "downgrade"
+)
+
+// Auth method names accepted in AUTH_ORDER; they match the SSH protocol names.
+const (
+ AuthPublicKey = "publickey"
+ AuthPassword  = "password"
+)
+
+// Values accepted for COLLISION_SUFFIX.
+const (
+ // suffixSequence renames report.csv to report(2).csv, report(3).csv
+ // and so on.
+ suffixSequence = "sequence"
+ // SuffixTimestamp renames report.csv to report_20240501T1030Z.csv
+ // using the run's start time, falling back to a sequence number when
+ // that name is taken too.
+ SuffixTimestamp = "timestamp"
+)
+
+// Values accepted for PATH_COLLISIONS.
+const (
+ collisionsFail  = "fail"
+ CollisionsAllow = "allow"
+)
+
+// Values accepted for CONCATENATE_ORDER.
+const (
+ concatOrderKey          = "key"
+ ConcatOrderLastModified = "lastModified"
+)
+
+// Values accepted for CONTROL_FILE_SCOPE.
+const (
+ controlScopeName  = "name"
+ ControlScopeBatch = "batch"
+)
+
+// Values accepted for REMOTE_FILENAME_ENCODING.
+const (
+ EncodingUTF8   = "utf8"
+ EncodingLatin1 = "latin1"
+)
+
+// Values accepted for REMOTE_FILENAME_UNREPRESENTABLE, the policy for runes
+// the remote filename encoding cannot represent.
+const (
+ UnrepresentableReplace = "replace"
+ unrepresentableStrip   = "strip"
+ UnrepresentableFail    = "fail"
+)
+
+// Values accepted for HOOK_FAILURE_MODE.
+const (
+ HookFailureWarn = "warn"
+ HookFailureFail = "fail"
+)
+
+// Values accepted for HOST_KEY_POLICY.
+const (
+ // hostKeyInsecure accepts hosts without a pinned key unverified.
+ hostKeyInsecure = "insecure"
+ // HostKeyStrict refuses hosts without a pinned key.
+ HostKeyStrict = "strict"
+ // HostKeyTOFU trusts the key a host presents on first use and
+ // requires the same key from then on.
+ HostKeyTOFU = "tofu"
+)
+
+// Values accepted for LIST_SHARDING.
+const (
+ ShardingOff       = "off"
+ ShardingChar      = "char"
+ ShardingDelimiter = "delimiter"
+)
+
+// Values accepted for PULL_KEY_TIME.
+const (
+ pullKeyTimePull  = "pull"
+ PullKeyTimeMtime = "mtime"
+)
+
+// Values accepted for OVERWRITE_POLICY.
+const (
+ OverwriteReplace = "overwrite"
+ OverwriteSkip    = "skip"
+ OverwriteSuffix  = "suffix"
+)
+
+// Behaviors for files whose extension has no entry in EXTENSION_ROUTES.
+const (
+ UnmappedDefault = "default"
+ UnmappedSkip    = "skip"
+ UnmappedFail    = "fail"
+)
+
+// Values accepted for REMOTE_LAYOUT.
+const (
+ layoutFlatten  = "flatten"
+ LayoutPreserve = "preserve"
+)
+
+// Values accepted for S3_RETRY_MODE.
+const (
+ retryModeStandard = "standard"
+ RetryModeAdaptive = "adaptive"
+)
+
+// Digest algorithms accepted for CHECKSUM_SIDECAR.
+const (
+ ChecksumSHA256 = "sha256"
+ ChecksumMD5    = "md5"
+)
+
+// Values accepted for SLACK_NOTIFY.
+const (
+ slackNotifyAlways  = "always"
+ SlackNotifyFailure = "failure"
+)
+
+// TextConvertCRLF is the TEXT_CONVERT value rewriting line endings to CRLF.
+const TextConvertCRLF = "crlf"
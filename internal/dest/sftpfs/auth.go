@@ -0,0 +1,70 @@
+package sftpfs
+
+import (
+ "fmt"
+ "strings"
+
+ "golang.org/x/crypto/ssh"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// authTracker records which auth methods the SSH client tried during a
+// handshake, so the successful one can be logged and a server demanding a
+// second factor can be told apart from plain bad credentials.
+type authTracker struct {
+ // last is the most recently attempted method; after a successful
+ // handshake it is the one the server accepted.
+ last string
+ // partial lists methods the server accepted as only partially
+ // sufficient.
+ partial []string
+}
+
+// methods builds the auth methods for the credentials present in the secret,
+// in the given order, leaving the SSH library to fall through from one to the
+// next.
+func (t *authTracker) methods(order []string, sftpConfig *config.SFTPConfig) []ssh.AuthMethod {
+ var auth []ssh.AuthMethod
+ for _, method := range order {
+  switch method {
+  case config.AuthPublicKey:
+   if sftpConfig.Signer == nil {
+    continue
+   }
+   auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+    t.last = config.AuthPublicKey
+    return []ssh.Signer{sftpConfig.Signer}, nil
+   }))
+  case config.AuthPassword:
+   if sftpConfig.SFTPPassword == "" {
+    continue
+   }
+   auth = append(auth, ssh.PasswordCallback(func() (string, error) {
+    t.last = config.AuthPassword
+    return sftpConfig.SFTPPassword, nil
+   }))
+  }
+ }
+ return auth
+}
+
+// observe is used as the ssh.ClientConfig AuthCallback. It only records the
+// handshake state and lets the library pick the next method from Auth.
+func (t *authTracker) observe(ctx *ssh.ClientAuthContext) (ssh.AuthMethod, error) {
+ t.partial = ctx.PartialSuccessMethods
+ return nil, nil
+}
+
+// classify attaches an error category to a failed handshake.
+func (t *authTracker) classify(err error) error {
+ if len(t.partial) > 0 {
+  return withCategory(CategoryAuthPartial, fmt.Errorf(
+   "server accepted %s but requires further authentication: %w",
+   strings.Join(t.partial, ","), err))
+ }
+ if strings.Contains(err.Error(), "unable to authenticate") {
+  return withCategory(CategoryAuth, err)
+ }
+ return withCategory(CategoryConnection, err)
+}
@@ -0,0 +1,31 @@
+package sftpfs
+
+import (
+ "slices"
+ "testing"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+func TestParseAuthOrder(t *testing.T) {
+ for _, tc := range []struct {
+  in      string
+  want    []string
+  wantErr bool
+ }{
+  {"", []string{config.AuthPublicKey, config.AuthPassword}, false},
+  {"password", []string{config.AuthPassword}, false},
+  {" password , publickey ", []string{config.AuthPassword, config.AuthPublicKey}, false},
+  {"password,password", nil, true},
+  {"keyboard-interactive", nil, true},
+ } {
+  got, err := config.ParseAuthOrder(tc.in)
+  if (err != nil) != tc.wantErr {
+   t.Errorf("parseAuthOrder(%q) error = %v, want error %t", tc.in, err, tc.wantErr)
+   continue
+  }
+  if !tc.wantErr && !slices.Equal(got, tc.want) {
+   t.Errorf("parseAuthOrder(%q) = %v, want %v", tc.in, got, tc.want)
+  }
+ }
+}
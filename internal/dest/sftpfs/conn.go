@@ -0,0 +1,303 @@
+// Package sftpfs connects to SFTP destinations: host selection, the
+// authentication methods, host key checks and the legacy SSH algorithms some
+// servers need. FS is what the transfer engine sees of a connection's remote
+// filesystem.
+package sftpfs
+
+import (
+ "context"
+ "errors"
+ "fmt"
+ "log"
+ "math/rand"
+ "net"
+ "strings"
+ "sync"
+ "sync/atomic"
+ "time"
+
+ "github.com/pkg/sftp"
+ "golang.org/x/crypto/ssh"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// PosixRenameExtension is the OpenSSH extension whose rename atomically
+// replaces an existing destination.
+const PosixRenameExtension = "posix-rename@openssh.com"
+
+// livenessTimeout bounds the health check of a cached connection. A socket
+// that went stale while the environment was frozen may otherwise block until
+// the kernel gives up on it.
+const livenessTimeout = 5 * time.Second
+
+// Conn is an established SSH connection with an SFTP session
+// running on it, along with how long each phase of setting it up took.
+type Conn struct {
+ SSH       *ssh.Client
+ SFTP      *sftp.Client
+ Timing    Timing
+ CreatedAt time.Time
+ // RenameUnsupported is set once the server has rejected a rename as
+ // unsupported. Batches sharing the connection read and set it
+ // concurrently.
+ RenameUnsupported atomic.Bool
+ // Home is the session's initial working directory, empty when the
+ // server would not report it, and Windows is set when it is a
+ // Windows-style path. Both are fixed while dialing, before the
+ // connection is shared.
+ Home    string
+ Windows bool
+
+ // keepaliveStop ends the keepalive goroutine and keepaliveDone is
+ // closed once it has returned. dead is set when the server stopped
+ // answering keepalives.
+ keepaliveStop chan struct{}
+ keepaliveDone chan struct{}
+ stopOnce      sync.Once
+ dead          atomic.Bool
+}
+
+// Close stops the keepalive and closes the SFTP session and its SSH
+// connection.
+func (c *Conn) Close() error {
+ if c.keepaliveStop != nil {
+  c.stopOnce.Do(func() { close(c.keepaliveStop) })
+  <-c.keepaliveDone
+ }
+ c.SFTP.Close()
+ return c.SSH.Close()
+}
+
+// startKeepalive sends keepalive@openssh.com requests every interval so
+// firewalls do not reap the connection during long transfers. After
+// maxMissed consecutive unanswered requests the connection is considered
+// dead and closed, failing any transfer in progress with a connection error.
+func (c *Conn) startKeepalive(interval time.Duration, maxMissed int) {
+ c.keepaliveStop = make(chan struct{})
+ c.keepaliveDone = make(chan struct{})
+ go func() {
+  defer close(c.keepaliveDone)
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  missed := 0
+  for {
+   select {
+   case <-c.keepaliveStop:
+    return
+   case <-ticker.C:
+   }
+
+   reply := make(chan error, 1)
+   go func() {
+    _, _, err := c.SSH.SendRequest("keepalive@openssh.com", true, nil)
+    reply <- err
+   }()
+   select {
+   case <-c.keepaliveStop:
+    return
+   case err := <-reply:
+    if err == nil {
+     missed = 0
+     continue
+    }
+    missed++
+   case <-time.After(interval):
+    missed++
+   }
+   if missed < maxMissed {
+    continue
+   }
+   log.Printf("SFTP connection to %s missed %d keepalives, closing it", c.Timing.Address, missed)
+   c.dead.Store(true)
+   c.SSH.Close()
+   return
+  }
+ }()
+}
+
+// Alive reports whether the server still answers on this connection.
+func (c *Conn) Alive() bool {
+ if c.dead.Load() {
+  return false
+ }
+ done := make(chan error, 1)
+ go func() {
+  _, err := c.SFTP.Getwd()
+  done <- err
+ }()
+ select {
+ case err := <-done:
+  return err == nil
+ case <-time.After(livenessTimeout):
+  return false
+ }
+}
+
+// Dial connects to the primary SFTP host, failing over to each of the
+// configured fallback hosts in turn when the connection or handshake fails.
+// The same credentials are used for every host.
+func Dial(cfg *config.Config, sftpConfig *config.SFTPConfig) (*Conn, error) {
+ hosts := sftpConfig.Hosts()
+ var failed []string
+ var errs []error
+ for i, host := range hosts {
+  c, err := DialHost(cfg, sftpConfig, host)
+  if err == nil {
+   c.Timing.EndpointIndex = i
+   c.Timing.FailedAddresses = failed
+   if i > 0 {
+    log.Printf("Failed over to SFTP host %s after %d failed endpoint(s)", host, i)
+   }
+   return c, nil
+  }
+  failed = append(failed, host)
+  errs = append(errs, fmt.Errorf("%s: %w", host, err))
+  if i < len(hosts)-1 {
+   log.Printf("SFTP host %s unavailable, trying next endpoint: %v", host, err)
+  }
+ }
+ if len(errs) == 1 {
+  return nil, errors.Unwrap(errs[0])
+ }
+ // Report the category of the last failure; earlier hosts are usually
+ // just unreachable.
+ return nil, withCategory(categoryOf(errs[len(errs)-1]), fmt.Errorf("all SFTP hosts failed: %w", errors.Join(errs...)))
+}
+
+// defaultAddressDialTimeout bounds the connect to each address of a host name
+// resolving to several when SFTP_DIAL_TIMEOUT is not set, so one black-holed
+// address does not use up the invocation.
+const defaultAddressDialTimeout = 10 * time.Second
+
+// dialResolved resolves host and connects to each of its addresses in turn,
+// shuffled under SFTP_SHUFFLE_ADDRESSES, until one accepts. It returns the
+// addresses that failed first. The SSH handshake that follows still verifies
+// the host key against host, not the address.
+func dialResolved(cfg *config.Config, dialer *net.Dialer, host, port string) (net.Conn, []string, error) {
+ if net.ParseIP(host) != nil {
+  conn, err := dialer.Dial("tcp", net.JoinHostPort(host, port))
+  return conn, nil, err
+ }
+ ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+ if err != nil {
+  return nil, nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+ }
+ if cfg.ShuffleAddresses {
+  rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+ }
+ d := *dialer
+ if d.Timeout == 0 && len(ips) > 1 {
+  d.Timeout = defaultAddressDialTimeout
+ }
+ var skipped []string
+ var errs []error
+ for _, ip := range ips {
+  address := net.JoinHostPort(ip.String(), port)
+  conn, err := d.Dial("tcp", address)
+  if err == nil {
+   if len(skipped) > 0 {
+    log.Printf("Connected to %s at %s after skipping %s", host, address, strings.Join(skipped, ", "))
+   } else {
+    cfg.Debugf("Connected to %s at %s", host, address)
+   }
+   return conn, skipped, nil
+  }
+  log.Printf("Address %s of %s failed, trying the next: %v", address, host, err)
+  skipped = append(skipped, address)
+  errs = append(errs, err)
+ }
+ return nil, skipped, fmt.Errorf("all %d address(es) of %s failed: %w", len(ips), host, errors.Join(errs...))
+}
+
+// DialHost connects to a single SFTP host, timing the TCP dial, SSH handshake
+// and SFTP subsystem negotiation independently.
+func DialHost(cfg *config.Config, sftpConfig *config.SFTPConfig, host string) (*Conn, error) {
+ verifyHostKey, err := hostKeyCallback(cfg, sftpConfig, host)
+ if err != nil {
+  return nil, config.Invalid(err)
+ }
+ tracker := &authTracker{}
+ sshConfig := &ssh.ClientConfig{
+  User:            sftpConfig.SFTPUsername,
+  Auth:            tracker.methods(cfg.AuthOrder, sftpConfig),
+  AuthCallback:    tracker.observe,
+  HostKeyCallback: verifyHostKey,
+ }
+ cfg.ApplySSHAlgorithms(sshConfig)
+ if cfg.LegacySSHAllowed(sftpConfig) {
+  applyLegacySSHAlgorithms(sshConfig)
+ }
+
+ address := net.JoinHostPort(host, sftpConfig.SFTPPort)
+ timing := Timing{Address: address}
+ log.Println("Dialing SFTP server:", address)
+
+ dialer := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: cfg.TCPKeepAlive}
+ if cfg.SourceAddress != nil {
+  dialer.LocalAddr = &net.TCPAddr{IP: cfg.SourceAddress}
+ }
+ start := time.Now()
+ tcpConn, skipped, err := dialResolved(cfg, dialer, host, sftpConfig.SFTPPort)
+ if err != nil {
+  log.Printf("Failed to dial SFTP server: %v", err)
+  return nil, withCategory(CategoryConnection, fmt.Errorf("failed to dial: %w", err))
+ }
+ timing.DialMs = time.Since(start).Milliseconds()
+ timing.IP = tcpConn.RemoteAddr().String()
+ timing.SkippedIPs = skipped
+
+ phase := time.Now()
+ sshConn, chans, reqs, err := ssh.NewClientConn(tcpConn, address, sshConfig)
+ if err != nil {
+  tcpConn.Close()
+  log.Printf("SSH handshake with SFTP server failed: %v", err)
+  return nil, tracker.classify(fmt.Errorf("failed to dial: %w", err))
+ }
+ timing.HandshakeMs = time.Since(phase).Milliseconds()
+ log.Printf("Authenticated to SFTP server method=%s", tracker.last)
+ conn := ssh.NewClient(sshConn, chans, reqs)
+
+ phase = time.Now()
+ sftpClient, err := sftp.NewClient(conn, sftp.MaxPacketUnchecked(cfg.SFTPMaxPacket), sftp.MaxConcurrentRequestsPerFile(config.SFTPConcurrentRequests))
+ if err != nil {
+  conn.Close()
+  log.Printf("Failed to create SFTP client: %v", err)
+  return nil, withCategory(CategoryConnection, fmt.Errorf("failed to create SFTP client: %w", err))
+ }
+ timing.SFTPInitMs = time.Since(phase).Milliseconds()
+ timing.TotalMs = time.Since(start).Milliseconds()
+
+ _, posixRename := sftpClient.HasExtension(PosixRenameExtension)
+ timing.MaxPacketBytes = cfg.SFTPMaxPacket
+ log.Printf("SFTP connection established address=%s dial_ms=%d handshake_ms=%d sftp_init_ms=%d total_ms=%d posix_rename=%t max_packet=%d",
+  address, timing.DialMs, timing.HandshakeMs, timing.SFTPInitMs, timing.TotalMs, posixRename, timing.MaxPacketBytes)
+ c := &Conn{SSH: conn, SFTP: sftpClient, Timing: timing, CreatedAt: time.Now()}
+ if c.Home, c.Windows = remoteHome(sftpClient); c.Windows {
+  log.Printf("SFTP server reports Windows-style paths, creating directories below the drive root")
+ }
+ if cfg.SSHKeepaliveInterval > 0 {
+  c.startKeepalive(cfg.SSHKeepaliveInterval, cfg.SSHKeepaliveMaxMissed)
+ }
+ return c, nil
+}
+
+// Timing breaks connection establishment into its phases so a slow
+// run can be attributed to the network, the SSH handshake or the SFTP server.
+type Timing struct {
+ Address     string `json:"address"`
+ DialMs      int64  `json:"dialMs"`
+ HandshakeMs int64  `json:"handshakeMs"`
+ SFTPInitMs  int64  `json:"sftpInitMs"`
+ TotalMs     int64  `json:"totalMs"`
+ // EndpointIndex is the position of the host that served the
+ // connection: 0 for the primary, 1 and up for fallback hosts.
+ EndpointIndex   int      `json:"endpointIndex"`
+ FailedAddresses []string `json:"failedAddresses,omitempty"`
+ // IP is the address the host name resolved to that accepted the
+ // connection, and SkippedIPs those that failed before it.
+ IP         string   `json:"ip,omitempty"`
+ SkippedIPs []string `json:"skippedIps,omitempty"`
+ // MaxPacketBytes is the SFTP packet payload size the client used.
+ MaxPacketBytes int `json:"maxPacketBytes"`
+}
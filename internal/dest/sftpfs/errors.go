@@ -0,0 +1,39 @@
+package sftpfs
+
+import "errors"
+
+// Categories of connection failures in reports.
+const (
+ CategoryConnection = "connection"
+ CategoryAuth       = "auth"
+ // CategoryAuthPartial means the server accepted a credential but
+ // then demanded a further factor we cannot provide.
+ CategoryAuthPartial = "auth_partial"
+)
+
+// categorizedError attaches a category to an error.
+type categorizedError struct {
+ category string
+ err      error
+}
+
+func (e *categorizedError) Error() string { return e.err.Error() }
+
+func (e *categorizedError) Unwrap() error { return e.err }
+
+// Category returns the category reports give e.
+func (e *categorizedError) Category() string { return e.category }
+
+func withCategory(category string, err error) error {
+ return &categorizedError{category: category, err: err}
+}
+
+// categoryOf returns the category of the first categorized error in
+// err's chain, or "" if there is none.
+func categoryOf(err error) string {
+ var ce interface{ Category() string }
+ if errors.As(err, &ce) {
+  return ce.Category()
+ }
+ return ""
+}
@@ -0,0 +1,32 @@
+package sftpfs
+
+import (
+ "os"
+
+ "github.com/kr/fs"
+ "github.com/pkg/sftp"
+)
+
+// FS is the remote filesystem the transfer engine delivers to and pulls
+// from. *sftp.Client implements it; Conn.SFTP is the one of a connection.
+type FS interface {
+ Open(path string) (*sftp.File, error)
+ OpenFile(path string, flags int) (*sftp.File, error)
+ Create(path string) (*sftp.File, error)
+ Stat(path string) (os.FileInfo, error)
+ StatVFS(path string) (*sftp.StatVFS, error)
+ ReadDir(path string) ([]os.FileInfo, error)
+ Walk(root string) *fs.Walker
+ RealPath(path string) (string, error)
+ Mkdir(path string) error
+ MkdirAll(path string) error
+ Chown(path string, uid, gid int) error
+ Rename(oldname, newname string) error
+ // PosixRename replaces newname, where the server has the
+ // posix-rename@openssh.com extension HasExtension reports on.
+ PosixRename(oldname, newname string) error
+ Remove(path string) error
+ HasExtension(name string) (string, bool)
+}
+
+var _ FS = (*sftp.Client)(nil)
@@ -0,0 +1,114 @@
+package sftpfs
+
+import (
+ "bytes"
+ "fmt"
+ "log"
+ "net"
+ "strings"
+
+ "golang.org/x/crypto/ssh"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// hostKeyCallback returns the host key verification for host. A host with a
+// pinned key in sftpHostKeys must present exactly that key whatever the
+// policy; other hosts are handled as HOST_KEY_POLICY says.
+func hostKeyCallback(cfg *config.Config, c *config.SFTPConfig, host string) (ssh.HostKeyCallback, error) {
+ expected, ok := c.SFTPHostKeys[host]
+ if !ok {
+  switch cfg.HostKeyPolicy {
+  case config.HostKeyStrict:
+   return nil, fmt.Errorf("HOST_KEY_POLICY=strict but sftpHostKeys has no entry for %s", host)
+  case config.HostKeyTOFU:
+   return tofuCallback(cfg, c, host), nil
+  }
+  return ssh.InsecureIgnoreHostKey(), nil
+ }
+ expected = strings.TrimSpace(expected)
+
+ if strings.HasPrefix(expected, "SHA256:") {
+  return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+   if got := ssh.FingerprintSHA256(key); got != expected {
+    return fmt.Errorf("host key mismatch for %s: expected %s, got %s", host, expected, got)
+   }
+   return nil
+  }, nil
+ }
+
+ pinned, _, _, _, err := ssh.ParseAuthorizedKey([]byte(expected))
+ if err != nil {
+  return nil, fmt.Errorf("invalid sftpHostKeys entry for %s: %w", host, err)
+ }
+ return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+  if !bytes.Equal(key.Marshal(), pinned.Marshal()) {
+   return fmt.Errorf("host key mismatch for %s: expected %s, got %s",
+    host, ssh.FingerprintSHA256(pinned), ssh.FingerprintSHA256(key))
+  }
+  log.Printf("Verified host key for %s: %s", host, ssh.FingerprintSHA256(key))
+  return nil
+ }, nil
+}
+
+// tofuCallback trusts the key host presents on the first connection and
+// stores its fingerprint in an SSM parameter under HOST_KEY_PARAMETER_PREFIX,
+// one per host and port. Later connections must present the stored key. When
+// a server's key is rotated legitimately, deleting the parameter makes the
+// next connection trust the new key.
+func tofuCallback(cfg *config.Config, c *config.SFTPConfig, host string) ssh.HostKeyCallback {
+ address := net.JoinHostPort(host, c.SFTPPort)
+ name := hostKeyParameter(cfg.HostKeyParameterPrefix, address)
+ return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+  got := ssh.FingerprintSHA256(key)
+  stored, err := readHostKey(c.Parameters, name)
+  if err != nil {
+   return err
+  }
+  if stored == "" {
+   err := c.Parameters.Put(name, got, "SSH host key fingerprint of "+address+", trusted on first use", false)
+   if err == nil {
+    log.Printf("WARNING: trusting host key %s for %s on first use, stored in %s", got, address, name)
+    return nil
+   }
+   // Another invocation stored a key first; it must match.
+   if !cloud.IsParameterExists(err) {
+    return fmt.Errorf("failed to store host key for %s in %s: %w", address, name, err)
+   }
+   if stored, err = readHostKey(c.Parameters, name); err != nil {
+    return err
+   }
+  }
+  if stored != got {
+   return fmt.Errorf("host key mismatch for %s: trusted %s (from %s), got %s; "+
+    "if the key was rotated legitimately, delete %s to trust the new key", address, stored, name, got, name)
+  }
+  log.Printf("Verified host key for %s against %s: %s", address, name, got)
+  return nil
+ }
+}
+
+// hostKeyParameter returns the SSM parameter holding the trusted key for
+// address. Characters SSM does not allow in names, such as the ":" before
+// the port, become "_".
+func hostKeyParameter(prefix, address string) string {
+ name := strings.Map(func(r rune) rune {
+  switch {
+  case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+   return r
+  }
+  return '_'
+ }, address)
+ return prefix + name
+}
+
+// readHostKey returns the fingerprint stored in name, or "" if there is
+// none yet.
+func readHostKey(params *cloud.Parameters, name string) (string, error) {
+ value, _, err := params.Get(name)
+ if err != nil {
+  return "", fmt.Errorf("failed to read trusted host key from %s: %w", name, err)
+ }
+ return strings.TrimSpace(value), nil
+}
@@ -0,0 +1,11 @@
+package sftpfs
+
+import "golang.org/x/crypto/ssh"
+
+// applyLegacySSHAlgorithms offers the host key algorithms the SSH library
+// considers insecure after the ones it supports, so servers presenting only
+// an ssh-rsa or ssh-dss host key can be reached. The list is set explicitly
+// so it does not depend on what the library version offers by default.
+func applyLegacySSHAlgorithms(c *ssh.ClientConfig) {
+ c.HostKeyAlgorithms = append(ssh.SupportedAlgorithms().HostKeys, ssh.InsecureAlgorithms().HostKeys...)
+}
@@ -0,0 +1,30 @@
+package sftpfs
+
+import (
+ "strings"
+
+ "github.com/pkg/sftp"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// DriveRoot returns the "/C:" prefix of a normalized path on a Windows
+// server, or "" if p has none.
+func DriveRoot(p string) string {
+ if len(p) >= 3 && p[0] == '/' && config.HasDriveLetter(p[1:]) {
+  return p[:3]
+ }
+ return ""
+}
+
+// remoteHome returns the session's initial working directory and whether it
+// looks like a Windows path. Servers that fail Getwd are treated as POSIX
+// with an unknown home.
+func remoteHome(client *sftp.Client) (string, bool) {
+ wd, err := client.Getwd()
+ if err != nil {
+  return "", false
+ }
+ home := config.NormalizeRemotePath(wd)
+ return home, strings.Contains(wd, `\`) || DriveRoot(home) != ""
+}
@@ -0,0 +1,18 @@
+package sftpfs
+
+import "testing"
+
+func TestDriveRoot(t *testing.T) {
+ tests := []struct{ in, want string }{
+  {"/C:/inetpub/ftproot", "/C:"},
+  {"/C:", "/C:"},
+  {"/uploads", ""},
+  {"C:/inetpub", ""},
+  {"/Cx/inetpub", ""},
+ }
+ for _, tt := range tests {
+  if got := DriveRoot(tt.in); got != tt.want {
+   t.Errorf("driveRoot(%q) = %q, want %q", tt.in, got, tt.want)
+  }
+ }
+}
@@ -0,0 +1,90 @@
+package source
+
+import (
+ "time"
+
+ "github.com/aws/aws-sdk-go/aws"
+ "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Storage classes whose objects must be restored before they can be read.
+// Glacier Instant Retrieval is readable directly and is not one of them.
+const (
+ ClassGlacier     = s3.ObjectStorageClassGlacier
+ ClassDeepArchive = s3.ObjectStorageClassDeepArchive
+)
+
+// Retrieval tiers of a restore.
+const (
+ TierStandard  = s3.TierStandard
+ TierBulk      = s3.TierBulk
+ TierExpedited = s3.TierExpedited
+)
+
+// errCodeNoObjectLock is returned for retention and legal hold lookups on an
+// object that has neither.
+const errCodeNoObjectLock = "NoSuchObjectLockConfiguration"
+
+// Restore requests a temporary copy of an archived object, kept for days,
+// retrieved at tier. It fails with an error IsRestoreInProgress reports on
+// while an earlier restore is still running.
+func (c *Client) Restore(bucket, key string, days int, tier string) error {
+ _, err := c.svc.RestoreObject(&s3.RestoreObjectInput{
+  Bucket: aws.String(bucket),
+  Key:    aws.String(key),
+  RestoreRequest: &s3.RestoreRequest{
+   Days:                 aws.Int64(int64(days)),
+   GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(tier)},
+  },
+ })
+ return err
+}
+
+// LockEnabled reports whether Object Lock is enabled on bucket.
+func (c *Client) LockEnabled(bucket string) (bool, error) {
+ out, err := c.svc.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{
+  Bucket: aws.String(bucket),
+ })
+ if err != nil {
+  if codeOf(err) == errCodeNoObjectLock {
+   return false, nil
+  }
+  return false, err
+ }
+ return out.ObjectLockConfiguration != nil &&
+  aws.StringValue(out.ObjectLockConfiguration.ObjectLockEnabled) == s3.ObjectLockEnabledEnabled, nil
+}
+
+// LegalHold reports whether a legal hold is on for an object.
+func (c *Client) LegalHold(bucket, key string) (bool, error) {
+ hold, err := c.svc.GetObjectLegalHold(&s3.GetObjectLegalHoldInput{
+  Bucket: aws.String(bucket),
+  Key:    aws.String(key),
+ })
+ if err != nil {
+  if codeOf(err) == errCodeNoObjectLock {
+   return false, nil
+  }
+  return false, err
+ }
+ return hold.LegalHold != nil && aws.StringValue(hold.LegalHold.Status) == s3.ObjectLockLegalHoldStatusOn, nil
+}
+
+// Retention returns the retention mode of an object and the time it is
+// retained until, zero when it has no retention.
+func (c *Client) Retention(bucket, key string) (string, time.Time, error) {
+ ret, err := c.svc.GetObjectRetention(&s3.GetObjectRetentionInput{
+  Bucket: aws.String(bucket),
+  Key:    aws.String(key),
+ })
+ if err != nil {
+  if codeOf(err) == errCodeNoObjectLock {
+   return "", time.Time{}, nil
+  }
+  return "", time.Time{}, err
+ }
+ if ret.Retention == nil {
+  return "", time.Time{}, nil
+ }
+ return aws.StringValue(ret.Retention.Mode), aws.TimeValue(ret.Retention.RetainUntilDate), nil
+}
@@ -0,0 +1,158 @@
+package source
+
+import (
+ "log"
+ "net"
+ "net/http"
+ "sync"
+ "time"
+
+ "github.com/aws/aws-sdk-go/aws"
+ "github.com/aws/aws-sdk-go/aws/client"
+ "github.com/aws/aws-sdk-go/aws/request"
+ "github.com/aws/aws-sdk-go/service/s3"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+)
+
+const (
+ minThrottleGap = 10 * time.Millisecond
+ maxThrottleGap = 2 * time.Second
+)
+
+// Clock is the time source the adaptive limiter waits on.
+type Clock interface {
+ Now() time.Time
+ Sleep(d time.Duration)
+}
+
+// Options configure the client New builds.
+type Options struct {
+ // MaxAttempts is the most attempts of each request, retries
+ // included.
+ MaxAttempts int
+ // RequestTimeout bounds connecting and waiting for response headers.
+ RequestTimeout time.Duration
+ // Adaptive spaces requests out while S3 throttles, waiting on Clock.
+ Adaptive bool
+ Clock    Clock
+ // Throttled, when set, is called for each throttled request that will
+ // be retried.
+ Throttled func()
+ // Retry, when set, is asked before each retry the SDK would make of
+ // the named operation, and vetoes it by returning false. Waited is
+ // told of the backoff slept before each retry.
+ Retry  func(operation string) bool
+ Waited func(d time.Duration)
+}
+
+// New builds a client of sess with its own retry policy and request
+// timeout, independent of the per-file transfer handling.
+func New(sess *cloud.Session, opts Options) *Client {
+ if Override != nil {
+  return Wrap(Override)
+ }
+ transport := http.DefaultTransport.(*http.Transport).Clone()
+ // Bound the wait for response headers only; a deadline on the whole
+ // request would also cut off long GetObject bodies mid-stream.
+ transport.ResponseHeaderTimeout = opts.RequestTimeout
+ transport.DialContext = (&net.Dialer{Timeout: opts.RequestTimeout, KeepAlive: 30 * time.Second}).DialContext
+
+ svc := s3.New(sess.AWS(), &aws.Config{
+  HTTPClient: &http.Client{Transport: transport},
+  Retryer: client.DefaultRetryer{
+   NumMaxRetries:    opts.MaxAttempts - 1,
+   MinThrottleDelay: 500 * time.Millisecond,
+   MaxThrottleDelay: 20 * time.Second,
+  },
+ })
+
+ var limiter *throttleLimiter
+ if opts.Adaptive {
+  limiter = &throttleLimiter{clock: opts.Clock}
+  svc.Handlers.Send.PushFront(func(*request.Request) { limiter.wait() })
+ }
+ svc.Handlers.Complete.PushBack(func(req *request.Request) {
+  throttled := req.Error != nil && request.IsErrorThrottle(req.Error)
+  if limiter != nil {
+   limiter.observe(throttled)
+  }
+ })
+ svc.Handlers.Retry.PushBack(func(req *request.Request) {
+  if req.Error != nil && request.IsErrorThrottle(req.Error) {
+   log.Printf("S3 throttled %s (attempt %d): %v", req.Operation.Name, req.RetryCount+1, req.Error)
+   if opts.Throttled != nil {
+    opts.Throttled()
+   }
+  }
+ })
+ if opts.Retry != nil {
+  // Run at the end of the Retry handlers, before the SDK's
+  // AfterRetry handler decides whether to retry and sleeps.
+  svc.Handlers.Retry.PushBack(func(req *request.Request) {
+   retryable := aws.BoolValue(req.Retryable)
+   if req.Retryable == nil {
+    retryable = req.ShouldRetry(req)
+   }
+   if !retryable || req.RetryCount >= req.MaxRetries() {
+    return
+   }
+   if !opts.Retry(req.Operation.Name) {
+    req.Retryable = aws.Bool(false)
+   }
+  })
+ }
+ if opts.Waited != nil {
+  // The SDK clears req.Error when it is going to retry.
+  svc.Handlers.AfterRetry.PushBack(func(req *request.Request) {
+   if req.Error == nil {
+    opts.Waited(req.RetryDelay)
+   }
+  })
+ }
+ return Wrap(svc)
+}
+
+// throttleLimiter is a simplified take on the SDK v2 adaptive retry mode: each
+// throttling response doubles the minimum gap between S3 requests, up to
+// maxThrottleGap, and each success halves it again.
+type throttleLimiter struct {
+ clock Clock
+
+ mu   sync.Mutex
+ gap  time.Duration
+ next time.Time
+}
+
+func (l *throttleLimiter) wait() {
+ l.mu.Lock()
+ now := l.clock.Now()
+ delay := l.next.Sub(now)
+ if delay < 0 {
+  delay = 0
+ }
+ l.next = now.Add(delay + l.gap)
+ l.mu.Unlock()
+ if delay > 0 {
+  l.clock.Sleep(delay)
+ }
+}
+
+func (l *throttleLimiter) observe(throttled bool) {
+ l.mu.Lock()
+ defer l.mu.Unlock()
+ switch {
+ case throttled && l.gap == 0:
+  l.gap = minThrottleGap
+ case throttled:
+  l.gap *= 2
+  if l.gap > maxThrottleGap {
+   l.gap = maxThrottleGap
+  }
+ case l.gap > 0:
+  l.gap /= 2
+  if l.gap < minThrottleGap {
+   l.gap = 0
+  }
+ }
+}
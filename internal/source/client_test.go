@@ -0,0 +1,26 @@
+package source
+
+import (
+ "reflect"
+ "testing"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/testutil"
+)
+
+func TestThrottleLimiterWaitsOnClock(t *testing.T) {
+ clk := testutil.NewClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+ l := &throttleLimiter{clock: clk}
+ // Nothing waits until S3 throttles; then each request waits out the
+ // gap, which doubles with every throttling response.
+ l.wait()
+ l.observe(true)
+ l.wait()
+ l.wait()
+ l.observe(true)
+ l.wait()
+ l.wait()
+ if want := []time.Duration{minThrottleGap, minThrottleGap, 2 * minThrottleGap}; !reflect.DeepEqual(clk.Sleeps(), want) {
+  t.Errorf("slept %v, want %v", clk.Sleeps(), want)
+ }
+}
@@ -0,0 +1,54 @@
+package source
+
+import (
+ "errors"
+
+ "github.com/aws/aws-sdk-go/aws/awserr"
+ "github.com/aws/aws-sdk-go/aws/request"
+ "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Error codes S3 returns that have no constant in the SDK.
+const (
+ errCodeRestoreInProgress = "RestoreAlreadyInProgress"
+ errCodeInvalidRange      = "InvalidRange"
+)
+
+func codeOf(err error) string {
+ var aerr awserr.Error
+ if errors.As(err, &aerr) {
+  return aerr.Code()
+ }
+ return ""
+}
+
+// IsNotFound reports whether err is S3 reporting that the key does not
+// exist.
+func IsNotFound(err error) bool {
+ return codeOf(err) == s3.ErrCodeNoSuchKey
+}
+
+// IsPreconditionFailed reports whether err is a read or copy refused because
+// the object no longer has the ETag it was made conditional on.
+func IsPreconditionFailed(err error) bool {
+ var rf awserr.RequestFailure
+ return errors.As(err, &rf) && rf.StatusCode() == 412
+}
+
+// IsInvalidRange reports whether err is a ranged read refused because the
+// object is shorter than the range, as an empty object is.
+func IsInvalidRange(err error) bool {
+ return codeOf(err) == errCodeInvalidRange
+}
+
+// IsRestoreInProgress reports whether err is Restore refused because an
+// earlier restore of the object is still running.
+func IsRestoreInProgress(err error) bool {
+ return codeOf(err) == errCodeRestoreInProgress
+}
+
+// IsThrottle reports whether err is S3 throttling the request. Like the
+// SDK's own check, it only looks at err itself, not what it wraps.
+func IsThrottle(err error) bool {
+ return request.IsErrorThrottle(err)
+}
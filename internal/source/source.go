@@ -0,0 +1,352 @@
+// Package source reads and writes the objects of the function's S3 buckets:
+// the source bucket files are delivered from, and the state, reports and
+// pulled files written next to them. Store is what the transfer engine sees
+// of S3, in plain values; SDK types stay inside this package.
+package source
+
+import (
+ "io"
+ "net/url"
+ "time"
+
+ "github.com/aws/aws-sdk-go/aws"
+ "github.com/aws/aws-sdk-go/service/s3"
+ "github.com/aws/aws-sdk-go/service/s3/s3iface"
+ "github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+)
+
+// Store is the S3 API the transfer engine uses. *Client implements it.
+type Store interface {
+ Get(in GetInput) (*Reader, error)
+ Head(bucket, key string) (*Head, error)
+ Put(in PutInput) error
+ Upload(in UploadInput) error
+ List(in ListInput, fn func(Page) bool) error
+ Copy(in CopyInput) error
+ Delete(bucket, key string) error
+ DeleteBatch(bucket string, keys []string) ([]DeleteError, error)
+ Restore(bucket, key string, days int, tier string) error
+ LockEnabled(bucket string) (bool, error)
+ LegalHold(bucket, key string) (bool, error)
+ Retention(bucket, key string) (mode string, until time.Time, err error)
+}
+
+// Override, when set, is used in place of every S3 client the function
+// builds, so tests can serve buckets from memory.
+var Override s3iface.S3API
+
+// Client is a Store backed by an S3 client.
+type Client struct {
+ svc s3iface.S3API
+}
+
+// Wrap returns a Client calling svc.
+func Wrap(svc s3iface.S3API) *Client {
+ return &Client{svc: svc}
+}
+
+// Default returns a plain client of sess, for the objects the function reads
+// and writes with its own role.
+func Default(sess *cloud.Session) *Client {
+ if Override != nil {
+  return Wrap(Override)
+ }
+ return Wrap(s3.New(sess.AWS()))
+}
+
+// Object is an object found by a listing.
+type Object struct {
+ Key          string
+ Size         int64
+ ETag         string
+ LastModified time.Time
+ StorageClass string
+}
+
+// GetInput names the object to read and how.
+type GetInput struct {
+ Bucket string
+ Key    string
+ // Range is an HTTP byte range, such as "bytes=100-".
+ Range string
+ // IfMatch fails the read with an error IsPreconditionFailed reports
+ // on unless the object still has this ETag.
+ IfMatch string
+ // Checksum asks S3 for the object's stored SHA-256 checksum.
+ Checksum bool
+}
+
+// Reader is the body of an object being read, with its headers.
+type Reader struct {
+ Body io.ReadCloser
+ // Size is the Content-Length of the response, which SizeKnown is
+ // false without.
+ Size           int64
+ SizeKnown      bool
+ ETag           string
+ LastModified   time.Time
+ Metadata       map[string]string
+ ChecksumSHA256 string
+}
+
+// Get reads an object.
+func (c *Client) Get(in GetInput) (*Reader, error) {
+ input := &s3.GetObjectInput{
+  Bucket: aws.String(in.Bucket),
+  Key:    aws.String(in.Key),
+ }
+ if in.Range != "" {
+  input.Range = aws.String(in.Range)
+ }
+ if in.IfMatch != "" {
+  input.IfMatch = aws.String(in.IfMatch)
+ }
+ if in.Checksum {
+  input.ChecksumMode = aws.String(s3.ChecksumModeEnabled)
+ }
+ out, err := c.svc.GetObject(input)
+ if err != nil {
+  return nil, err
+ }
+ return &Reader{
+  Body:           out.Body,
+  Size:           aws.Int64Value(out.ContentLength),
+  SizeKnown:      out.ContentLength != nil,
+  ETag:           aws.StringValue(out.ETag),
+  LastModified:   aws.TimeValue(out.LastModified),
+  Metadata:       aws.StringValueMap(out.Metadata),
+  ChecksumSHA256: aws.StringValue(out.ChecksumSHA256),
+ }, nil
+}
+
+// Headers are the content headers an object is stored with, which a copy
+// keeps.
+type Headers struct {
+ ContentType        string
+ ContentEncoding    string
+ ContentDisposition string
+ CacheControl       string
+ StorageClass       string
+}
+
+// Head is what HeadObject returns of an object.
+type Head struct {
+ Headers
+ ETag string
+ Size int64
+ // Restore is the Restore header, set once a restore of an archived
+ // object was requested.
+ Restore  string
+ Metadata map[string]string
+}
+
+// Head reads the headers of an object.
+func (c *Client) Head(bucket, key string) (*Head, error) {
+ out, err := c.svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+ if err != nil {
+  return nil, err
+ }
+ return &Head{
+  Headers: Headers{
+   ContentType:        aws.StringValue(out.ContentType),
+   ContentEncoding:    aws.StringValue(out.ContentEncoding),
+   ContentDisposition: aws.StringValue(out.ContentDisposition),
+   CacheControl:       aws.StringValue(out.CacheControl),
+   StorageClass:       aws.StringValue(out.StorageClass),
+  },
+  ETag:     aws.StringValue(out.ETag),
+  Size:     aws.Int64Value(out.ContentLength),
+  Restore:  aws.StringValue(out.Restore),
+  Metadata: aws.StringValueMap(out.Metadata),
+ }, nil
+}
+
+// PutInput is an object to write in a single request.
+type PutInput struct {
+ Bucket      string
+ Key         string
+ Body        io.ReadSeeker
+ ContentType string
+ // ContentMD5 is the base64 MD5 of Body, which buckets with Object
+ // Lock enabled require.
+ ContentMD5 string
+ Metadata   map[string]string
+}
+
+// Put writes an object.
+func (c *Client) Put(in PutInput) error {
+ _, err := c.svc.PutObject(&s3.PutObjectInput{
+  Bucket:      aws.String(in.Bucket),
+  Key:         aws.String(in.Key),
+  Body:        in.Body,
+  ContentType: optional(in.ContentType),
+  ContentMD5:  optional(in.ContentMD5),
+  Metadata:    stringMap(in.Metadata),
+ })
+ return err
+}
+
+// MaxUploadParts is the most parts S3 allows in a multipart upload, and
+// MinUploadPartSize the smallest part but the last.
+const (
+ MaxUploadParts    = s3manager.MaxUploadParts
+ MinUploadPartSize = s3manager.MinUploadPartSize
+)
+
+// UploadInput is an object to write in PartSize parts, Concurrency of them
+// at a time, or in a single request when it is smaller than a part.
+type UploadInput struct {
+ Bucket      string
+ Key         string
+ Body        io.Reader
+ ContentType string
+ Metadata    map[string]string
+ PartSize    int64
+ Concurrency int
+}
+
+// Upload writes an object in parts. A failed multipart upload is aborted so
+// its parts are not left behind. Bodies that support ReadAt are read part by
+// part without copying.
+func (c *Client) Upload(in UploadInput) error {
+ u := s3manager.NewUploaderWithClient(c.svc, func(u *s3manager.Uploader) {
+  u.PartSize = in.PartSize
+  u.Concurrency = in.Concurrency
+  u.LeavePartsOnError = false
+  // Never copy parts of a ReadAt body into pooled buffers.
+  u.BufferProvider = nil
+ })
+ _, err := u.Upload(&s3manager.UploadInput{
+  Bucket:      aws.String(in.Bucket),
+  Key:         aws.String(in.Key),
+  Body:        in.Body,
+  ContentType: optional(in.ContentType),
+  Metadata:    stringMap(in.Metadata),
+ })
+ return err
+}
+
+// ListInput is a listing of the keys under Prefix, starting after
+// StartAfter when it is set. With a Delimiter, keys holding it past the
+// prefix are rolled up into common prefixes.
+type ListInput struct {
+ Bucket     string
+ Prefix     string
+ Delimiter  string
+ StartAfter string
+}
+
+// Page is one page of a listing.
+type Page struct {
+ Objects []Object
+ // Prefixes are the common prefixes of a delimiter listing.
+ Prefixes []string
+}
+
+// List calls fn with each page of a listing, in key order, until fn returns
+// false or the listing ends.
+func (c *Client) List(in ListInput, fn func(Page) bool) error {
+ input := &s3.ListObjectsV2Input{
+  Bucket:     aws.String(in.Bucket),
+  Prefix:     aws.String(in.Prefix),
+  Delimiter:  optional(in.Delimiter),
+  StartAfter: optional(in.StartAfter),
+ }
+ return c.svc.ListObjectsV2Pages(input, func(out *s3.ListObjectsV2Output, _ bool) bool {
+  page := Page{Objects: make([]Object, 0, len(out.Contents))}
+  for _, cp := range out.CommonPrefixes {
+   page.Prefixes = append(page.Prefixes, aws.StringValue(cp.Prefix))
+  }
+  for _, obj := range out.Contents {
+   page.Objects = append(page.Objects, Object{
+    Key:          aws.StringValue(obj.Key),
+    Size:         aws.Int64Value(obj.Size),
+    ETag:         aws.StringValue(obj.ETag),
+    LastModified: aws.TimeValue(obj.LastModified),
+    StorageClass: aws.StringValue(obj.StorageClass),
+   })
+  }
+  return fn(page)
+ })
+}
+
+// CopyInput copies From to Key in the same bucket, replacing its metadata
+// with Metadata and its headers with Headers. CopyObject handles objects of
+// up to 5GB.
+type CopyInput struct {
+ Headers
+ Bucket string
+ Key    string
+ From   string
+ // IfMatch fails the copy unless From still has this ETag.
+ IfMatch  string
+ Metadata map[string]string
+}
+
+// Copy copies an object.
+func (c *Client) Copy(in CopyInput) error {
+ _, err := c.svc.CopyObject(&s3.CopyObjectInput{
+  Bucket:             aws.String(in.Bucket),
+  Key:                aws.String(in.Key),
+  CopySource:         aws.String(in.Bucket + "/" + (&url.URL{Path: in.From}).EscapedPath()),
+  CopySourceIfMatch:  optional(in.IfMatch),
+  MetadataDirective:  aws.String(s3.MetadataDirectiveReplace),
+  Metadata:           stringMap(in.Metadata),
+  ContentType:        optional(in.ContentType),
+  ContentEncoding:    optional(in.ContentEncoding),
+  ContentDisposition: optional(in.ContentDisposition),
+  CacheControl:       optional(in.CacheControl),
+  StorageClass:       optional(in.StorageClass),
+ })
+ return err
+}
+
+// Delete removes an object.
+func (c *Client) Delete(bucket, key string) error {
+ _, err := c.svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+ return err
+}
+
+// DeleteError is a key a batch delete failed to remove.
+type DeleteError struct {
+ Key     string
+ Message string
+}
+
+// DeleteBatch removes up to 1000 objects in a single request, returning the
+// keys S3 failed to remove.
+func (c *Client) DeleteBatch(bucket string, keys []string) ([]DeleteError, error) {
+ ids := make([]*s3.ObjectIdentifier, len(keys))
+ for i, key := range keys {
+  ids[i] = &s3.ObjectIdentifier{Key: aws.String(key)}
+ }
+ out, err := c.svc.DeleteObjects(&s3.DeleteObjectsInput{
+  Bucket: aws.String(bucket),
+  Delete: &s3.Delete{Objects: ids, Quiet: aws.Bool(true)},
+ })
+ if err != nil {
+  return nil, err
+ }
+ var failed []DeleteError
+ for _, e := range out.Errors {
+  failed = append(failed, DeleteError{Key: aws.StringValue(e.Key), Message: aws.StringValue(e.Message)})
+ }
+ return failed, nil
+}
+
+// optional returns nil for "", leaving the field unset.
+func optional(v string) *string {
+ if v == "" {
+  return nil
+ }
+ return aws.String(v)
+}
+
+func stringMap(m map[string]string) map[string]*string {
+ if m == nil {
+  return nil
+ }
+ return aws.StringMap(m)
+}
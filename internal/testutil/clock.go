@@ -0,0 +1,60 @@
+// Package testutil holds helpers shared by the function's tests.
+package testutil
+
+import (
+ "sync"
+ "time"
+)
+
+// Clock is a clock for tests that only moves when told to. Sleep and After
+// return at once, advancing the clock by the duration asked for and
+// recording it, so code that backs off can be tested without waiting.
+type Clock struct {
+ mu     sync.Mutex
+ now    time.Time
+ sleeps []time.Duration
+}
+
+// NewClock returns a Clock reading now.
+func NewClock(now time.Time) *Clock {
+ return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+ c.mu.Lock()
+ defer c.mu.Unlock()
+ return c.now
+}
+
+func (c *Clock) Since(t time.Time) time.Duration {
+ return c.Now().Sub(t)
+}
+
+func (c *Clock) Sleep(d time.Duration) {
+ c.mu.Lock()
+ defer c.mu.Unlock()
+ c.sleeps = append(c.sleeps, d)
+ c.now = c.now.Add(d)
+}
+
+// After is Sleep, returning a channel that is ready at once.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+ c.Sleep(d)
+ ch := make(chan time.Time, 1)
+ ch <- c.Now()
+ return ch
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+ c.mu.Lock()
+ defer c.mu.Unlock()
+ c.now = c.now.Add(d)
+}
+
+// Sleeps returns the durations Sleep was called with, in order.
+func (c *Clock) Sleeps() []time.Duration {
+ c.mu.Lock()
+ defer c.mu.Unlock()
+ return append([]time.Duration(nil), c.sleeps...)
+}
@@ -0,0 +1,208 @@
+package transfer
+
+import (
+ "archive/tar"
+ "archive/zip"
+ "bufio"
+ "compress/gzip"
+ "fmt"
+ "io"
+ "log"
+ "strings"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// archiveReport summarizes the single archive written in archive mode.
+type archiveReport struct {
+ RemotePath      string `json:"remotePath"`
+ Format          string `json:"format"`
+ Members         int    `json:"members"`
+ CompressedBytes int64  `json:"compressedBytes"`
+}
+
+// archiveWriter is the subset of tar and zip writing needed to stream S3
+// objects into an archive.
+type archiveWriter interface {
+ add(name string, size int64, modTime time.Time, src io.Reader) error
+ Close() error
+}
+
+type tarGzWriter struct {
+ gz *gzip.Writer
+ tw *tar.Writer
+}
+
+func (w *tarGzWriter) add(name string, size int64, modTime time.Time, src io.Reader) error {
+ hdr := &tar.Header{Name: name, Mode: 0o644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg}
+ if err := w.tw.WriteHeader(hdr); err != nil {
+  return err
+ }
+ _, err := io.Copy(w.tw, src)
+ return err
+}
+
+func (w *tarGzWriter) Close() error {
+ if err := w.tw.Close(); err != nil {
+  return err
+ }
+ return w.gz.Close()
+}
+
+// zipStreamWriter relies on archive/zip writing sizes in data descriptors
+// after each member, so the archive can be streamed to the server without
+// seeking back or spooling to /tmp.
+type zipStreamWriter struct {
+ zw *zip.Writer
+}
+
+func (w *zipStreamWriter) add(name string, _ int64, modTime time.Time, src io.Reader) error {
+ dst, err := w.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+ if err != nil {
+  return err
+ }
+ _, err = io.Copy(dst, src)
+ return err
+}
+
+func (w *zipStreamWriter) Close() error { return w.zw.Close() }
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+ w io.Writer
+ n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+ n, err := c.w.Write(p)
+ c.n += int64(n)
+ return n, err
+}
+
+// transferArchive streams every key into a single archive written directly to
+// the SFTP server, using member names relative to the source prefix. Any
+// member failure aborts the run and removes the partial archive.
+func (r *transferRun) transferArchive(client sftpfs.FS, keys []string) error {
+ name := renderNameTemplate(r.cfg.ArchiveName, r.clock.Now().UTC())
+ dir := r.resolveRemotePath(r.cfg.RemoteDir)
+ remotePath := remoteJoin(dir, name)
+ summary := &archiveReport{RemotePath: remotePath, Format: r.cfg.ArchiveMode}
+ r.report.Archive = summary
+
+ if err := r.ensureRemoteDir(client, dir); err != nil {
+  return err
+ }
+ release, err := r.inflight.acquire("writing the archive", r.cfg.CopyBufferBytes()+config.ArchiveBufferBytes)
+ if err != nil {
+  return err
+ }
+ defer release()
+
+ log.Printf("Writing %s archive of %d objects to %s", r.cfg.ArchiveMode, len(keys), remotePath)
+ dstFile, err := createRemoteFile(client, remotePath, r.cfg.OverwritePolicy != config.OverwriteSkip)
+ if err != nil {
+  log.Printf("Failed to create remote file: %v", err)
+  return fmt.Errorf("failed to create remote file: %w", err)
+ }
+ counter := &countingWriter{w: dstFile}
+ buf := bufio.NewWriterSize(counter, config.ArchiveBufferBytes)
+
+ var aw archiveWriter
+ if r.cfg.ArchiveMode == config.ArchiveZip {
+  aw = &zipStreamWriter{zw: zip.NewWriter(buf)}
+ } else {
+  gz := gzip.NewWriter(buf)
+  aw = &tarGzWriter{gz: gz, tw: tar.NewWriter(gz)}
+ }
+
+ var added []string
+ abort := func(err error) error {
+  dstFile.Close()
+  if rmErr := client.Remove(remotePath); rmErr != nil {
+   log.Printf("Failed to remove partial archive %s: %v", remotePath, rmErr)
+  }
+  // Members already added went nowhere once the archive is removed.
+  for _, key := range added {
+   if f := r.report.lastFile(key); f != nil {
+    f.Status = statusFailed
+    f.Error = err.Error()
+   }
+  }
+  return err
+ }
+
+ start := r.clock.Now()
+ var total int64
+ for _, key := range keys {
+  member := strings.TrimPrefix(strings.TrimPrefix(key, r.cfg.SourcePrefix), "/")
+  n, err := r.addArchiveMember(aw, key, member)
+  entry := fileReport{Key: key, RemotePath: remotePath + ":" + member, Bytes: n, Status: statusTransferred}
+  if err != nil {
+   entry.Status = statusFailed
+   entry.Error = err.Error()
+   r.report.addFile(entry)
+   log.Printf("Failed to add %s to archive: %v", key, err)
+   return abort(fmt.Errorf("failed to add %s to archive: %w", key, err))
+  }
+  r.report.addFile(entry)
+  added = append(added, key)
+  summary.Members++
+  total += n
+ }
+
+ if err := aw.Close(); err != nil {
+  return abort(fmt.Errorf("failed to finalize archive: %w", err))
+ }
+ if err := buf.Flush(); err != nil {
+  return abort(fmt.Errorf("failed to copy file to remote: %w", err))
+ }
+ opts, err := r.writeOptions(client, nil)
+ if err != nil {
+  return abort(err)
+ }
+ if opts.fsync {
+  if err := dstFile.Sync(); err != nil {
+   return abort(fmt.Errorf("failed to fsync remote archive: %w", err))
+  }
+ }
+ if err := dstFile.Close(); err != nil {
+  return abort(fmt.Errorf("failed to close remote archive: %w", err))
+ }
+ summary.CompressedBytes = counter.n
+
+ elapsed := r.clock.Since(start)
+ r.metrics.addDuration("TransferDuration", elapsed)
+ r.metrics.add("BytesTransferred", unitBytes, float64(counter.n))
+ log.Printf("Archive written to %s members=%d uncompressed_bytes=%d compressed_bytes=%d duration_ms=%d",
+  remotePath, summary.Members, total, summary.CompressedBytes, elapsed.Milliseconds())
+ return nil
+}
+
+func (r *transferRun) addArchiveMember(aw archiveWriter, key, member string) (int64, error) {
+ out, err := r.s3.Get(source.GetInput{Bucket: s3Bucket, Key: key})
+ if err != nil {
+  return 0, fmt.Errorf("failed to get S3 object: %w", err)
+ }
+ defer out.Body.Close()
+
+ size := out.Size
+ if err := aw.add(member, size, out.LastModified, out.Body); err != nil {
+  return 0, err
+ }
+ return size, nil
+}
+
+// renderNameTemplate expands the date placeholders {yyyymmdd}, {yyyy}, {mm},
+// {dd} and {hhmmss} in a remote file name template.
+func renderNameTemplate(tmpl string, t time.Time) string {
+ return strings.NewReplacer(
+  "{yyyymmdd}", t.Format("20060102"),
+  "{yyyy}", t.Format("2006"),
+  "{mm}", t.Format("01"),
+  "{dd}", t.Format("02"),
+  "{hhmmss}", t.Format("150405"),
+ ).Replace(tmpl)
+}
@@ -0,0 +1,118 @@
+package transfer
+
+import (
+ "archive/tar"
+ "archive/zip"
+ "bytes"
+ "compress/gzip"
+ "io"
+ "reflect"
+ "testing"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/schema"
+)
+
+// readArchive returns the members of the tar.gz or zip archive data, by name.
+func readArchive(t *testing.T, format string, data []byte) map[string]string {
+ t.Helper()
+ members := make(map[string]string)
+ if format == config.ArchiveZip {
+  zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+  if err != nil {
+   t.Fatal(err)
+  }
+  for _, f := range zr.File {
+   rc, err := f.Open()
+   if err != nil {
+    t.Fatal(err)
+   }
+   body, err := io.ReadAll(rc)
+   rc.Close()
+   if err != nil {
+    t.Fatal(err)
+   }
+   members[f.Name] = string(body)
+  }
+  return members
+ }
+ gz, err := gzip.NewReader(bytes.NewReader(data))
+ if err != nil {
+  t.Fatal(err)
+ }
+ tr := tar.NewReader(gz)
+ for {
+  hdr, err := tr.Next()
+  if err == io.EOF {
+   return members
+  }
+  if err != nil {
+   t.Fatal(err)
+  }
+  body, err := io.ReadAll(tr)
+  if err != nil {
+   t.Fatal(err)
+  }
+  members[hdr.Name] = string(body)
+ }
+}
+
+func TestArchiveMode(t *testing.T) {
+ for _, format := range []string{config.ArchiveTarGz, config.ArchiveZip} {
+  t.Run(format, func(t *testing.T) {
+   e := newTestEnv(t, testServerConfig{password: "secret"})
+   installFakeClock(t, time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC))
+   t.Setenv("ARCHIVE_MODE", format)
+   e.s3.put("test-poc/orders.csv", "id,total\n1,10\n")
+   e.s3.put("test-poc/2024/summary.txt", "all good\n")
+
+   result, err := e.run("")
+   if err != nil {
+    t.Fatalf("run failed: %v", err)
+   }
+   if result.Transferred != 2 || result.Failed != 0 {
+    t.Fatalf("result = %+v, want 2 members", result)
+   }
+   remotePath := "/uploads/archive_20240701." + format
+   data, ok := e.server.file(remotePath)
+   if !ok {
+    t.Fatalf("%s was not written", remotePath)
+   }
+   // Members are named relative to the prefix, keeping their folders.
+   want := map[string]string{
+    "orders.csv":       "id,total\n1,10\n",
+    "2024/summary.txt": "all good\n",
+   }
+   if got := readArchive(t, format, data); !reflect.DeepEqual(got, want) {
+    t.Errorf("members = %q, want %q", got, want)
+   }
+   if e.server.exists("/uploads/orders.csv") {
+    t.Error("orders.csv delivered loose as well as archived")
+   }
+  })
+ }
+}
+
+func TestArchiveFailureRemovesArchive(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ installFakeClock(t, time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC))
+ t.Setenv("ARCHIVE_MODE", config.ArchiveTarGz)
+ t.Setenv("ARCHIVE_NAME", "batch.tar.gz")
+ e.s3.put("test-poc/orders.csv", "id,total\n1,10\n")
+ e.server.failClose["/uploads/batch.tar.gz"] = true
+
+ result, err := e.run("")
+ if err == nil && result.Status != schema.StatusFailed {
+  t.Fatalf("result = %+v, want the run failed", result)
+ }
+ // Members already added are not reported delivered, so they are not
+ // treated as done.
+ if result != nil && (result.Transferred != 0 || result.Failed != 1) {
+  t.Errorf("result = %+v, want the member failed", result)
+ }
+ // The partner never sees a truncated archive.
+ if e.server.exists("/uploads/batch.tar.gz") {
+  t.Error("partial archive left behind")
+ }
+}
@@ -0,0 +1,108 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+ "strings"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// categoryArchived means the object is in an archive storage class and must
+// be restored before it can be read.
+const categoryArchived errorCategory = "archived"
+
+// isArchivedClass reports whether objects of the storage class must be
+// restored before GetObject succeeds. Glacier Instant Retrieval is readable
+// directly and is not included.
+func isArchivedClass(class string) bool {
+ return class == source.ClassGlacier || class == source.ClassDeepArchive
+}
+
+// restoreStatus parses the Restore header of HeadObject: whether a restore
+// was ever requested, and whether it is still running.
+func restoreStatus(header string) (requested, ongoing bool) {
+ if header == "" {
+  return false, false
+ }
+ return true, strings.Contains(header, `ongoing-request="true"`)
+}
+
+// admitArchived applies ARCHIVED_OBJECT_POLICY to an object listed in an
+// archive storage class, recording the outcome in the report. It returns
+// true when the object has a restored copy and can be delivered normally.
+func (r *transferRun) admitArchived(key, class string) bool {
+ switch r.cfg.ArchivedObjectPolicy {
+ case config.ArchivedSkip:
+  log.Printf("Skipping %s: stored in %s", key, class)
+  r.report.addFile(fileReport{Key: key, Status: statusSkipped, Category: string(categoryArchived)})
+  r.metrics.add("ArchivedObjectsSkipped", unitCount, 1)
+  return false
+ case config.ArchivedRestore:
+  return r.restoreArchived(key, class)
+ }
+ err := withCategory(categoryArchived, fmt.Errorf("object is stored in %s and must be restored first", class))
+ log.Printf("Failed to transfer %s: %v", key, err)
+ r.report.addFile(fileReport{Key: key, Status: statusFailed, Category: string(categoryArchived), Error: err.Error()})
+ return false
+}
+
+// restoreArchived requests a restore of key unless one is already running or
+// has completed. Objects with a completed restore are admitted for delivery;
+// the rest are reported as restoring for a later run to pick up. A key that
+// was restored before but has no restored copy any more had it expire before
+// delivery and is restored again.
+func (r *transferRun) restoreArchived(key, class string) bool {
+ pending, err := r.loadPendingRestores()
+ if err != nil {
+  log.Printf("Failed to transfer %s: %v", key, err)
+  r.report.addFile(fileReport{Key: key, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+  return false
+ }
+ head, err := r.s3.Head(s3Bucket, key)
+ if err != nil {
+  err = classifyS3Error(fmt.Errorf("failed to check restore status: %w", err))
+  log.Printf("Failed to transfer %s: %v", key, err)
+  r.report.addFile(fileReport{Key: key, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+  return false
+ }
+ requested, ongoing := restoreStatus(head.Restore)
+ switch {
+ case requested && !ongoing:
+  log.Printf("Restored copy of %s is available", key)
+  r.report.Restores.Completed++
+  r.metrics.add("RestoresCompleted", unitCount, 1)
+  return true
+ case ongoing:
+  log.Printf("Restore of %s is still in progress", key)
+  if _, ok := pending.Keys[key]; !ok {
+   pending.Keys[key] = pendingRestore{RequestedAt: r.clock.Now().UTC()}
+  }
+  r.report.addFile(fileReport{Key: key, Status: statusRestoring})
+  return false
+ }
+ if p, ok := pending.Keys[key]; ok {
+  log.Printf("WARNING: restored copy of %s (requested %s) expired before it was delivered, restoring again",
+   key, p.RequestedAt.Format(time.RFC3339))
+  r.report.Restores.Expired++
+  r.metrics.add("RestoresExpired", unitCount, 1)
+ }
+
+ err = r.s3.Restore(s3Bucket, key, r.cfg.RestoreDays, r.cfg.RestoreTier)
+ if source.IsRestoreInProgress(err) {
+  err = nil
+ }
+ if err != nil {
+  err = classifyS3Error(fmt.Errorf("failed to restore from %s: %w", class, err))
+  log.Printf("Failed to transfer %s: %v", key, err)
+  r.report.addFile(fileReport{Key: key, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+  return false
+ }
+ pending.Keys[key] = pendingRestore{RequestedAt: r.clock.Now().UTC(), Tier: r.cfg.RestoreTier}
+ log.Printf("Restore of %s from %s initiated tier=%s days=%d, will retry later", key, class, r.cfg.RestoreTier, r.cfg.RestoreDays)
+ r.report.addFile(fileReport{Key: key, Status: statusRestoring})
+ r.metrics.add("RestoresInitiated", unitCount, 1)
+ return false
+}
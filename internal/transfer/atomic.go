@@ -0,0 +1,99 @@
+package transfer
+
+import (
+ "errors"
+ "fmt"
+ "log"
+
+ "github.com/pkg/sftp"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// atomicTempSuffix is appended to the remote name while an atomic upload is
+// in progress.
+const atomicTempSuffix = ".tmp"
+
+// atomicEnabled reports whether files are uploaded under a temporary name
+// and renamed into place.
+func (r *transferRun) atomicEnabled() bool {
+ if !r.cfg.AtomicUpload || r.atomicDowngraded {
+  return false
+ }
+ return r.conn == nil || !r.conn.RenameUnsupported.Load()
+}
+
+func isRenameUnsupported(err error) bool {
+ var se *sftp.StatusError
+ return errors.As(err, &se) && se.FxCode() == sftp.ErrSSHFxOpUnsupported
+}
+
+// commitAtomic renames tmpPath to remotePath. When the server does not
+// support rename the result is cached on the connection and the file is
+// rescued by copying it to its final name over the same connection.
+func (r *transferRun) commitAtomic(client sftpfs.FS, tmpPath, remotePath string, opts writeOptions) error {
+ err := renameOver(client, tmpPath, remotePath)
+ if err == nil {
+  return nil
+ }
+ if !isRenameUnsupported(err) {
+  client.Remove(tmpPath)
+  return fmt.Errorf("failed to rename %s to %s: %w", tmpPath, remotePath, err)
+ }
+
+ if r.conn != nil {
+  r.conn.RenameUnsupported.Store(true)
+ }
+ if r.cfg.AtomicRenameFallback == config.RenameFallbackDowngrade {
+  r.atomicDowngraded = true
+  log.Printf("WARNING: SFTP server does not support rename, atomic uploads are DISABLED for the rest of this run")
+ } else {
+  log.Printf("SFTP server does not support rename, uploading directly to final names on this connection")
+ }
+ opts.overwrite = true
+ return copyRemoteFile(client, tmpPath, remotePath, opts)
+}
+
+// renameOver renames oldPath to newPath, replacing newPath if it exists. It
+// uses posix-rename when the server advertises it. Otherwise a plain rename
+// is tried, and if that fails because newPath exists, newPath is removed and
+// the rename repeated, leaving a short window in which newPath is missing.
+func renameOver(client sftpfs.FS, oldPath, newPath string) error {
+ if _, ok := client.HasExtension(sftpfs.PosixRenameExtension); ok {
+  log.Printf("Renaming %s to %s using %s", oldPath, newPath, sftpfs.PosixRenameExtension)
+  return client.PosixRename(oldPath, newPath)
+ }
+ log.Printf("Renaming %s to %s using plain rename", oldPath, newPath)
+ err := client.Rename(oldPath, newPath)
+ if err == nil || isRenameUnsupported(err) {
+  return err
+ }
+ if _, serr := client.Stat(newPath); serr != nil {
+  return err
+ }
+ log.Printf("Plain rename onto existing %s failed, removing it first; %s is briefly absent: %v", newPath, newPath, err)
+ if rerr := client.Remove(newPath); rerr != nil {
+  return fmt.Errorf("%w (removing existing destination: %v)", err, rerr)
+ }
+ return client.Rename(oldPath, newPath)
+}
+
+// copyRemoteFile copies src to dst through the client, replacing dst, then
+// removes src. The data makes a round trip since SFTP has no server-side
+// copy.
+func copyRemoteFile(client sftpfs.FS, src, dst string, opts writeOptions) error {
+ in, err := client.Open(src)
+ if err != nil {
+  return fmt.Errorf("failed to open %s: %w", src, err)
+ }
+ _, err = writeRemoteFile(client, dst, in, opts)
+ in.Close()
+ if err != nil {
+  return err
+ }
+ if err := client.Remove(src); err != nil {
+  log.Printf("Failed to remove temporary file %s: %v", src, err)
+ }
+ return nil
+}
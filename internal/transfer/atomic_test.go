@@ -0,0 +1,65 @@
+package transfer
+
+import (
+ "fmt"
+ "slices"
+ "testing"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+func TestRenameOverExisting(t *testing.T) {
+ for _, tc := range []struct {
+  name    string
+  server  testServerConfig
+  renames []string
+ }{
+  {"posix-rename advertised", testServerConfig{}, []string{"posix-rename"}},
+  // The plain rename fails on the existing file, which is removed
+  // before renaming again.
+  {"posix-rename not advertised", testServerConfig{noPosixRename: true}, []string{"rename", "rename"}},
+ } {
+  t.Run(tc.name, func(t *testing.T) {
+   s := startSFTPServer(t, tc.server)
+   c, err := sftpfs.DialHost(testConfig(t), s.sftpConfig(), s.host)
+   if err != nil {
+    t.Fatalf("dial failed: %v", err)
+   }
+   defer c.Close()
+   s.putFile("/uploads/data.csv", []byte("old"))
+   s.putFile("/uploads/data.csv.tmp", []byte("new"))
+
+   if err := renameOver(c.SFTP, "/uploads/data.csv.tmp", "/uploads/data.csv"); err != nil {
+    t.Fatalf("renameOver failed: %v", err)
+   }
+   if got, _ := s.file("/uploads/data.csv"); string(got) != "new" {
+    t.Errorf("destination = %q, want the renamed file", got)
+   }
+   if _, ok := s.file("/uploads/data.csv.tmp"); ok {
+    t.Error("temporary file left behind")
+   }
+   if got := s.renameRequests(); !slices.Equal(got, tc.renames) {
+    t.Errorf("rename requests = %v, want %v", got, tc.renames)
+   }
+  })
+ }
+}
+
+func TestAtomicUploadReplacesExisting(t *testing.T) {
+ for _, noPosixRename := range []bool{false, true} {
+  t.Run(fmt.Sprintf("noPosixRename=%t", noPosixRename), func(t *testing.T) {
+   e := newTestEnv(t, testServerConfig{password: "secret", noPosixRename: noPosixRename})
+   t.Setenv("ATOMIC_UPLOAD", "true")
+   e.s3.put("test-poc/data.csv", "new\n")
+   e.server.putFile("/uploads/data.csv", []byte("old\n"))
+
+   if _, err := e.run(""); err != nil {
+    t.Fatalf("run failed: %v", err)
+   }
+   e.wantFile("/uploads/data.csv", "new\n")
+   if _, ok := e.server.file("/uploads/data.csv" + atomicTempSuffix); ok {
+    t.Error("temporary file left behind")
+   }
+  })
+ }
+}
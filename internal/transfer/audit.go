@@ -0,0 +1,107 @@
+package transfer
+
+import (
+ "bytes"
+ "crypto/md5"
+ "encoding/base64"
+ "encoding/json"
+ "fmt"
+ "log"
+ "path"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+const auditMaxAttempts = 3
+
+// auditRecord is one line of the audit log: the outcome of a single delivery
+// attempt. Unlike the transfer report it is written once and never updated,
+// so the bucket can enforce Object Lock on it.
+type auditRecord struct {
+ Timestamp   time.Time `json:"timestamp"`
+ RequestID   string    `json:"requestId"`
+ Bucket      string    `json:"bucket"`
+ Key         string    `json:"key"`
+ Member      string    `json:"member,omitempty"`
+ ETag        string    `json:"etag,omitempty"`
+ Destination string    `json:"destination"`
+ RemotePath  string    `json:"remotePath,omitempty"`
+ Outcome     string    `json:"outcome"`
+ Bytes       int64     `json:"bytes"`
+ Checksum    string    `json:"checksum,omitempty"`
+ Error       string    `json:"error,omitempty"`
+}
+
+// auditLog renders one JSONL line per file outcome in report.
+func auditLog(report *transferReport, destination string) ([]byte, error) {
+ var buf bytes.Buffer
+ enc := json.NewEncoder(&buf)
+ for _, f := range report.Files {
+  rec := auditRecord{
+   Timestamp:   f.at,
+   RequestID:   report.RequestID,
+   Bucket:      report.Bucket,
+   Key:         f.Key,
+   Member:      f.Member,
+   ETag:        f.ETag,
+   Destination: destination,
+   RemotePath:  f.RemotePath,
+   Outcome:     f.Status,
+   Bytes:       f.Bytes,
+   Checksum:    f.Checksum,
+   Error:       f.Error,
+  }
+  if err := enc.Encode(rec); err != nil {
+   return nil, fmt.Errorf("failed to marshal audit record: %w", err)
+  }
+ }
+ return buf.Bytes(), nil
+}
+
+// writeAuditLog writes the run's audit records as a single JSONL object
+// under AUDIT_PREFIX/yyyy/mm/dd/<requestid>.jsonl in AUDIT_BUCKET, retrying
+// failed writes. It is a no-op when AUDIT_BUCKET is not configured. A failure
+// does not fail the run; it is logged as a warning and counted in the
+// AuditWriteFailed metric.
+func writeAuditLog(svc source.Store, cfg *Config, report *transferReport, m *metrics, clk clock) {
+ if cfg.AuditBucket == "" || len(report.Files) == 0 {
+  return
+ }
+ body, err := auditLog(report, cfg.DestinationName)
+ if err == nil {
+  key := path.Join(cfg.AuditPrefix, report.StartedAt.Format("2006/01/02"), report.RequestID+".jsonl")
+  err = putAuditObject(svc, cfg.AuditBucket, key, body, clk)
+ }
+ if err != nil {
+  log.Printf("WARNING: audit log not written: %v", err)
+  m.add("AuditWriteFailed", unitNone, 1)
+  return
+ }
+ m.add("AuditWriteFailed", unitNone, 0)
+}
+
+func putAuditObject(svc source.Store, bucket, key string, body []byte, clk clock) error {
+ // Buckets with Object Lock enabled reject uploads without Content-MD5.
+ sum := md5.Sum(body)
+ contentMD5 := base64.StdEncoding.EncodeToString(sum[:])
+ var err error
+ for attempt := 1; attempt <= auditMaxAttempts; attempt++ {
+  if attempt > 1 {
+   clk.Sleep(time.Duration(attempt-1) * time.Second)
+  }
+  err = svc.Put(source.PutInput{
+   Bucket:      bucket,
+   Key:         key,
+   Body:        bytes.NewReader(body),
+   ContentType: "application/x-ndjson",
+   ContentMD5:  contentMD5,
+  })
+  if err == nil {
+   log.Printf("Wrote audit log to s3://%s/%s", bucket, key)
+   return nil
+  }
+  log.Printf("Failed to write audit log (attempt %d): %v", attempt, err)
+ }
+ return fmt.Errorf("failed to write s3://%s/%s after %d attempts: %w", bucket, key, auditMaxAttempts, err)
+}
@@ -0,0 +1,29 @@
+package transfer
+
+import (
+ "reflect"
+ "testing"
+ "time"
+)
+
+func TestAuditLogRetriesOnRunClock(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ clk := installFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+ t.Setenv("AUDIT_BUCKET", "audit")
+ e.s3.put("test-poc/orders.csv", "id\n")
+ e.s3.failPuts = auditMaxAttempts - 1
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if keys := e.s3.keys("audit"); len(keys) != 1 {
+  t.Errorf("audit bucket holds %v, want the run's log", keys)
+ }
+ var want []time.Duration
+ for attempt := 2; attempt <= auditMaxAttempts; attempt++ {
+  want = append(want, time.Duration(attempt-1)*time.Second)
+ }
+ if !reflect.DeepEqual(clk.Sleeps(), want) {
+  t.Errorf("slept %v, want %v", clk.Sleeps(), want)
+ }
+}
@@ -0,0 +1,63 @@
+package transfer
+
+import (
+ "slices"
+ "testing"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+func TestAuthOrderFallsThrough(t *testing.T) {
+ signer := testSigner(t)
+ for _, tc := range []struct {
+  name   string
+  server testServerConfig
+  order  string
+  want   string
+ }{
+  {"key only, key first", testServerConfig{authorizedKey: signer.PublicKey()}, "publickey,password", config.AuthPublicKey},
+  {"key only, password first", testServerConfig{authorizedKey: signer.PublicKey()}, "password,publickey", config.AuthPublicKey},
+  {"password only, key first", testServerConfig{password: "secret"}, "publickey,password", config.AuthPassword},
+  {"password only, password first", testServerConfig{password: "secret"}, "password,publickey", config.AuthPassword},
+ } {
+  t.Run(tc.name, func(t *testing.T) {
+   t.Setenv("AUTH_ORDER", tc.order)
+   s := startSFTPServer(t, tc.server)
+   sftpConfig := s.sftpConfig()
+   sftpConfig.Signer = signer
+
+   c, err := sftpfs.DialHost(testConfig(t), sftpConfig, s.host)
+   if err != nil {
+    t.Fatalf("dial failed: %v", err)
+   }
+   c.Close()
+   if _, methods := s.accepted(); !slices.Equal(methods, []string{tc.want}) {
+    t.Errorf("server accepted %v, want [%s]", methods, tc.want)
+   }
+  })
+ }
+}
+
+func TestAuthLeavesOutMissingCredentials(t *testing.T) {
+ s := startSFTPServer(t, testServerConfig{authorizedKey: testSigner(t).PublicKey()})
+ // The secret has only a password, which the server does not take.
+ _, err := sftpfs.DialHost(testConfig(t), s.sftpConfig(), s.host)
+ if err == nil {
+  t.Fatal("dial succeeded without an accepted credential")
+ }
+ if got := categoryOf(err); got != categoryAuth {
+  t.Errorf("category = %s, want %s (%v)", got, categoryAuth, err)
+ }
+}
+
+func TestAuthPartialSuccess(t *testing.T) {
+ s := startSFTPServer(t, testServerConfig{password: "secret", partialPassword: true})
+ _, err := sftpfs.DialHost(testConfig(t), s.sftpConfig(), s.host)
+ if err == nil {
+  t.Fatal("dial succeeded although the server demanded a second factor")
+ }
+ if got := categoryOf(err); got != categoryAuthPartial {
+  t.Errorf("category = %s, want %s (%v)", got, categoryAuthPartial, err)
+ }
+}
@@ -0,0 +1,112 @@
+package transfer
+
+import (
+ "context"
+ "encoding/json"
+ "fmt"
+ "log"
+ "net/url"
+ "strings"
+
+ "github.com/aws/aws-lambda-go/events"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// Result codes of an S3 Batch Operations task.
+const (
+ batchSucceeded        = "Succeeded"
+ batchTemporaryFailure = "TemporaryFailure"
+ batchPermanentFailure = "PermanentFailure"
+)
+
+// maxBatchResultString bounds the resultString of a task, which S3 writes
+// into the job's completion report.
+const maxBatchResultString = 1024
+
+// batchJobEvent is an S3 Batch Operations LambdaInvoke event. Tasks carry
+// s3BucketArn under schema 1.0 and s3Bucket under 2.0.
+type batchJobEvent struct {
+ InvocationSchemaVersion string `json:"invocationSchemaVersion"`
+ InvocationID            string `json:"invocationId"`
+ Tasks                   []struct {
+  TaskID      string `json:"taskId"`
+  S3Key       string `json:"s3Key"`
+  S3BucketARN string `json:"s3BucketArn"`
+  S3Bucket    string `json:"s3Bucket"`
+ } `json:"tasks"`
+}
+
+// parseBatchJob reports whether event is an S3 Batch Operations invocation.
+func parseBatchJob(event json.RawMessage) (*batchJobEvent, bool) {
+ ev := &batchJobEvent{}
+ if err := json.Unmarshal(event, ev); err != nil || ev.InvocationSchemaVersion == "" || ev.InvocationID == "" {
+  return nil, false
+ }
+ return ev, true
+}
+
+// handleBatchJob delivers the objects of an S3 Batch Operations invocation,
+// one run per task through the same handler as any other invocation, and
+// answers with the result of each task. S3 retries TemporaryFailure tasks,
+// so failures a fresh attempt may get past are reported as temporary and
+// the rest as permanent. Connections stay pooled across the invocations of
+// a job like any other warm invocation.
+func handleBatchJob(ctx context.Context, ev *batchJobEvent) *events.S3BatchJobResponse {
+ log.Printf("S3 Batch Operations invocation %s with %d task(s)", ev.InvocationID, len(ev.Tasks))
+ resp := &events.S3BatchJobResponse{
+  InvocationSchemaVersion: ev.InvocationSchemaVersion,
+  TreatMissingKeysAs:      batchPermanentFailure,
+  InvocationID:            ev.InvocationID,
+ }
+ for _, task := range ev.Tasks {
+  code, msg := runBatchTask(ctx, task.S3Key, strings.TrimPrefix(task.S3BucketARN+task.S3Bucket, "arn:aws:s3:::"))
+  log.Printf("Batch task %s (%s): %s %s", task.TaskID, task.S3Key, code, msg)
+  if len(msg) > maxBatchResultString {
+   msg = msg[:maxBatchResultString]
+  }
+  resp.Results = append(resp.Results, events.S3BatchJobResult{TaskID: task.TaskID, ResultCode: code, ResultString: msg})
+ }
+ return resp
+}
+
+// runBatchTask delivers one task's object as a run with an explicit key list
+// and maps its outcome to a result code.
+func runBatchTask(ctx context.Context, rawKey, bucket string) (string, string) {
+ if bucket != s3Bucket {
+  return batchPermanentFailure, fmt.Sprintf("bucket %s is not the source bucket %s", bucket, s3Bucket)
+ }
+ // Batch Operations URL-encodes keys in the event.
+ key, err := url.QueryUnescape(rawKey)
+ if err != nil {
+  key = rawKey
+ }
+ payload, err := json.Marshal(&config.Payload{Keys: []string{key}})
+ if err != nil {
+  return batchPermanentFailure, err.Error()
+ }
+ result, err := lambdaHandler(ctx, payload)
+ switch {
+ case err != nil:
+  return batchResultCode(categoryOf(err)), err.Error()
+ case result.Transferred > 0:
+  return batchSucceeded, fmt.Sprintf("delivered %d bytes", result.Bytes)
+ case result.Skipped > 0:
+  return batchSucceeded, "already delivered"
+ case result.Failed > 0:
+  return batchPermanentFailure, result.Error
+ }
+ // Deferred, pending or restoring: a later attempt can deliver it.
+ return batchTemporaryFailure, fmt.Sprintf("not delivered yet: status %s", result.Status)
+}
+
+// batchResultCode maps the category of a failed run to a result code.
+func batchResultCode(category errorCategory) string {
+ switch category {
+ case categoryConfig, categoryAuth, categoryAuthPartial, categoryPermission, categorySourceAccess,
+  categoryPathCollision, categoryUnrepresentableName, categorySymlink, categoryDanglingSymlink, categoryStagingMove,
+  categoryValidation:
+  return batchPermanentFailure
+ }
+ return batchTemporaryFailure
+}
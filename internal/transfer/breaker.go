@@ -0,0 +1,87 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// categoryDestinationUnavailable marks files not attempted, and the run
+// error, once the circuit breaker for their destination has opened.
+const categoryDestinationUnavailable errorCategory = "destination_unavailable"
+
+// circuitBreaker counts the consecutive connection-level failures against one
+// destination. Once CIRCUIT_BREAKER_THRESHOLD is reached it opens and the
+// destination is not tried again for the rest of the invocation.
+type circuitBreaker struct {
+ failures int
+ open     bool
+ lastErr  error
+}
+
+// breaker returns the circuit breaker for the destination sftpConfig was read
+// from, so one dead destination does not stop deliveries to the others.
+func (r *transferRun) breaker(sftpConfig *SFTPConfig) *circuitBreaker {
+ if r.breakers == nil {
+  r.breakers = make(map[string]*circuitBreaker)
+ }
+ b := r.breakers[sftpConfig.SecretName]
+ if b == nil {
+  b = &circuitBreaker{}
+  r.breakers[sftpConfig.SecretName] = b
+ }
+ return b
+}
+
+// recordConnFailure records a connection-level failure and reports whether
+// the breaker is now open.
+func (r *transferRun) recordConnFailure(sftpConfig *SFTPConfig, err error) bool {
+ b := r.breaker(sftpConfig)
+ b.failures++
+ b.lastErr = err
+ if !b.open && b.failures >= r.cfg.BreakerThreshold {
+  b.open = true
+  r.metrics.add("CircuitBreakerOpen", unitCount, 1)
+  log.Printf("WARNING: %d consecutive connection failures for %s, not attempting it again this run", b.failures, sftpConfig.SecretName)
+ }
+ return b.open
+}
+
+// unavailable returns the error for a destination whose breaker is open.
+func (b *circuitBreaker) unavailable(sftpConfig *SFTPConfig) error {
+ return withCategory(categoryDestinationUnavailable, fmt.Errorf("destination %s unavailable after %d consecutive connection failures: %w",
+  sftpConfig.SecretName, b.failures, b.lastErr))
+}
+
+// connectWithBreaker connects for sftpConfig. With the circuit breaker on,
+// failed dials are retried, backing off a second more each time, until one
+// succeeds or the breaker opens.
+func (r *transferRun) connectWithBreaker(sftpConfig *SFTPConfig) (*sftpfs.Conn, func(broken bool), error) {
+ b := r.breaker(sftpConfig)
+ for {
+  if b.open {
+   return nil, nil, b.unavailable(sftpConfig)
+  }
+  conn, release, err := r.connect(sftpConfig)
+  if err == nil || r.cfg.BreakerThreshold == 0 {
+   return conn, release, err
+  }
+  if r.recordConnFailure(sftpConfig, err) {
+   return nil, nil, b.unavailable(sftpConfig)
+  }
+  log.Printf("Failed to connect for %s (%d consecutive failure(s)), retrying: %v", sftpConfig.SecretName, b.failures, err)
+  r.clock.Sleep(time.Duration(b.failures) * time.Second)
+ }
+}
+
+// skipUnavailable records keys as skipped because their destination is
+// unavailable. They are not treated as done by the listing checkpoint, so
+// the next run tries them again.
+func (r *transferRun) skipUnavailable(keys []string, err error) {
+ for _, key := range keys {
+  r.report.addFile(fileReport{Key: key, Status: statusSkipped, Category: string(categoryDestinationUnavailable), Error: err.Error()})
+ }
+ log.Printf("Skipped %d file(s): %v", len(keys), err)
+}
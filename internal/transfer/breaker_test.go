@@ -0,0 +1,34 @@
+package transfer
+
+import (
+ "reflect"
+ "testing"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/testutil"
+)
+
+func TestBreakerBacksOffBetweenDials(t *testing.T) {
+ resetWarmState(t)
+ t.Setenv("CIRCUIT_BREAKER_THRESHOLD", "3")
+ s := startSFTPServer(t, testServerConfig{password: "secret"})
+ sftpConfig := s.sftpConfig()
+ sftpConfig.SecretName = "down"
+ s.close()
+ r := testRun(testConfig(t), nil)
+ clk := testutil.NewClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+ r.clock = clk
+
+ _, _, err := r.connectWithBreaker(sftpConfig)
+ if got := categoryOf(err); got != categoryDestinationUnavailable {
+  t.Fatalf("category = %s, want %s (%v)", got, categoryDestinationUnavailable, err)
+ }
+ // Two retries, a second longer each, before the third failure opens
+ // the breaker.
+ if want := []time.Duration{time.Second, 2 * time.Second}; !reflect.DeepEqual(clk.Sleeps(), want) {
+  t.Errorf("slept %v, want %v", clk.Sleeps(), want)
+ }
+ if r.stats.Connect != 0 {
+  t.Errorf("connect took %s on a clock that did not move", r.stats.Connect)
+ }
+}
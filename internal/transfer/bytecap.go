@@ -0,0 +1,59 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+)
+
+// deferredReport describes the files left for a later run because the run
+// reached MAX_BYTES_PER_RUN. ContinuationToken is the last key the run
+// started; with CHECKPOINT_PREFIX set the next run resumes after the last
+// key that completed, which is never past it.
+type deferredReport struct {
+ Files             int    `json:"files"`
+ Bytes             int64  `json:"bytes"`
+ ContinuationToken string `json:"continuationToken,omitempty"`
+}
+
+// withinByteCap reports whether a file whose listing size is size can be
+// started after sent bytes have already gone out. The first file of a run is
+// always allowed so a single file larger than the cap cannot stall delivery.
+func (r *transferRun) withinByteCap(sent, size int64) bool {
+ if r.cfg.MaxBytesPerRun <= 0 || sent == 0 {
+  return true
+ }
+ return sent+size <= r.cfg.MaxBytesPerRun
+}
+
+// deferRemaining records keys as deferred to a later run. after is the last
+// key the run started, if any, and reason is logged.
+func (r *transferRun) deferRemaining(keys []string, after, reason string) {
+ d := &deferredReport{Files: len(keys), ContinuationToken: after}
+ for _, key := range keys {
+  d.Bytes += r.sizes[key]
+  r.report.addFile(fileReport{Key: key, Status: statusDeferred})
+ }
+ r.report.Deferred = d
+ log.Printf("%s, deferring %d file(s) totalling %d bytes to the next run", reason, d.Files, d.Bytes)
+}
+
+// deferOverCap defers keys because the run reached MAX_BYTES_PER_RUN.
+func (r *transferRun) deferOverCap(keys []string, after string) {
+ r.metrics.add("ByteCapReached", unitCount, 1)
+ r.deferRemaining(keys, after, fmt.Sprintf("Reached MAX_BYTES_PER_RUN of %d bytes", r.cfg.MaxBytesPerRun))
+}
+
+// planByteCap returns the prefix of keys whose listing sizes fit within
+// MAX_BYTES_PER_RUN and defers the rest. It is used where the actual bytes
+// cannot be checked between files, such as when building a single archive.
+func (r *transferRun) planByteCap(keys []string) []string {
+ var planned int64
+ for i, key := range keys {
+  if !r.withinByteCap(planned, r.sizes[key]) {
+   r.deferOverCap(keys[i:], keys[i-1])
+   return keys[:i]
+  }
+  planned += r.sizes[key]
+ }
+ return keys
+}
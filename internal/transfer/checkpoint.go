@@ -0,0 +1,105 @@
+package transfer
+
+import (
+ "bytes"
+ "encoding/json"
+ "fmt"
+ "log"
+ "strings"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// listCheckpoint records how far enumeration of the source prefix has got.
+// Every key up to and including After was transferred or deliberately
+// skipped, so the next run can start its listing after it.
+type listCheckpoint struct {
+ After        string    `json:"after"`
+ FullListedAt time.Time `json:"fullListedAt"`
+ UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// checkpointKey is the object holding the checkpoint for the source prefix
+// and destination.
+func (r *transferRun) checkpointKey() string {
+ name := strings.Trim(strings.ReplaceAll(r.cfg.SourcePrefix, "/", "_"), "_")
+ return r.cfg.CheckpointPrefix + r.cfg.DestinationName + "/" + name + ".json"
+}
+
+// loadCheckpoint reads the listing checkpoint and sets the key the listing
+// starts after. Once CHECKPOINT_FULL_RELIST has passed since the last full
+// listing the checkpoint is ignored for this run, so objects added behind it
+// are still picked up.
+func (r *transferRun) loadCheckpoint() error {
+ r.checkpoint = &listCheckpoint{}
+ key := r.checkpointKey()
+ out, err := r.s3.Get(source.GetInput{Bucket: s3Bucket, Key: key})
+ if err != nil {
+  if source.IsNotFound(err) {
+   log.Printf("No listing checkpoint at s3://%s/%s, listing from the beginning", s3Bucket, key)
+   r.fullListing = true
+   return nil
+  }
+  return classifyS3Error(fmt.Errorf("failed to read listing checkpoint: %w", err))
+ }
+ defer out.Body.Close()
+ if err := json.NewDecoder(out.Body).Decode(r.checkpoint); err != nil {
+  return withCategory(categoryConfig, fmt.Errorf("failed to decode listing checkpoint s3://%s/%s: %w", s3Bucket, key, err))
+ }
+
+ if every := r.cfg.CheckpointFullRelist; every > 0 && r.clock.Since(r.checkpoint.FullListedAt) >= every {
+  log.Printf("Last full listing was at %s, ignoring checkpoint %q for a full re-list",
+   r.checkpoint.FullListedAt.Format(time.RFC3339), r.checkpoint.After)
+  r.fullListing = true
+  return nil
+ }
+ r.listAfter = r.checkpoint.After
+ log.Printf("Resuming listing after checkpoint %q", r.listAfter)
+ return nil
+}
+
+// saveCheckpoint advances the checkpoint over the listed keys, in order, for
+// as long as each one was transferred or skipped. It stops at the first key
+// that failed or was never attempted so that key is listed again next run.
+func (r *transferRun) saveCheckpoint() error {
+ if r.checkpoint == nil || r.listed == nil {
+  return nil
+ }
+
+ ok := r.report.doneKeys()
+ after := r.listAfter
+ for _, key := range r.listed {
+  if !ok[key] {
+   break
+  }
+  after = key
+ }
+
+ now := r.clock.Now().UTC()
+ if after == r.checkpoint.After && !r.fullListing {
+  return nil
+ }
+ r.checkpoint.After = after
+ r.checkpoint.UpdatedAt = now
+ if r.fullListing {
+  r.checkpoint.FullListedAt = now
+ }
+
+ body, err := json.Marshal(r.checkpoint)
+ if err != nil {
+  return fmt.Errorf("failed to marshal listing checkpoint: %w", err)
+ }
+ key := r.checkpointKey()
+ err = r.s3.Put(source.PutInput{
+  Bucket:      s3Bucket,
+  Key:         key,
+  Body:        bytes.NewReader(body),
+  ContentType: "application/json",
+ })
+ if err != nil {
+  return classifyS3Error(fmt.Errorf("failed to write listing checkpoint: %w", err))
+ }
+ log.Printf("Listing checkpoint s3://%s/%s advanced to %q", s3Bucket, key, after)
+ return nil
+}
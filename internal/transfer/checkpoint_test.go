@@ -0,0 +1,90 @@
+package transfer
+
+import (
+ "encoding/json"
+ "testing"
+ "time"
+)
+
+// checkpointAfter returns the key the stored listing checkpoint is at.
+func (e *testEnv) checkpointAfter() string {
+ e.t.Helper()
+ o := e.s3.object(s3Bucket, "checkpoints/sftp-poc/test-poc.json")
+ if o == nil {
+  e.t.Fatal("no listing checkpoint was written")
+ }
+ var c listCheckpoint
+ if err := json.Unmarshal(o.body, &c); err != nil {
+  e.t.Fatal(err)
+ }
+ return c.After
+}
+
+func TestCheckpointResumesListing(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ clk := installFakeClock(t, time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC))
+ t.Setenv("CHECKPOINT_PREFIX", "checkpoints/")
+ t.Setenv("CHECKPOINT_FULL_RELIST", "24h")
+ for _, name := range []string{"a.csv", "b.csv", "c.csv"} {
+  e.s3.put("test-poc/"+name, "id\n")
+ }
+ e.server.failClose["/uploads/b.csv"] = true
+
+ // The checkpoint never moves past a failure.
+ e.run("")
+ if got := e.checkpointAfter(); got != "test-poc/a.csv" {
+  t.Fatalf("checkpoint after the failed run = %q, want test-poc/a.csv", got)
+ }
+
+ e.server.mu.Lock()
+ delete(e.server.failClose, "/uploads/b.csv")
+ e.server.mu.Unlock()
+ // Added behind the checkpoint, so only a full re-list finds it.
+ e.s3.put("test-poc/0-late.csv", "id\n")
+ clk.Advance(time.Hour)
+ result, err := e.run("")
+ if err != nil {
+  t.Fatalf("resumed run failed: %v", err)
+ }
+ if result.Transferred != 2 || e.server.exists("/uploads/0-late.csv") {
+  t.Fatalf("resumed run = %+v, want b.csv and c.csv only", result)
+ }
+ if got := e.checkpointAfter(); got != "test-poc/c.csv" {
+  t.Fatalf("checkpoint = %q, want test-poc/c.csv", got)
+ }
+
+ // CHECKPOINT_FULL_RELIST after the first full listing.
+ clk.Advance(24 * time.Hour)
+ result, err = e.run("")
+ if err != nil {
+  t.Fatalf("full re-list failed: %v", err)
+ }
+ if result.Transferred != 4 {
+  t.Fatalf("full re-list = %+v, want every object", result)
+ }
+ e.wantFile("/uploads/0-late.csv", "id\n")
+}
+
+func TestSaveCheckpointStopsAtFirstUndone(t *testing.T) {
+ f := installFakeS3(t)
+ cfg := &Config{CheckpointPrefix: "checkpoints/", DestinationName: "sftp-poc", SourcePrefix: "test-poc"}
+ r := testRun(cfg, f)
+ r.checkpoint = &listCheckpoint{}
+ r.listed = []string{"test-poc/a", "test-poc/b", "test-poc/c", "test-poc/d", "test-poc/e"}
+ r.report.addFile(fileReport{Key: "test-poc/a", Status: statusTransferred})
+ r.report.addFile(fileReport{Key: "test-poc/b", Status: statusSkipped})
+ // Skipped only because the destination was down: still to deliver.
+ r.report.addFile(fileReport{Key: "test-poc/c", Status: statusSkipped, Category: string(categoryDestinationUnavailable)})
+ r.report.addFile(fileReport{Key: "test-poc/d", Status: statusTransferred})
+
+ if err := r.saveCheckpoint(); err != nil {
+  t.Fatal(err)
+ }
+ var c listCheckpoint
+ if err := json.Unmarshal(f.object(s3Bucket, "checkpoints/sftp-poc/test-poc.json").body, &c); err != nil {
+  t.Fatal(err)
+ }
+ if c.After != "test-poc/b" {
+  t.Errorf("checkpoint = %q, want test-poc/b", c.After)
+ }
+}
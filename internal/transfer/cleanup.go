@@ -0,0 +1,131 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// maxDeleteBatch is the most keys a single DeleteObjects call accepts.
+const maxDeleteBatch = 1000
+
+// cleanupReport records the retention pass over the processed prefix.
+type cleanupReport struct {
+ Prefix  string `json:"prefix"`
+ DryRun  bool   `json:"dryRun"`
+ Expired int    `json:"expired"`
+ Deleted int    `json:"deleted"`
+ Failed  int    `json:"failed"`
+ // Retained counts expired objects left in place because of an
+ // Object Lock retention period or legal hold.
+ Retained int `json:"retained,omitempty"`
+ // CapReached is set when more objects had expired than
+ // CLEANUP_MAX_DELETES allows in one run.
+ CapReached bool `json:"capReached,omitempty"`
+}
+
+// cleanupProcessed deletes objects under PROCESSED_PREFIX older than
+// PROCESSED_RETENTION_DAYS. At most CLEANUP_MAX_DELETES objects are removed
+// per run, and with CLEANUP_DRY_RUN set they are only logged.
+//
+// Objects under an Object Lock retention period or legal hold are left in
+// place and counted as retained rather than deleted; in a versioned bucket
+// the delete would only add a delete marker and leave the locked version
+// behind. With OBJECT_LOCK_STRICT they fail the cleanup instead.
+func (r *transferRun) cleanupProcessed() error {
+ if r.cfg.ProcessedRetentionDays <= 0 {
+  return nil
+ }
+ lockEnabled, err := r.bucketLockEnabled()
+ if err != nil {
+  return fmt.Errorf("processed prefix cleanup failed: %w", err)
+ }
+ cutoff := r.clock.Now().AddDate(0, 0, -r.cfg.ProcessedRetentionDays)
+ summary := &cleanupReport{Prefix: r.cfg.ProcessedPrefix, DryRun: r.cfg.CleanupDryRun}
+ r.report.Cleanup = summary
+ log.Printf("Cleaning up s3://%s/%s objects older than %s (dry_run=%t)",
+  s3Bucket, r.cfg.ProcessedPrefix, cutoff.Format(time.RFC3339), r.cfg.CleanupDryRun)
+
+ var batch []string
+ flush := func() error {
+  if len(batch) == 0 {
+   return nil
+  }
+  defer func() { batch = batch[:0] }()
+  if r.cfg.CleanupDryRun {
+   for _, key := range batch {
+    log.Printf("Dry run: would delete %s", key)
+   }
+   return nil
+  }
+  failed, err := r.s3.DeleteBatch(s3Bucket, batch)
+  if err != nil {
+   summary.Failed += len(batch)
+   return fmt.Errorf("failed to delete expired objects: %w", err)
+  }
+  for _, e := range failed {
+   log.Printf("Failed to delete %s: %s", e.Key, e.Message)
+  }
+  summary.Failed += len(failed)
+  summary.Deleted += len(batch) - len(failed)
+  return nil
+ }
+
+ var flushErr error
+ err = r.s3.List(source.ListInput{Bucket: s3Bucket, Prefix: r.cfg.ProcessedPrefix}, func(page source.Page) bool {
+  for _, obj := range page.Objects {
+   if !obj.LastModified.Before(cutoff) {
+    continue
+   }
+   if summary.Expired == r.cfg.CleanupMaxDeletes {
+    summary.CapReached = true
+    return false
+   }
+   summary.Expired++
+   if lockEnabled {
+    reason, lerr := r.objectLock(obj.Key)
+    if lerr != nil {
+     log.Printf("Not deleting %s: %v", obj.Key, lerr)
+     summary.Failed++
+     continue
+    }
+    if reason != "" {
+     log.Printf("Retaining %s in place: %s", obj.Key, reason)
+     summary.Retained++
+     continue
+    }
+   }
+   batch = append(batch, obj.Key)
+   if len(batch) == maxDeleteBatch {
+    if flushErr = flush(); flushErr != nil {
+     return false
+    }
+   }
+  }
+  return true
+ })
+ if err == nil {
+  err = flushErr
+ }
+ if err == nil {
+  err = flush()
+ }
+
+ if summary.CapReached {
+  log.Printf("Cleanup stopped at CLEANUP_MAX_DELETES=%d; remaining expired objects will be removed by later runs", r.cfg.CleanupMaxDeletes)
+ }
+ r.metrics.add("ProcessedObjectsExpired", unitCount, float64(summary.Expired))
+ r.metrics.add("ProcessedObjectsDeleted", unitCount, float64(summary.Deleted))
+ r.metrics.add("ProcessedObjectsDeleteFailed", unitCount, float64(summary.Failed))
+ r.metrics.add("ProcessedObjectsRetained", unitCount, float64(summary.Retained))
+ log.Printf("Cleanup finished expired=%d deleted=%d retained=%d failed=%d", summary.Expired, summary.Deleted, summary.Retained, summary.Failed)
+ if err == nil && r.cfg.ObjectLockStrict && summary.Retained > 0 {
+  err = fmt.Errorf("%d expired object(s) are locked and cannot be deleted", summary.Retained)
+ }
+ if err != nil {
+  return fmt.Errorf("processed prefix cleanup failed: %w", err)
+ }
+ return nil
+}
@@ -0,0 +1,100 @@
+package transfer
+
+import (
+ "fmt"
+ "reflect"
+ "testing"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/testutil"
+)
+
+// cleanupRun returns a run cleaning up processed/ objects older than 30 days
+// at now, with the fake f holding 1500 expired objects and two recent ones.
+func cleanupRun(f *fakeS3, now time.Time) *transferRun {
+ for i := 0; i < 1500; i++ {
+  f.put(fmt.Sprintf("processed/old-%04d.csv", i), "id\n").modified = now.AddDate(0, 0, -31)
+ }
+ f.put("processed/recent.csv", "id\n").modified = now.AddDate(0, 0, -29)
+ f.put("test-poc/orders.csv", "id\n").modified = now.AddDate(0, -6, 0)
+ cfg := &Config{ProcessedPrefix: "processed/", ProcessedRetentionDays: 30, CleanupMaxDeletes: config.DefaultCleanupMaxDeletes}
+ r := testRun(cfg, f)
+ r.clock = testutil.NewClock(now)
+ return r
+}
+
+func TestCleanupProcessed(t *testing.T) {
+ f := installFakeS3(t)
+ r := cleanupRun(f, time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC))
+
+ if err := r.cleanupProcessed(); err != nil {
+  t.Fatal(err)
+ }
+ // DeleteObjects takes at most 1000 keys a call.
+ if want := []int{1000, 500}; !reflect.DeepEqual(f.deleteBatches, want) {
+  t.Errorf("delete batches = %v, want %v", f.deleteBatches, want)
+ }
+ if want := []string{"processed/recent.csv", "test-poc/orders.csv"}; !reflect.DeepEqual(f.keys(s3Bucket), want) {
+  t.Errorf("keys left = %q, want %q", f.keys(s3Bucket), want)
+ }
+ if c := r.report.Cleanup; c == nil || c.Expired != 1500 || c.Deleted != 1500 || c.Failed != 0 || c.CapReached {
+  t.Errorf("cleanup = %+v, want 1500 expired and deleted", c)
+ }
+}
+
+func TestCleanupProcessedDryRun(t *testing.T) {
+ f := installFakeS3(t)
+ r := cleanupRun(f, time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC))
+ r.cfg.CleanupDryRun = true
+
+ if err := r.cleanupProcessed(); err != nil {
+  t.Fatal(err)
+ }
+ if len(f.deleteBatches) != 0 || len(f.keys(s3Bucket)) != 1502 {
+  t.Errorf("dry run deleted objects: batches %v", f.deleteBatches)
+ }
+ if c := r.report.Cleanup; c == nil || !c.DryRun || c.Expired != 1500 || c.Deleted != 0 {
+  t.Errorf("cleanup = %+v, want 1500 expired and none deleted", c)
+ }
+}
+
+func TestCleanupProcessedCap(t *testing.T) {
+ f := installFakeS3(t)
+ r := cleanupRun(f, time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC))
+ r.cfg.CleanupMaxDeletes = 3
+
+ if err := r.cleanupProcessed(); err != nil {
+  t.Fatal(err)
+ }
+ if want := []int{3}; !reflect.DeepEqual(f.deleteBatches, want) {
+  t.Errorf("delete batches = %v, want %v", f.deleteBatches, want)
+ }
+ if c := r.report.Cleanup; c == nil || c.Deleted != 3 || !c.CapReached {
+  t.Errorf("cleanup = %+v, want 3 deleted and the cap reached", c)
+ }
+}
+
+func TestCleanupOnlyAfterSuccessfulRun(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ now := time.Now()
+ t.Setenv("PROCESSED_RETENTION_DAYS", "30")
+ e.s3.put("processed/old.csv", "id\n").modified = now.AddDate(0, 0, -31)
+ e.s3.put("test-poc/orders.csv", "id\n")
+ e.server.failClose["/uploads/orders.csv"] = true
+
+ e.run("")
+ if e.s3.object(s3Bucket, "processed/old.csv") == nil {
+  t.Fatal("cleanup ran after a failed run")
+ }
+
+ e.server.mu.Lock()
+ delete(e.server.failClose, "/uploads/orders.csv")
+ e.server.mu.Unlock()
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if e.s3.object(s3Bucket, "processed/old.csv") != nil {
+  t.Error("expired object kept after a successful run")
+ }
+}
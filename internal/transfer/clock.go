@@ -0,0 +1,41 @@
+package transfer
+
+import "time"
+
+// clock is the source of time for a run: the decisions it makes from it
+// (age cutoffs, deadlines, expiries, retention, the secret cache TTL, the
+// date in name templates and the backoffs of every retry, notifications and
+// the S3 throttle limiter included) and the durations it measures for
+// reports and metrics. The connection pool, shared across runs, and the
+// keepalive, stall and hook timeouts, which must fire in real time, read the
+// wall clock directly.
+type clock interface {
+ Now() time.Time
+ Since(t time.Time) time.Duration
+ Sleep(d time.Duration)
+ // After is Sleep for waits that must also end with a context.
+ After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the clock of every invocation.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Since(t time.Time) time.Duration { return time.Since(t) }
+
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clockOverride, when set, is the clock of every run instead of the real
+// one, for tests.
+var clockOverride clock
+
+// runClock returns the clock runs use.
+func runClock() clock {
+ if clockOverride != nil {
+  return clockOverride
+ }
+ return realClock{}
+}
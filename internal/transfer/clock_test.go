@@ -0,0 +1,122 @@
+package transfer
+
+import (
+ "testing"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/schema"
+)
+
+func TestMinObjectAgeOnRunClock(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+ clk := installFakeClock(t, now)
+ t.Setenv("MIN_OBJECT_AGE", "10m")
+ t.Setenv("OBJECT_CLOCK_SKEW", "0s")
+ e.s3.put("test-poc/old.csv", "old\n").modified = now.Add(-11 * time.Minute)
+ e.s3.put("test-poc/new.csv", "new\n").modified = now.Add(-5 * time.Minute)
+
+ result, err := e.run("")
+ if err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if result.Transferred != 1 {
+  t.Fatalf("result = %+v, want only old.csv transferred", result)
+ }
+ e.wantFile("/uploads/old.csv", "old\n")
+ if e.server.exists("/uploads/new.csv") {
+  t.Fatal("new.csv delivered within MIN_OBJECT_AGE")
+ }
+
+ // Five minutes on the run's clock later new.csv is old enough.
+ clk.Advance(5 * time.Minute)
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("second run failed: %v", err)
+ }
+ e.wantFile("/uploads/new.csv", "new\n")
+}
+
+func TestPullMinAgeOnRunClock(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ clk := installFakeClock(t, time.Now())
+ t.Setenv("PULL_MODE", "true")
+ t.Setenv("PULL_MIN_AGE", "10m")
+ e.server.putFile("/uploads/inbound.csv", []byte("id\n"))
+
+ result, err := e.run("")
+ if err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if result.Transferred != 0 || len(e.s3.keys(s3Bucket)) != 0 {
+  t.Fatalf("result = %+v, want the file left for a later pull", result)
+ }
+
+ clk.Advance(11 * time.Minute)
+ if result, err = e.run(""); err != nil {
+  t.Fatalf("second run failed: %v", err)
+ }
+ if result.Transferred != 1 || e.s3.object(s3Bucket, config.DefaultPullPrefix+"inbound.csv") == nil {
+  t.Fatalf("result = %+v, keys %v, want inbound.csv pulled", result, e.s3.keys(s3Bucket))
+ }
+}
+
+func TestPullKeyTemplateOnRunClock(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ installFakeClock(t, time.Date(2024, 2, 29, 23, 59, 58, 0, time.UTC))
+ t.Setenv("PULL_MODE", "true")
+ t.Setenv("PULL_KEY_TEMPLATE", "inbound/{yyyy}/{mm}/{dd}/{hhmmss}-{filename}")
+ e.server.putFile("/uploads/orders.csv", []byte("id\n"))
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if o := e.s3.object(s3Bucket, "inbound/2024/02/29/235958-orders.csv"); o == nil {
+  t.Fatalf("keys = %v, want the key dated by the run's clock", e.s3.keys(s3Bucket))
+ }
+}
+
+func TestArchiveNameOnRunClock(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ installFakeClock(t, time.Date(2024, 12, 31, 8, 30, 0, 0, time.UTC))
+ t.Setenv("ARCHIVE_MODE", config.ArchiveTarGz)
+ t.Setenv("ARCHIVE_NAME", "batch_{yyyymmdd}_{hhmmss}.tar.gz")
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if !e.server.exists("/uploads/batch_20241231_083000.tar.gz") {
+  t.Fatal("archive not named by the run's clock")
+ }
+}
+
+func TestSecretCacheTTLOnRunClock(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ clk := installFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+ t.Setenv("SECRET_CACHE_TTL", "5m")
+ e.s3.put("test-poc/orders.csv", "id\n")
+ run := func() {
+  t.Helper()
+  if result, err := e.run(""); err != nil || result.Status != schema.StatusSucceeded {
+   t.Fatalf("run = %+v, %v", result, err)
+  }
+ }
+ calls := func() int {
+  e.secrets.mu.Lock()
+  defer e.secrets.mu.Unlock()
+  return e.secrets.calls
+ }
+
+ run()
+ clk.Advance(4 * time.Minute)
+ run()
+ if n := calls(); n != 1 {
+  t.Errorf("secret read %d times within SECRET_CACHE_TTL, want once", n)
+ }
+ clk.Advance(2 * time.Minute)
+ run()
+ if n := calls(); n != 2 {
+  t.Errorf("secret read %d times after SECRET_CACHE_TTL, want twice", n)
+ }
+}
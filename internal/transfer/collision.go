@@ -0,0 +1,133 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+ "path"
+ "strings"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// categoryPathCollision marks files, and the run error, refused because
+// another file of the run routes to the same remote path.
+const categoryPathCollision errorCategory = "path_collision"
+
+// maxCollisionSuffix bounds the sequence numbers tried for one file.
+const maxCollisionSuffix = 1000
+
+// avoidCollision returns remotePath, or a suffixed variant of it when another
+// file of this run already claimed that name or a file is already there on
+// the server. The name returned is claimed for the rest of the run. Names are
+// tried in a fixed order so the same inputs always get the same names.
+func (r *transferRun) avoidCollision(client sftpfs.FS, remotePath string, split bool) (string, error) {
+ if r.claimed == nil {
+  r.claimed = make(map[string]bool)
+ }
+ taken := func(p string) bool {
+  if r.claimed[p] {
+   return true
+  }
+  existing := p
+  if split {
+   existing += ".parts"
+  }
+  return r.remoteExists(client, existing)
+ }
+ claim := func(p string) (string, error) {
+  r.claimed[p] = true
+  return p, nil
+ }
+
+ if !taken(remotePath) {
+  return claim(remotePath)
+ }
+ base := remotePath
+ if r.cfg.CollisionSuffix == config.SuffixTimestamp {
+  base = insertSuffix(remotePath, "_"+r.report.StartedAt.UTC().Format("20060102T1504Z"))
+  if !taken(base) {
+   return claim(base)
+  }
+ }
+ for n := 2; n <= maxCollisionSuffix; n++ {
+  if candidate := insertSuffix(base, fmt.Sprintf("(%d)", n)); !taken(candidate) {
+   return claim(candidate)
+  }
+ }
+ return "", fmt.Errorf("no free name for %s after %d attempts", remotePath, maxCollisionSuffix)
+}
+
+// checkCollisions routes keys by name, without any remote call, and refuses
+// the run when two of them would land on the same remote path, listing every
+// colliding pair. Under OVERWRITE_POLICY=suffix the pairs are only logged, as
+// the later files will be renamed. Objects routed by sftp-destination
+// metadata are checked against the route their name gives; claimPath
+// catches what that misses when they are delivered.
+func (r *transferRun) checkCollisions(keys []string) error {
+ if r.cfg.PathCollisions == config.CollisionsAllow {
+  return nil
+ }
+ owners := make(map[string]string, len(keys))
+ var pairs []string
+ for _, key := range keys {
+  if isDirectory(key) {
+   continue
+  }
+  // Routing errors are reported per file when it is delivered.
+  rt, err := r.route(&deliveryItem{key: key, name: r.remoteName(key)})
+  if err != nil || rt.skip {
+   continue
+  }
+  if first, ok := owners[rt.path]; ok {
+   pairs = append(pairs, fmt.Sprintf("%s and %s -> %s", first, key, rt.path))
+   continue
+  }
+  owners[rt.path] = key
+ }
+ if len(pairs) == 0 {
+  return nil
+ }
+ if r.cfg.OverwritePolicy == config.OverwriteSuffix {
+  log.Printf("%d remote path collision(s), the later files will be renamed: %s", len(pairs), strings.Join(pairs, "; "))
+  return nil
+ }
+ r.metrics.add("PathCollisions", unitCount, float64(len(pairs)))
+ for _, pair := range pairs {
+  log.Printf("Remote path collision: %s", pair)
+ }
+ return withCategory(categoryPathCollision, fmt.Errorf(
+  "%d remote path collision(s), first %s: set REMOTE_LAYOUT=preserve, OVERWRITE_POLICY=suffix or PATH_COLLISIONS=allow",
+  len(pairs), pairs[0]))
+}
+
+// claimPath records that label is delivered to remotePath, refusing it under
+// PATH_COLLISIONS=fail when another file of the run already was.
+func (r *transferRun) claimPath(remotePath, label string) error {
+ if r.cfg.PathCollisions == config.CollisionsAllow {
+  return nil
+ }
+ if r.routed == nil {
+  r.routed = make(map[string]string)
+ }
+ if other, ok := r.routed[remotePath]; ok && other != label {
+  return withCategory(categoryPathCollision, fmt.Errorf("%s routes to %s, already delivered from %s", label, remotePath, other))
+ }
+ r.routed[remotePath] = label
+ return nil
+}
+
+// insertSuffix adds suffix to the file name in p before its extension, which
+// starts at the first dot so that "report.csv.gz" becomes
+// "report<suffix>.csv.gz". A leading dot is part of the name.
+func insertSuffix(p, suffix string) string {
+ dir, name := path.Split(p)
+ if name == "" {
+  return p + suffix
+ }
+ i := strings.Index(name[1:], ".") + 1
+ if i == 0 {
+  return dir + name + suffix
+ }
+ return dir + name[:i] + suffix + name[i:]
+}
@@ -0,0 +1,265 @@
+package transfer
+
+import (
+ "bytes"
+ "crypto/sha256"
+ "encoding/hex"
+ "encoding/json"
+ "errors"
+ "fmt"
+ "io"
+ "log"
+ "os"
+ "sort"
+ "time"
+
+ "github.com/pkg/sftp"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// categoryConcatState marks a concatenated file that no longer matches the
+// state recorded for it, so appending to it could corrupt it.
+const categoryConcatState errorCategory = "concat_state_mismatch"
+
+// concatState records what has been appended to one concatenated remote
+// file. Size is the last good offset: anything past it was left by a failed
+// append and is truncated before the next one.
+type concatState struct {
+ RemotePath string         `json:"remotePath"`
+ Size       int64          `json:"size"`
+ Members    []concatMember `json:"members"`
+ UpdatedAt  time.Time      `json:"updatedAt"`
+}
+
+// concatMember is one object appended to the concatenated file. Offset is
+// where it starts, including the delimiter written before it, and Bytes
+// counts the delimiter and the content.
+type concatMember struct {
+ Key    string `json:"key"`
+ ETag   string `json:"etag,omitempty"`
+ Offset int64  `json:"offset"`
+ Bytes  int64  `json:"bytes"`
+}
+
+// concatReport summarizes the file appended to in concatenate mode.
+// Members lists only the objects appended by this run.
+type concatReport struct {
+ RemotePath    string         `json:"remotePath"`
+ StartOffset   int64          `json:"startOffset"`
+ Size          int64          `json:"size"`
+ TruncatedFrom int64          `json:"truncatedFrom,omitempty"`
+ Previous      int            `json:"previousMembers"`
+ Members       []concatMember `json:"members"`
+}
+
+// transferConcat appends every key, in CONCATENATE_ORDER, to the single remote
+// file named by CONCATENATE_NAME, one object at a time. The state saved after
+// each object lets the next run skip what was already appended and truncate
+// whatever a failed append left behind.
+func (r *transferRun) transferConcat(client sftpfs.FS, keys []string) error {
+ name := renderNameTemplate(r.cfg.ConcatenateName, r.clock.Now().UTC())
+ dir := r.resolveRemotePath(r.cfg.RemoteDir)
+ remotePath := remoteJoin(dir, name)
+ summary := &concatReport{RemotePath: remotePath}
+ r.report.Concatenate = summary
+
+ if err := r.ensureRemoteDir(client, dir); err != nil {
+  return err
+ }
+ st, err := r.loadConcatState(remotePath)
+ if err != nil {
+  return err
+ }
+ var size int64
+ info, err := client.Stat(remotePath)
+ switch {
+ case err == nil:
+  size = info.Size()
+ case !errors.Is(err, os.ErrNotExist):
+  return fmt.Errorf("failed to stat remote file %s: %w", remotePath, err)
+ }
+ if st == nil {
+  st = &concatState{RemotePath: remotePath, Size: size}
+  if size > 0 {
+   log.Printf("Appending after the %d bytes already in %s", size, remotePath)
+  }
+ } else if size < st.Size {
+  return withCategory(categoryConcatState, fmt.Errorf("remote file %s has %d bytes, fewer than the %d already appended to it",
+   remotePath, size, st.Size))
+ }
+ summary.StartOffset = st.Size
+ summary.Previous = len(st.Members)
+ release, err := r.inflight.acquire("appending to "+remotePath, r.cfg.CopyBufferBytes())
+ if err != nil {
+  return err
+ }
+ defer release()
+
+ f, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+ if err != nil {
+  log.Printf("Failed to open remote file: %v", err)
+  return fmt.Errorf("failed to open remote file %s: %w", remotePath, err)
+ }
+ defer f.Close()
+ if size > st.Size {
+  log.Printf("Truncating %s from %d to %d bytes, the end of the last complete append", remotePath, size, st.Size)
+  if err := f.Truncate(st.Size); err != nil {
+   return fmt.Errorf("failed to truncate remote file %s: %w", remotePath, err)
+  }
+  summary.TruncatedFrom = size
+ }
+
+ appended := make(map[string]string, len(st.Members))
+ for _, m := range st.Members {
+  appended[m.Key] = m.ETag
+ }
+ r.sortConcatKeys(keys)
+ keys = r.planByteCap(keys)
+
+ start := r.clock.Now()
+ for i, key := range keys {
+  if etag, ok := appended[key]; ok {
+   r.cfg.Debugf("Skipping %s: already appended to %s", key, remotePath)
+   r.report.addFile(fileReport{Key: key, ETag: etag, RemotePath: remotePath, Status: statusSkipped, Error: "already appended"})
+   continue
+  }
+  if i > 0 && r.pastDeadline() {
+   r.deferRemaining(keys[i:], keys[i-1], "Invocation deadline reached")
+   break
+  }
+  m, err := r.appendConcatMember(f, key, st.Size)
+  entry := fileReport{Key: key, ETag: m.ETag, RemotePath: remotePath, Bytes: m.Bytes, Status: statusTransferred}
+  if err != nil {
+   // Cut the failed append off now; should that fail too, the
+   // next run truncates to the saved size before appending.
+   if terr := f.Truncate(st.Size); terr != nil {
+    log.Printf("Failed to truncate %s back to %d bytes: %v", remotePath, st.Size, terr)
+   }
+   entry.Status = statusFailed
+   entry.Error = err.Error()
+   r.report.addFile(entry)
+   log.Printf("Failed to append %s to %s: %v", key, remotePath, err)
+   return fmt.Errorf("failed to append %s: %w", key, err)
+  }
+  r.report.addFile(entry)
+  st.Members = append(st.Members, m)
+  st.Size += m.Bytes
+  summary.Members = append(summary.Members, m)
+  r.stats.BytesSent += m.Bytes
+  // Losing the state only costs re-appending: the next run
+  // truncates back to the last saved size.
+  if err := r.saveConcatState(st); err != nil {
+   log.Printf("WARNING: %v", err)
+  }
+ }
+ summary.Size = st.Size
+
+ opts, err := r.writeOptions(client, nil)
+ if err != nil {
+  return err
+ }
+ if opts.fsync {
+  if err := f.Sync(); err != nil {
+   return fmt.Errorf("failed to fsync remote file %s: %w", remotePath, err)
+  }
+ }
+ if err := f.Close(); err != nil {
+  return fmt.Errorf("failed to close remote file %s: %w", remotePath, err)
+ }
+
+ elapsed := r.clock.Since(start)
+ r.metrics.addDuration("TransferDuration", elapsed)
+ r.metrics.add("BytesTransferred", unitBytes, float64(st.Size-summary.StartOffset))
+ log.Printf("Appended %d object(s) to %s offset=%d size=%d duration_ms=%d",
+  len(summary.Members), remotePath, summary.StartOffset, summary.Size, elapsed.Milliseconds())
+ return nil
+}
+
+// appendConcatMember writes key at offset, preceded by CONCATENATE_DELIMITER
+// unless it is the first thing in the file.
+func (r *transferRun) appendConcatMember(f *sftp.File, key string, offset int64) (concatMember, error) {
+ m := concatMember{Key: key, Offset: offset}
+ out, err := r.s3.Get(source.GetInput{Bucket: s3Bucket, Key: key})
+ if err != nil {
+  return m, classifyS3Error(fmt.Errorf("failed to get S3 object: %w", err))
+ }
+ defer out.Body.Close()
+ m.ETag = out.ETag
+
+ // Seek as well as append, so servers that honour either one write
+ // at the same place.
+ if _, err := f.Seek(offset, io.SeekStart); err != nil {
+  return m, fmt.Errorf("failed to seek remote file: %w", err)
+ }
+ counter := &countingWriter{w: f}
+ if offset > 0 && r.cfg.ConcatenateDelimiter != "" {
+  if _, err := io.WriteString(counter, r.cfg.ConcatenateDelimiter); err != nil {
+   m.Bytes = counter.n
+   return m, fmt.Errorf("failed to copy file to remote: %w", err)
+  }
+ }
+ _, err = io.Copy(counter, out.Body)
+ m.Bytes = counter.n
+ if err != nil {
+  return m, fmt.Errorf("failed to copy file to remote: %w", err)
+ }
+ return m, nil
+}
+
+// sortConcatKeys orders keys for concatenation: by key, or by last modified
+// time with ties broken by key, so every run appends in the same order.
+func (r *transferRun) sortConcatKeys(keys []string) {
+ sort.SliceStable(keys, func(i, j int) bool {
+  if r.cfg.ConcatenateOrder == config.ConcatOrderLastModified {
+   if a, b := r.modified[keys[i]], r.modified[keys[j]]; !a.Equal(b) {
+    return a.Before(b)
+   }
+  }
+  return keys[i] < keys[j]
+ })
+}
+
+func (r *transferRun) concatStateKey(remotePath string) string {
+ sum := sha256.Sum256([]byte(remotePath))
+ return r.cfg.ConcatenateStatePrefix + r.cfg.DestinationName + "/" + hex.EncodeToString(sum[:]) + ".json"
+}
+
+// loadConcatState returns the saved state for remotePath, or nil when there
+// is none.
+func (r *transferRun) loadConcatState(remotePath string) (*concatState, error) {
+ out, err := r.s3.Get(source.GetInput{Bucket: s3Bucket, Key: r.concatStateKey(remotePath)})
+ if err != nil {
+  if source.IsNotFound(err) {
+   return nil, nil
+  }
+  return nil, classifyS3Error(fmt.Errorf("failed to read concatenate state: %w", err))
+ }
+ defer out.Body.Close()
+ st := &concatState{}
+ if err := json.NewDecoder(out.Body).Decode(st); err != nil {
+  return nil, withCategory(categoryConcatState, fmt.Errorf("failed to decode concatenate state for %s: %w", remotePath, err))
+ }
+ log.Printf("Continuing %s at byte %d after %d appended object(s)", remotePath, st.Size, len(st.Members))
+ return st, nil
+}
+
+func (r *transferRun) saveConcatState(st *concatState) error {
+ st.UpdatedAt = r.clock.Now().UTC()
+ body, err := json.Marshal(st)
+ if err != nil {
+  return fmt.Errorf("failed to marshal concatenate state: %w", err)
+ }
+ err = r.s3.Put(source.PutInput{
+  Bucket:      s3Bucket,
+  Key:         r.concatStateKey(st.RemotePath),
+  Body:        bytes.NewReader(body),
+  ContentType: "application/json",
+ })
+ if err != nil {
+  return classifyS3Error(fmt.Errorf("failed to write concatenate state: %w", err))
+ }
+ return nil
+}
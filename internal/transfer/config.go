@@ -0,0 +1,16 @@
+package transfer
+
+import "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+
+// Config and SFTPConfig are the run and destination settings resolved by
+// internal/config.
+type (
+ Config     = config.Config
+ SFTPConfig = config.SFTPConfig
+)
+
+const (
+ s3Bucket       = config.S3Bucket
+ s3FolderPrefix = config.S3FolderPrefix
+ secretName     = config.SecretName
+)
@@ -0,0 +1,49 @@
+package transfer
+
+import (
+ "strings"
+ "testing"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+func TestRemoteOwnerIDs(t *testing.T) {
+ tests := []struct {
+  value   string
+  want    int
+  wantErr bool
+ }{
+  {"", -1, false},
+  {"-1", -1, false},
+  {"0", 0, false},
+  {"1001", 1001, false},
+  {"4294967294", 4294967294, false},
+  {"-2", 0, true},
+  {"4294967296", 0, true},
+  {"root", 0, true},
+ }
+ for _, name := range []string{"REMOTE_UID", "REMOTE_GID"} {
+  for _, tt := range tests {
+   t.Run(name+"="+tt.value, func(t *testing.T) {
+    t.Setenv(name, tt.value)
+    cfg, err := config.Load()
+    if tt.wantErr {
+     if err == nil || !strings.Contains(err.Error(), "invalid "+name) {
+      t.Fatalf("err = %v, want %s rejected", err, name)
+     }
+     return
+    }
+    if err != nil {
+     t.Fatal(err)
+    }
+    got := cfg.RemoteUID
+    if name == "REMOTE_GID" {
+     got = cfg.RemoteGID
+    }
+    if got != tt.want {
+     t.Errorf("%s = %d, want %d", name, got, tt.want)
+    }
+   })
+  }
+ }
+}
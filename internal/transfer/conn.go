@@ -0,0 +1,177 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+ "sync"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// connPool holds the connections kept open between invocations of a warm
+// Lambda environment, at most POOL_SIZE of them, keyed by the secret they
+// were opened with. Lambda freezes the environment between invocations, so
+// instead of a background reaper every limit is checked lazily when a
+// connection is acquired.
+var connPool struct {
+ mu      sync.Mutex
+ entries []*pooledConn
+}
+
+type pooledConn struct {
+ conn       *sftpfs.Conn
+ secretName string
+ version    string
+ lastUsed   time.Time
+ inUse      bool
+}
+
+// poolEvents counts what happened to the pool while acquiring a connection.
+type poolEvents struct {
+ reused    bool
+ redialed  bool
+ evictions int
+}
+
+// expired returns why p should no longer be handed out, or "" if it may
+// be reused.
+func (p *pooledConn) expired(cfg *Config, now time.Time) string {
+ switch {
+ case cfg.ConnMaxLifetime > 0 && now.Sub(p.conn.CreatedAt) > cfg.ConnMaxLifetime:
+  return fmt.Sprintf("exceeded max lifetime of %s", cfg.ConnMaxLifetime)
+ case cfg.ConnMaxIdle > 0 && now.Sub(p.lastUsed) > cfg.ConnMaxIdle:
+  return fmt.Sprintf("idle for longer than %s", cfg.ConnMaxIdle)
+ }
+ return ""
+}
+
+// evictLocked closes and removes the pool entry at index i.
+func evictLocked(i int) {
+ connPool.entries[i].conn.Close()
+ connPool.entries = append(connPool.entries[:i], connPool.entries[i+1:]...)
+}
+
+// evict closes and removes p, if it is still in the pool.
+func evict(p *pooledConn) {
+ connPool.mu.Lock()
+ defer connPool.mu.Unlock()
+ for i, e := range connPool.entries {
+  if e == p {
+   evictLocked(i)
+   return
+  }
+ }
+}
+
+// acquireConnection returns a live connection for sftpConfig, reusing a
+// pooled one when it was opened with the same secret and version, is younger
+// than CONN_MAX_LIFETIME, was last used within CONN_MAX_IDLE and still
+// answers. The returned release function must be called when the run is done
+// with the connection; passing broken=true discards the connection instead of
+// keeping it for the next invocation.
+//
+// The pool is only locked to pick a connection and to add one: the liveness
+// check and the dial, which can each take seconds, run unlocked so they do
+// not hold up acquiring connections to other destinations. The connection
+// being checked is marked in use meanwhile, so no one else takes it.
+func acquireConnection(cfg *Config, sftpConfig *SFTPConfig) (*sftpfs.Conn, poolEvents, func(broken bool), error) {
+ var events poolEvents
+ connPool.mu.Lock()
+ now := time.Now()
+ for i := 0; i < len(connPool.entries); i++ {
+  p := connPool.entries[i]
+  if p.inUse {
+   continue
+  }
+  if reason := p.expired(cfg, now); reason != "" {
+   cfg.Debugf("Evicting pooled SFTP connection to %s: %s", p.conn.Timing.Address, reason)
+   evictLocked(i)
+   events.evictions++
+   i--
+  }
+ }
+
+ var candidate *pooledConn
+ for _, p := range connPool.entries {
+  if !p.inUse && p.secretName == sftpConfig.SecretName {
+   candidate = p
+   candidate.inUse = true
+   break
+  }
+ }
+ connPool.mu.Unlock()
+
+ if candidate != nil {
+  switch {
+  case candidate.version != sftpConfig.Version:
+   log.Println("Secret version changed, closing pooled SFTP connection")
+  case !candidate.conn.Alive():
+   log.Println("Pooled SFTP connection failed liveness check, re-dialing")
+  default:
+   log.Printf("Reusing pooled SFTP connection to %s", candidate.conn.Timing.Address)
+   events.reused = true
+   return candidate.conn, events, releaseFunc(candidate), nil
+  }
+  evict(candidate)
+  events.evictions++
+  events.redialed = true
+ }
+
+ c, err := sftpfs.Dial(cfg, sftpConfig)
+ if err != nil {
+  return nil, events, nil, err
+ }
+
+ connPool.mu.Lock()
+ defer connPool.mu.Unlock()
+ // Make room by closing the least recently used idle connections.
+ for len(connPool.entries) >= cfg.PoolSize {
+  lru := -1
+  for i, p := range connPool.entries {
+   if !p.inUse && (lru < 0 || p.lastUsed.Before(connPool.entries[lru].lastUsed)) {
+    lru = i
+   }
+  }
+  if lru < 0 {
+   break
+  }
+  cfg.Debugf("Evicting least recently used SFTP connection to %s, pool full", connPool.entries[lru].conn.Timing.Address)
+  evictLocked(lru)
+  events.evictions++
+ }
+ p := &pooledConn{conn: c, secretName: sftpConfig.SecretName, version: sftpConfig.Version, inUse: true}
+ connPool.entries = append(connPool.entries, p)
+ cfg.Debugf("Pooled SFTP connection to %s size=%d/%d", c.Timing.Address, len(connPool.entries), cfg.PoolSize)
+ return c, events, releaseFunc(p), nil
+}
+
+// releaseFunc returns the function handing p back to the pool.
+func releaseFunc(p *pooledConn) func(broken bool) {
+ return func(broken bool) {
+  connPool.mu.Lock()
+  defer connPool.mu.Unlock()
+  p.inUse = false
+  p.lastUsed = time.Now()
+  if !broken {
+   return
+  }
+  for i, e := range connPool.entries {
+   if e == p {
+    log.Println("Discarding pooled SFTP connection")
+    evictLocked(i)
+    return
+   }
+  }
+ }
+}
+
+func recordConnection(t sftpfs.Timing, report *transferReport, m *metrics) {
+ report.addConnection(t)
+ m.add("DialLatency", unitMilliseconds, float64(t.DialMs))
+ m.add("HandshakeLatency", unitMilliseconds, float64(t.HandshakeMs))
+ m.add("SFTPInitLatency", unitMilliseconds, float64(t.SFTPInitMs))
+ m.add("ConnectLatency", unitMilliseconds, float64(t.TotalMs))
+ m.add("EndpointIndex", unitNone, float64(t.EndpointIndex))
+ m.add("MaxPacketBytes", unitBytes, float64(t.MaxPacketBytes))
+}
@@ -0,0 +1,129 @@
+package transfer
+
+import (
+ "strings"
+ "testing"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+func TestAcquireDoesNotWaitForOtherLivenessChecks(t *testing.T) {
+ resetWarmState(t)
+ t.Setenv("POOL_SIZE", "2")
+ cfg := testConfig(t)
+ stalled, other := startSFTPServer(t, testServerConfig{}), startSFTPServer(t, testServerConfig{})
+ stalledConfig, otherConfig := stalled.sftpConfig(), other.sftpConfig()
+ stalledConfig.SecretName, otherConfig.SecretName = "stalled", "other"
+ for _, c := range []*SFTPConfig{stalledConfig, otherConfig} {
+  _, _, release, err := acquireConnection(cfg, c)
+  if err != nil {
+   t.Fatal(err)
+  }
+  release(false)
+ }
+
+ // The pooled connection to the stalled server hangs in its liveness
+ // check, which must not keep the other one from being handed out.
+ unstall := make(chan struct{})
+ stalled.mu.Lock()
+ stalled.stall = unstall
+ stalled.mu.Unlock()
+ checked := make(chan poolEvents)
+ go func() {
+  _, events, release, err := acquireConnection(cfg, stalledConfig)
+  if err == nil {
+   release(false)
+  }
+  checked <- events
+ }()
+ time.Sleep(100 * time.Millisecond)
+
+ acquired := make(chan poolEvents)
+ go func() {
+  _, events, release, err := acquireConnection(cfg, otherConfig)
+  if err == nil {
+   release(false)
+  }
+  acquired <- events
+ }()
+ select {
+ case events := <-acquired:
+  if !events.reused {
+   t.Error("the other connection was not reused")
+  }
+ case <-time.After(time.Second):
+  t.Error("acquiring the other connection waited for the stalled liveness check")
+  close(unstall)
+  <-acquired
+  <-checked
+  return
+ }
+ close(unstall)
+ if events := <-checked; !events.reused {
+  t.Error("the stalled connection was not reused once it answered")
+ }
+}
+
+func TestAcquireSkipsConnectionBeingChecked(t *testing.T) {
+ resetWarmState(t)
+ t.Setenv("POOL_SIZE", "2")
+ cfg := testConfig(t)
+ s := startSFTPServer(t, testServerConfig{})
+ _, _, release, err := acquireConnection(cfg, s.sftpConfig())
+ if err != nil {
+  t.Fatal(err)
+ }
+ release(false)
+
+ // While the pooled connection is being checked, a second run of the
+ // same secret dials its own instead of sharing it.
+ unstall := make(chan struct{})
+ s.mu.Lock()
+ s.stall = unstall
+ s.mu.Unlock()
+ first := make(chan *sftpfs.Conn)
+ go func() {
+  c, _, release, err := acquireConnection(cfg, s.sftpConfig())
+  if err != nil {
+   first <- nil
+   return
+  }
+  release(false)
+  first <- c
+ }()
+ time.Sleep(100 * time.Millisecond)
+ s.mu.Lock()
+ s.stall = nil
+ s.mu.Unlock()
+
+ c, events, release, err := acquireConnection(cfg, s.sftpConfig())
+ if err != nil {
+  t.Fatal(err)
+ }
+ release(false)
+ close(unstall)
+ if events.reused {
+  t.Error("second acquire reused the connection being checked")
+ }
+ if got := <-first; got == nil || got == c {
+  t.Errorf("both acquires got the same connection")
+ }
+}
+
+func TestSSHCompressionIsReportedUnsupported(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ t.Setenv("SSH_COMPRESSION", "true")
+ e.s3.put("test-poc/orders.csv", "id\n")
+ out := captureLog(t)
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ e.wantFile("/uploads/orders.csv", "id\n")
+ for _, want := range []string{"compression=none", "SSH_COMPRESSION is not supported", "ARCHIVE_MODE=tar.gz"} {
+  if !strings.Contains(out.String(), want) {
+   t.Errorf("log does not say %q", want)
+  }
+ }
+}
@@ -0,0 +1,82 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+ "strings"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// categoryControlHeld marks control files held back because a data file
+// they announce was not delivered.
+const categoryControlHeld errorCategory = "control_held"
+
+// controlBase returns key without its CONTROL_FILE_SUFFIXES suffix, and
+// whether key is a control file at all.
+func (r *transferRun) controlBase(key string) (string, bool) {
+ lower := strings.ToLower(key)
+ for _, suffix := range r.cfg.ControlFileSuffixes {
+  if strings.HasSuffix(lower, suffix) && len(key) > len(suffix) {
+   return key[:len(key)-len(suffix)], true
+  }
+ }
+ return "", false
+}
+
+// orderControlFiles moves control files after every data file, keeping the
+// listing order within each, so a partner polling for the control file
+// never sees it before its data.
+func (r *transferRun) orderControlFiles(keys []string) []string {
+ if len(r.cfg.ControlFileSuffixes) == 0 {
+  return keys
+ }
+ ordered := make([]string, 0, len(keys))
+ var control []string
+ for _, key := range keys {
+  if _, ok := r.controlBase(key); ok {
+   control = append(control, key)
+  } else {
+   ordered = append(ordered, key)
+  }
+ }
+ return append(ordered, control...)
+}
+
+// controlBlocker returns a data file that control file key announces and that
+// was not delivered, or "" when key can be sent. Under CONTROL_FILE_SCOPE=name
+// a control file announces the data files sharing its base name, such as
+// INVOICE_123.csv for INVOICE_123.ctl; under batch it announces every data
+// file of the run.
+func (r *transferRun) controlBlocker(key string, keys []string, delivered map[string]bool) string {
+ base, ok := r.controlBase(key)
+ if !ok {
+  return ""
+ }
+ for _, k := range keys {
+  if delivered[k] || isDirectory(k) {
+   continue
+  }
+  if _, control := r.controlBase(k); control {
+   continue
+  }
+  if r.cfg.ControlFileScope == config.ControlScopeBatch || k == base || strings.HasPrefix(k, base+".") {
+   return k
+  }
+ }
+ return ""
+}
+
+// holdControl records control file key as deferred because blocker was not
+// delivered. It is not treated as done by the listing checkpoint, so the
+// next run sends it once its data has arrived.
+func (r *transferRun) holdControl(key, blocker string) {
+ r.metrics.add("ControlFilesHeld", unitCount, 1)
+ r.report.addFile(fileReport{
+  Key:      key,
+  Status:   statusDeferred,
+  Category: string(categoryControlHeld),
+  Error:    fmt.Sprintf("held back: data file %s was not delivered", blocker),
+ })
+ log.Printf("Holding back control file %s: data file %s was not delivered", key, blocker)
+}
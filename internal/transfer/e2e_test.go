@@ -0,0 +1,258 @@
+package transfer
+
+import (
+ "context"
+ "encoding/json"
+ "strings"
+ "testing"
+ "time"
+
+ "github.com/aws/aws-lambda-go/lambdacontext"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/testutil"
+ "github.com/vishalk7890/s3-sftp-lambda/schema"
+)
+
+// testEnv runs the handler against a test SFTP server, with S3 and Secrets
+// Manager served from memory.
+type testEnv struct {
+ t       *testing.T
+ server  *testSFTPServer
+ s3      *fakeS3
+ secrets *fakeSecretsManager
+ // secret holds the fields of the secret the handler reads.
+ secret map[string]any
+}
+
+// newTestEnv starts a test server with cfg and stores a secret for it that
+// pins its host key and logs in with the password "secret".
+func newTestEnv(t *testing.T, cfg testServerConfig) *testEnv {
+ t.Helper()
+ resetWarmState(t)
+ e := &testEnv{
+  t:       t,
+  server:  startSFTPServer(t, cfg),
+  s3:      installFakeS3(t),
+  secrets: installFakeSecretsManager(t),
+ }
+ e.secret = map[string]any{
+  "sftpHost":     e.server.host,
+  "sftpPort":     e.server.port,
+  "sftpUsername": "partner",
+  "sftpPassword": "secret",
+  "sftpHostKeys": map[string]string{e.server.host: e.server.fingerprint()},
+ }
+ e.saveSecret()
+ return e
+}
+
+// saveSecret stores e.secret, and drops any cached copy of it.
+func (e *testEnv) saveSecret() {
+ e.t.Helper()
+ value, err := json.Marshal(e.secret)
+ if err != nil {
+  e.t.Fatal(err)
+ }
+ e.secrets.set(secretName, string(value))
+ secretCache.mu.Lock()
+ delete(secretCache.entries, secretName)
+ secretCache.mu.Unlock()
+}
+
+// run invokes the handler with payload, "" for none.
+func (e *testEnv) run(payload string) (*schema.ResultV1, error) {
+ ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "test-request"})
+ if payload == "" {
+  payload = "{}"
+ }
+ return lambdaHandler(ctx, json.RawMessage(payload))
+}
+
+// testRun returns a run of cfg reading from the fake S3 f, for tests of the
+// steps of a run below the handler.
+func testRun(cfg *Config, f *fakeS3) *transferRun {
+ return &transferRun{
+  cfg:     cfg,
+  s3:      f,
+  clock:   realClock{},
+  report:  newTransferReport("test-request"),
+  metrics: newMetrics(),
+  listing: newRemoteListing(cfg, realClock{}),
+ }
+}
+
+// installFakeClock makes the returned clock, reading now, the clock of every
+// run until the end of the test.
+func installFakeClock(t *testing.T, now time.Time) *testutil.Clock {
+ clk := testutil.NewClock(now)
+ clockOverride = clk
+ t.Cleanup(func() { clockOverride = nil })
+ return clk
+}
+
+// resetWarmState clears what warm invocations keep between runs, before the
+// test and again after it.
+func resetWarmState(t *testing.T) {
+ reset := func() {
+  connPool.mu.Lock()
+  for len(connPool.entries) > 0 {
+   evictLocked(0)
+  }
+  connPool.mu.Unlock()
+  secretCache.mu.Lock()
+  secretCache.entries = make(map[string]*cachedSecret)
+  secretCache.mu.Unlock()
+ }
+ reset()
+ t.Cleanup(reset)
+}
+
+func (e *testEnv) wantFile(p, content string) {
+ e.t.Helper()
+ got, ok := e.server.file(p)
+ if !ok {
+  e.t.Fatalf("%s was not delivered", p)
+ }
+ if string(got) != content {
+  e.t.Fatalf("%s = %q, want %q", p, got, content)
+ }
+}
+
+func TestHandlerDeliversPrefix(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ e.s3.put("test-poc/orders.csv", "id,total\n1,10\n")
+ e.s3.put("test-poc/2024/summary.txt", "all good\n")
+
+ result, err := e.run("")
+ if err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if result.Status != schema.StatusSucceeded || result.Transferred != 2 || result.Failed != 0 {
+  t.Fatalf("result = %+v, want 2 files transferred", result)
+ }
+ if result.Bytes != int64(len("id,total\n1,10\n")+len("all good\n")) {
+  t.Errorf("result.Bytes = %d", result.Bytes)
+ }
+ e.wantFile("/uploads/orders.csv", "id,total\n1,10\n")
+ e.wantFile("/uploads/summary.txt", "all good\n")
+}
+
+func TestHandlerMkdirFailure(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ e.s3.put("test-poc/orders.csv", "id\n")
+ t.Setenv("REMOTE_DIR", "/uploads/inbound")
+ e.server.mkdirAll("/uploads")
+ e.server.failMkdir["/uploads/inbound"] = true
+
+ result, err := e.run("")
+ if err == nil {
+  t.Fatal("run succeeded with the remote directory failing to be created")
+ }
+ if result != nil && result.Transferred != 0 {
+  t.Errorf("result = %+v, want nothing transferred", result)
+ }
+ if _, ok := e.server.file("/uploads/inbound/orders.csv"); ok {
+  t.Error("file delivered although its directory could not be created")
+ }
+}
+
+func TestHandlerAuthFailure(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ e.s3.put("test-poc/orders.csv", "id\n")
+ e.secret["sftpPassword"] = "wrong"
+ e.saveSecret()
+
+ _, err := e.run("")
+ if err == nil {
+  t.Fatal("run succeeded with a wrong password")
+ }
+ if got := categoryOf(err); got != categoryAuth {
+  t.Errorf("category = %s, want %s (%v)", got, categoryAuth, err)
+ }
+ if logins, _ := e.server.accepted(); logins != 0 {
+  t.Errorf("server accepted %d login(s)", logins)
+ }
+}
+
+func TestHandlerDisconnectMidCopy(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ e.s3.put("test-poc/large.bin", strings.Repeat("x", 1<<20))
+ e.server.dropAfter = 256 << 10
+
+ result, err := e.run("")
+ if err == nil {
+  t.Fatal("run succeeded although the connection dropped mid-copy")
+ }
+ if result != nil && (result.Transferred != 0 || result.Failed != 1) {
+  t.Errorf("result = %+v, want the file failed", result)
+ }
+ if got, ok := e.server.file("/uploads/large.bin"); ok && len(got) == 1<<20 {
+  t.Error("file complete on the server although the connection dropped")
+ }
+
+ // Once the server is back, the next run delivers the file over a new
+ // connection rather than the broken pooled one.
+ e.server.mu.Lock()
+ e.server.dropAfter = 0
+ e.server.mu.Unlock()
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("second run failed: %v", err)
+ }
+ e.wantFile("/uploads/large.bin", strings.Repeat("x", 1<<20))
+}
+
+func TestHandlerSkipsExisting(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ t.Setenv("OVERWRITE_POLICY", "skip")
+ e.s3.put("test-poc/orders.csv", "new\n")
+ e.s3.put("test-poc/fresh.csv", "fresh\n")
+ e.server.putFile("/uploads/orders.csv", []byte("old\n"))
+
+ result, err := e.run("")
+ if err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if result.Transferred != 1 || result.Skipped != 1 {
+  t.Fatalf("result = %+v, want 1 transferred and 1 skipped", result)
+ }
+ e.wantFile("/uploads/orders.csv", "old\n")
+ e.wantFile("/uploads/fresh.csv", "fresh\n")
+}
+
+func TestHandlerCloseFailure(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ e.s3.put("test-poc/orders.csv", "id\n")
+ e.server.failClose["/uploads/orders.csv"] = true
+
+ result, err := e.run("")
+ if err == nil {
+  t.Fatal("run succeeded although the server failed to close the file")
+ }
+ if result != nil && (result.Transferred != 0 || result.Failed != 1) {
+  t.Errorf("result = %+v, want the file failed", result)
+ }
+}
+
+func TestHandlerInvalidSecret(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ e.s3.put("test-poc/orders.csv", "id\n")
+ delete(e.secret, "sftpUsername")
+ delete(e.secret, "sftpPassword")
+ e.saveSecret()
+
+ _, err := e.run("")
+ if err == nil {
+  t.Fatal("run succeeded with an invalid secret")
+ }
+ if got := categoryOf(err); got != categoryConfig {
+  t.Errorf("category = %s, want %s (%v)", got, categoryConfig, err)
+ }
+ for _, want := range []string{"sftpUsername is empty", "neither sftpPassword nor sftpPrivateKey is set"} {
+  if !strings.Contains(err.Error(), want) {
+   t.Errorf("error %q does not say %q", err, want)
+  }
+ }
+ if logins, methods := e.server.accepted(); logins != 0 || len(methods) != 0 {
+  t.Errorf("server saw %d login(s) with %v, want the run to stop before dialing", logins, methods)
+ }
+}
@@ -0,0 +1,39 @@
+package transfer
+
+import (
+ "encoding/json"
+ "log"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// logEffectiveConfig logs the environment, payload and secret settings the
+// run uses. sftpConfig is nil when no secret was read, as for tenant runs,
+// which read one per tenant.
+func (r *transferRun) logEffectiveConfig(sftpConfig *SFTPConfig) {
+ rec := config.EffectiveConfigRecord{
+  Type:      "effective_config",
+  RequestID: r.report.RequestID,
+  Knobs:     make(map[string]config.Knob, len(r.cfg.EnvKnobs())),
+ }
+ for name, k := range r.cfg.EnvKnobs() {
+  rec.Knobs[name] = k
+ }
+ if r.payload != nil {
+  for name, k := range r.payload.Knobs() {
+   rec.Knobs[name] = k
+  }
+ }
+ if sftpConfig != nil {
+  rec.Secret = sftpConfig.SecretName
+  for name, k := range config.SecretKnobs(sftpConfig) {
+   rec.Knobs[name] = k
+  }
+ }
+ line, err := json.Marshal(rec)
+ if err != nil {
+  log.Printf("Failed to encode the effective configuration: %v", err)
+  return
+ }
+ log.Println(string(line))
+}
@@ -0,0 +1,124 @@
+package transfer
+
+import (
+ "bytes"
+ "crypto/ed25519"
+ "crypto/rand"
+ "encoding/json"
+ "encoding/pem"
+ "log"
+ "os"
+ "strings"
+ "testing"
+
+ "golang.org/x/crypto/ssh"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// captureLog sends the standard logger to the returned buffer until the end
+// of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+ var buf bytes.Buffer
+ log.SetOutput(&buf)
+ t.Cleanup(func() { log.SetOutput(os.Stderr) })
+ return &buf
+}
+
+// effectiveConfig returns the effective_config record logged in out.
+func effectiveConfig(t *testing.T, out *bytes.Buffer) config.EffectiveConfigRecord {
+ t.Helper()
+ for _, line := range strings.Split(out.String(), "\n") {
+  if i := strings.Index(line, `{"type":"effective_config"`); i >= 0 {
+   var rec config.EffectiveConfigRecord
+   if err := json.Unmarshal([]byte(line[i:]), &rec); err != nil {
+    t.Fatal(err)
+   }
+   return rec
+  }
+ }
+ t.Fatalf("no effective_config record in %s", out)
+ return config.EffectiveConfigRecord{}
+}
+
+func TestEffectiveConfigRedactsSecrets(t *testing.T) {
+ _, priv, err := ed25519.GenerateKey(rand.Reader)
+ if err != nil {
+  t.Fatal(err)
+ }
+ block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("key-passphrase"))
+ if err != nil {
+  t.Fatal(err)
+ }
+ keyPEM := string(pem.EncodeToMemory(block))
+ signer, err := ssh.ParsePrivateKeyWithPassphrase([]byte(keyPEM), []byte("key-passphrase"))
+ if err != nil {
+  t.Fatal(err)
+ }
+
+ t.Setenv("WEBHOOK_URL", "https://hooks.example.com/services/T0/B0/webhook-tok3n")
+ t.Setenv("REMOTE_DIR", "/uploads")
+ r := testRun(testConfig(t), nil)
+ r.payload, err = config.ParsePayload(json.RawMessage(`{
+  "accessKeyId": "AKIAEXAMPLE",
+  "secretAccessKey": "payload-secret-key",
+  "sessionToken": "payload-session-token",
+  "presignedUrls": [{"url": "https://bucket.s3.amazonaws.com/a.csv?X-Amz-Signature=sig4tur3"}],
+  "inlineFiles": [{"name": "a.csv", "contentBase64": "aW5saW5lLWNvbnRlbnQ="}]
+ }`))
+ if err != nil {
+  t.Fatal(err)
+ }
+ sftpConfig := &SFTPConfig{
+  SecretName:               "sftp-partner",
+  SFTPHost:                 "sftp.example.com",
+  SFTPUsername:             "partner",
+  SFTPPassword:             "sftp-hunter2",
+  SFTPPrivateKey:           keyPEM,
+  SFTPPrivateKeyPassphrase: "key-passphrase",
+  Signer:                   signer,
+ }
+ out := captureLog(t)
+ r.logEffectiveConfig(sftpConfig)
+
+ sensitive := []string{
+  "webhook-tok3n", "/services/",
+  "payload-secret-key", "payload-session-token", "sig4tur3", "aW5saW5lLWNvbnRlbnQ=",
+  "sftp-hunter2", "key-passphrase", "PRIVATE KEY",
+ }
+ // No line of the key itself, however it is wrapped or escaped.
+ for _, line := range strings.Split(keyPEM, "\n") {
+  if len(line) > 16 && !strings.HasPrefix(line, "-----") {
+   sensitive = append(sensitive, line[:16])
+  }
+ }
+ for _, v := range sensitive {
+  if strings.Contains(out.String(), v) {
+   t.Errorf("effective configuration includes %q: %s", v, out)
+  }
+ }
+
+ rec := effectiveConfig(t, out)
+ if rec.Secret != "sftp-partner" {
+  t.Errorf("secret = %q", rec.Secret)
+ }
+ for name, want := range map[string]config.Knob{
+  "REMOTE_DIR":                      {Value: "/uploads", Source: config.SourceEnv},
+  "WEBHOOK_URL":                     {Value: "https://hooks.example.com/" + config.Redacted, Source: config.SourceEnv},
+  "payload.secretAccessKey":         {Value: config.Redacted, Source: config.SourcePayload},
+  "payload.sessionToken":            {Value: config.Redacted, Source: config.SourcePayload},
+  "payload.presignedUrls":           {Value: "1 URL(s)", Source: config.SourcePayload},
+  "payload.inlineFiles":             {Value: "1 file(s)", Source: config.SourcePayload},
+  "secret.sftpHost":                 {Value: "sftp.example.com", Source: config.SourceSecret},
+  "secret.sftpPassword":             {Value: config.Redacted, Source: config.SourceSecret},
+  "secret.sftpPrivateKey":           {Value: ssh.FingerprintSHA256(signer.PublicKey()), Source: config.SourceSecret},
+  "secret.sftpPrivateKeyPassphrase": {Value: config.Redacted, Source: config.SourceSecret},
+ } {
+  if got := rec.Knobs[name]; got != want {
+   t.Errorf("%s = %+v, want %+v", name, got, want)
+  }
+ }
+ if k := rec.Knobs["SFTP_MAX_PACKET_BYTES"]; k.Source != config.SourceDefault {
+  t.Errorf("SFTP_MAX_PACKET_BYTES = %+v, want its default", k)
+ }
+}
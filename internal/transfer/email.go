@@ -0,0 +1,102 @@
+package transfer
+
+import (
+ "bytes"
+ "encoding/base64"
+ "fmt"
+ "log"
+ "mime"
+ "strings"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// sendReportEmail emails a summary with the per-file CSV report attached to
+// REPORT_EMAIL_TO. When REPORT_EMAIL_DAILY_ONLY is set only runs invoked with
+// {"dailyBatch": true} send mail. Failures are logged and never change the
+// result of the run.
+func sendReportEmail(cfg *Config, sess *cloud.Session, report *transferReport, payload *config.Payload) {
+ if len(cfg.ReportEmailTo) == 0 {
+  return
+ }
+ if cfg.ReportEmailDailyOnly && !payload.DailyBatch {
+  return
+ }
+ if err := emailReport(cfg, sess, report); err != nil {
+  log.Printf("Failed to send report email: %v", err)
+ }
+}
+
+func emailReport(cfg *Config, sess *cloud.Session, report *transferReport) error {
+ attachment, err := report.csv()
+ if err != nil {
+  return err
+ }
+ s := report.summary()
+ subject := fmt.Sprintf("SFTP delivery to %s: %d files delivered, %d failed (%s)",
+  cfg.DestinationName, s.Transferred, s.Failed, s.StartedAt.Format("2006-01-02"))
+
+ var text strings.Builder
+ fmt.Fprintf(&text, "Delivery run %s to %s %s.\n\n", s.RequestID, cfg.DestinationName, s.Status)
+ fmt.Fprintf(&text, "Started:     %s\n", s.StartedAt.Format(time.RFC1123))
+ fmt.Fprintf(&text, "Duration:    %s\n", (time.Duration(s.DurationMs) * time.Millisecond).Round(time.Second))
+ fmt.Fprintf(&text, "Delivered:   %d files (%s)\n", s.Transferred, humanBytes(s.Bytes))
+ fmt.Fprintf(&text, "Failed:      %d\n", s.Failed)
+ fmt.Fprintf(&text, "Skipped:     %d\n", s.Skipped)
+ if s.Error != "" {
+  fmt.Fprintf(&text, "\nError: %s\n", s.Error)
+ }
+ text.WriteString("\nThe attached CSV lists every file in this run.\n")
+
+ raw := buildRawEmail(cfg.ReportEmailFrom, cfg.ReportEmailTo, subject, text.String(),
+  fmt.Sprintf("transfer-report-%s.csv", s.StartedAt.Format("20060102-150405")), attachment)
+
+ err = sess.SendRawEmail(cfg.ReportEmailFrom, cfg.ReportEmailTo, raw)
+ if err != nil {
+  if cloud.IsEmailRejected(err) {
+   return fmt.Errorf("SES rejected the message; verify %s and the recipients in SES, "+
+    "or move the account out of the SES sandbox: %w", cfg.ReportEmailFrom, err)
+  }
+  return fmt.Errorf("failed to send email via SES: %w", err)
+ }
+ log.Printf("Report email sent to %s", strings.Join(cfg.ReportEmailTo, ", "))
+ return nil
+}
+
+// buildRawEmail assembles a multipart/mixed MIME message with a plain text
+// body and a single CSV attachment, as required by SendRawEmail.
+func buildRawEmail(from string, to []string, subject, body, filename string, attachment []byte) []byte {
+ const boundary = "sftp-transfer-report-boundary"
+ var b bytes.Buffer
+ fmt.Fprintf(&b, "From: %s\r\n", from)
+ fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+ fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+ b.WriteString("MIME-Version: 1.0\r\n")
+ fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+
+ fmt.Fprintf(&b, "--%s\r\n", boundary)
+ b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+ b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+ writeBase64Lines(&b, []byte(body))
+
+ fmt.Fprintf(&b, "--%s\r\n", boundary)
+ fmt.Fprintf(&b, "Content-Type: text/csv; name=%q\r\n", filename)
+ fmt.Fprintf(&b, "Content-Disposition: attachment; filename=%q\r\n", filename)
+ b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+ writeBase64Lines(&b, attachment)
+
+ fmt.Fprintf(&b, "--%s--\r\n", boundary)
+ return b.Bytes()
+}
+
+// writeBase64Lines base64 encodes data wrapped at 76 characters per line.
+func writeBase64Lines(b *bytes.Buffer, data []byte) {
+ encoded := base64.StdEncoding.EncodeToString(data)
+ for len(encoded) > 76 {
+  b.WriteString(encoded[:76] + "\r\n")
+  encoded = encoded[76:]
+ }
+ b.WriteString(encoded + "\r\n")
+}
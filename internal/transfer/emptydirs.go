@@ -0,0 +1,39 @@
+package transfer
+
+import (
+ "log"
+ "strings"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// isEmptyDir reports whether item is a folder marker to create on the server
+// under CREATE_EMPTY_DIRS. The marker of the source prefix itself is not, as
+// it maps to REMOTE_DIR.
+func (r *transferRun) isEmptyDir(item source.Object) bool {
+ key := item.Key
+ return r.cfg.CreateEmptyDirs && !r.cfg.DryRun && item.Size == 0 &&
+  strings.TrimSuffix(key, "/") != strings.TrimSuffix(r.cfg.SourcePrefix, "/")
+}
+
+// createEmptyDir creates the remote directory for the folder marker key. A
+// failure is only logged unless EMPTY_DIRS_FATAL is set.
+func (r *transferRun) createEmptyDir(client sftpfs.FS, key string) error {
+ dir, _, err := r.encodeRemotePath(r.resolveRemotePath(remoteJoin(r.cfg.RemoteDir, r.remoteName(key))))
+ if err == nil {
+  err = r.ensureRemoteDir(client, dir)
+ }
+ if err != nil {
+  r.metrics.add("EmptyDirFailed", unitCount, 1)
+  if !r.cfg.EmptyDirsFatal {
+   log.Printf("WARNING: %v, continuing (EMPTY_DIRS_FATAL is off)", err)
+   return nil
+  }
+  r.report.addFile(fileReport{Key: key, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+  return err
+ }
+ r.report.DirectoriesCreated++
+ r.metrics.add("DirectoriesCreated", unitCount, 1)
+ return nil
+}
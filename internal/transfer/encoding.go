@@ -0,0 +1,54 @@
+package transfer
+
+import (
+ "fmt"
+ "strings"
+
+ "golang.org/x/text/encoding/charmap"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// categoryUnrepresentableName marks files whose remote path cannot be
+// written in REMOTE_FILENAME_ENCODING under
+// REMOTE_FILENAME_UNREPRESENTABLE=fail.
+const categoryUnrepresentableName errorCategory = "unrepresentable_name"
+
+// encodeRemotePath returns p as it is sent to a server expecting
+// REMOTE_FILENAME_ENCODING, and reports whether the policy for
+// unrepresentable runes changed it. UTF-8 paths are returned unchanged.
+func (r *transferRun) encodeRemotePath(p string) (string, bool, error) {
+ if r.cfg.RemoteFilenameEncoding != config.EncodingLatin1 {
+  return p, false, nil
+ }
+ var b strings.Builder
+ changed := false
+ for _, c := range p {
+  if e, ok := charmap.ISO8859_1.EncodeRune(c); ok {
+   b.WriteByte(e)
+   continue
+  }
+  switch r.cfg.RemoteFilenameUnrepresentable {
+  case config.UnrepresentableFail:
+   return "", false, withCategory(categoryUnrepresentableName,
+    fmt.Errorf("remote path %s has %q, which %s cannot represent", p, c, r.cfg.RemoteFilenameEncoding))
+  case config.UnrepresentableReplace:
+   b.WriteByte('_')
+  }
+  changed = true
+ }
+ return b.String(), changed, nil
+}
+
+// remotePathText returns the remote path p, as sent to the server, as
+// UTF-8 text for logs and the report.
+func (r *transferRun) remotePathText(p string) string {
+ if r.cfg.RemoteFilenameEncoding != config.EncodingLatin1 {
+  return p
+ }
+ var b strings.Builder
+ for i := 0; i < len(p); i++ {
+  b.WriteRune(charmap.ISO8859_1.DecodeByte(p[i]))
+ }
+ return b.String()
+}
@@ -0,0 +1,55 @@
+package transfer
+
+import (
+ "errors"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// errorCategory classifies failures so reports and alerts can tell, for
+// example, a credential problem from a network one.
+type errorCategory string
+
+const (
+ categoryConfig     errorCategory = config.Category
+ categoryConnection errorCategory = sftpfs.CategoryConnection
+ categoryAuth       errorCategory = sftpfs.CategoryAuth
+ // categoryAuthPartial means the server accepted a credential but then
+ // demanded a further factor we cannot provide.
+ categoryAuthPartial errorCategory = sftpfs.CategoryAuthPartial
+ // categoryThrottling means S3 kept rejecting requests with SlowDown or
+ // similar responses after the client's own retries.
+ categoryThrottling errorCategory = "throttling"
+ // categoryTransient means a read failed in a way a fresh attempt is
+ // likely to get past, such as a body that ended before its length.
+ categoryTransient errorCategory = "transient"
+)
+
+// categorizedError attaches an errorCategory to an error.
+type categorizedError struct {
+ category errorCategory
+ err      error
+}
+
+func (e *categorizedError) Error() string { return e.err.Error() }
+
+func (e *categorizedError) Unwrap() error { return e.err }
+
+// Category returns the category reports give e.
+func (e *categorizedError) Category() string { return string(e.category) }
+
+func withCategory(category errorCategory, err error) error {
+ return &categorizedError{category: category, err: err}
+}
+
+// categoryOf returns the category of the first categorized error in err's
+// chain, or "" if there is none. Errors of the config and connection code
+// carry their category the same way.
+func categoryOf(err error) errorCategory {
+ var ce interface{ Category() string }
+ if errors.As(err, &ce) {
+  return errorCategory(ce.Category())
+ }
+ return ""
+}
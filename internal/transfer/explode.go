@@ -0,0 +1,176 @@
+package transfer
+
+import (
+ "archive/tar"
+ "archive/zip"
+ "compress/gzip"
+ "errors"
+ "fmt"
+ "io"
+ "log"
+ "os"
+ "path"
+ "strings"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// archiveFormat returns the archive format implied by key's extension, or ""
+// when key is not an archive EXPLODE_ARCHIVES knows how to unpack.
+func archiveFormat(key string) string {
+ lower := strings.ToLower(key)
+ switch {
+ case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+  return config.ArchiveTarGz
+ case strings.HasSuffix(lower, ".tar"):
+  return "tar"
+ case strings.HasSuffix(lower, ".zip"):
+  return config.ArchiveZip
+ }
+ return ""
+}
+
+// explodeArchive delivers each regular file inside the archive object as its
+// own remote file through the normal delivery pipeline. Member failures are
+// reported individually and the remaining members are still attempted unless
+// FAIL_FAST is set.
+func (r *transferRun) explodeArchive(sftpClient sftpfs.FS, key string, out *source.Reader) error {
+ format := archiveFormat(key)
+ log.Printf("Exploding %s archive %s", format, key)
+
+ var total, failed int
+ visit := func(member string, size int64, body io.Reader) error {
+  total++
+  clean, err := safeMemberPath(member)
+  if err != nil {
+   failed++
+   log.Printf("Rejecting member %q of %s: %v", member, key, err)
+   r.report.addFile(fileReport{Key: key, Member: member, Status: statusFailed, Error: err.Error()})
+   return err
+  }
+  err = r.deliver(sftpClient, &deliveryItem{
+   key:      key,
+   member:   clean,
+   name:     path.Base(clean),
+   body:     body,
+   size:     size,
+   metadata: out.Metadata,
+  })
+  if err != nil {
+   failed++
+  }
+  return err
+ }
+
+ var err error
+ switch format {
+ case config.ArchiveZip:
+  err = r.walkZip(out, visit)
+ case config.ArchiveTarGz:
+  var gz *gzip.Reader
+  if gz, err = gzip.NewReader(out.Body); err == nil {
+   err = walkTar(gz, r.cfg.FailFast, visit)
+  }
+ default:
+  err = walkTar(out.Body, r.cfg.FailFast, visit)
+ }
+
+ if failed > 0 {
+  return fmt.Errorf("%d of %d members of %s failed", failed, total, key)
+ }
+ if err != nil {
+  r.report.addFile(fileReport{Key: key, Status: statusFailed, Error: err.Error()})
+  return fmt.Errorf("failed to read archive %s: %w", key, err)
+ }
+ log.Printf("Exploded %s into %d files", key, total)
+ return nil
+}
+
+// errMemberFailed stops archive iteration in fail-fast mode after a member
+// failure that has already been reported.
+var errMemberFailed = errors.New("archive member failed")
+
+func walkTar(src io.Reader, failFast bool, visit func(string, int64, io.Reader) error) error {
+ tr := tar.NewReader(src)
+ for {
+  hdr, err := tr.Next()
+  if err == io.EOF {
+   return nil
+  }
+  if err != nil {
+   return err
+  }
+  if hdr.Typeflag != tar.TypeReg {
+   continue
+  }
+  if err := visit(hdr.Name, hdr.Size, tr); err != nil && failFast {
+   return errMemberFailed
+  }
+ }
+}
+
+// walkZip spools the object to /tmp, or SPOOL_DIR, since a zip's central directory is at
+// the end of the file and members cannot be located while streaming.
+func (r *transferRun) walkZip(out *source.Reader, visit func(string, int64, io.Reader) error) error {
+ want := out.Size
+ if err := r.checkSpoolSpace("archive", want); err != nil {
+  return err
+ }
+ tmp, err := os.CreateTemp(r.spoolDir, "explode-*.zip")
+ if err != nil {
+  return fmt.Errorf("failed to create spool file: %w", err)
+ }
+ defer os.Remove(tmp.Name())
+ defer tmp.Close()
+
+ start := r.clock.Now()
+ size, err := io.Copy(tmp, out.Body)
+ if err != nil {
+  return fmt.Errorf("failed to spool archive: %w", err)
+ }
+ r.recordSpool(tmp.Name(), size, r.clock.Now().Sub(start))
+ if want > 0 && size != want {
+  return fmt.Errorf("spooled %d bytes, expected %d", size, want)
+ }
+
+ zr, err := zip.NewReader(tmp, size)
+ if err != nil {
+  return err
+ }
+ for _, f := range zr.File {
+  if !f.Mode().IsRegular() {
+   continue
+  }
+  rc, err := f.Open()
+  if err != nil {
+   return fmt.Errorf("failed to open member %s: %w", f.Name, err)
+  }
+  err = visit(f.Name, int64(f.UncompressedSize64), rc)
+  rc.Close()
+  if err != nil && r.cfg.FailFast {
+   return errMemberFailed
+  }
+ }
+ return nil
+}
+
+// safeMemberPath rejects zip-slip style member names that would escape the
+// destination directory, returning the cleaned relative path otherwise.
+func safeMemberPath(name string) (string, error) {
+ if strings.Contains(name, "\\") {
+  return "", fmt.Errorf("member path contains a backslash")
+ }
+ if path.IsAbs(name) {
+  return "", fmt.Errorf("member path is absolute")
+ }
+ clean := path.Clean(name)
+ if clean == ".." || strings.HasPrefix(clean, "../") {
+  return "", fmt.Errorf("member path escapes the archive root")
+ }
+ if clean == "." {
+  return "", fmt.Errorf("member path is empty")
+ }
+ return clean, nil
+}
@@ -0,0 +1,238 @@
+package transfer
+
+import (
+ "archive/tar"
+ "archive/zip"
+ "bytes"
+ "compress/gzip"
+ "errors"
+ "io"
+ "io/fs"
+ "reflect"
+ "strings"
+ "testing"
+
+ "github.com/vishalk7890/s3-sftp-lambda/schema"
+)
+
+// testMember is an archive member; a link is a symlink to its body.
+type testMember struct {
+ name, body string
+ dir, link  bool
+}
+
+func buildTar(t *testing.T, gz bool, members ...testMember) string {
+ t.Helper()
+ var buf bytes.Buffer
+ var w io.Writer = &buf
+ var zw *gzip.Writer
+ if gz {
+  zw = gzip.NewWriter(&buf)
+  w = zw
+ }
+ tw := tar.NewWriter(w)
+ for _, m := range members {
+  hdr := &tar.Header{Name: m.name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(m.body))}
+  switch {
+  case m.dir:
+   hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeDir, 0o755, 0
+  case m.link:
+   hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, m.body, 0
+  }
+  if err := tw.WriteHeader(hdr); err != nil {
+   t.Fatal(err)
+  }
+  if hdr.Typeflag == tar.TypeReg {
+   io.WriteString(tw, m.body)
+  }
+ }
+ if err := tw.Close(); err != nil {
+  t.Fatal(err)
+ }
+ if zw != nil {
+  zw.Close()
+ }
+ return buf.String()
+}
+
+func buildZip(t *testing.T, members ...testMember) string {
+ t.Helper()
+ var buf bytes.Buffer
+ zw := zip.NewWriter(&buf)
+ for _, m := range members {
+  hdr := &zip.FileHeader{Name: m.name, Method: zip.Deflate}
+  switch {
+  case m.dir:
+   hdr.Name = strings.TrimSuffix(m.name, "/") + "/"
+  case m.link:
+   hdr.SetMode(fs.ModeSymlink | 0o777)
+  }
+  w, err := zw.CreateHeader(hdr)
+  if err != nil {
+   t.Fatal(err)
+  }
+  if !m.dir {
+   io.WriteString(w, m.body)
+  }
+ }
+ if err := zw.Close(); err != nil {
+  t.Fatal(err)
+ }
+ return buf.String()
+}
+
+func TestSafeMemberPath(t *testing.T) {
+ tests := []struct{ name, want, wantErr string }{
+  {"orders.csv", "orders.csv", ""},
+  {"2024/05/orders.csv", "2024/05/orders.csv", ""},
+  {"./2024//orders.csv", "2024/orders.csv", ""},
+  {"2024/../orders.csv", "orders.csv", ""},
+  {"..", "", "escapes the archive root"},
+  {"../orders.csv", "", "escapes the archive root"},
+  {"2024/../../orders.csv", "", "escapes the archive root"},
+  {"/etc/passwd", "", "absolute"},
+  {`..\orders.csv`, "", "backslash"},
+  {`2024\orders.csv`, "", "backslash"},
+  {"", "", "empty"},
+  {"./", "", "empty"},
+ }
+ for _, tt := range tests {
+  got, err := safeMemberPath(tt.name)
+  switch {
+  case tt.wantErr == "" && (err != nil || got != tt.want):
+   t.Errorf("safeMemberPath(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+  case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+   t.Errorf("safeMemberPath(%q) = %q, %v, want an error saying %q", tt.name, got, err, tt.wantErr)
+  }
+ }
+}
+
+func TestWalkTar(t *testing.T) {
+ archive := buildTar(t, false,
+  testMember{name: "in/", dir: true},
+  testMember{name: "in/a.csv", body: "a\n"},
+  testMember{name: "in/link.csv", body: "/etc/passwd", link: true},
+  testMember{name: "in/b.csv", body: "bb\n"},
+  testMember{name: "in/c.csv", body: "ccc\n"},
+ )
+ errBad := errors.New("bad member")
+ for _, failFast := range []bool{false, true} {
+  var visited []string
+  err := walkTar(strings.NewReader(archive), failFast, func(name string, size int64, body io.Reader) error {
+   b, _ := io.ReadAll(body)
+   if int64(len(b)) != size {
+    t.Errorf("%s: read %d bytes, header says %d", name, len(b), size)
+   }
+   visited = append(visited, name+"="+string(b))
+   if name == "in/b.csv" {
+    return errBad
+   }
+   return nil
+  })
+  want := []string{"in/a.csv=a\n", "in/b.csv=bb\n", "in/c.csv=ccc\n"}
+  var wantErr error
+  if failFast {
+   want, wantErr = want[:2], errMemberFailed
+  }
+  if !reflect.DeepEqual(visited, want) || err != wantErr {
+   t.Errorf("failFast=%t: visited %q, err %v; want %q, %v", failFast, visited, err, want, wantErr)
+  }
+ }
+
+ // A truncated archive is an error of the archive, not of a member.
+ err := walkTar(strings.NewReader(archive[:700]), false, func(string, int64, io.Reader) error { return nil })
+ if err == nil {
+  t.Error("walkTar read a truncated archive without error")
+ }
+}
+
+func TestExplodeArchives(t *testing.T) {
+ members := []testMember{
+  {name: "batch/", dir: true},
+  {name: "batch/orders.csv", body: "id\n1\n"},
+  {name: "batch/link.csv", body: "../../etc/passwd", link: true},
+  {name: "batch/sub/../totals.csv", body: "total\n"},
+ }
+ for _, tt := range []struct{ key, body string }{
+  {"test-poc/batch.tar", buildTar(t, false, members...)},
+  {"test-poc/batch.tar.gz", buildTar(t, true, members...)},
+  {"test-poc/batch.zip", buildZip(t, members...)},
+ } {
+  t.Run(archiveFormat(tt.key), func(t *testing.T) {
+   e := newTestEnv(t, testServerConfig{password: "secret"})
+   t.Setenv("EXPLODE_ARCHIVES", "true")
+   e.s3.put(tt.key, tt.body)
+
+   result, err := e.run("")
+   if err != nil {
+    t.Fatalf("run failed: %v", err)
+   }
+   if result.Transferred != 2 || result.Failed != 0 {
+    t.Fatalf("result = %+v, want the 2 regular members delivered", result)
+   }
+   e.wantFile("/uploads/orders.csv", "id\n1\n")
+   e.wantFile("/uploads/totals.csv", "total\n")
+   if e.server.exists("/uploads/link.csv") {
+    t.Error("symlink member delivered")
+   }
+   if e.server.exists("/uploads/" + strings.TrimPrefix(tt.key, "test-poc/")) {
+    t.Error("archive delivered whole")
+   }
+  })
+ }
+}
+
+func TestExplodeRejectsZipSlip(t *testing.T) {
+ for _, tt := range []struct{ key, body string }{
+  {"test-poc/evil.tar", buildTar(t, false,
+   testMember{name: "ok.csv", body: "ok\n"},
+   testMember{name: "../../escape.csv", body: "pwned\n"},
+   testMember{name: "/abs.csv", body: "pwned\n"},
+   testMember{name: "after.csv", body: "after\n"},
+  )},
+  {"test-poc/evil.zip", buildZip(t,
+   testMember{name: "ok.csv", body: "ok\n"},
+   testMember{name: "../../escape.csv", body: "pwned\n"},
+   testMember{name: "/abs.csv", body: "pwned\n"},
+   testMember{name: "after.csv", body: "after\n"},
+  )},
+ } {
+  t.Run(archiveFormat(tt.key), func(t *testing.T) {
+   e := newTestEnv(t, testServerConfig{password: "secret"})
+   t.Setenv("EXPLODE_ARCHIVES", "true")
+   e.s3.put(tt.key, tt.body)
+
+   // The rejected members fail the run, which returns its partial
+   // result.
+   result, err := e.run("")
+   if err != nil {
+    t.Fatalf("run failed: %v", err)
+   }
+   if result.Status != schema.StatusPartial || result.Transferred != 2 || result.Failed != 2 {
+    t.Errorf("result = %+v, want 2 members delivered and 2 rejected", result)
+   }
+   e.wantFile("/uploads/ok.csv", "ok\n")
+   e.wantFile("/uploads/after.csv", "after\n")
+   for _, p := range []string{"/escape.csv", "/uploads/escape.csv", "/abs.csv", "/uploads/abs.csv"} {
+    if e.server.exists(p) {
+     t.Errorf("%s written outside the archive root", p)
+    }
+   }
+  })
+ }
+
+ // FAIL_FAST stops at the first rejected member.
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ t.Setenv("EXPLODE_ARCHIVES", "true")
+ t.Setenv("FAIL_FAST", "true")
+ e.s3.put("test-poc/evil.tar", buildTar(t, false,
+  testMember{name: "../escape.csv", body: "pwned\n"},
+  testMember{name: "after.csv", body: "after\n"},
+ ))
+ if _, err := e.run(""); err == nil {
+  t.Fatal("run succeeded with a member escaping the archive")
+ }
+ if e.server.exists("/uploads/after.csv") {
+  t.Error("member after the rejected one delivered with FAIL_FAST")
+ }
+}
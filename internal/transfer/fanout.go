@@ -0,0 +1,92 @@
+package transfer
+
+import (
+ "context"
+ "encoding/json"
+ "fmt"
+ "log"
+)
+
+// maxAsyncPayloadBytes is the most an asynchronous Lambda invocation accepts
+// as its payload.
+const maxAsyncPayloadBytes = 256 << 10
+
+// fanoutReport is what a FANOUT coordinator dispatched. Deferred counts the
+// keys left for the next run because FANOUT_MAX_CHILDREN was reached.
+type fanoutReport struct {
+ Children int           `json:"children"`
+ Keys     int           `json:"keys"`
+ Failed   int           `json:"failed"`
+ Deferred int           `json:"deferred,omitempty"`
+ Chunks   []fanoutChunk `json:"chunks"`
+}
+
+// fanoutChunk is one child invocation: the keys it was given, by the first
+// and last, and the request ID it was accepted under or why dispatching it
+// failed.
+type fanoutChunk struct {
+ Index     int    `json:"index"`
+ Keys      int    `json:"keys"`
+ First     string `json:"first"`
+ Last      string `json:"last"`
+ RequestID string `json:"requestId,omitempty"`
+ Error     string `json:"error,omitempty"`
+}
+
+// fanOut dispatches keys, the listing after filters, as asynchronous
+// invocations of this function with FANOUT_CHUNK_SIZE keys each, instead of
+// delivering them. At most FANOUT_MAX_CHILDREN children are started per run;
+// the rest are left for the next run. Children carry the coordinator's
+// overrides and fanoutParent, which turns fan-out off for them.
+func (r *transferRun) fanOut(keys []string) error {
+ if r.functionARN == "" {
+  return withCategory(categoryConfig, fmt.Errorf("FANOUT needs to run in Lambda to invoke itself"))
+ }
+ rep := &fanoutReport{}
+ r.report.Fanout = rep
+ for start := 0; start < len(keys); start += r.cfg.FanoutChunkSize {
+  if rep.Children == r.cfg.FanoutMaxChildren {
+   rep.Deferred = len(keys) - start
+   log.Printf("Reached FANOUT_MAX_CHILDREN=%d, leaving %d key(s) for the next run", r.cfg.FanoutMaxChildren, rep.Deferred)
+   break
+  }
+  chunk := keys[start:min(start+r.cfg.FanoutChunkSize, len(keys))]
+  c := fanoutChunk{Index: len(rep.Chunks), Keys: len(chunk), First: chunk[0], Last: chunk[len(chunk)-1]}
+  if id, err := r.dispatchChunk(chunk); err != nil {
+   c.Error = err.Error()
+   rep.Failed++
+   log.Printf("Failed to dispatch chunk %d (%s .. %s): %v", c.Index, c.First, c.Last, err)
+  } else {
+   c.RequestID = id
+   rep.Children++
+   rep.Keys += len(chunk)
+   r.cfg.Debugf("Dispatched chunk %d (%d key(s)) as %s", c.Index, len(chunk), id)
+  }
+  rep.Chunks = append(rep.Chunks, c)
+ }
+ r.metrics.add("FanoutChildren", unitCount, float64(rep.Children))
+ r.metrics.add("FanoutDispatchFailures", unitCount, float64(rep.Failed))
+ log.Printf("Fanned out %d key(s) to %d child invocation(s), %d chunk(s) failed to dispatch", rep.Keys, rep.Children, rep.Failed)
+ if rep.Failed > 0 {
+  return fmt.Errorf("failed to dispatch %d of %d fan-out chunk(s)", rep.Failed, len(rep.Chunks))
+ }
+ return nil
+}
+
+// dispatchChunk invokes this function asynchronously to deliver keys,
+// returning the request ID of the child.
+func (r *transferRun) dispatchChunk(keys []string) (string, error) {
+ child := *r.payload
+ child.Keys = keys
+ child.FanoutParent = r.report.RequestID
+ child.PresignedURLs, child.InlineFiles = nil, nil
+ child.DryRun, child.ExecutePlan, child.Profile = false, "", false
+ body, err := json.Marshal(&child)
+ if err != nil {
+  return "", err
+ }
+ if len(body) > maxAsyncPayloadBytes {
+  return "", fmt.Errorf("payload of %d bytes exceeds the %d byte limit of asynchronous invocations: lower FANOUT_CHUNK_SIZE", len(body), maxAsyncPayloadBytes)
+ }
+ return r.sess.InvokeAsync(context.Background(), r.functionARN, body)
+}
@@ -0,0 +1,51 @@
+package transfer
+
+import (
+ "path"
+ "strings"
+)
+
+// nameFilter selects files by include and exclude glob patterns in
+// path.Match syntax. A pattern containing "/" is matched against the file's
+// relative path and any other pattern against its name alone, so "*.csv"
+// matches at every depth while "2024/*/*.csv" names specific directories.
+// A file is selected when it matches an include pattern, or there are none,
+// and matches no exclude pattern.
+type nameFilter struct {
+ include []string
+ exclude []string
+}
+
+// newNameFilter returns the filter of patterns the config has validated, or
+// nil, selecting every file, when there are none.
+func newNameFilter(include, exclude []string) *nameFilter {
+ if len(include) == 0 && len(exclude) == 0 {
+  return nil
+ }
+ return &nameFilter{include: include, exclude: exclude}
+}
+
+// match reports whether the file at rel is selected.
+func (f *nameFilter) match(rel string) bool {
+ if f == nil {
+  return true
+ }
+ if len(f.include) > 0 && !matchAny(f.include, rel) {
+  return false
+ }
+ return !matchAny(f.exclude, rel)
+}
+
+func matchAny(patterns []string, rel string) bool {
+ name := path.Base(rel)
+ for _, p := range patterns {
+  subject := name
+  if strings.Contains(p, "/") {
+   subject = rel
+  }
+  if ok, _ := path.Match(p, subject); ok {
+   return true
+  }
+ }
+ return false
+}
@@ -0,0 +1,28 @@
+package transfer
+
+import (
+ "log"
+ "strings"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+)
+
+// logCryptoPosture logs the AWS endpoints and SSH algorithms in effect, as
+// audit evidence that FIPS_MODE was honoured, and warns that SSH_COMPRESSION
+// has no effect.
+func logCryptoPosture(cfg *Config, sess *cloud.Session) {
+ log.Printf("AWS endpoint service=s3 endpoint=%s fips=%t", sess.Endpoint("s3"), cfg.FIPSMode)
+ log.Printf("AWS endpoint service=secretsmanager endpoint=%s fips=%t", sess.SecretsManagerEndpoint(cfg.SecretsManagerEndpoint), cfg.FIPSMode)
+ show := func(l []string) string {
+  if len(l) == 0 {
+   return "default"
+  }
+  return strings.Join(l, ",")
+ }
+ log.Printf("SSH algorithms fips=%t ciphers=%s kex=%s macs=%s compression=none", cfg.FIPSMode,
+  show(cfg.SSHCiphers), show(cfg.SSHKeyExchanges), show(cfg.SSHMACs))
+ if cfg.SSHCompression {
+  log.Printf("WARNING: SSH_COMPRESSION is not supported: the SSH client only negotiates \"none\" compression; set ARCHIVE_MODE=tar.gz to compress files before they are sent")
+ }
+ log.Printf("SSH host key policy=%s", cfg.HostKeyPolicy)
+}
@@ -0,0 +1,116 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+ "sort"
+ "strings"
+)
+
+// Group outcomes recorded in groupReport.Outcome.
+const (
+ groupComplete = "complete"
+ groupPartial  = "partial"
+ groupFailed   = "failed"
+)
+
+// groupReport is the outcome of one top-level folder under GROUP_BY_FOLDER.
+// Marker is the completion marker written for a complete group.
+type groupReport struct {
+ Name      string `json:"name"`
+ Outcome   string `json:"outcome"`
+ Files     int    `json:"files"`
+ Delivered int    `json:"delivered"`
+ Marker    string `json:"marker,omitempty"`
+ Error     string `json:"error,omitempty"`
+}
+
+// fileGroup returns the first path segment of key under the source prefix,
+// or "" for files directly under the prefix, which belong to no group.
+func (r *transferRun) fileGroup(key string) string {
+ rel := strings.TrimPrefix(strings.TrimPrefix(key, r.cfg.SourcePrefix), "/")
+ group, _, ok := strings.Cut(rel, "/")
+ if !ok {
+  return ""
+ }
+ return group
+}
+
+// finishGroups works out the outcome of every group keys belong to and
+// writes GROUP_MARKER into the remote directory of each complete one. A
+// group is complete when each of its files was delivered, or skipped as
+// already on the server.
+func (r *transferRun) finishGroups(keys []string) error {
+ done := r.report.doneKeys()
+ groups := make(map[string]*groupReport)
+ var names []string
+ for _, key := range keys {
+  name := r.fileGroup(key)
+  if name == "" || isDirectory(key) {
+   continue
+  }
+  g := groups[name]
+  if g == nil {
+   g = &groupReport{Name: name}
+   groups[name] = g
+   names = append(names, name)
+  }
+  g.Files++
+  if done[key] {
+   g.Delivered++
+  }
+ }
+ sort.Strings(names)
+
+ var failed int
+ for _, name := range names {
+  g := groups[name]
+  switch {
+  case g.Delivered == g.Files:
+   g.Outcome = groupComplete
+  case g.Delivered > 0:
+   g.Outcome = groupPartial
+  default:
+   g.Outcome = groupFailed
+  }
+  if g.Outcome == groupComplete {
+   if err := r.writeGroupMarker(g); err != nil {
+    g.Error = err.Error()
+    failed++
+    log.Printf("Failed to write completion marker for group %s: %v", name, err)
+   }
+  } else {
+   log.Printf("Group %s is %s: %d of %d file(s) delivered, not writing its completion marker", name, g.Outcome, g.Delivered, g.Files)
+  }
+  r.report.Groups = append(r.report.Groups, *g)
+ }
+ r.metrics.add("GroupMarkersFailed", unitCount, float64(failed))
+ if failed > 0 {
+  return fmt.Errorf("failed to write %d group completion marker(s)", failed)
+ }
+ return nil
+}
+
+// writeGroupMarker writes an empty GROUP_MARKER into the group's directory
+// under REMOTE_DIR.
+func (r *transferRun) writeGroupMarker(g *groupReport) error {
+ if r.conn == nil {
+  return fmt.Errorf("no SFTP connection")
+ }
+ markerPath, _, err := r.encodeRemotePath(r.resolveRemotePath(remoteJoin(r.cfg.RemoteDir, g.Name, r.cfg.GroupMarker)))
+ if err != nil {
+  return err
+ }
+ opts, err := r.writeOptions(r.conn.SFTP, nil)
+ if err != nil {
+  return err
+ }
+ opts.overwrite = true
+ if _, err := writeRemoteFile(r.conn.SFTP, markerPath, strings.NewReader(""), opts); err != nil {
+  return err
+ }
+ g.Marker = markerPath
+ r.metrics.add("GroupMarkersWritten", unitCount, 1)
+ log.Printf("Group %s complete: %d file(s) delivered, wrote %s", g.Name, g.Files, markerPath)
+ return nil
+}
@@ -0,0 +1,78 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+ "strconv"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+)
+
+// trackEmptyRuns keeps the count of consecutive runs that found nothing to
+// transfer in the EMPTY_RUN_PARAMETER SSM parameter. When the count reaches
+// EMPTY_RUN_ALERT_AFTER a notification is published to EMPTY_RUN_TOPIC_ARN,
+// once per streak, and with EMPTY_RUN_FAIL set every run from then on
+// returns an error so a Lambda error alarm fires.
+func (r *transferRun) trackEmptyRuns() error {
+ if r.cfg.EmptyRunAlertAfter == 0 || r.listed == nil {
+  return nil
+ }
+ params := r.sess.Parameters()
+ count, err := readEmptyRunCount(params, r.cfg.EmptyRunParameter)
+ if err != nil {
+  return err
+ }
+
+ empty := len(r.listed) == 0
+ switch {
+ case empty:
+  count++
+ case count == 0:
+  return nil
+ default:
+  log.Printf("Files found after %d consecutive empty run(s), resetting count", count)
+  count = 0
+ }
+ if err := params.Put(r.cfg.EmptyRunParameter, strconv.Itoa(count), "", true); err != nil {
+  return fmt.Errorf("failed to write empty run count to %s: %w", r.cfg.EmptyRunParameter, err)
+ }
+ r.report.ConsecutiveEmptyRuns = count
+ if !empty || count < r.cfg.EmptyRunAlertAfter {
+  return nil
+ }
+
+ log.Printf("WARNING: %d consecutive runs found no files under s3://%s/%s", count, s3Bucket, r.cfg.SourcePrefix)
+ if count == r.cfg.EmptyRunAlertAfter && r.cfg.EmptyRunTopicARN != "" {
+  if err := r.publishEmptyRunAlert(count); err != nil {
+   log.Printf("Failed to publish empty run alert: %v", err)
+  }
+ }
+ if r.cfg.EmptyRunFail {
+  return fmt.Errorf("no files found in %d consecutive runs", count)
+ }
+ return nil
+}
+
+func readEmptyRunCount(params *cloud.Parameters, name string) (int, error) {
+ value, found, err := params.Get(name)
+ if err != nil {
+  return 0, fmt.Errorf("failed to read empty run count from %s: %w", name, err)
+ }
+ if !found {
+  return 0, nil
+ }
+ count, err := strconv.Atoi(value)
+ if err != nil {
+  log.Printf("Ignoring malformed empty run count %q in %s", value, name)
+  return 0, nil
+ }
+ return count, nil
+}
+
+func (r *transferRun) publishEmptyRunAlert(count int) error {
+ subject := fmt.Sprintf("No files for %s in %d consecutive runs", r.cfg.DestinationName, count)
+ message := fmt.Sprintf("The last %d runs delivering to %s found no files under s3://%s/%s. "+
+  "Check that the upstream export is still producing files.",
+  count, r.cfg.DestinationName, s3Bucket, r.cfg.SourcePrefix)
+ return r.sess.Publish(r.cfg.EmptyRunTopicARN, subject, message)
+}
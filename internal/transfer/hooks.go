@@ -0,0 +1,125 @@
+package transfer
+
+import (
+ "bytes"
+ "errors"
+ "fmt"
+ "log"
+ "strings"
+ "sync"
+ "time"
+
+ "golang.org/x/crypto/ssh"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// maxHookOutput caps how much command output is kept for logs and the report.
+const maxHookOutput = 4 << 10
+
+// hookResult records one execution of a remote command.
+type hookResult struct {
+ Command    string `json:"command"`
+ ExitStatus int    `json:"exitStatus"`
+ Output     string `json:"output,omitempty"`
+ DurationMs int64  `json:"durationMs"`
+ Error      string `json:"error,omitempty"`
+}
+
+// renderCommand substitutes placeholders in tmpl. Every value is inserted as a
+// single-quoted shell word, so object keys can never inject shell syntax.
+func renderCommand(tmpl string, values map[string]string) string {
+ return config.PlaceholderPattern.ReplaceAllStringFunc(tmpl, func(m string) string {
+  return shellQuote(values[m[1:len(m)-1]])
+ })
+}
+
+func shellQuote(s string) string {
+ return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// lockedBuffer collects a command's combined output. The SSH session copies
+// stdout and stderr from separate goroutines.
+type lockedBuffer struct {
+ mu  sync.Mutex
+ buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+ b.mu.Lock()
+ defer b.mu.Unlock()
+ return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+ b.mu.Lock()
+ defer b.mu.Unlock()
+ return b.buf.String()
+}
+
+// runRemoteCommand executes command in a new SSH session on client, killing it
+// if it runs longer than timeout.
+func runRemoteCommand(client *ssh.Client, command string, timeout time.Duration) *hookResult {
+ result := &hookResult{Command: command}
+ start := time.Now()
+ defer func() { result.DurationMs = time.Since(start).Milliseconds() }()
+
+ session, err := client.NewSession()
+ if err != nil {
+  result.ExitStatus = -1
+  result.Error = fmt.Sprintf("failed to open SSH session: %v", err)
+  return result
+ }
+ defer session.Close()
+
+ var output lockedBuffer
+ session.Stdout = &output
+ session.Stderr = &output
+
+ done := make(chan error, 1)
+ go func() { done <- session.Run(command) }()
+
+ select {
+ case err = <-done:
+ case <-time.After(timeout):
+  session.Signal(ssh.SIGKILL)
+  session.Close()
+  <-done
+  err = fmt.Errorf("command timed out after %s", timeout)
+ }
+
+ out := output.String()
+ if len(out) > maxHookOutput {
+  out = out[:maxHookOutput] + "...(truncated)"
+ }
+ result.Output = out
+
+ var exitErr *ssh.ExitError
+ switch {
+ case err == nil:
+ case errors.As(err, &exitErr):
+  result.ExitStatus = exitErr.ExitStatus()
+  result.Error = fmt.Sprintf("exited with status %d", result.ExitStatus)
+ default:
+  result.ExitStatus = -1
+  result.Error = err.Error()
+ }
+ return result
+}
+
+// runHook runs a rendered hook command on the run's connection and logs the
+// outcome. The returned error is non-nil only when the command failed and
+// HOOK_FAILURE_MODE is "fail".
+func (r *transferRun) runHook(kind, command string) (*hookResult, error) {
+ log.Printf("Running %s hook: %s", kind, command)
+ result := runRemoteCommand(r.conn.SSH, command, r.cfg.HookTimeout)
+ if result.Error == "" {
+  log.Printf("%s hook succeeded duration_ms=%d output=%q", kind, result.DurationMs, result.Output)
+  return result, nil
+ }
+ log.Printf("%s hook failed: %s duration_ms=%d output=%q", kind, result.Error, result.DurationMs, result.Output)
+ if r.cfg.HookFailureMode == config.HookFailureFail {
+  return result, fmt.Errorf("%s hook failed: %s", kind, result.Error)
+ }
+ return result, nil
+}
@@ -0,0 +1,126 @@
+package transfer
+
+import (
+ "encoding/json"
+ "reflect"
+ "strings"
+ "testing"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// readReport returns the run report written to the "reports" bucket.
+func (e *testEnv) readReport() *transferReport {
+ e.t.Helper()
+ for _, key := range e.s3.keys("reports") {
+  if strings.HasSuffix(key, ".json") {
+   var report transferReport
+   if err := json.Unmarshal(e.s3.object("reports", key).body, &report); err != nil {
+    e.t.Fatal(err)
+   }
+   return &report
+  }
+ }
+ e.t.Fatal("no report was written")
+ return nil
+}
+
+func TestHooks(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret", exec: func(command string) (string, int) {
+  return "ok\n", 0
+ }})
+ installFakeClock(t, time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC))
+ t.Setenv("REPORT_BUCKET", "reports")
+ t.Setenv("POST_UPLOAD_COMMAND", "/opt/ingest/notify.sh {filename} {size}")
+ t.Setenv("POST_BATCH_COMMAND", "touch /uploads/.done-{date} {count}")
+ e.s3.put("test-poc/orders.csv", "id\n")
+ // A key cannot inject shell syntax into the command.
+ e.s3.put("test-poc/x';rm -rf ~;'.csv", "id,total\n")
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ want := []string{
+  `/opt/ingest/notify.sh 'orders.csv' '3'`,
+  `/opt/ingest/notify.sh 'x'\'';rm -rf ~;'\''.csv' '9'`,
+  `touch /uploads/.done-'20240701' '2'`,
+ }
+ if got := e.server.execCommands(); !reflect.DeepEqual(got, want) {
+  t.Errorf("commands = %q, want %q", got, want)
+ }
+ report := e.readReport()
+ for _, f := range report.Files {
+  if f.Hook == nil || f.Hook.ExitStatus != 0 || f.Hook.Output != "ok\n" {
+   t.Errorf("hook of %s = %+v, want its output recorded", f.Key, f.Hook)
+  }
+ }
+ if report.BatchHook == nil || report.BatchHook.Command != want[2] {
+  t.Errorf("batch hook = %+v, want %q recorded", report.BatchHook, want[2])
+ }
+}
+
+func TestHookFailureMode(t *testing.T) {
+ for _, tc := range []struct {
+  mode          string
+  wantDelivered bool
+ }{
+  {config.HookFailureWarn, true},
+  {config.HookFailureFail, false},
+ } {
+  t.Run(tc.mode, func(t *testing.T) {
+   e := newTestEnv(t, testServerConfig{password: "secret", exec: func(command string) (string, int) {
+    return "no such partner\n", 3
+   }})
+   t.Setenv("REPORT_BUCKET", "reports")
+   t.Setenv("POST_UPLOAD_COMMAND", "/opt/ingest/notify.sh {filename}")
+   t.Setenv("HOOK_FAILURE_MODE", tc.mode)
+   e.s3.put("test-poc/orders.csv", "id\n")
+
+   result, err := e.run("")
+   if delivered := err == nil && result.Transferred == 1; delivered != tc.wantDelivered {
+    t.Errorf("result = %+v, %v, want delivered %v", result, err, tc.wantDelivered)
+   }
+   e.wantFile("/uploads/orders.csv", "id\n")
+   hook := e.readReport().Files[0].Hook
+   if hook == nil || hook.ExitStatus != 3 || hook.Output != "no such partner\n" || hook.Error == "" {
+    t.Errorf("hook = %+v, want exit status 3 and its output", hook)
+   }
+  })
+ }
+}
+
+func TestHookTimeout(t *testing.T) {
+ release := make(chan struct{})
+ e := newTestEnv(t, testServerConfig{password: "secret", exec: func(command string) (string, int) {
+  <-release
+  return "", 0
+ }})
+ t.Cleanup(func() { close(release) })
+ t.Setenv("POST_UPLOAD_COMMAND", "/opt/ingest/notify.sh {filename}")
+ t.Setenv("HOOK_FAILURE_MODE", config.HookFailureFail)
+ t.Setenv("HOOK_TIMEOUT", "50ms")
+ t.Setenv("REPORT_BUCKET", "reports")
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ result, err := e.run("")
+ if err == nil && result.Transferred != 0 {
+  t.Fatalf("result = %+v, want the hung hook to fail the file", result)
+ }
+ if hook := e.readReport().Files[0].Hook; hook == nil || !strings.Contains(hook.Error, "timed out") {
+  t.Errorf("hook = %+v, want it timed out", hook)
+ }
+}
+
+func TestCommandTemplatePlaceholders(t *testing.T) {
+ if err := config.ValidateCommandTemplate("POST_UPLOAD_COMMAND", "notify {filename} {size}", config.FileHookPlaceholders); err != nil {
+  t.Errorf("valid template rejected: %v", err)
+ }
+ // Batch hooks have no single file to name.
+ if err := config.ValidateCommandTemplate("POST_BATCH_COMMAND", "notify {filename}", config.BatchHookPlaceholders); err == nil {
+  t.Error("{filename} accepted in a batch hook")
+ }
+ if err := config.ValidateCommandTemplate("POST_UPLOAD_COMMAND", "notify {etag}", config.FileHookPlaceholders); err == nil {
+  t.Error("unknown placeholder accepted")
+ }
+}
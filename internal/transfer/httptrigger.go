@@ -0,0 +1,307 @@
+package transfer
+
+import (
+ "context"
+ "crypto/subtle"
+ "encoding/base64"
+ "encoding/json"
+ "fmt"
+ "log"
+ "net/http"
+ "net/url"
+ "strings"
+
+ "github.com/aws/aws-lambda-go/events"
+ "github.com/aws/aws-lambda-go/lambdacontext"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// httpQueryFields maps the query parameters of an HTTP trigger to the
+// payload fields they set. Anything else is rejected.
+var httpQueryFields = map[string]string{
+ "prefix":      "prefix",
+ "remoteDir":   "remoteDir",
+ "destination": "secretName",
+ "secretName":  "secretName",
+ "dryRun":      "dryRun",
+ "executePlan": "executePlan",
+ "dailyBatch":  "dailyBatch",
+ "profile":     "profile",
+}
+
+// httpBoolFields are the payload fields given as booleans in a query string.
+var httpBoolFields = map[string]bool{"dryRun": true, "dailyBatch": true, "profile": true}
+
+// httpErrorBody is the body of every response that does not carry a result.
+type httpErrorBody struct {
+ Error string `json:"error"`
+}
+
+// httpAcceptedBody is the body of a 202 response to an async request.
+type httpAcceptedBody struct {
+ Accepted  bool   `json:"accepted"`
+ RequestID string `json:"requestId,omitempty"`
+}
+
+// HandleInvocation is the Lambda entry point. Lambda Function URL and API
+// Gateway HTTP API requests, which share an event shape, are answered with
+// an HTTP response, {"mode":"version"} with the build metadata, S3 Batch
+// Operations jobs with a result per task and SQS batches with their failed
+// records; every other event is a plain invocation.
+func HandleInvocation(ctx context.Context, event json.RawMessage) (interface{}, error) {
+ if req, ok := parseHTTPRequest(event); ok {
+  return handleHTTP(ctx, req), nil
+ }
+ if isVersionRequest(event) {
+  return CurrentBuild(), nil
+ }
+ if ev, ok := parseBatchJob(event); ok {
+  return handleBatchJob(ctx, ev), nil
+ }
+ if ev, ok := parseSQSEvent(event); ok {
+  return handleSQSBatch(ctx, ev)
+ }
+ result, err := lambdaHandler(ctx, event)
+ return result, err
+}
+
+// parseHTTPRequest reports whether event is an HTTP request, which carries
+// the method under requestContext.http.
+func parseHTTPRequest(event json.RawMessage) (*events.LambdaFunctionURLRequest, bool) {
+ req := &events.LambdaFunctionURLRequest{}
+ if err := json.Unmarshal(event, req); err != nil || req.RequestContext.HTTP.Method == "" {
+  return nil, false
+ }
+ return req, true
+}
+
+// handleHTTP runs a delivery requested over HTTP. The request must carry
+// the shared secret named by HTTP_TRIGGER_SECRET_NAME in
+// HTTP_TRIGGER_HEADER. Overrides are taken from the JSON body and the query
+// string, the latter taking precedence, and are validated before anything
+// runs. With ?async=true the function invokes itself asynchronously and
+// answers 202; otherwise runs listing more than HTTP_SYNC_MAX_OBJECTS
+// objects or HTTP_SYNC_MAX_BYTES bytes are refused with 413.
+func handleHTTP(ctx context.Context, req *events.LambdaFunctionURLRequest) *events.LambdaFunctionURLResponse {
+ log.Printf("HTTP trigger: %s %s from %s", req.RequestContext.HTTP.Method, req.RawPath, req.RequestContext.HTTP.SourceIP)
+ if m := req.RequestContext.HTTP.Method; m != http.MethodGet && m != http.MethodPost {
+  return httpError(http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed: use GET or POST", m))
+ }
+ cfg, err := config.Load()
+ if err != nil {
+  log.Printf("Invalid configuration: %v", err)
+  return httpError(http.StatusInternalServerError, "invalid configuration")
+ }
+ sess, err := cloud.NewSession(cfg.FIPSMode)
+ if err != nil {
+  log.Printf("Failed to create AWS session: %v", err)
+  return httpError(http.StatusInternalServerError, "failed to create AWS session")
+ }
+ if status, err := authorizeHTTP(cfg, sess, req); err != nil {
+  log.Printf("HTTP trigger refused: %v", err)
+  return httpError(status, err.Error())
+ }
+
+ query, err := url.ParseQuery(req.RawQueryString)
+ if err != nil {
+  return httpError(http.StatusBadRequest, fmt.Sprintf("invalid query string: %v", err))
+ }
+ async, err := httpQueryBool(query, "async")
+ if err != nil {
+  return httpError(http.StatusBadRequest, err.Error())
+ }
+ query.Del("async")
+ raw, err := httpPayload(req, query)
+ if err != nil {
+  return httpError(http.StatusBadRequest, err.Error())
+ }
+ payload, err := config.ParsePayload(raw)
+ if err == nil {
+  err = payload.Apply(cfg)
+ }
+ if err != nil {
+  return httpError(http.StatusBadRequest, err.Error())
+ }
+
+ if async {
+  id, err := invokeAsync(ctx, sess, raw)
+  if err != nil {
+   log.Printf("Failed to start async run: %v", err)
+   return httpError(http.StatusInternalServerError, "failed to start async run")
+  }
+  log.Printf("HTTP trigger: started async run %s", id)
+  return httpJSON(http.StatusAccepted, httpAcceptedBody{Accepted: true, RequestID: id})
+ }
+ if err := checkSyncSize(cfg, sess, payload); err != nil {
+  log.Printf("HTTP trigger refused: %v", err)
+  return httpError(http.StatusRequestEntityTooLarge, err.Error()+"; retry with ?async=true to run it in the background")
+ }
+
+ result, err := lambdaHandler(ctx, raw)
+ if result == nil {
+  return httpError(http.StatusInternalServerError, err.Error())
+ }
+ status := http.StatusOK
+ if err != nil {
+  status = http.StatusInternalServerError
+ }
+ return httpJSON(status, result)
+}
+
+// authorizeHTTP checks the request's shared secret header, returning the
+// status to answer with when it is refused.
+func authorizeHTTP(cfg *Config, sess *cloud.Session, req *events.LambdaFunctionURLRequest) (int, error) {
+ if cfg.HTTPTriggerSecretName == "" {
+  return http.StatusForbidden, fmt.Errorf("HTTP trigger is not enabled")
+ }
+ var token string
+ for name, v := range req.Headers {
+  if strings.EqualFold(name, cfg.HTTPTriggerHeader) {
+   token = v
+  }
+ }
+ if token == "" {
+  return http.StatusUnauthorized, fmt.Errorf("missing %s header", cfg.HTTPTriggerHeader)
+ }
+ secret, err := config.SecretString(sess, cfg, cfg.HTTPTriggerSecretName)
+ if err != nil {
+  log.Printf("Failed to read HTTP trigger secret: %v", err)
+  return http.StatusInternalServerError, fmt.Errorf("failed to read HTTP trigger secret")
+ }
+ secret = strings.TrimSpace(secret)
+ if secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+  return http.StatusForbidden, fmt.Errorf("invalid %s header", cfg.HTTPTriggerHeader)
+ }
+ return 0, nil
+}
+
+// httpPayload builds the invocation payload from the request body, a JSON
+// object of payload fields, and the query parameters set on top of it.
+func httpPayload(req *events.LambdaFunctionURLRequest, query url.Values) (json.RawMessage, error) {
+ fields := make(map[string]interface{})
+ body := []byte(req.Body)
+ if req.IsBase64Encoded {
+  var err error
+  if body, err = base64.StdEncoding.DecodeString(req.Body); err != nil {
+   return nil, fmt.Errorf("invalid base64 body: %w", err)
+  }
+ }
+ if strings.TrimSpace(string(body)) != "" {
+  if err := json.Unmarshal(body, &fields); err != nil {
+   return nil, fmt.Errorf("invalid request body: must be a JSON object: %v", err)
+  }
+ }
+ for name := range query {
+  field, ok := httpQueryFields[name]
+  if !ok {
+   return nil, fmt.Errorf("unknown query parameter %q", name)
+  }
+  if httpBoolFields[field] {
+   b, err := httpQueryBool(query, name)
+   if err != nil {
+    return nil, err
+   }
+   fields[field] = b
+  } else {
+   fields[field] = query.Get(name)
+  }
+ }
+ raw, err := json.Marshal(fields)
+ if err != nil {
+  return nil, fmt.Errorf("invalid request: %w", err)
+ }
+ return raw, nil
+}
+
+// httpQueryBool parses a boolean query parameter; a parameter given without
+// a value is true.
+func httpQueryBool(query url.Values, name string) (bool, error) {
+ if _, ok := query[name]; !ok {
+  return false, nil
+ }
+ switch v := query.Get(name); v {
+ case "", "true", "1":
+  return true, nil
+ case "false", "0":
+  return false, nil
+ default:
+  return false, fmt.Errorf("invalid %s %q: must be true or false", name, v)
+ }
+}
+
+// checkSyncSize refuses synchronous runs listing more than the
+// HTTP_SYNC_MAX_OBJECTS or HTTP_SYNC_MAX_BYTES limits, which would outlast
+// the caller's timeout. The listing stops as soon as a limit is passed.
+func checkSyncSize(cfg *Config, sess *cloud.Session, p *config.Payload) error {
+ if cfg.HTTPSyncMaxObjects == 0 && cfg.HTTPSyncMaxBytes == 0 || cfg.ExecutePlan != "" {
+  return nil
+ }
+ if n := len(p.PresignedURLs) + len(p.InlineFiles); n > 0 {
+  if cfg.HTTPSyncMaxObjects > 0 && n > cfg.HTTPSyncMaxObjects {
+   return fmt.Errorf("%d payload file(s) exceed HTTP_SYNC_MAX_OBJECTS=%d", n, cfg.HTTPSyncMaxObjects)
+  }
+  return nil
+ }
+ sourceSess, err := p.SourceSession(sess, cfg)
+ if err != nil {
+  return err
+ }
+ input := source.ListInput{Bucket: s3Bucket, Prefix: cfg.SourcePrefix}
+ if !cfg.Recursive {
+  input.Delimiter = "/"
+ }
+ var objects int
+ var bytes int64
+ var over error
+ m := newMetrics()
+ err = newS3Client(sourceSess, cfg, m, newRetryBudget(cfg, m), runClock()).List(input, func(page source.Page) bool {
+  for _, item := range page.Objects {
+   if isDirectory(item.Key) {
+    continue
+   }
+   objects++
+   bytes += item.Size
+  }
+  switch {
+  case cfg.HTTPSyncMaxObjects > 0 && objects > cfg.HTTPSyncMaxObjects:
+   over = fmt.Errorf("more than HTTP_SYNC_MAX_OBJECTS=%d objects under %s", cfg.HTTPSyncMaxObjects, cfg.SourcePrefix)
+  case cfg.HTTPSyncMaxBytes > 0 && bytes > cfg.HTTPSyncMaxBytes:
+   over = fmt.Errorf("more than HTTP_SYNC_MAX_BYTES=%d bytes under %s", cfg.HTTPSyncMaxBytes, cfg.SourcePrefix)
+  }
+  return over == nil
+ })
+ if err != nil {
+  log.Printf("Failed to size synchronous run, running it anyway: %v", err)
+  return nil
+ }
+ return over
+}
+
+// invokeAsync starts the run as an asynchronous invocation of this function
+// with the validated payload, returning its request ID.
+func invokeAsync(ctx context.Context, sess *cloud.Session, payload json.RawMessage) (string, error) {
+ lc, ok := lambdacontext.FromContext(ctx)
+ if !ok {
+  return "", fmt.Errorf("not running in Lambda")
+ }
+ return sess.InvokeAsync(ctx, lc.InvokedFunctionArn, payload)
+}
+
+func httpJSON(status int, body interface{}) *events.LambdaFunctionURLResponse {
+ b, err := json.Marshal(body)
+ if err != nil {
+  status, b = http.StatusInternalServerError, []byte(`{"error":"failed to encode response"}`)
+ }
+ return &events.LambdaFunctionURLResponse{
+  StatusCode: status,
+  Headers:    map[string]string{"Content-Type": "application/json"},
+  Body:       string(b),
+ }
+}
+
+func httpError(status int, msg string) *events.LambdaFunctionURLResponse {
+ return httpJSON(status, httpErrorBody{Error: msg})
+}
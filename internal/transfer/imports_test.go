@@ -0,0 +1,33 @@
+package transfer
+
+import (
+ "go/parser"
+ "go/token"
+ "path/filepath"
+ "strconv"
+ "strings"
+ "testing"
+)
+
+func TestNoAWSSDKImports(t *testing.T) {
+ files, err := filepath.Glob("*.go")
+ if err != nil {
+  t.Fatal(err)
+ }
+ fset := token.NewFileSet()
+ for _, name := range files {
+  if strings.HasSuffix(name, "_test.go") {
+   continue
+  }
+  f, err := parser.ParseFile(fset, name, nil, parser.ImportsOnly)
+  if err != nil {
+   t.Fatal(err)
+  }
+  for _, imp := range f.Imports {
+   path, _ := strconv.Unquote(imp.Path.Value)
+   if strings.HasPrefix(path, "github.com/aws/aws-sdk-go") {
+    t.Errorf("%s imports %s; S3 goes through internal/source and other AWS calls through internal/cloud", name, path)
+   }
+  }
+ }
+}
@@ -0,0 +1,17 @@
+package transfer
+
+import (
+ "bytes"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+func (r *transferRun) deliverInline(client sftpfs.FS, f config.InlineFile) error {
+ return r.deliver(client, &deliveryItem{
+  key:  "inline:" + f.Name,
+  name: f.Name,
+  body: bytes.NewReader(f.Data),
+  size: int64(len(f.Data)),
+ })
+}
@@ -0,0 +1,267 @@
+package transfer
+
+import (
+ "compress/gzip"
+ "encoding/csv"
+ "encoding/json"
+ "errors"
+ "fmt"
+ "io"
+ "log"
+ "net/url"
+ "path"
+ "strconv"
+ "strings"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// maxInventorySample bounds each list of keys and paths recorded in the
+// inventory discrepancy report.
+const maxInventorySample = 1000
+
+// inventoryManifest is the manifest.json S3 Inventory writes next to the
+// data files of each report.
+type inventoryManifest struct {
+ SourceBucket      string `json:"sourceBucket"`
+ DestinationBucket string `json:"destinationBucket"`
+ FileFormat        string `json:"fileFormat"`
+ FileSchema        string `json:"fileSchema"`
+ CreationTimestamp string `json:"creationTimestamp"`
+ Files             []struct {
+  Key string `json:"key"`
+ } `json:"files"`
+}
+
+// inventoryReport describes a run whose source of truth was an S3 Inventory
+// report. Missing counts the files absent from the server, SizeMismatch
+// those present with another size and Extra the remote files no inventory
+// entry maps to; with INVENTORY_DISCREPANCIES set the report also lists
+// them, up to maxInventorySample each.
+type inventoryReport struct {
+ Manifest     string    `json:"manifest"`
+ CreatedAt    time.Time `json:"createdAt"`
+ Entries      int       `json:"entries"`
+ GapListed    int       `json:"gapListed"`
+ Missing      int       `json:"missing"`
+ SizeMismatch int       `json:"sizeMismatch"`
+ Present      int       `json:"present"`
+ Extra        int       `json:"extra"`
+
+ MissingKeys      []string `json:"missingKeys,omitempty"`
+ SizeMismatchKeys []string `json:"sizeMismatchKeys,omitempty"`
+ ExtraPaths       []string `json:"extraPaths,omitempty"`
+}
+
+// listInventory returns the objects under the source prefix from the S3
+// Inventory report whose manifest is INVENTORY_MANIFEST, instead of listing
+// the bucket. Objects written after the report was created are not in it;
+// those under INVENTORY_GAP_PREFIX are found with a listing of that prefix,
+// and any others are left to incremental runs.
+func (r *transferRun) listInventory() ([]source.Object, error) {
+ start := r.clock.Now()
+ manifest, err := r.loadInventoryManifest()
+ if err != nil {
+  return nil, err
+ }
+ ms, err := strconv.ParseInt(manifest.CreationTimestamp, 10, 64)
+ if err != nil {
+  return nil, withCategory(categoryConfig, fmt.Errorf("invalid creationTimestamp %q in inventory manifest %s", manifest.CreationTimestamp, r.cfg.InventoryManifest))
+ }
+ rep := &inventoryReport{Manifest: r.cfg.InventoryManifest, CreatedAt: time.UnixMilli(ms).UTC()}
+ r.report.Inventory = rep
+
+ columns := make(map[string]int)
+ for i, name := range strings.Split(manifest.FileSchema, ",") {
+  columns[strings.TrimSpace(name)] = i
+ }
+ for _, name := range []string{"Key", "Size", "LastModifiedDate"} {
+  if _, ok := columns[name]; !ok {
+   return nil, withCategory(categoryConfig, fmt.Errorf("inventory %s has no %s field: it must include Size and LastModifiedDate", r.cfg.InventoryManifest, name))
+  }
+ }
+ bucket := strings.TrimPrefix(manifest.DestinationBucket, "arn:aws:s3:::")
+ var objects []source.Object
+ for _, f := range manifest.Files {
+  found, err := r.readInventoryFile(bucket, f.Key, columns)
+  if err != nil {
+   return nil, err
+  }
+  objects = append(objects, found...)
+ }
+ rep.Entries = len(objects)
+
+ gap := r.clock.Since(rep.CreatedAt).Round(time.Minute)
+ if r.cfg.InventoryGapPrefix != "" {
+  prefix := renderNameTemplate(r.cfg.InventoryGapPrefix, r.clock.Now().UTC())
+  listed, err := r.listShards([]listShard{{prefix: prefix}})
+  if err != nil {
+   return nil, err
+  }
+  for _, obj := range listed {
+   if obj.LastModified.After(rep.CreatedAt) {
+    objects = append(objects, obj)
+    rep.GapListed++
+   }
+  }
+  log.Printf("Listed %s for the %s since the inventory was created: %d newer object(s)", prefix, gap, rep.GapListed)
+ } else {
+  log.Printf("Inventory was created %s ago; objects written since are not in it and are left to incremental runs (set INVENTORY_GAP_PREFIX to list them)", gap)
+ }
+ log.Printf("Read inventory %s: %d object(s) under %s", r.cfg.InventoryManifest, rep.Entries, r.cfg.SourcePrefix)
+ return r.finishListing(objects, len(manifest.Files), start), nil
+}
+
+func (r *transferRun) loadInventoryManifest() (*inventoryManifest, error) {
+ bucket, key, _ := config.ParsePlanURI(r.cfg.InventoryManifest)
+ out, err := r.s3.Get(source.GetInput{Bucket: bucket, Key: key})
+ if err != nil {
+  return nil, classifyS3Error(fmt.Errorf("failed to read inventory manifest %s: %w", r.cfg.InventoryManifest, err))
+ }
+ defer out.Body.Close()
+ m := &inventoryManifest{}
+ if err := json.NewDecoder(out.Body).Decode(m); err != nil {
+  return nil, withCategory(categoryConfig, fmt.Errorf("failed to decode inventory manifest %s: %w", r.cfg.InventoryManifest, err))
+ }
+ switch {
+ case m.FileFormat != "CSV":
+  return nil, withCategory(categoryConfig, fmt.Errorf("inventory %s is in %s format: only CSV is supported", r.cfg.InventoryManifest, m.FileFormat))
+ case m.SourceBucket != s3Bucket:
+  return nil, withCategory(categoryConfig, fmt.Errorf("inventory %s is of bucket %s, not %s", r.cfg.InventoryManifest, m.SourceBucket, s3Bucket))
+ }
+ return m, nil
+}
+
+// readInventoryFile reads one gzipped CSV data file of the report, keeping
+// the current versions of objects under the source prefix.
+func (r *transferRun) readInventoryFile(bucket, key string, columns map[string]int) ([]source.Object, error) {
+ out, err := r.s3.Get(source.GetInput{Bucket: bucket, Key: key})
+ if err != nil {
+  return nil, classifyS3Error(fmt.Errorf("failed to read inventory file s3://%s/%s: %w", bucket, key, err))
+ }
+ defer out.Body.Close()
+ gz, err := gzip.NewReader(out.Body)
+ if err != nil {
+  return nil, fmt.Errorf("failed to read inventory file s3://%s/%s: %w", bucket, key, err)
+ }
+ field := func(rec []string, name string) string {
+  if i, ok := columns[name]; ok && i < len(rec) {
+   return rec[i]
+  }
+  return ""
+ }
+ cr := csv.NewReader(gz)
+ cr.FieldsPerRecord = -1
+ var objects []source.Object
+ for {
+  rec, err := cr.Read()
+  if errors.Is(err, io.EOF) {
+   break
+  }
+  if err != nil {
+   return nil, fmt.Errorf("failed to parse inventory file s3://%s/%s: %w", bucket, key, err)
+  }
+  if field(rec, "IsLatest") == "false" || field(rec, "IsDeleteMarker") == "true" {
+   continue
+  }
+  objKey, err := url.QueryUnescape(field(rec, "Key"))
+  if err != nil || !strings.HasPrefix(objKey, r.cfg.SourcePrefix) {
+   continue
+  }
+  if !r.cfg.Recursive && strings.Contains(strings.TrimPrefix(objKey, folderPrefix(r.cfg.SourcePrefix)), "/") {
+   continue
+  }
+  size, _ := strconv.ParseInt(field(rec, "Size"), 10, 64)
+  modified, err := time.Parse(time.RFC3339, field(rec, "LastModifiedDate"))
+  if err != nil {
+   return nil, fmt.Errorf("invalid LastModifiedDate %q for %s in inventory file s3://%s/%s", field(rec, "LastModifiedDate"), objKey, bucket, key)
+  }
+  obj := source.Object{Key: objKey, Size: size, LastModified: modified, StorageClass: field(rec, "StorageClass")}
+  if etag := field(rec, "ETag"); etag != "" {
+   obj.ETag = `"` + etag + `"`
+  }
+  objects = append(objects, obj)
+ }
+ return objects, nil
+}
+
+// reconcileInventory compares keys with the remote directories they route
+// to and returns the ones to deliver: those missing from the server, and
+// under OVERWRITE_POLICY=overwrite those present with another size. The rest
+// are recorded as skipped. Remote files no key routes to are counted as
+// extra.
+func (r *transferRun) reconcileInventory(client sftpfs.FS, keys []string) []string {
+ rep := r.report.Inventory
+ if r.listing == nil {
+  r.listing = &remoteListing{maxAge: r.cfg.RemoteListingMaxAge, clock: r.clock, dirs: make(map[listingKey]*dirListing)}
+ }
+ sample := func(list *[]string, s string) {
+  if r.cfg.InventoryDiscrepancies && len(*list) < maxInventorySample {
+   *list = append(*list, s)
+  }
+ }
+ claimed := make(map[string]map[string]bool)
+ var deliver []string
+ for _, key := range keys {
+  if isDirectory(key) {
+   deliver = append(deliver, key)
+   continue
+  }
+  item := &deliveryItem{key: key, name: r.remoteName(key)}
+  rt, err := r.route(item)
+  if err != nil || rt.skip {
+   deliver = append(deliver, key)
+   continue
+  }
+  if dir, name := path.Split(rt.path); r.transforms(item).remoteName(name) != name {
+   rt.path = dir + r.transforms(item).remoteName(name)
+  }
+  remotePath := r.resolveRemotePath(rt.path)
+  dir, name := path.Dir(remotePath), path.Base(remotePath)
+  entries, ok := r.listingOf(client, dir)
+  if !ok {
+   deliver = append(deliver, key)
+   continue
+  }
+  if claimed[dir] == nil {
+   claimed[dir] = make(map[string]bool)
+  }
+  claimed[dir][name] = true
+  e, found := entries[name]
+  switch {
+  case !found:
+   rep.Missing++
+   sample(&rep.MissingKeys, key)
+   deliver = append(deliver, key)
+  case !r.convertsText(item.name) && e.size != r.sizes[key]:
+   rep.SizeMismatch++
+   sample(&rep.SizeMismatchKeys, key)
+   if r.cfg.OverwritePolicy == config.OverwriteReplace {
+    deliver = append(deliver, key)
+   } else {
+    r.report.addFile(fileReport{Key: key, RemotePath: remotePath, Status: statusSkipped,
+     Error: fmt.Sprintf("on the server with %d bytes instead of %d, not replaced under OVERWRITE_POLICY=%s", e.size, r.sizes[key], r.cfg.OverwritePolicy)})
+   }
+  default:
+   rep.Present++
+   r.report.addFile(fileReport{Key: key, RemotePath: remotePath, Status: statusSkipped})
+  }
+ }
+ for dir, names := range claimed {
+  entries, _ := r.listingOf(client, dir)
+  for name, e := range entries {
+   if !names[name] && !e.dir {
+    rep.Extra++
+    sample(&rep.ExtraPaths, path.Join(dir, name))
+   }
+  }
+ }
+ r.metrics.add("InventoryMissing", unitCount, float64(rep.Missing))
+ r.metrics.add("InventorySizeMismatch", unitCount, float64(rep.SizeMismatch))
+ log.Printf("Reconciled %d inventory object(s) with the server: %d missing, %d with another size, %d present, %d extra remote file(s)",
+  len(keys), rep.Missing, rep.SizeMismatch, rep.Present, rep.Extra)
+ return deliver
+}
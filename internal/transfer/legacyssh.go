@@ -0,0 +1,10 @@
+package transfer
+
+import "log"
+
+// warnLegacySSH logs, on every run that connects with them allowed, that
+// legacy SSH algorithms are in use for the destination.
+func warnLegacySSH(sftpConfig *SFTPConfig) {
+ log.Printf("SECURITY WARNING: legacy SSH algorithms (ssh-rsa SHA-1 host keys and signatures) are ALLOWED for %s; "+
+  "this weakens server authentication and should only be used until the partner upgrades", sftpConfig.SFTPHost)
+}
@@ -0,0 +1,200 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+ "sort"
+ "strings"
+ "sync"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// defaultShardBoundaries splits the keyspace after the prefix into ranges at
+// these characters. Ranges are half-open on the left, so every key falls into
+// exactly one of them whatever its first character is.
+const defaultShardBoundaries = "123456789abcdefghijklmnopqrstuvwxyz"
+
+// listShard lists the keys under prefix in the range (after, upTo]. An empty
+// after starts at the beginning of the prefix and an empty upTo has no upper
+// bound.
+type listShard struct {
+ prefix string
+ after  string
+ upTo   string
+}
+
+// listObjects lists every object under the source prefix, sharding the
+// listing across concurrent requests when LIST_SHARDING is enabled. Results
+// are de-duplicated and sorted by key.
+func (r *transferRun) listObjects() ([]source.Object, error) {
+ start := r.clock.Now()
+ if r.cfg.CheckpointPrefix != "" {
+  if err := r.loadCheckpoint(); err != nil {
+   return nil, err
+  }
+ }
+ if !r.cfg.Recursive {
+  folders, top, err := r.delimiterShards(folderPrefix(r.cfg.SourcePrefix))
+  if err != nil {
+   return nil, err
+  }
+  r.cfg.Debugf("Ignoring %d sub-folder(s) of %s, RECURSIVE=false", len(folders), r.cfg.SourcePrefix)
+  return r.finishListing(top, 1, start), nil
+ }
+ var shards []listShard
+ var objects []source.Object
+ switch r.cfg.ListSharding {
+ case config.ShardingChar:
+  shards = charShards(r.cfg.SourcePrefix, defaultShardBoundaries)
+ case config.ShardingDelimiter:
+  var err error
+  if shards, objects, err = r.delimiterShards(r.cfg.SourcePrefix); err != nil {
+   return nil, err
+  }
+ default:
+  shards = []listShard{{prefix: r.cfg.SourcePrefix}}
+ }
+
+ found, err := r.listShards(shards)
+ if err != nil {
+  return nil, err
+ }
+ return r.finishListing(append(objects, found...), len(shards), start), nil
+}
+
+func (r *transferRun) finishListing(objects []source.Object, shards int, start time.Time) []source.Object {
+ seen := make(map[string]bool, len(objects))
+ unique := objects[:0]
+ for _, obj := range objects {
+  key := obj.Key
+  if seen[key] {
+   continue
+  }
+  seen[key] = true
+  unique = append(unique, obj)
+ }
+ sort.Slice(unique, func(i, j int) bool {
+  return unique[i].Key < unique[j].Key
+ })
+ elapsed := r.clock.Since(start)
+ r.stats.List = elapsed
+ r.metrics.addDuration("ListDuration", elapsed)
+ log.Printf("Listed %d objects in %d shard(s) duration_ms=%d", len(unique), shards, elapsed.Milliseconds())
+ return unique
+}
+
+// folderPrefix returns prefix with a trailing "/", so a delimiter listing of
+// "outbox" returns the objects in the outbox folder rather than the single
+// common prefix "outbox/".
+func folderPrefix(prefix string) string {
+ if prefix == "" || strings.HasSuffix(prefix, "/") {
+  return prefix
+ }
+ return prefix + "/"
+}
+
+// keyDepth is the number of path segments of key below prefix, so an object
+// directly under the prefix has depth 1. Empty segments from consecutive
+// slashes are not counted.
+func keyDepth(key, prefix string) int {
+ depth := 0
+ for _, seg := range strings.Split(strings.TrimPrefix(key, prefix), "/") {
+  if seg != "" {
+   depth++
+  }
+ }
+ return depth
+}
+
+// charShards splits the keys under prefix into one range per boundary
+// character, plus a final unbounded range.
+func charShards(prefix, boundaries string) []listShard {
+ var shards []listShard
+ after := ""
+ for _, c := range boundaries {
+  upTo := prefix + string(c)
+  shards = append(shards, listShard{prefix: prefix, after: after, upTo: upTo})
+  after = upTo
+ }
+ return append(shards, listShard{prefix: prefix, after: after})
+}
+
+// delimiterShards lists prefix with a "/" delimiter and returns one shard per
+// common prefix along with the objects directly under prefix.
+func (r *transferRun) delimiterShards(prefix string) ([]listShard, []source.Object, error) {
+ var shards []listShard
+ var top []source.Object
+ err := r.s3.List(source.ListInput{Bucket: s3Bucket, Prefix: prefix, Delimiter: "/"}, func(page source.Page) bool {
+  for _, p := range page.Prefixes {
+   shards = append(shards, listShard{prefix: p})
+  }
+  for _, obj := range page.Objects {
+   if obj.Key > r.listAfter {
+    top = append(top, obj)
+   }
+  }
+  return true
+ })
+ if err != nil {
+  return nil, nil, classifyS3Error(fmt.Errorf("failed to list objects: %w", err))
+ }
+ return shards, top, nil
+}
+
+// listShards lists every shard with up to LIST_CONCURRENCY requests in flight.
+func (r *transferRun) listShards(shards []listShard) ([]source.Object, error) {
+ var (
+  mu      sync.Mutex
+  objects []source.Object
+  errs    []error
+  wg      sync.WaitGroup
+  sem     = make(chan struct{}, r.cfg.ListConcurrency)
+ )
+ for _, shard := range shards {
+  wg.Add(1)
+  sem <- struct{}{}
+  go func(shard listShard) {
+   defer wg.Done()
+   defer func() { <-sem }()
+   found, err := r.listShard(shard)
+   mu.Lock()
+   defer mu.Unlock()
+   if err != nil {
+    errs = append(errs, err)
+    return
+   }
+   objects = append(objects, found...)
+  }(shard)
+ }
+ wg.Wait()
+ if len(errs) > 0 {
+  log.Printf("Failed to list objects: %v", errs[0])
+  return nil, classifyS3Error(fmt.Errorf("failed to list objects: %w", errs[0]))
+ }
+ return objects, nil
+}
+
+func (r *transferRun) listShard(shard listShard) ([]source.Object, error) {
+ // A checkpoint past the end of the shard leaves nothing to list.
+ if shard.upTo != "" && r.listAfter >= shard.upTo {
+  return nil, nil
+ }
+ if r.listAfter > shard.after {
+  shard.after = r.listAfter
+ }
+ input := source.ListInput{Bucket: s3Bucket, Prefix: shard.prefix, StartAfter: shard.after}
+ var objects []source.Object
+ err := r.s3.List(input, func(page source.Page) bool {
+  for _, obj := range page.Objects {
+   if shard.upTo != "" && obj.Key > shard.upTo {
+    return false
+   }
+   objects = append(objects, obj)
+  }
+  return true
+ })
+ return objects, err
+}
@@ -0,0 +1,208 @@
+package transfer
+
+import (
+ "fmt"
+ "slices"
+ "testing"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// listedKeys lists prefix the way the run does and returns the keys found, in
+// order.
+func listedKeys(t *testing.T, f *fakeS3, prefix string) []string {
+ t.Helper()
+ cfg := testConfig(t)
+ cfg.SourcePrefix = prefix
+ objects, err := testRun(cfg, f).listObjects()
+ if err != nil {
+  t.Fatalf("listing failed: %v", err)
+ }
+ var keys []string
+ for _, obj := range objects {
+  keys = append(keys, obj.Key)
+ }
+ return keys
+}
+
+func TestShardedListingIsCompleteAndUnique(t *testing.T) {
+ f := installFakeS3(t)
+ // Keys on and either side of the shard boundaries, outside the
+ // boundary characters, and nested below them.
+ for _, key := range []string{
+  "test-poc/",
+  "test-poc/0",
+  "test-poc/1",
+  "test-poc/1/nested.csv",
+  "test-poc/10",
+  "test-poc/9~",
+  "test-poc/A.csv",
+  "test-poc/Z",
+  "test-poc/_tmp",
+  "test-poc/a",
+  "test-poc/a/",
+  "test-poc/a/b/c.csv",
+  "test-poc/a0",
+  "test-poc/az",
+  "test-poc/b",
+  "test-poc/y/z",
+  "test-poc/z",
+  "test-poc/zz",
+  "test-poc/~last",
+  "test-poc/été.csv",
+ } {
+  f.put(key, "x")
+ }
+ f.put("other/a.csv", "x")
+ want := slices.DeleteFunc(f.keys(s3Bucket), func(key string) bool { return key == "other/a.csv" })
+
+ for _, sharding := range []string{config.ShardingOff, config.ShardingChar, config.ShardingDelimiter} {
+  for _, prefix := range []string{"test-poc", "test-poc/"} {
+   for _, pageSize := range []int{1, 2, 1000} {
+    t.Run(fmt.Sprintf("%s/%s/page%d", sharding, prefix, pageSize), func(t *testing.T) {
+     t.Setenv("LIST_SHARDING", sharding)
+     t.Setenv("LIST_CONCURRENCY", "3")
+     f.pageSize = pageSize
+     got := listedKeys(t, f, prefix)
+     if !slices.Equal(got, want) {
+      t.Errorf("listed %q\nwant %q", got, want)
+     }
+    })
+   }
+  }
+ }
+}
+
+func TestCharShardsCoverKeyspace(t *testing.T) {
+ shards := charShards("p/", "bm")
+ want := []listShard{
+  {prefix: "p/", after: "", upTo: "p/b"},
+  {prefix: "p/", after: "p/b", upTo: "p/m"},
+  {prefix: "p/", after: "p/m"},
+ }
+ if !slices.Equal(shards, want) {
+  t.Fatalf("charShards = %+v, want %+v", shards, want)
+ }
+ // Every key belongs to exactly one range (after, upTo].
+ for _, key := range []string{"p/", "p/a", "p/b", "p/ba", "p/m", "p/z", "p/ÿ"} {
+  n := 0
+  for _, s := range shards {
+   if key > s.after && (s.upTo == "" || key <= s.upTo) {
+    n++
+   }
+  }
+  if n != 1 {
+   t.Errorf("%q falls into %d shards", key, n)
+  }
+ }
+}
+
+func TestNonRecursiveListing(t *testing.T) {
+ f := installFakeS3(t)
+ for _, key := range []string{
+  "top.csv",
+  "test-poc/outbox/",
+  "test-poc/outbox/a.csv",
+  "test-poc/outbox/b.csv",
+  "test-poc/outbox/wip/c.csv",
+  "test-poc/outbox/wip/deeper/d.csv",
+  "test-poc/outbox/z/",
+  "test-poc/outbox-old/e.csv",
+  "test-poc/outboxes.csv",
+ } {
+  f.put(key, "x")
+ }
+ top := []string{"test-poc/outbox/", "test-poc/outbox/a.csv", "test-poc/outbox/b.csv"}
+ tests := []struct {
+  prefix string
+  want   []string
+ }{
+  // Without the trailing slash, a delimiter listing would return
+  // just the common prefix "test-poc/outbox/" and the sibling
+  // test-poc/outboxes.csv, so the folder is listed instead.
+  {prefix: "test-poc/outbox", want: top},
+  {prefix: "test-poc/outbox/", want: top},
+  {prefix: "test-poc/outbox/wip", want: []string{"test-poc/outbox/wip/c.csv"}},
+  {prefix: "test-poc/missing", want: nil},
+  {prefix: "", want: []string{"top.csv"}},
+ }
+ for _, tt := range tests {
+  for _, pageSize := range []int{1, 1000} {
+   t.Run(fmt.Sprintf("%q/page%d", tt.prefix, pageSize), func(t *testing.T) {
+    t.Setenv("RECURSIVE", "false")
+    f.pageSize = pageSize
+    got := listedKeys(t, f, tt.prefix)
+    if !slices.Equal(got, tt.want) {
+     t.Errorf("listed %q\nwant %q", got, tt.want)
+    }
+   })
+  }
+ }
+}
+
+func TestTenantSecretsRejectsNonRecursive(t *testing.T) {
+ t.Setenv("TENANT_SECRETS", `{"alpha":"sftp-alpha"}`)
+ t.Setenv("RECURSIVE", "false")
+ if _, err := config.Load(); err == nil {
+  t.Fatal("loadConfig accepted TENANT_SECRETS with RECURSIVE=false")
+ }
+ t.Setenv("RECURSIVE", "true")
+ if _, err := config.Load(); err != nil {
+  t.Fatalf("loadConfig rejected TENANT_SECRETS with RECURSIVE=true: %v", err)
+ }
+}
+
+func TestKeyDepth(t *testing.T) {
+ tests := []struct {
+  key, prefix string
+  want        int
+ }{
+  {"test-poc/a.csv", "test-poc/", 1},
+  {"test-poc/2024/05/a.csv", "test-poc/", 3},
+  {"test-poc/2024/05/a.csv", "test-poc", 3},
+  {"test-poc/2024//05/a.csv", "test-poc/", 3},
+  {"test-poc//2024/05///a.csv", "test-poc/", 3},
+  {"test-poc/2024/05/", "test-poc/", 2},
+  {"test-poc/2024/05//", "test-poc/", 2},
+  {"test-poc/", "test-poc/", 0},
+  {"2024/05/a.csv", "", 3},
+  {"/2024/05/a.csv", "", 3},
+ }
+ for _, tt := range tests {
+  if got := keyDepth(tt.key, tt.prefix); got != tt.want {
+   t.Errorf("keyDepth(%q, %q) = %d, want %d", tt.key, tt.prefix, got, tt.want)
+  }
+ }
+}
+
+func TestMaxDepthBoundsPreservedLayout(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ t.Setenv("MAX_DEPTH", "2")
+ t.Setenv("REMOTE_LAYOUT", "preserve")
+ // The name pattern only applies to the keys within MAX_DEPTH: the deep
+ // ones are filtered before they are validated.
+ t.Setenv("VALIDATE_NAME_PATTERN", `\.csv$`)
+ e.s3.put("test-poc/top.csv", "1\n")
+ e.s3.put("test-poc/2024/day.csv", "2\n")
+ e.s3.put("test-poc/2024//gap.csv", "3\n")
+ e.s3.put("test-poc/2024/05/deep.csv", "4\n")
+ e.s3.put("test-poc/2024/05/deep.txt", "5\n")
+ // Sorted last, as the run stops at its failure.
+ e.s3.put("test-poc/zz.txt", "6\n")
+
+ result, _ := e.run("")
+ if result.Transferred != 3 || result.Failed != 1 {
+  t.Fatalf("result = %+v, want 3 transferred and zz.txt failed", result)
+ }
+ e.wantFile("/uploads/top.csv", "1\n")
+ e.wantFile("/uploads/2024/day.csv", "2\n")
+ e.wantFile("/uploads/2024/gap.csv", "3\n")
+ for _, p := range []string{"/uploads/2024/05/deep.csv", "/uploads/2024/05/deep.txt", "/uploads/zz.txt"} {
+  if _, ok := e.server.file(p); ok {
+   t.Errorf("%s delivered", p)
+  }
+ }
+ if !e.server.exists("/uploads/2024") || e.server.exists("/uploads/2024/05") {
+  t.Error("the remote directories do not stop at MAX_DEPTH")
+ }
+}
@@ -0,0 +1,36 @@
+package transfer
+
+import "log"
+
+// sampleLogs switches the run to bulk logging when it handles more than
+// LOG_SAMPLE_THRESHOLD objects: per-file progress lines are demoted to debug
+// and a progress aggregate is logged every LOG_PROGRESS_EVERY files instead.
+// Failures are always logged in full, and the report and run summary are
+// unaffected.
+func (r *transferRun) sampleLogs(objects int) {
+ if r.bulkLogging || r.cfg.LogSampleThreshold == 0 || objects <= r.cfg.LogSampleThreshold {
+  return
+ }
+ r.bulkLogging = true
+ log.Printf("Run has %d objects, above LOG_SAMPLE_THRESHOLD=%d: per-file logs are demoted to debug, progress is logged every %d files",
+  objects, r.cfg.LogSampleThreshold, r.cfg.LogProgressEvery)
+}
+
+// filef logs a routine per-file line, at debug level under bulk logging.
+func (r *transferRun) filef(format string, args ...any) {
+ if r.bulkLogging {
+  r.cfg.Debugf(format, args...)
+  return
+ }
+ log.Printf(format, args...)
+}
+
+// logProgress logs the aggregate progress under bulk logging after every
+// LOG_PROGRESS_EVERY files and after the last of total.
+func (r *transferRun) logProgress(done, total int) {
+ if !r.bulkLogging || done%r.cfg.LogProgressEvery != 0 && done != total {
+  return
+ }
+ log.Printf("Progress: transferred %d/%d, %s, %d failure(s)",
+  r.report.count(statusTransferred), total, humanBytes(r.stats.BytesSent), r.report.count(statusFailed))
+}
@@ -0,0 +1,1116 @@
+// Package transfer is the delivery engine: it lists the files of a run,
+// filters and transforms them, uploads them to the SFTP destination with
+// retries and reports the outcome. S3 is reached through internal/source and
+// the destination through internal/dest/sftpfs; the AWS SDK is not imported
+// here.
+package transfer
+
+import (
+ "context"
+ "encoding/hex"
+ "encoding/json"
+ "errors"
+ "fmt"
+ "io"
+ "log"
+ "path"
+ "strconv"
+ "sync"
+ "time"
+
+ "github.com/aws/aws-lambda-go/lambdacontext"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+ "github.com/vishalk7890/s3-sftp-lambda/schema"
+)
+
+// secretCache holds the most recently fetched SFTP config of each secret,
+// including its resolved private key, so warm invocations skip Secrets
+// Manager and S3.
+var secretCache = struct {
+ mu      sync.Mutex
+ entries map[string]*cachedSecret
+}{entries: make(map[string]*cachedSecret)}
+
+type cachedSecret struct {
+ config    *SFTPConfig
+ fetchedAt time.Time
+}
+
+// lambdaHandler runs one delivery and returns its result. The result is also
+// written to the S3 report and webhook body, so its shape is kept stable by
+// the schema package.
+//
+// A run that failed after delivering some files returns its result with
+// status "partial" and a nil error unless STRICT_FAILURES is set, so
+// synchronous callers get the summary instead of an error string. Async
+// invocations of such runs therefore count as successes: Lambda does not
+// retry them or send them to an on-failure destination.
+func lambdaHandler(ctx context.Context, event json.RawMessage) (result *schema.ResultV1, err error) {
+ log.Println("Lambda handler started")
+ logFirstInvocation()
+
+ m := newMetrics()
+ defer m.flush()
+
+ var requestID, functionARN string
+ if lc, ok := lambdacontext.FromContext(ctx); ok {
+  requestID = lc.AwsRequestID
+  functionARN = lc.InvokedFunctionArn
+ }
+ report := newTransferReport(requestID)
+ trace := newRunTrace()
+ root := trace.start("transfer run", nil)
+ defer func() {
+  if trace != nil {
+   s := report.summary()
+   root.set("faas.invocation_id", requestID)
+   root.set("destination", report.Destination)
+   root.set("prefix", report.Prefix)
+   root.set("outcome", s.Status)
+   root.set("files.transferred", s.Transferred)
+   root.set("files.failed", s.Failed)
+   root.set("bytes", s.Bytes)
+  }
+  root.end(err)
+  trace.flush()
+ }()
+ var run *transferRun
+ defer func() { logRunSummary(report, run, err) }()
+
+ cfg, err := config.Load()
+ if err != nil {
+  log.Printf("Invalid configuration: %v", err)
+  return nil, fmt.Errorf("invalid configuration: %w", err)
+ }
+ payload, err := config.ParsePayload(event)
+ if err == nil {
+  err = payload.Apply(cfg)
+ }
+ if err != nil {
+  log.Printf("Invalid configuration: %v", err)
+  return nil, fmt.Errorf("invalid configuration: %w", err)
+ }
+ report.Prefix = cfg.SourcePrefix
+ report.Destination = cfg.DestinationName
+ m.setDestination(cfg.MetricDestination(cfg.DestinationName))
+
+ sess, err := cloud.NewSession(cfg.FIPSMode)
+ if err != nil {
+  log.Printf("Failed to create AWS session: %v", err)
+  return nil, fmt.Errorf("failed to create AWS session: %w", err)
+ }
+ log.Println("AWS session ready")
+ logCryptoPosture(cfg, sess)
+
+ sourceSess, err := payload.SourceSession(sess, cfg)
+ if err != nil {
+  log.Printf("Invalid configuration: %v", err)
+  return nil, fmt.Errorf("invalid configuration: %w", err)
+ }
+ retries := newRetryBudget(cfg, m)
+ clk := runClock()
+ run = &transferRun{
+  cfg:       cfg,
+  sess:      sess,
+  s3:        newS3Client(sourceSess, cfg, m, retries, clk),
+  clock:     clk,
+  stop:      shutdownSignal(ctx),
+  retries:   retries,
+  inflight:  newByteBudget(cfg.MaxInflightBytes),
+  listing:   newRemoteListing(cfg, clk),
+  report:    report,
+  metrics:   m,
+  presigned: payload.PresignedURLs,
+  inline:    payload.InlineFiles,
+  payload:   payload,
+  keys:      payload.Keys,
+  trace:     trace,
+  span:      root,
+
+  functionARN: functionARN,
+ }
+ if d, ok := ctx.Deadline(); ok && cfg.ResumeStatePrefix != "" {
+  run.deadline = d.Add(-cfg.ResumeDeadlineMargin)
+ }
+ if err = run.prepareSpool(requestID); err != nil {
+  log.Printf("Invalid configuration: %v", err)
+  return nil, fmt.Errorf("invalid configuration: %w", err)
+ }
+ defer run.removeSpool()
+ profiler := startProfiling(cfg.Profile)
+ err = run.transferObjects()
+ // A dry run leaves the state of later runs alone.
+ if !cfg.DryRun {
+  if cerr := run.saveCheckpoint(); cerr != nil {
+   log.Printf("Failed to save listing checkpoint: %v", cerr)
+  }
+  if rerr := run.savePendingRestores(); rerr != nil {
+   log.Printf("Failed to save restore state: %v", rerr)
+  }
+ }
+ if err == nil && !cfg.DryRun {
+  err = run.trackEmptyRuns()
+ }
+ if err == nil && !cfg.DryRun {
+  // Retention cleanup only runs after a fully successful run, and a
+  // cleanup failure is reported without failing the delivery.
+  if cerr := run.cleanupProcessed(); cerr != nil {
+   log.Printf("Cleanup failed: %v", cerr)
+  }
+ }
+ // Profiles are written with the function's own role, like reports.
+ report.Profiles = profiler.finish(source.Default(sess), cfg, requestID)
+ report.RetryBudget = retries.report()
+ if report.PeakInflightBytes = run.inflight.peakBytes(); report.PeakInflightBytes > 0 {
+  m.add("PeakInflightBytes", unitBytes, float64(report.PeakInflightBytes))
+ }
+ if err != nil && report.RetryBudget != nil && report.RetryBudget.Exhausted {
+  err = fmt.Errorf("%w (retry budget exhausted)", err)
+ }
+ report.finish(err)
+ addFileMetrics(m, cfg, report)
+ report.computeThroughput(cfg.ThroughputMinBytes)
+ if t := report.Throughput; t != nil {
+  m.add("RunThroughput", unitMBPerSecond, t.RunMBps)
+  log.Printf("Run throughput files=%d p50_mbps=%.2f p95_mbps=%.2f run_mbps=%.2f (files under %d bytes excluded)",
+   t.Files, t.P50MBps, t.P95MBps, t.RunMBps, t.MinBytes)
+ }
+ // Reports are written with the function's own role, which may differ
+ // from the one given for reading the source bucket.
+ if werr := writeReport(source.Default(sess), report); werr != nil {
+  log.Printf("Failed to write transfer report: %v", werr)
+ }
+ writeAuditLog(source.Default(sess), cfg, report, m, clk)
+ sendWebhook(ctx, cfg, sess, report, clk)
+ sendSlack(ctx, cfg, sess, report, clk)
+ sendReportEmail(cfg, sess, report, payload)
+ s := report.summary()
+ if err != nil && s.Status == runPartial && !cfg.StrictFailures {
+  log.Printf("Run partially failed, returning its result without an error: %v", err)
+  err = nil
+ }
+ return &s, err
+}
+
+// transferRun carries the state shared by the steps of a single invocation.
+type transferRun struct {
+ cfg     *Config
+ sess    *cloud.Session
+ s3      source.Store
+ report  *transferReport
+ metrics *metrics
+ // conn is the SFTP connection used by the run once established, and
+ // sftpConfig the config it was dialed with.
+ conn       *sftpfs.Conn
+ sftpConfig *SFTPConfig
+
+ // checkpoint is the listing checkpoint loaded for the run, or nil
+ // when checkpoints are disabled. listAfter is the key the listing
+ // started after, fullListing is set when the checkpoint was
+ // ignored, and listed holds the keys in the order they were listed.
+ checkpoint  *listCheckpoint
+ listAfter   string
+ fullListing bool
+ listed      []string
+ // restores is the pending restore state, loaded once an archived
+ // object is handled under the restore policy.
+ restores *pendingRestores
+ // sizes holds the listing size of each key, and modified its last
+ // modified time.
+ sizes    map[string]int64
+ modified map[string]time.Time
+
+ stats runStats
+ // fsyncWarned is set once the missing fsync extension has been
+ // logged for the run.
+ fsyncWarned bool
+ // chownUnsupported is set once the server has rejected setstat as
+ // unsupported, so no further chown is attempted in the run.
+ chownUnsupported bool
+ // bulkLogging is set when the run has more objects than
+ // LOG_SAMPLE_THRESHOLD, replacing per-file logs with progress.
+ bulkLogging bool
+ // presigned and inline replace the S3 listing with files from the
+ // payload when set.
+ presigned []config.PresignedSource
+ inline    []config.InlineFile
+ // deadline is when resumable transfers stop so their state can be
+ // saved before the invocation times out; zero when resume is off.
+ deadline time.Time
+ // atomicDowngraded turns atomic uploads off for the rest of the run
+ // after the server turned out not to support rename.
+ atomicDowngraded bool
+ // space is the estimated free space on the server.
+ space remoteSpace
+ // planned holds the actions of the plan being executed, by key.
+ planned map[string]planAction
+ // claimed holds the remote paths delivered to in this run under
+ // OVERWRITE_POLICY=suffix, and routed the file routed to each remote
+ // path under PATH_COLLISIONS=fail.
+ claimed map[string]bool
+ routed  map[string]string
+ // clock is the time source of the run's time-dependent decisions.
+ clock clock
+ // retries is the retry budget shared by the whole run, and inflight
+ // the budget of bytes it may buffer at once.
+ retries  *retryBudget
+ inflight *byteBudget
+ // breakers holds the circuit breaker of each destination, by secret.
+ breakers map[string]*circuitBreaker
+ // listing caches remote directory listings for existence checks.
+ listing *remoteListing
+ // payload is the invocation payload, and keys the explicit key list
+ // it carried, if any. functionARN is the ARN the function was
+ // invoked by, for fanning out to itself.
+ payload     *config.Payload
+ keys        []string
+ functionARN string
+ // stop is closed when the service is shutting down under
+ // RUN_MODE=serve; nil under Lambda.
+ stop <-chan struct{}
+ // spoolDir is the run's directory under SPOOL_DIR, or "" to spool
+ // to the default temporary directory.
+ spoolDir string
+ // trace collects the run's spans under span, its root; both are nil
+ // when no OTLP endpoint is configured.
+ trace *runTrace
+ span  *traceSpan
+ // tenantConns, in a run forked to deliver a batch of a tenant, holds
+ // the connections the tenant's batches share.
+ tenantConns *tenantConns
+}
+
+func (r *transferRun) transferObjects() (err error) {
+ payloadFiles := len(r.presigned) > 0 || len(r.inline) > 0
+ var sftpConfig *SFTPConfig
+ if len(r.cfg.TenantSecrets) == 0 || payloadFiles {
+  span := r.trace.start("secret fetch", r.span)
+  span.set("secret", r.cfg.SecretName)
+  sftpConfig, err = getSFTPConfig(r.sess, r.cfg, r.cfg.SecretName, r.clock)
+  span.end(err)
+ }
+ r.logEffectiveConfig(sftpConfig)
+ if err != nil {
+  log.Printf("Failed to get SFTP config: %v", err)
+  return fmt.Errorf("failed to get SFTP config: %w", err)
+ }
+ if payloadFiles {
+  return r.transferPayloadFiles(sftpConfig)
+ }
+ if r.cfg.PullMode {
+  return r.pullFiles(sftpConfig)
+ }
+ if r.cfg.ExecutePlan != "" {
+  keys, err := r.loadPlan()
+  if err != nil {
+   r.report.addFile(fileReport{Key: r.cfg.ExecutePlan, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+   return err
+  }
+  if len(keys) == 0 {
+   r.report.EmptyRun = true
+   log.Println("Plan has no files to transfer")
+   return nil
+  }
+  transferStart := r.clock.Now()
+  defer func() { r.stats.Transfer = r.clock.Since(transferStart) }()
+  return r.deliverKeys(sftpConfig, keys)
+ }
+ if len(r.keys) > 0 {
+  log.Printf("Delivering %d key(s) from the payload of fan-out parent %s", len(r.keys), r.payload.FanoutParent)
+  r.stats.Found = len(r.keys)
+  transferStart := r.clock.Now()
+  defer func() { r.stats.Transfer = r.clock.Since(transferStart) }()
+  if len(r.cfg.TenantSecrets) > 0 {
+   return r.transferTenants(r.keys)
+  }
+  return r.deliverKeys(sftpConfig, r.keys)
+ }
+
+ if r.cfg.ReplayQuarantine {
+  if err := r.replayQuarantined(); err != nil {
+   return err
+  }
+ }
+
+ // List objects in the specified folder
+ var objects []source.Object
+ span := r.trace.start("list", r.span)
+ if r.cfg.InventoryManifest != "" {
+  log.Printf("Reading objects from inventory %s", r.cfg.InventoryManifest)
+  span.set("inventory", r.cfg.InventoryManifest)
+  objects, err = r.listInventory()
+ } else {
+  log.Println("Listing objects in S3 bucket")
+  objects, err = r.listObjects()
+ }
+ span.set("prefix", r.cfg.SourcePrefix)
+ span.set("objects", len(objects))
+ span.end(err)
+ if err != nil {
+  return err
+ }
+
+ var keys, dirs []string
+ var tooDeep, tooNew int
+ archived := make(map[string]string)
+ r.stats.Found = len(objects)
+ r.sizes = make(map[string]int64, len(objects))
+ r.modified = make(map[string]time.Time, len(objects))
+ r.sampleLogs(len(objects))
+ for _, item := range objects {
+  key := item.Key
+  r.filef("Found object: %s", key)
+  if isDirectory(key) { // Skip directories
+   if r.isEmptyDir(item) {
+    dirs = append(dirs, key)
+   } else {
+    r.stats.Filtered++
+   }
+   continue
+  }
+  if r.cfg.MaxDepth > 0 && keyDepth(key, r.cfg.SourcePrefix) > r.cfg.MaxDepth {
+   r.cfg.Debugf("Skipping %s: deeper than MAX_DEPTH=%d", key, r.cfg.MaxDepth)
+   r.stats.Filtered++
+   tooDeep++
+   continue
+  }
+  r.listed = append(r.listed, key)
+  r.sizes[key] = item.Size
+  r.modified[key] = item.LastModified
+  if r.cfg.MinObjectAge > 0 {
+   if age := r.clock.Since(item.LastModified); age < r.cfg.MinObjectAge+r.cfg.ObjectClockSkew {
+    reason := fmt.Sprintf("too new: modified %s ago, MIN_OBJECT_AGE is %s", age.Round(time.Second), r.cfg.MinObjectAge)
+    r.cfg.Debugf("Leaving %s for a later run: %s", key, reason)
+    r.report.addFile(fileReport{Key: key, ETag: item.ETag, Status: statusPending, Error: reason})
+    tooNew++
+    continue
+   }
+  }
+  if class := item.StorageClass; isArchivedClass(class) {
+   // A dry run records archived objects in the plan without
+   // restoring them; executing the plan does not deliver them.
+   if r.cfg.DryRun {
+    archived[key] = class
+   } else if !r.admitArchived(key, class) {
+    continue
+   }
+  }
+  keys = append(keys, key)
+ }
+ if tooDeep > 0 {
+  log.Printf("Filtered %d object(s) deeper than MAX_DEPTH=%d", tooDeep, r.cfg.MaxDepth)
+ }
+ if tooNew > 0 {
+  log.Printf("Left %d object(s) modified within MIN_OBJECT_AGE=%s for a later run", tooNew, r.cfg.MinObjectAge)
+  r.metrics.add("ObjectsPending", unitNone, float64(tooNew))
+ }
+ r.metrics.add("FilesFound", unitCount, float64(len(r.listed)))
+ if len(r.listed) == 0 && len(dirs) == 0 {
+  r.report.EmptyRun = true
+  log.Println("No files to transfer")
+  return nil
+ }
+ // Archived objects the policy failed do not stop the others from
+ // being delivered, but do fail the run.
+ defer func() {
+  if n := r.report.count(statusFailed); err == nil && n > 0 {
+   err = fmt.Errorf("%d archived object(s) could not be transferred", n)
+  }
+ }()
+ if len(keys) == 0 && len(dirs) == 0 {
+  log.Println("No files ready to transfer")
+  return nil
+ }
+ if r.cfg.DryRun {
+  return r.writePlan(keys, archived)
+ }
+ // Directories come first so the skeleton exists before the files.
+ keys = append(dirs, keys...)
+ if r.cfg.Fanout {
+  return r.fanOut(keys)
+ }
+
+ transferStart := r.clock.Now()
+ defer func() { r.stats.Transfer = r.clock.Since(transferStart) }()
+ if len(r.cfg.TenantSecrets) > 0 {
+  return r.transferTenants(keys)
+ }
+ if err := r.deliverKeys(sftpConfig, keys); err != nil {
+  return err
+ }
+ log.Println("Files transferred successfully!")
+ return nil
+}
+
+// deliverKeys delivers keys over a connection for sftpConfig and then runs
+// the batch hook on it.
+func (r *transferRun) deliverKeys(sftpConfig *SFTPConfig, keys []string) (err error) {
+ if r.cfg.ArchiveMode == "" && !r.cfg.Concatenate {
+  if err := r.checkCollisions(keys); err != nil {
+   r.report.addFile(fileReport{Key: keys[0], Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+   return err
+  }
+ }
+ conn, release, err := r.connectWithBreaker(sftpConfig)
+ if err != nil {
+  if categoryOf(err) == categoryDestinationUnavailable {
+   r.skipUnavailable(keys, err)
+   return err
+  }
+  r.report.addFile(fileReport{Key: keys[0], Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+  log.Printf("Failed to copy file to SFTP: %v", err)
+  return fmt.Errorf("failed to copy file to SFTP: %w", err)
+ }
+ // Keep the connection for the next invocation unless a transfer failed
+ // on it, in which case its health is unknown.
+ defer func() {
+  if release != nil {
+   release(err != nil)
+  }
+ }()
+ r.conn = conn
+ r.sftpConfig = sftpConfig
+ r.stats.Host = conn.Timing.Address
+
+ if r.cfg.Preflight {
+  if err := r.preflight(conn.SFTP); err != nil {
+   r.report.addFile(fileReport{Key: keys[0], Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+   return err
+  }
+ }
+
+ if r.cfg.StagingDir != "" {
+  r.cleanStaging(conn.SFTP)
+ }
+ if r.report.Inventory != nil {
+  keys = r.reconcileInventory(conn.SFTP, keys)
+ }
+ if r.cfg.ArchiveMode != "" {
+  return r.transferArchive(conn.SFTP, r.planByteCap(keys))
+ }
+ if r.cfg.Concatenate {
+  return r.transferConcat(conn.SFTP, keys)
+ }
+ keys = r.orderControlFiles(keys)
+ delivered := make(map[string]bool, len(keys))
+ // Groups finished before a failure still get their marker.
+ if r.cfg.GroupByFolder {
+  defer func() {
+   if gerr := r.finishGroups(keys); gerr != nil && err == nil {
+    err = gerr
+   }
+  }()
+ }
+
+ spaceDir := r.resolveRemotePath(r.cfg.RemoteDir)
+ if err := r.checkRemoteSpace(conn.SFTP, spaceDir); err != nil {
+  log.Printf("WARNING: %v, continuing without a free space check", err)
+ }
+ r.sampleLogs(len(keys))
+ // lost counts the files that failed on a connection the circuit
+ // breaker replaced.
+ var lost int
+ for i, key := range keys {
+  if i > 0 {
+   r.logProgress(i, len(keys))
+  }
+  var after string
+  if i > 0 {
+   after = keys[i-1]
+  }
+  if !r.withinByteCap(r.stats.BytesSent, r.sizes[key]) {
+   r.deferOverCap(keys[i:], after)
+   break
+  }
+  if r.stats.BytesSent > 0 && r.pastDeadline() {
+   r.deferRemaining(keys[i:], after, "Invocation deadline reached")
+   break
+  }
+  if r.stopping() {
+   r.deferRemaining(keys[i:], after, "Shutting down")
+   break
+  }
+  if isDirectory(key) {
+   if err := r.createEmptyDir(conn.SFTP, key); err != nil {
+    return err
+   }
+   continue
+  }
+  if blocker := r.controlBlocker(key, keys, delivered); blocker != "" {
+   r.holdControl(key, blocker)
+   continue
+  }
+  if !r.fitsRemoteSpace(conn.SFTP, spaceDir, r.sizes[key]) {
+   r.deferForSpace(key)
+   continue
+  }
+  sent := r.stats.BytesSent
+  if err := r.copyObjectToSFTP(conn.SFTP, key); err != nil {
+   log.Printf("Failed to copy file to SFTP: %v", err)
+   // With the circuit breaker on, a file lost to the connection
+   // is left failed and the rest continue over a new one.
+   if r.cfg.BreakerThreshold == 0 || categoryOf(err) != categoryConnection && conn.Alive() {
+    return fmt.Errorf("failed to copy file to SFTP: %w", err)
+   }
+   lost++
+   release(true)
+   release = nil
+   if !r.recordConnFailure(sftpConfig, err) {
+    conn, release, err = r.connectWithBreaker(sftpConfig)
+   }
+   if release == nil {
+    err = r.breaker(sftpConfig).unavailable(sftpConfig)
+    r.skipUnavailable(keys[i+1:], err)
+    return err
+   }
+   r.conn = conn
+   continue
+  }
+  r.breaker(sftpConfig).failures = 0
+  r.space.free -= r.stats.BytesSent - sent
+  delivered[key] = true
+ }
+ r.logProgress(len(keys), len(keys))
+
+ if r.cfg.PostBatchCommand != "" {
+  command := renderCommand(r.cfg.PostBatchCommand, map[string]string{
+   "count":      strconv.Itoa(r.report.count(statusTransferred)),
+   "remote_dir": r.cfg.RemoteDir,
+   "date":       r.clock.Now().UTC().Format("20060102"),
+  })
+  if r.report.BatchHook, err = r.runHook("batch", command); err != nil {
+   return err
+  }
+ }
+ if lost > 0 {
+  return withCategory(categoryConnection, fmt.Errorf("%d file(s) failed on a lost connection", lost))
+ }
+ return nil
+}
+
+// connect acquires an SFTP connection for the run, shared with the other
+// batches of its tenant in a forked run.
+func (r *transferRun) connect(sftpConfig *SFTPConfig) (*sftpfs.Conn, func(broken bool), error) {
+ if r.tenantConns != nil {
+  return r.tenantConns.acquire(r, sftpConfig)
+ }
+ return r.openConnection(sftpConfig)
+}
+
+// openConnection acquires an SFTP connection from the pool and records
+// whether it was reused from a previous invocation.
+func (r *transferRun) openConnection(sftpConfig *SFTPConfig) (*sftpfs.Conn, func(broken bool), error) {
+ if r.cfg.LegacySSHAllowed(sftpConfig) {
+  warnLegacySSH(sftpConfig)
+ }
+ span := r.trace.start("connect", r.span)
+ start := r.clock.Now()
+ conn, events, release, err := acquireConnection(r.cfg, sftpConfig)
+ r.stats.Connect = r.clock.Since(start)
+ span.set("reused", events.reused)
+ span.end(err)
+ r.metrics.add("PoolEvictions", unitCount, float64(events.evictions))
+ if events.redialed {
+  r.metrics.add("PoolRedials", unitCount, 1)
+ }
+ if err != nil {
+  return nil, nil, err
+ }
+ if events.reused {
+  r.metrics.add("ConnectionReused", unitNone, 1)
+ } else {
+  r.metrics.add("ConnectionReused", unitNone, 0)
+  recordConnection(conn.Timing, r.report, r.metrics)
+ }
+ return conn, release, nil
+}
+
+func isDirectory(key string) bool {
+ return key[len(key)-1] == '/'
+}
+
+// getSFTPConfig returns the SFTP config from the named secret, served from
+// secretCache when it was fetched less than SecretCacheTTL ago on clk.
+func getSFTPConfig(sess *cloud.Session, cfg *Config, name string, clk clock) (*SFTPConfig, error) {
+ secretCache.mu.Lock()
+ defer secretCache.mu.Unlock()
+ if e := secretCache.entries[name]; e != nil && clk.Since(e.fetchedAt) < cfg.SecretCacheTTL {
+  log.Printf("Using cached SFTP config from %s", name)
+  return config.WithTransferServer(sess, cfg, e.config)
+ }
+
+ sftpConfig, err := config.LoadSFTPConfig(sess, cfg, name)
+ if err != nil {
+  return nil, err
+ }
+ secretCache.entries[name] = &cachedSecret{config: sftpConfig, fetchedAt: clk.Now()}
+ return config.WithTransferServer(sess, cfg, sftpConfig)
+}
+
+// copyObjectToSFTP delivers key, fetching it again when the transfer failed
+// in a way a new attempt may get past, such as a body shorter than its
+// ContentLength. Only the last attempt stays in the report.
+func (r *transferRun) copyObjectToSFTP(sftpClient sftpfs.FS, key string) (err error) {
+ span := r.trace.start("file", r.span)
+ defer func() {
+  if span != nil {
+   span.set("key", key)
+   span.set("destination", r.cfg.DestinationName)
+   if f := r.report.lastFile(key); f != nil {
+    span.set("bytes", f.Bytes)
+    span.set("outcome", f.Status)
+    span.set("remote_path", f.RemotePath)
+   }
+  }
+  span.end(err)
+ }()
+ for attempt := 1; ; attempt++ {
+  err := r.copyObjectOnce(sftpClient, key, attempt)
+  if err == nil {
+   return nil
+  }
+  // With a quarantine to fall back on, checksum mismatches get the
+  // same retries as short reads before the object is moved aside.
+  quarantine := r.cfg.QuarantinePrefix != "" && isIntegrityFailure(err)
+  retryable := categoryOf(err) == categoryTransient || quarantine
+  if !retryable || attempt > r.cfg.ShortReadRetries || !r.retries.take("copy of "+key) {
+   if quarantine {
+    r.quarantine(key, err)
+   }
+   return err
+  }
+  log.Printf("Retrying %s (attempt %d of %d): %v", key, attempt+1, r.cfg.ShortReadRetries+1, err)
+  r.report.dropLast(key)
+ }
+}
+
+func (r *transferRun) copyObjectOnce(sftpClient sftpfs.FS, key string, attempt int) error {
+ r.filef("Copying S3 object %s to SFTP", key)
+ var resume *resumeState
+ if r.cfg.ResumeStatePrefix != "" && r.sizes[key] >= r.cfg.ResumeMinBytes && !r.convertsText(r.remoteName(key)) {
+  var err error
+  if resume, err = r.loadResumeState(sftpClient, key); err != nil {
+   r.report.addFile(fileReport{Key: key, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+   return err
+  }
+ }
+ // A resumed file was validated when its transfer started.
+ if resume == nil {
+  if err := r.validateObject(key); err != nil {
+   return err
+  }
+ }
+ input := source.GetInput{Bucket: s3Bucket, Key: key}
+ if resume != nil {
+  input.Range = fmt.Sprintf("bytes=%d-", resume.Bytes)
+  input.IfMatch = resume.ETag
+ } else if action, ok := r.planned[key]; ok {
+  input.IfMatch = action.ETag
+ }
+ // S3 returns no checksum for a ranged read, so only whole objects
+ // are verified.
+ input.Checksum = r.cfg.VerifyS3Checksum
+ getObjectOutput, err := r.s3.Get(input)
+ if resume != nil && source.IsPreconditionFailed(err) {
+  r.abandonResume(sftpClient, resume, "S3 object changed")
+  resume = nil
+  input.Range, input.IfMatch = "", ""
+  getObjectOutput, err = r.s3.Get(input)
+ }
+ if err != nil {
+  log.Printf("Failed to get S3 object: %v", err)
+  err = classifyS3Error(fmt.Errorf("failed to get S3 object: %w", err))
+  r.report.addFile(fileReport{Key: key, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+  return err
+ }
+ defer getObjectOutput.Body.Close()
+
+ if r.cfg.ExplodeArchives && archiveFormat(key) != "" {
+  return r.explodeArchive(sftpClient, key, getObjectOutput)
+ }
+ var body io.Reader = getObjectOutput.Body
+ if r.cfg.VerifyContentLength && getObjectOutput.SizeKnown {
+  body = &sizeCheckReader{src: getObjectOutput.Body, want: getObjectOutput.Size}
+ }
+ var sourceChecksum string
+ if r.cfg.VerifyS3Checksum && input.Range == "" {
+  stored := getObjectOutput.ChecksumSHA256
+  var verified bool
+  if body, verified = r.verifiedBody(key, body, stored); verified {
+   sourceChecksum = "sha256:" + stored
+  }
+ }
+ return r.deliver(sftpClient, &deliveryItem{
+  key:      key,
+  name:     r.remoteName(key),
+  body:     body,
+  size:     getObjectOutput.Size,
+  metadata: getObjectOutput.Metadata,
+  etag:     getObjectOutput.ETag,
+  resume:   resume,
+  attempt:  attempt,
+
+  sourceChecksum: sourceChecksum,
+ })
+}
+
+// deliveryItem is a single file to be written to the SFTP server.
+type deliveryItem struct {
+ // key is the S3 key the data came from.
+ key string
+ // member is the path inside key when the file was extracted from an
+ // archive.
+ member string
+ // name is the file name used for routing and the remote path.
+ name     string
+ body     io.Reader
+ size     int64
+ metadata map[string]string
+ // etag identifies the object version, and resume is the saved state
+ // of a partial transfer being continued, if any.
+ etag   string
+ resume *resumeState
+ // attempt counts the fetches of key, starting at 1.
+ attempt int
+ // sourceChecksum is the S3 stored checksum body is verified against,
+ // if any.
+ sourceChecksum string
+}
+
+// deliver routes item to its remote path and writes it, recording the
+// outcome in the report.
+func (r *transferRun) deliver(sftpClient sftpfs.FS, item *deliveryItem) error {
+ entry := fileReport{Key: item.key, Member: item.member, ETag: item.etag, Status: statusFailed}
+ if item.attempt > 1 {
+  entry.Attempts = item.attempt
+ }
+ defer func() { r.report.addFile(entry) }()
+ label := item.key
+ if item.member != "" {
+  label = item.key + ":" + item.member
+ }
+
+ rt, err := r.route(item)
+ if err != nil {
+  log.Printf("Failed to route %s: %v", label, err)
+  entry.Error = err.Error()
+  return err
+ }
+ entry.PathSource = rt.source
+ entry.Route = rt.rule
+ if rt.skip {
+  log.Printf("Skipping %s: no extension route (rule=%s)", label, rt.rule)
+  entry.Status = statusSkipped
+  return nil
+ }
+ pipeline := r.transforms(item)
+ if dir, name := path.Split(rt.path); pipeline.remoteName(name) != name {
+  rt.path = dir + pipeline.remoteName(name)
+ }
+ remoteFilePath := r.resolveRemotePath(rt.path)
+ if remoteFilePath != rt.path {
+  log.Printf("Remote path for %s is %s, resolved from %s (source=%s rule=%s)", label, remoteFilePath, rt.path, rt.source, rt.rule)
+ } else {
+  log.Printf("Remote path for %s is %s (source=%s rule=%s)", label, remoteFilePath, rt.source, rt.rule)
+ }
+ entry.RemotePath = remoteFilePath
+ if r.cfg.RemoteFilenameEncoding != config.EncodingUTF8 {
+  encoded, changed, err := r.encodeRemotePath(remoteFilePath)
+  entry.RemoteEncoding = r.cfg.RemoteFilenameEncoding
+  entry.EncodingPolicy = r.cfg.RemoteFilenameUnrepresentable
+  if err != nil {
+   log.Printf("Failed to deliver %s: %v", label, err)
+   entry.Category = string(categoryOf(err))
+   entry.Error = err.Error()
+   return err
+  }
+  if changed {
+   entry.TranscodedFrom = remoteFilePath
+   entry.RemotePath = r.remotePathText(encoded)
+   log.Printf("Remote path for %s is %s in %s (REMOTE_FILENAME_UNREPRESENTABLE=%s)",
+    label, entry.RemotePath, r.cfg.RemoteFilenameEncoding, r.cfg.RemoteFilenameUnrepresentable)
+  }
+  remoteFilePath = encoded
+ }
+ remoteDir := path.Dir(remoteFilePath)
+
+ if err = r.ensureRemoteDir(sftpClient, remoteDir); err != nil {
+  entry.Error = err.Error()
+  return err
+ }
+
+ split := r.cfg.SplitSizeBytes > 0 && item.size > r.cfg.SplitSizeBytes
+ if r.cfg.OverwritePolicy == config.OverwriteSuffix {
+  final, err := r.avoidCollision(sftpClient, remoteFilePath, split)
+  if err != nil {
+   entry.Error = err.Error()
+   return err
+  }
+  if final != remoteFilePath {
+   log.Printf("Remote name %s for %s is taken, delivering as %s (OVERWRITE_POLICY=suffix)", remoteFilePath, label, final)
+   entry.RenamedFrom = remoteFilePath
+   entry.RemotePath = r.remotePathText(final)
+   remoteFilePath = final
+  }
+ } else if err = r.claimPath(remoteFilePath, label); err != nil {
+  log.Printf("Failed to deliver %s: %v", label, err)
+  entry.Category = string(categoryOf(err))
+  entry.Error = err.Error()
+  return err
+ }
+ var syncTime time.Duration
+ opts, err := r.writeOptions(sftpClient, &syncTime)
+ if err != nil {
+  entry.Error = err.Error()
+  return err
+ }
+ if !opts.overwrite {
+  // A split file is only complete once its manifest exists.
+  existing := remoteFilePath
+  if split {
+   existing += ".parts"
+  }
+  if r.remoteExists(sftpClient, existing) {
+   log.Printf("Skipping %s: %s already exists (OVERWRITE_POLICY=skip)", label, existing)
+   entry.Status = statusSkipped
+   return nil
+  }
+ }
+
+ // Digests are taken while streaming so the data is only read once,
+ // after any transform that changes it.
+ body, err := pipeline.wrap(item.body)
+ if err != nil {
+  entry.Error = err.Error()
+  return err
+ }
+ if names := pipeline.contentNames(); names != "" {
+  r.cfg.Debugf("Transforming %s with %s", label, names)
+  entry.Transform = names
+ }
+ if item.resume != nil && r.cfg.ChecksumSidecar != "" {
+  log.Printf("Not writing a checksum sidecar for %s: only the resumed part of the file passed through this run", label)
+ }
+ digest := pipeline.digest(r.cfg.ChecksumSidecar)
+ sha := pipeline.digest(config.ChecksumSHA256)
+
+ need := r.cfg.CopyBufferBytes()
+ if r.convertsText(item.name) {
+  need += config.TextBufferBytes
+ }
+ release, err := r.inflight.acquire("copying "+label, need)
+ if err != nil {
+  entry.Category = string(categoryOf(err))
+  entry.Error = err.Error()
+  return err
+ }
+ defer release()
+
+ body, stopWatch := r.watchStalls(body, item.body)
+ log.Printf("Transferring data to %s", remoteFilePath)
+ start := r.clock.Now()
+ var n int64
+ partial := []string{remoteFilePath}
+ if r.resumable(item) && !split {
+  partial = []string{remoteFilePath + atomicTempSuffix}
+  var deferred bool
+  if n, deferred, err = r.deliverResumable(sftpClient, item, body, remoteFilePath, opts); err == nil && deferred {
+   stopWatch()
+   r.stats.BytesSent += n
+   entry.Bytes = n
+   entry.Status = statusDeferred
+   log.Printf("Deferred the rest of %s to the next run after %d bytes", label, n)
+   return nil
+  }
+ } else if split {
+  log.Printf("Splitting %s (%d bytes) into parts of at most %d bytes", label, item.size, r.cfg.SplitSizeBytes)
+  entry.Parts, n, err = uploadParts(sftpClient, remoteFilePath, body, r.cfg.SplitSizeBytes, opts)
+ } else if r.cfg.StagingDir != "" {
+  var staged string
+  n, staged, err = r.deliverStaged(sftpClient, body, remoteFilePath, opts)
+  partial = []string{staged}
+ } else if r.atomicEnabled() {
+  tmpPath := remoteFilePath + atomicTempSuffix
+  partial = []string{tmpPath}
+  tmpOpts := opts
+  tmpOpts.overwrite = true
+  if n, err = writeRemoteFile(sftpClient, tmpPath, body, tmpOpts); err != nil {
+   sftpClient.Remove(tmpPath)
+  } else {
+   err = r.commitAtomic(sftpClient, tmpPath, remoteFilePath, opts)
+  }
+ } else {
+  n, err = writeRemoteFile(sftpClient, remoteFilePath, body, opts)
+ }
+ if stopWatch() {
+  // The partial file could not be removed over the connection
+  // that was torn down to abort the transfer.
+  if !split {
+   r.removeAfterStall(partial...)
+  }
+  err = withCategory(categoryConnection, fmt.Errorf("%w after %d bytes: %v", errTransferStalled, n, err))
+  entry.Category = string(categoryConnection)
+ }
+ elapsed := r.clock.Since(start)
+ r.stats.BytesSent += n
+ entry.Bytes = n
+ entry.DurationMs = elapsed.Milliseconds()
+ entry.SyncMs = syncTime.Milliseconds()
+ entry.ThroughputMBps = throughputMBps(n, elapsed)
+ var mismatch *sizeMismatchError
+ if errors.As(err, &mismatch) {
+  entry.ExpectedBytes = mismatch.Expected
+  entry.ReceivedBytes = mismatch.Received
+  entry.Category = string(categoryTransient)
+  // Split uploads remove their own parts on failure.
+  if !split {
+   r.removePartial(sftpClient, partial...)
+   if item.resume != nil {
+    r.deleteResumeState(item.key)
+   }
+  }
+ }
+ if err != nil {
+  log.Printf("Failed to transfer %s: %v", label, err)
+  if entry.Category == "" {
+   entry.Category = string(categoryOf(err))
+  }
+  entry.Error = err.Error()
+  return err
+ }
+ entry.Status = statusTransferred
+ if split {
+  r.recordRemote(sftpClient, remoteFilePath+".parts", 0)
+ } else {
+  r.recordRemote(sftpClient, remoteFilePath, n)
+  if err := r.applyOwnership(sftpClient, remoteFilePath, &entry); err != nil {
+   log.Printf("File %s delivered but its owner could not be set: %v", remoteFilePath, err)
+   entry.Status = statusPartial
+   entry.Category = string(categoryOf(err))
+   entry.Error = err.Error()
+   return err
+  }
+ }
+ // The body was read to the end, so it matched the stored checksum.
+ entry.SourceChecksum = item.sourceChecksum
+
+ if digest != nil {
+  sum := hex.EncodeToString(digest.Sum(nil))
+  entry.Checksum = r.cfg.ChecksumSidecar + ":" + sum
+  // The sidecar is written only once the data file is complete so
+  // it never appears before the file it describes.
+  if err := writeChecksumSidecar(sftpClient, remoteFilePath, r.cfg.ChecksumSidecar, sum, opts); err != nil {
+   log.Printf("File %s delivered but its checksum sidecar failed: %v", remoteFilePath, err)
+   entry.Status = statusPartial
+   entry.Error = err.Error()
+   return err
+  }
+ }
+
+ if r.cfg.MetadataSidecar {
+  values := map[string]interface{}{
+   config.SidecarSourceBucket: s3Bucket,
+   config.SidecarSourceKey:    item.key,
+   config.SidecarSize:         n,
+   config.SidecarExportedAt:   r.clock.Now().UTC().Format(time.RFC3339),
+  }
+  if item.member != "" {
+   values[config.SidecarMember] = item.member
+  }
+  if item.etag != "" {
+   values[config.SidecarETag] = item.etag
+  }
+  if sha != nil {
+   values[config.SidecarSHA256] = hex.EncodeToString(sha.Sum(nil))
+  }
+  // Sidecars always replace an older one, whatever OVERWRITE_POLICY
+  // says about data files.
+  sidecarOpts := opts
+  sidecarOpts.overwrite = true
+  if err := writeMetadataSidecar(sftpClient, remoteFilePath, r.cfg.SidecarFieldNames, values, sidecarOpts); err != nil {
+   log.Printf("File %s delivered but its metadata sidecar failed: %v", remoteFilePath, err)
+   entry.Status = statusPartial
+   entry.Error = err.Error()
+   return err
+  }
+ }
+
+ if r.cfg.PostUploadCommand != "" {
+  command := renderCommand(r.cfg.PostUploadCommand, map[string]string{
+   "filename":    path.Base(remoteFilePath),
+   "remote_path": remoteFilePath,
+   "remote_dir":  remoteDir,
+   "size":        strconv.FormatInt(n, 10),
+   "key":         item.key,
+  })
+  if entry.Hook, err = r.runHook("post-upload", command); err != nil {
+   entry.Status = statusPartial
+   entry.Error = err.Error()
+   return err
+  }
+ }
+
+ r.metrics.addDuration("TransferDuration", elapsed)
+ if opts.fsync {
+  r.metrics.addDuration("SyncDuration", syncTime)
+ }
+ if n >= r.cfg.ThroughputMinBytes {
+  r.metrics.add("TransferThroughput", unitMBPerSecond, entry.ThroughputMBps)
+ }
+ r.metrics.add("BytesTransferred", unitBytes, float64(n))
+ r.filef("File transferred successfully to %s bytes=%d duration_ms=%d sync_ms=%d throughput_mbps=%.2f",
+  remoteFilePath, n, entry.DurationMs, entry.SyncMs, entry.ThroughputMBps)
+ return nil
+}
+
+// writeOptions control how writeRemoteFile creates and completes a file.
+type writeOptions struct {
+ // overwrite allows replacing an existing file the server refuses to
+ // truncate with Create.
+ overwrite bool
+ // fsync flushes the file to the server's disk before it is closed.
+ // The time spent, read from clock, is added to syncTime when that is
+ // set.
+ fsync    bool
+ syncTime *time.Duration
+ clock    clock
+}
+
+// writeRemoteFile creates (or truncates) remotePath and copies src into it.
+func writeRemoteFile(sftpClient sftpfs.FS, remotePath string, src io.Reader, opts writeOptions) (int64, error) {
+ dstFile, err := createRemoteFile(sftpClient, remotePath, opts.overwrite)
+ if err != nil {
+  log.Printf("Failed to create remote file: %v", err)
+  return 0, fmt.Errorf("failed to create remote file %s: %w", remotePath, err)
+ }
+
+ n, err := io.Copy(dstFile, src)
+ if err != nil {
+  dstFile.Close()
+  log.Printf("Failed to copy file to remote: %v", err)
+  return n, fmt.Errorf("failed to write remote file %s: %w", remotePath, err)
+ }
+ if opts.fsync {
+  start := opts.clock.Now()
+  err := dstFile.Sync()
+  if opts.syncTime != nil {
+   *opts.syncTime += opts.clock.Since(start)
+  }
+  if err != nil {
+   dstFile.Close()
+   log.Printf("Failed to fsync remote file: %v", err)
+   return n, fmt.Errorf("failed to fsync remote file %s: %w", remotePath, err)
+  }
+ }
+ // Servers may only report a failed write, such as a full disk or an
+ // exceeded quota, when the file is closed.
+ if err := dstFile.Close(); err != nil {
+  log.Printf("Failed to close remote file: %v", err)
+  return n, fmt.Errorf("failed to close remote file %s: %w", remotePath, err)
+ }
+ return n, nil
+}
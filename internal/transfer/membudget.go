@@ -0,0 +1,70 @@
+package transfer
+
+import (
+ "fmt"
+ "sync"
+)
+
+// categoryMemoryBudget marks a file that needed more buffering than
+// MAX_INFLIGHT_BYTES allows.
+const categoryMemoryBudget errorCategory = "memory_budget"
+
+// byteBudget bounds the bytes buffered at once across the run to
+// MAX_INFLIGHT_BYTES. Every component that buffers acquires what it may hold
+// before it starts and releases it once done. A nil byteBudget is unlimited.
+// It is safe for concurrent use.
+type byteBudget struct {
+ limit int64
+
+ mu   sync.Mutex
+ cond *sync.Cond
+ used int64
+ peak int64
+}
+
+func newByteBudget(limit int64) *byteBudget {
+ if limit <= 0 {
+  return nil
+ }
+ b := &byteBudget{limit: limit}
+ b.cond = sync.NewCond(&b.mu)
+ return b
+}
+
+// acquire waits until n bytes fit in the budget and reserves them, returning
+// the func that releases them. A request larger than the whole budget can
+// never fit and fails at once.
+func (b *byteBudget) acquire(what string, n int64) (func(), error) {
+ if b == nil || n <= 0 {
+  return func() {}, nil
+ }
+ if n > b.limit {
+  return nil, withCategory(categoryMemoryBudget, fmt.Errorf("%s needs %d bytes of buffers, more than MAX_INFLIGHT_BYTES=%d", what, n, b.limit))
+ }
+ b.mu.Lock()
+ for b.used+n > b.limit {
+  b.cond.Wait()
+ }
+ b.used += n
+ b.peak = max(b.peak, b.used)
+ b.mu.Unlock()
+ var once sync.Once
+ return func() {
+  once.Do(func() {
+   b.mu.Lock()
+   b.used -= n
+   b.mu.Unlock()
+   b.cond.Broadcast()
+  })
+ }, nil
+}
+
+// peakBytes returns the most bytes held at once so far.
+func (b *byteBudget) peakBytes() int64 {
+ if b == nil {
+  return 0
+ }
+ b.mu.Lock()
+ defer b.mu.Unlock()
+ return b.peak
+}
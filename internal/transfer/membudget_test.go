@@ -0,0 +1,118 @@
+package transfer
+
+import (
+ "math/rand"
+ "strings"
+ "sync"
+ "sync/atomic"
+ "testing"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+func TestByteBudgetStaysUnderLimit(t *testing.T) {
+ const limit = 1 << 20
+ b := newByteBudget(limit)
+ var held, peak atomic.Int64
+ var wg sync.WaitGroup
+ for i := 0; i < 64; i++ {
+  wg.Add(1)
+  go func(seed int64) {
+   defer wg.Done()
+   rng := rand.New(rand.NewSource(seed))
+   for j := 0; j < 200; j++ {
+    n := 1 + rng.Int63n(limit/3)
+    release, err := b.acquire("stress", n)
+    if err != nil {
+     t.Error(err)
+     return
+    }
+    now := held.Add(n)
+    for p := peak.Load(); now > p && !peak.CompareAndSwap(p, now); p = peak.Load() {
+    }
+    if now > limit {
+     t.Errorf("%d bytes held, over the limit of %d", now, limit)
+    }
+    if rng.Intn(4) == 0 {
+     time.Sleep(time.Duration(rng.Intn(50)) * time.Microsecond)
+    }
+    held.Add(-n)
+    release()
+    // Releasing twice gives nothing back a second time.
+    release()
+   }
+  }(int64(i))
+ }
+ wg.Wait()
+
+ if got := b.peakBytes(); got > limit || got < peak.Load() {
+  t.Errorf("peakBytes = %d, held at most %d under a limit of %d", got, peak.Load(), limit)
+ }
+ if peak.Load() <= limit/3 {
+  t.Errorf("peak %d: the acquirers never overlapped", peak.Load())
+ }
+ if b.used != 0 {
+  t.Errorf("%d bytes still held after every release", b.used)
+ }
+}
+
+func TestByteBudgetRefusesOversizedRequests(t *testing.T) {
+ b := newByteBudget(1 << 10)
+ if _, err := b.acquire("copying big.bin", 1<<10+1); categoryOf(err) != categoryMemoryBudget {
+  t.Errorf("err = %v, want a %s error", err, categoryMemoryBudget)
+ }
+ release, err := b.acquire("copying small.bin", 1<<10)
+ if err != nil {
+  t.Fatal(err)
+ }
+ release()
+
+ // Without MAX_INFLIGHT_BYTES there is no budget and nothing waits.
+ unlimited := newByteBudget(0)
+ if unlimited != nil {
+  t.Fatal("newByteBudget(0) is not unlimited")
+ }
+ if release, err := unlimited.acquire("copying big.bin", 1<<40); err != nil {
+  t.Error(err)
+ } else {
+  release()
+ }
+ if unlimited.peakBytes() != 0 {
+  t.Error("unlimited budget reports a peak")
+ }
+}
+
+func TestCheckInflightBytes(t *testing.T) {
+ copyBytes := int64(config.SFTPConcurrentRequests * 32768)
+ tests := []struct {
+  name    string
+  cfg     Config
+  wantErr string
+ }{
+  {"off", Config{SFTPMaxPacket: 32768}, ""},
+  {"copy fits", Config{SFTPMaxPacket: 32768, MaxInflightBytes: copyBytes}, ""},
+  {"copy too big", Config{SFTPMaxPacket: 32768, MaxInflightBytes: copyBytes - 1},
+   "SFTP copy (64 requests x SFTP_MAX_PACKET_BYTES 32768) 2097152 = 2097152 bytes"},
+  {"text conversion", Config{SFTPMaxPacket: 32768, TextConvert: config.TextConvertCRLF, MaxInflightBytes: copyBytes},
+   "+ text conversion buffer 32768 = 2129920 bytes"},
+  {"archive", Config{SFTPMaxPacket: 32768, ArchiveMode: "zip", MaxInflightBytes: copyBytes},
+   "+ archive buffer 262144 = 2359296 bytes"},
+  {"pull", Config{PullMode: true, PullPartSize: 5 << 20, PullUploadConcurrency: 4, MaxInflightBytes: 16 << 20},
+   "pull parts (PULL_PART_SIZE 5242880 x PULL_UPLOAD_CONCURRENCY 4) 20971520 = 20971520 bytes"},
+ }
+ for _, tt := range tests {
+  t.Run(tt.name, func(t *testing.T) {
+   err := tt.cfg.CheckInflightBytes()
+   if tt.wantErr == "" {
+    if err != nil {
+     t.Fatal(err)
+    }
+    return
+   }
+   if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+    t.Errorf("err = %v, want it to contain %q", err, tt.wantErr)
+   }
+  })
+ }
+}
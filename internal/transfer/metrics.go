@@ -0,0 +1,219 @@
+package transfer
+
+import (
+ "encoding/json"
+ "fmt"
+ "os"
+ "sort"
+ "sync"
+ "time"
+)
+
+const defaultMetricsNamespace = "S3SFTPTransfer"
+
+// EMF units used by the metrics emitted from this function.
+const (
+ unitMilliseconds = "Milliseconds"
+ unitBytes        = "Bytes"
+ unitMBPerSecond  = "Megabytes/Second"
+ unitCount        = "Count"
+ // unitNone is for values that are not counts of events, such as
+ // indexes, levels and 0/1 samples, which must not be summed.
+ unitNone = "None"
+)
+
+// maxEMFValues is the maximum number of values CloudWatch accepts for a
+// single metric in one EMF record.
+const maxEMFValues = 100
+
+// metrics collects values during an invocation and writes them to stdout in
+// CloudWatch Embedded Metric Format on flush. Recording every sample rather
+// than a pre-aggregated value lets CloudWatch compute p50/p95.
+//
+// Values are recorded against the current destination, the logical name set
+// by setDestination. Each destination's values are emitted with both the
+// FunctionName and the FunctionName+Destination dimension sets, so every
+// metric has a total and a per-destination variant.
+type metrics struct {
+ mu          sync.Mutex
+ namespace   string
+ function    string
+ destination string
+ values      map[metricKey][]float64
+ units       map[string]string
+ // started is when collection began, the start of the OTLP interval.
+ started time.Time
+}
+
+type metricKey struct {
+ destination string
+ name        string
+}
+
+func newMetrics() *metrics {
+ namespace := os.Getenv("METRICS_NAMESPACE")
+ if namespace == "" {
+  namespace = defaultMetricsNamespace
+ }
+ return &metrics{
+  namespace: namespace,
+  function:  functionName(),
+  values:    make(map[metricKey][]float64),
+  units:     make(map[string]string),
+  started:   time.Now(),
+ }
+}
+
+// setDestination sets the destination later values are recorded against.
+// It must already have been mapped by Config.metricDestination.
+func (m *metrics) setDestination(destination string) {
+ m.mu.Lock()
+ defer m.mu.Unlock()
+ m.destination = destination
+}
+
+// fork returns a collector recording against destination, for a worker to
+// fill on its own until merged back into m.
+func (m *metrics) fork(destination string) *metrics {
+ return &metrics{
+  namespace:   m.namespace,
+  function:    m.function,
+  destination: destination,
+  values:      make(map[metricKey][]float64),
+  units:       make(map[string]string),
+  started:     m.started,
+ }
+}
+
+// merge adds the values collected by f to m.
+func (m *metrics) merge(f *metrics) {
+ f.mu.Lock()
+ defer f.mu.Unlock()
+ m.mu.Lock()
+ defer m.mu.Unlock()
+ for key, values := range f.values {
+  m.values[key] = append(m.values[key], values...)
+ }
+ for name, unit := range f.units {
+  m.units[name] = unit
+ }
+}
+
+func (m *metrics) add(name, unit string, value float64) {
+ m.mu.Lock()
+ defer m.mu.Unlock()
+ key := metricKey{m.destination, name}
+ m.values[key] = append(m.values[key], value)
+ m.units[name] = unit
+}
+
+func (m *metrics) addDuration(name string, d time.Duration) {
+ m.add(name, unitMilliseconds, float64(d.Microseconds())/1000)
+}
+
+// flush writes the collected values as EMF records, one set per
+// destination, and resets the collector. Metrics with more than maxEMFValues
+// samples are split across records.
+func (m *metrics) flush() {
+ m.mu.Lock()
+ defer m.mu.Unlock()
+
+ byDestination := make(map[string][]string)
+ for key := range m.values {
+  byDestination[key.destination] = append(byDestination[key.destination], key.name)
+ }
+ destinations := make([]string, 0, len(byDestination))
+ for d := range byDestination {
+  destinations = append(destinations, d)
+ }
+ sort.Strings(destinations)
+ for _, d := range destinations {
+  names := byDestination[d]
+  sort.Strings(names)
+  m.flushDestination(d, names)
+ }
+ m.exportOTLP(otlp())
+
+ m.values = make(map[metricKey][]float64)
+ m.units = make(map[string]string)
+ m.started = time.Now()
+}
+
+func (m *metrics) flushDestination(destination string, names []string) {
+ dimensions := [][]string{{"FunctionName"}}
+ if destination != "" {
+  dimensions = append(dimensions, []string{"FunctionName", "Destination"})
+ }
+ for offset := 0; ; offset += maxEMFValues {
+  record := map[string]interface{}{}
+  var definitions []map[string]string
+  for _, name := range names {
+   values := m.values[metricKey{destination, name}]
+   if offset >= len(values) {
+    continue
+   }
+   end := offset + maxEMFValues
+   if end > len(values) {
+    end = len(values)
+   }
+   record[name] = values[offset:end]
+   definitions = append(definitions, map[string]string{"Name": name, "Unit": m.units[name]})
+  }
+  if len(definitions) == 0 {
+   break
+  }
+
+  record["FunctionName"] = m.function
+  if destination != "" {
+   record["Destination"] = destination
+  }
+  record["_aws"] = map[string]interface{}{
+   "Timestamp": time.Now().UnixMilli(),
+   "CloudWatchMetrics": []map[string]interface{}{{
+    "Namespace":  m.namespace,
+    "Dimensions": dimensions,
+    "Metrics":    definitions,
+   }},
+  }
+  line, err := json.Marshal(record)
+  if err != nil {
+   fmt.Fprintf(os.Stderr, "failed to marshal metrics: %v\n", err)
+   break
+  }
+  // EMF records must be written to stdout without the log package prefix.
+  fmt.Println(string(line))
+ }
+}
+
+// addFileMetrics records the FilesTransferred and FilesFailed counts of the
+// run, per tenant when files were delivered for tenants, so each destination
+// gets its own variant.
+func addFileMetrics(m *metrics, cfg *Config, report *transferReport) {
+ type counts struct {
+  transferred, failed int
+ }
+ byTenant := make(map[string]*counts)
+ for _, f := range report.Files {
+  c := byTenant[f.Tenant]
+  if c == nil {
+   c = &counts{}
+   byTenant[f.Tenant] = c
+  }
+  switch f.Status {
+  case statusTransferred:
+   c.transferred++
+  case statusFailed, statusPartial:
+   c.failed++
+  }
+ }
+ defer m.setDestination(cfg.MetricDestination(cfg.DestinationName))
+ for tenant, c := range byTenant {
+  name := cfg.DestinationName
+  if tenant != "" {
+   name = tenant
+  }
+  m.setDestination(cfg.MetricDestination(name))
+  m.add("FilesTransferred", unitCount, float64(c.transferred))
+  m.add("FilesFailed", unitCount, float64(c.failed))
+ }
+}
@@ -0,0 +1,38 @@
+package transfer
+
+import (
+ "fmt"
+ "time"
+)
+
+// bucketLockEnabled reports whether Object Lock is enabled on the source
+// bucket, so per-object lookups can be skipped when it is not.
+func (r *transferRun) bucketLockEnabled() (bool, error) {
+ enabled, err := r.s3.LockEnabled(s3Bucket)
+ if err != nil {
+  return false, fmt.Errorf("failed to get Object Lock configuration of %s: %w", s3Bucket, err)
+ }
+ return enabled, nil
+}
+
+// objectLock returns why key may not be removed: an active legal hold or a
+// retention period that has not yet passed. It returns "" when the object is
+// not locked.
+func (r *transferRun) objectLock(key string) (string, error) {
+ held, err := r.s3.LegalHold(s3Bucket, key)
+ if err != nil {
+  return "", fmt.Errorf("failed to get legal hold of %s: %w", key, err)
+ }
+ if held {
+  return "legal hold", nil
+ }
+
+ mode, until, err := r.s3.Retention(s3Bucket, key)
+ if err != nil {
+  return "", fmt.Errorf("failed to get retention of %s: %w", key, err)
+ }
+ if r.clock.Now().Before(until) {
+  return fmt.Sprintf("%s retention until %s", mode, until.Format(time.RFC3339)), nil
+ }
+ return "", nil
+}
@@ -0,0 +1,99 @@
+package transfer
+
+import (
+ "errors"
+ "fmt"
+ "log"
+ "os"
+ "strconv"
+
+ "github.com/pkg/sftp"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// categoryOwnership marks files delivered but left with the wrong owner
+// under REMOTE_CHOWN_STRICT.
+const categoryOwnership errorCategory = "ownership"
+
+// applyOwnership sets the owner of the delivered file at remotePath to
+// REMOTE_UID and REMOTE_GID, noting the ownership asked for and the one the
+// server reports afterwards in entry. A refused chown is a warning unless
+// REMOTE_CHOWN_STRICT is set; a server that does not implement setstat at
+// all is warned about once and not asked again for the rest of the run.
+func (r *transferRun) applyOwnership(client sftpfs.FS, remotePath string, entry *fileReport) error {
+ if !r.cfg.ChownEnabled() || r.chownUnsupported {
+  return nil
+ }
+ wanted, err := r.chown(client, remotePath)
+ entry.OwnerRequested = wanted
+ if info, serr := client.Stat(remotePath); serr == nil {
+  if st, ok := info.Sys().(*sftp.FileStat); ok {
+   entry.Owner = fmt.Sprintf("%d:%d", st.UID, st.GID)
+  }
+ }
+ return err
+}
+
+// applyDirOwnership sets the owner of a directory created for delivery, when
+// REMOTE_CHOWN_DIRS is set, with the same leniency as applyOwnership.
+func (r *transferRun) applyDirOwnership(client sftpfs.FS, dir string) error {
+ if !r.cfg.RemoteChownDirs || !r.cfg.ChownEnabled() || r.chownUnsupported {
+  return nil
+ }
+ _, err := r.chown(client, dir)
+ return err
+}
+
+// chown changes the owner of p, keeping the current uid or gid when only
+// one of REMOTE_UID and REMOTE_GID is set, and returns the "uid:gid" it
+// asked for.
+func (r *transferRun) chown(client sftpfs.FS, p string) (string, error) {
+ uid, gid := r.cfg.RemoteUID, r.cfg.RemoteGID
+ if uid < 0 || gid < 0 {
+  info, err := client.Stat(p)
+  if err != nil {
+   return "", r.chownFailed(p, fmt.Errorf("failed to stat %s for chown: %w", p, err))
+  }
+  if st, ok := info.Sys().(*sftp.FileStat); ok {
+   if uid < 0 {
+    uid = int(st.UID)
+   }
+   if gid < 0 {
+    gid = int(st.GID)
+   }
+  }
+ }
+ wanted := strconv.Itoa(uid) + ":" + strconv.Itoa(gid)
+ err := client.Chown(p, uid, gid)
+ if err == nil {
+  r.cfg.Debugf("Set owner of %s to %s", p, wanted)
+  r.metrics.add("ChownApplied", unitCount, 1)
+  return wanted, nil
+ }
+ var se *sftp.StatusError
+ if errors.As(err, &se) && se.FxCode() == sftp.ErrSSHFxOpUnsupported {
+  r.chownUnsupported = true
+  if r.cfg.RemoteChownStrict {
+   return wanted, withCategory(categoryOwnership, fmt.Errorf("REMOTE_CHOWN_STRICT is set but the SFTP server does not support setstat: %w", err))
+  }
+  log.Printf("WARNING: the SFTP server does not support setstat, delivered files keep the owner the server gives them: %v", err)
+  return wanted, nil
+ }
+ return wanted, r.chownFailed(p, fmt.Errorf("failed to chown %s to %s: %w", p, wanted, err))
+}
+
+// chownFailed fails with err under REMOTE_CHOWN_STRICT, and otherwise only
+// logs it.
+func (r *transferRun) chownFailed(p string, err error) error {
+ r.metrics.add("ChownFailed", unitCount, 1)
+ if r.cfg.RemoteChownStrict {
+  return withCategory(categoryOwnership, err)
+ }
+ if isPermissionDenied(err) || os.IsPermission(err) {
+  log.Printf("WARNING: server refused to change the owner of %s, leaving it as is: %v", p, err)
+ } else {
+  log.Printf("WARNING: %v", err)
+ }
+ return nil
+}
@@ -0,0 +1,40 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+)
+
+// transferPayloadFiles delivers the presigned URLs and inline files carried
+// in the payload through the normal upload pipeline instead of listing the
+// source bucket. A file that fails only fails its own item.
+func (r *transferRun) transferPayloadFiles(sftpConfig *SFTPConfig) (err error) {
+ conn, release, err := r.connect(sftpConfig)
+ if err != nil {
+  r.report.addFile(fileReport{Key: "payload", Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+  return fmt.Errorf("failed to copy file to SFTP: %w", err)
+ }
+ defer func() { release(err != nil) }()
+ r.conn = conn
+ r.sftpConfig = sftpConfig
+ r.stats.Host = conn.Timing.Address
+ r.stats.Found = len(r.presigned) + len(r.inline)
+
+ var failed int
+ for _, src := range r.presigned {
+  if err := r.copyURLToSFTP(conn.SFTP, src); err != nil {
+   log.Printf("Failed to copy presigned URL to SFTP: %v", err)
+   failed++
+  }
+ }
+ for _, f := range r.inline {
+  if err := r.deliverInline(conn.SFTP, f); err != nil {
+   log.Printf("Failed to write inline file %s to SFTP: %v", f.Name, err)
+   failed++
+  }
+ }
+ if failed > 0 {
+  return fmt.Errorf("%d of %d payload file(s) failed", failed, r.stats.Found)
+ }
+ return nil
+}
@@ -0,0 +1,183 @@
+package transfer
+
+import (
+ "bytes"
+ "encoding/json"
+ "fmt"
+ "log"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// planVersion is the Version of transferPlan.
+const planVersion = 1
+
+// Actions recorded in a plan.
+const (
+ planTransfer = "transfer"
+ planSkip     = "skip"
+ planArchived = "archived"
+)
+
+// pathSourcePlan marks remote paths taken from an executed plan.
+const pathSourcePlan = "plan"
+
+// categoryPlanStale marks a plan refused because the objects it lists
+// changed since it was written.
+const categoryPlanStale errorCategory = "plan_stale"
+
+// transferPlan is the reviewable list of what a dry run would deliver. A
+// later invocation with {"executePlan":"s3://..."} delivers exactly these
+// actions, provided no planned object changed in between.
+type transferPlan struct {
+ Version      int          `json:"version"`
+ RequestID    string       `json:"requestId"`
+ CreatedAt    time.Time    `json:"createdAt"`
+ Destination  string       `json:"destination"`
+ SourcePrefix string       `json:"sourcePrefix"`
+ RemoteDir    string       `json:"remoteDir"`
+ Actions      []planAction `json:"actions"`
+}
+
+// planAction is one planned object. RemotePath is the routed path, before
+// any relative path is resolved against the server's login directory.
+type planAction struct {
+ Key        string `json:"key"`
+ ETag       string `json:"etag"`
+ Bytes      int64  `json:"bytes"`
+ Action     string `json:"action"`
+ RemotePath string `json:"remotePath,omitempty"`
+ Rule       string `json:"rule,omitempty"`
+}
+
+// planReport summarizes the plan written by a dry run or executed by the
+// run.
+type planReport struct {
+ Location string `json:"location"`
+ Actions  int    `json:"actions"`
+ Bytes    int64  `json:"bytes"`
+ Executed bool   `json:"executed"`
+}
+
+// writePlan routes keys without connecting to the server and writes the
+// resulting plan under PLAN_PREFIX. Nothing is delivered. Checks that need
+// the server, such as OVERWRITE_POLICY=skip, are made when the plan is
+// executed.
+func (r *transferRun) writePlan(keys []string, archived map[string]string) error {
+ var deliverable []string
+ for _, key := range keys {
+  if _, ok := archived[key]; !ok {
+   deliverable = append(deliverable, key)
+  }
+ }
+ if err := r.checkCollisions(deliverable); err != nil {
+  return err
+ }
+ plan := &transferPlan{
+  Version:      planVersion,
+  RequestID:    r.report.RequestID,
+  CreatedAt:    r.clock.Now().UTC(),
+  Destination:  r.cfg.DestinationName,
+  SourcePrefix: r.cfg.SourcePrefix,
+  RemoteDir:    r.cfg.RemoteDir,
+ }
+ summary := &planReport{}
+ for _, key := range keys {
+  head, err := r.s3.Head(s3Bucket, key)
+  if err != nil {
+   return classifyS3Error(fmt.Errorf("failed to plan %s: %w", key, err))
+  }
+  action := planAction{Key: key, ETag: head.ETag, Bytes: head.Size}
+  if class, ok := archived[key]; ok {
+   action.Action, action.Rule = planArchived, class
+  } else {
+   rt, err := r.route(&deliveryItem{key: key, name: r.remoteName(key), metadata: head.Metadata})
+   if err != nil {
+    return fmt.Errorf("failed to plan %s: %w", key, err)
+   }
+   action.RemotePath, action.Rule = rt.path, rt.rule
+   action.Action = planTransfer
+   if rt.skip {
+    action.Action = planSkip
+   } else {
+    summary.Bytes += action.Bytes
+   }
+  }
+  log.Printf("Plan: %s %s -> %s bytes=%d", action.Action, key, action.RemotePath, action.Bytes)
+  plan.Actions = append(plan.Actions, action)
+ }
+ summary.Actions = len(plan.Actions)
+
+ body, err := json.MarshalIndent(plan, "", "  ")
+ if err != nil {
+  return fmt.Errorf("failed to marshal plan: %w", err)
+ }
+ key := r.cfg.PlanPrefix + r.cfg.DestinationName + "/" + plan.CreatedAt.Format("2006/01/02") + "/" + plan.RequestID + ".json"
+ err = r.s3.Put(source.PutInput{
+  Bucket:      s3Bucket,
+  Key:         key,
+  Body:        bytes.NewReader(body),
+  ContentType: "application/json",
+ })
+ if err != nil {
+  return classifyS3Error(fmt.Errorf("failed to write plan: %w", err))
+ }
+ summary.Location = "s3://" + s3Bucket + "/" + key
+ r.report.Plan = summary
+ log.Printf("Dry run: wrote plan of %d action(s) totalling %d bytes to %s", summary.Actions, summary.Bytes, summary.Location)
+ return nil
+}
+
+// loadPlan reads the plan given by executePlan and checks every planned object
+// still has the ETag it was planned with. Any change refuses the whole plan
+// before anything is delivered.
+func (r *transferRun) loadPlan() ([]string, error) {
+ bucket, key, _ := config.ParsePlanURI(r.cfg.ExecutePlan)
+ out, err := r.s3.Get(source.GetInput{Bucket: bucket, Key: key})
+ if err != nil {
+  return nil, classifyS3Error(fmt.Errorf("failed to read plan %s: %w", r.cfg.ExecutePlan, err))
+ }
+ defer out.Body.Close()
+ plan := &transferPlan{}
+ if err := json.NewDecoder(out.Body).Decode(plan); err != nil {
+  return nil, withCategory(categoryConfig, fmt.Errorf("failed to decode plan %s: %w", r.cfg.ExecutePlan, err))
+ }
+ if plan.Version != planVersion {
+  return nil, withCategory(categoryConfig, fmt.Errorf("plan %s has unsupported version %d", r.cfg.ExecutePlan, plan.Version))
+ }
+ if plan.Destination != r.cfg.DestinationName {
+  return nil, withCategory(categoryConfig, fmt.Errorf("plan %s is for destination %q, not %q", r.cfg.ExecutePlan, plan.Destination, r.cfg.DestinationName))
+ }
+
+ summary := &planReport{Location: r.cfg.ExecutePlan, Actions: len(plan.Actions), Executed: true}
+ r.report.Plan = summary
+ r.planned = make(map[string]planAction, len(plan.Actions))
+ r.sizes = make(map[string]int64, len(plan.Actions))
+ var keys, changed []string
+ for _, action := range plan.Actions {
+  if action.Action != planTransfer {
+   continue
+  }
+  head, err := r.s3.Head(s3Bucket, action.Key)
+  if err != nil {
+   return nil, classifyS3Error(fmt.Errorf("failed to check planned object %s: %w", action.Key, err))
+  }
+  if etag := head.ETag; etag != action.ETag {
+   changed = append(changed, action.Key)
+   continue
+  }
+  r.planned[action.Key] = action
+  r.sizes[action.Key] = action.Bytes
+  summary.Bytes += action.Bytes
+  keys = append(keys, action.Key)
+ }
+ if len(changed) > 0 {
+  return nil, withCategory(categoryPlanStale, fmt.Errorf("plan %s is stale: %d object(s) changed since planning, first %s",
+   r.cfg.ExecutePlan, len(changed), changed[0]))
+ }
+ log.Printf("Executing plan %s from %s: %d of %d action(s) to transfer, %d bytes",
+  r.cfg.ExecutePlan, plan.CreatedAt.Format(time.RFC3339), len(keys), len(plan.Actions), summary.Bytes)
+ return keys, nil
+}
@@ -0,0 +1,88 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// preflightProbePrefix starts the name of the zero-byte file written to
+// check that the remote directory is writable.
+const preflightProbePrefix = ".s3-sftp-preflight-"
+
+// preflight checks that the remote directory can be written before any object
+// is read from S3, so a permission change on the server fails the run once
+// instead of file by file. Every failure is a config-category error.
+func (r *transferRun) preflight(client sftpfs.FS) error {
+ start := r.clock.Now()
+ dir := r.resolveRemotePath(r.cfg.RemoteDir)
+ fail := func(err error) error {
+  r.metrics.add("PreflightFailed", unitCount, 1)
+  log.Printf("Preflight failed: %v", err)
+  return withCategory(categoryConfig, fmt.Errorf("preflight failed: %w", err))
+ }
+
+ if err := r.ensureRemoteDir(client, dir); err != nil {
+  return fail(err)
+ }
+ info, err := client.Stat(dir)
+ if err != nil {
+  return fail(fmt.Errorf("remote directory %s: %w", dir, err))
+ }
+ if !info.IsDir() {
+  return fail(fmt.Errorf("remote path %s is not a directory", dir))
+ }
+
+ if r.cfg.PreflightProbe {
+  probe := remoteJoin(dir, preflightProbePrefix+r.report.RequestID)
+  if err := r.probeWrite(client, probe); err != nil {
+   return fail(err)
+  }
+ }
+ log.Printf("Preflight passed for %s duration_ms=%d", dir, r.clock.Since(start).Milliseconds())
+ return nil
+}
+
+// probeWrite creates and removes a zero-byte file at probe. With atomic
+// uploads on, the file is created under the temporary suffix and renamed to
+// probe first. A server that does not support rename is not a failure: it is
+// recorded on the connection so ATOMIC_RENAME_FALLBACK applies from the first
+// file.
+func (r *transferRun) probeWrite(client sftpfs.FS, probe string) error {
+ created := probe
+ if r.atomicEnabled() {
+  created = probe + atomicTempSuffix
+ }
+ f, err := client.Create(created)
+ if err != nil {
+  return fmt.Errorf("failed to create probe file %s: %w", created, err)
+ }
+ if err := f.Close(); err != nil {
+  client.Remove(created)
+  return fmt.Errorf("failed to close probe file %s: %w", created, err)
+ }
+ if created != probe {
+  err := renameOver(client, created, probe)
+  switch {
+  case err == nil:
+   created = probe
+  case isRenameUnsupported(err):
+   log.Printf("Preflight: SFTP server does not support rename, applying ATOMIC_RENAME_FALLBACK=%s", r.cfg.AtomicRenameFallback)
+   if r.conn != nil {
+    r.conn.RenameUnsupported.Store(true)
+   }
+   if r.cfg.AtomicRenameFallback == config.RenameFallbackDowngrade {
+    r.atomicDowngraded = true
+   }
+  default:
+   client.Remove(created)
+   return fmt.Errorf("failed to rename probe file %s to %s: %w", created, probe, err)
+  }
+ }
+ if err := client.Remove(created); err != nil {
+  return fmt.Errorf("failed to remove probe file %s: %w", created, err)
+ }
+ return nil
+}
@@ -0,0 +1,155 @@
+package transfer
+
+import (
+ "fmt"
+ "io"
+ "log"
+ "net/http"
+ "net/url"
+ "path"
+ "strconv"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// categorySourceAccess means a presigned source URL was expired or refused.
+const categorySourceAccess errorCategory = "source_access"
+
+const presignedMaxAttempts = 3
+
+// presignedClient downloads presigned URLs. Only the wait for response
+// headers is bounded so large bodies are not cut off.
+var presignedClient = &http.Client{
+ Transport: &http.Transport{
+  Proxy:                 http.ProxyFromEnvironment,
+  ResponseHeaderTimeout: 30 * time.Second,
+ },
+}
+
+// redactURL drops the query string, which carries the signature, so the URL
+// can be logged and reported.
+func redactURL(u *url.URL) string {
+ return u.Scheme + "://" + u.Host + u.Path
+}
+
+// presignedExpiry returns when a SigV4 presigned URL expires, if it says.
+func presignedExpiry(u *url.URL) (time.Time, bool) {
+ q := u.Query()
+ signed, err := time.Parse("20060102T150405Z", q.Get("X-Amz-Date"))
+ if err != nil {
+  return time.Time{}, false
+ }
+ seconds, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+ if err != nil {
+  return time.Time{}, false
+ }
+ return signed.Add(time.Duration(seconds) * time.Second), true
+}
+
+func (r *transferRun) copyURLToSFTP(client sftpfs.FS, src config.PresignedSource) error {
+ u, err := url.Parse(src.URL)
+ if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+  err = withCategory(categoryConfig, fmt.Errorf("invalid presigned URL"))
+  r.report.addFile(fileReport{Key: "presigned", Status: statusFailed, Category: string(categoryConfig), Error: err.Error()})
+  return err
+ }
+ key := redactURL(u)
+ fail := func(err error) error {
+  r.report.addFile(fileReport{Key: key, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+  return err
+ }
+
+ resp, err := getPresigned(u, r.retries, r.clock)
+ if err != nil {
+  return fail(err)
+ }
+ defer resp.Body.Close()
+
+ name := src.RemoteName
+ if name == "" {
+  name = path.Base(u.Path)
+ }
+ log.Printf("Copying presigned URL %s to SFTP as %s", key, name)
+ var body io.Reader = resp.Body
+ if resp.ContentLength >= 0 {
+  body = &sizeCheckReader{src: resp.Body, want: resp.ContentLength}
+ }
+ return r.deliver(client, &deliveryItem{
+  key:  key,
+  name: name,
+  body: body,
+  size: resp.ContentLength,
+ })
+}
+
+// getPresigned fetches u, retrying transient failures until the URL
+// expires or the run's retry budget is spent. Expired and refused URLs are
+// categorised as source access failures.
+func getPresigned(u *url.URL, budget *retryBudget, clk clock) (*http.Response, error) {
+ expires, hasExpiry := presignedExpiry(u)
+ var lastErr error
+ for attempt := 1; attempt <= presignedMaxAttempts; attempt++ {
+  if hasExpiry && clk.Now().After(expires) {
+   return nil, withCategory(categorySourceAccess, fmt.Errorf("presigned URL expired at %s", expires.Format(time.RFC3339)))
+  }
+  if attempt > 1 {
+   if !budget.take("presigned URL fetch") {
+    break
+   }
+   delay := time.Duration(attempt-1) * time.Second
+   clk.Sleep(delay)
+   budget.spent(delay)
+  }
+  resp, err := presignedClient.Get(u.String())
+  if err != nil {
+   // The error text includes the full URL; keep the signature out
+   // of logs and reports.
+   lastErr = withCategory(categoryConnection, fmt.Errorf("failed to fetch %s (attempt %d)", redactURL(u), attempt))
+   continue
+  }
+  switch {
+  case resp.StatusCode == http.StatusOK:
+   return resp, nil
+  case resp.StatusCode == http.StatusForbidden:
+   resp.Body.Close()
+   return nil, withCategory(categorySourceAccess, fmt.Errorf("presigned URL refused with %s; it may be expired or revoked", resp.Status))
+  case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+   resp.Body.Close()
+   lastErr = withCategory(categoryConnection, fmt.Errorf("presigned URL returned %s (attempt %d)", resp.Status, attempt))
+  default:
+   resp.Body.Close()
+   return nil, withCategory(categorySourceAccess, fmt.Errorf("presigned URL returned %s", resp.Status))
+  }
+ }
+ return nil, lastErr
+}
+
+// sizeCheckReader fails the transfer when the body ends before or after
+// the announced Content-Length.
+type sizeCheckReader struct {
+ src  io.Reader
+ want int64
+ got  int64
+}
+
+func (s *sizeCheckReader) Read(p []byte) (int, error) {
+ n, err := s.src.Read(p)
+ s.got += int64(n)
+ if err == io.EOF && s.got != s.want {
+  return n, withCategory(categoryTransient, &sizeMismatchError{Expected: s.want, Received: s.got})
+ }
+ return n, err
+}
+
+// sizeMismatchError is the error of a sizeCheckReader whose body did not
+// match its Content-Length.
+type sizeMismatchError struct {
+ Expected int64
+ Received int64
+}
+
+func (e *sizeMismatchError) Error() string {
+ return fmt.Sprintf("received %d bytes, Content-Length was %d", e.Received, e.Expected)
+}
@@ -0,0 +1,67 @@
+package transfer
+
+import (
+ "net/http"
+ "net/http/httptest"
+ "net/url"
+ "reflect"
+ "sync"
+ "testing"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/testutil"
+)
+
+func TestGetPresignedBacksOff(t *testing.T) {
+ var mu sync.Mutex
+ requests := 0
+ srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+  mu.Lock()
+  requests++
+  n := requests
+  mu.Unlock()
+  if n < presignedMaxAttempts {
+   w.WriteHeader(http.StatusServiceUnavailable)
+   return
+  }
+  w.Write([]byte("ok"))
+ }))
+ defer srv.Close()
+ u, _ := url.Parse(srv.URL + "/orders.csv")
+ clk := testutil.NewClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+ budget := newRetryBudget(&Config{}, newMetrics())
+
+ resp, err := getPresigned(u, budget, clk)
+ if err != nil {
+  t.Fatalf("getPresigned failed: %v", err)
+ }
+ resp.Body.Close()
+ if want := []time.Duration{time.Second, 2 * time.Second}; !reflect.DeepEqual(clk.Sleeps(), want) {
+  t.Errorf("slept %v, want %v", clk.Sleeps(), want)
+ }
+ if r := budget.report(); r.Attempts != 2 || r.BackoffMs != 3000 {
+  t.Errorf("retry budget = %+v, want 2 retries over 3s", r)
+ }
+}
+
+func TestGetPresignedExpiresWhileBackingOff(t *testing.T) {
+ clk := testutil.NewClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+ requests := 0
+ srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+  requests++
+  clk.Advance(time.Second)
+  w.WriteHeader(http.StatusServiceUnavailable)
+ }))
+ defer srv.Close()
+ // Each request takes a second, so the URL, signed at noon for 2s, has
+ // expired by the time the third attempt comes round.
+ u, _ := url.Parse(srv.URL + "/orders.csv?X-Amz-Date=20240501T120000Z&X-Amz-Expires=2")
+
+ _, err := getPresigned(u, newRetryBudget(&Config{}, newMetrics()), clk)
+ if got := categoryOf(err); got != categorySourceAccess {
+  t.Fatalf("category = %s, want %s (%v)", got, categorySourceAccess, err)
+ }
+ if requests != 2 {
+  t.Errorf("made %d request(s), want 2 before the URL expired", requests)
+ }
+}
@@ -0,0 +1,81 @@
+package transfer
+
+import (
+ "bytes"
+ "fmt"
+ "log"
+ "runtime"
+ "runtime/pprof"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// runProfiler holds the CPU profile of a run started with {"profile":true}.
+// A nil runProfiler does nothing, so runs without the flag pay nothing.
+type runProfiler struct {
+ cpu bytes.Buffer
+}
+
+// startProfiling starts CPU profiling when enabled is set. A profile that
+// cannot be started is logged and the run goes ahead without it.
+func startProfiling(enabled bool) *runProfiler {
+ if !enabled {
+  return nil
+ }
+ p := &runProfiler{}
+ if err := pprof.StartCPUProfile(&p.cpu); err != nil {
+  log.Printf("WARNING: failed to start CPU profile: %v", err)
+  return nil
+ }
+ log.Println("CPU profiling enabled for this run")
+ return p
+}
+
+// finish stops CPU profiling, takes a heap profile and uploads both under
+// PROFILE_PREFIX, returning the s3:// URIs written. Upload failures are only
+// logged, so they never change the outcome of the run.
+func (p *runProfiler) finish(svc source.Store, cfg *Config, requestID string) []string {
+ if p == nil {
+  return nil
+ }
+ pprof.StopCPUProfile()
+ var heap bytes.Buffer
+ // A GC first makes the heap profile show live data as of the end
+ // of the run rather than at the last collection.
+ runtime.GC()
+ if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+  log.Printf("WARNING: failed to write heap profile: %v", err)
+ }
+
+ bucket := cfg.ProfileBucket
+ if bucket == "" {
+  bucket = s3Bucket
+ }
+ var uris []string
+ for _, prof := range []struct {
+  ext  string
+  body *bytes.Buffer
+ }{
+  {".cpu.pprof", &p.cpu},
+  {".heap.pprof", &heap},
+ } {
+  if prof.body.Len() == 0 {
+   continue
+  }
+  key := cfg.ProfilePrefix + requestID + prof.ext
+  err := svc.Put(source.PutInput{
+   Bucket:      bucket,
+   Key:         key,
+   Body:        bytes.NewReader(prof.body.Bytes()),
+   ContentType: "application/octet-stream",
+  })
+  if err != nil {
+   log.Printf("WARNING: failed to upload profile %s: %v", key, err)
+   continue
+  }
+  uri := fmt.Sprintf("s3://%s/%s", bucket, key)
+  log.Printf("Wrote profile %s (%d bytes)", uri, prof.body.Len())
+  uris = append(uris, uri)
+ }
+ return uris
+}
@@ -0,0 +1,473 @@
+package transfer
+
+import (
+ "errors"
+ "fmt"
+ "io"
+ "log"
+ "mime"
+ "net/http"
+ "net/url"
+ "os"
+ "path"
+ "sort"
+ "strconv"
+ "strings"
+ "sync"
+ "time"
+
+ "github.com/pkg/sftp"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// Categories of remote entries that are skipped rather than pulled.
+const (
+ categorySymlink         errorCategory = "symlink"
+ categoryDanglingSymlink errorCategory = "dangling_symlink"
+)
+
+// pullFiles copies the files under PULL_REMOTE_DIR on the SFTP server to the
+// bucket under PULL_PREFIX, the reverse of the default direction.
+func (r *transferRun) pullFiles(sftpConfig *SFTPConfig) (err error) {
+ dir := r.cfg.PullRemoteDir
+ conn, release, err := r.connect(sftpConfig)
+ if err != nil {
+  r.report.addFile(fileReport{Key: dir, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+  log.Printf("Failed to pull files from SFTP: %v", err)
+  return fmt.Errorf("failed to pull files from SFTP: %w", err)
+ }
+ defer func() { release(err != nil) }()
+ r.conn = conn
+ r.sftpConfig = sftpConfig
+ r.stats.Host = conn.Timing.Address
+ client := conn.SFTP
+ dir = r.resolveRemotePath(dir)
+
+ transferStart := r.clock.Now()
+ defer func() { r.stats.Transfer = r.clock.Since(transferStart) }()
+
+ // Symlink targets are resolved by the server; compare them against
+ // the real path of the directory, which may itself be a link.
+ root, err := client.RealPath(dir)
+ root = config.NormalizeRemotePath(root)
+ if err != nil {
+  err = withCategory(categoryConnection, fmt.Errorf("failed to resolve remote directory %s: %w", dir, err))
+  r.report.addFile(fileReport{Key: dir, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+  return err
+ }
+ w := &pullWalker{run: r, client: client, root: root, filter: newNameFilter(r.cfg.PullInclude, r.cfg.PullExclude), visited: map[string]bool{root: true}}
+ if err := w.walk(dir, "", 1); err != nil {
+  r.report.addFile(fileReport{Key: dir, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+  return err
+ }
+ log.Printf("Found %d remote file(s) under %s entries=%d truncated=%t", len(w.files), dir, w.entries, w.truncated)
+ r.stats.Found = w.entries
+ if w.truncated {
+  r.metrics.add("PullEntryCapReached", unitCount, 1)
+ }
+
+ if r.cfg.PullStabilityWait > 0 && len(w.files) > 0 {
+  if w.files, err = r.stableFiles(client, w.files); err != nil {
+   r.report.addFile(fileReport{Key: dir, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+   return err
+  }
+ }
+ for _, f := range w.files {
+  if err := r.pullFile(client, f); err != nil {
+   return err
+  }
+ }
+ if n := r.stats.PatternFiltered; n > 0 {
+  log.Printf("Filtered %d remote file(s) by PULL_INCLUDE/PULL_EXCLUDE", n)
+ }
+ // Files left pending show the partner is producing, so they do not
+ // count towards the empty-run streak.
+ if len(w.files) == 0 && r.report.count(statusPending) == 0 {
+  r.report.EmptyRun = true
+  log.Println("No files to pull")
+ }
+ if n := r.report.count(statusFailed); n > 0 {
+  return fmt.Errorf("%d remote director(ies) could not be read", n)
+ }
+ return nil
+}
+
+// categoryPermission means the server refused access to a remote path.
+const categoryPermission errorCategory = "permission_denied"
+
+// remoteFile is a file found by the pull traversal. rel is its path
+// relative to the pull directory.
+type remoteFile struct {
+ path string
+ rel  string
+ info os.FileInfo
+ // checks records the outcome of each readiness check, such as
+ // "age:ok", for the report.
+ checks []string
+}
+
+// leavePending reports f as left for a later run.
+func (r *transferRun) leavePending(f remoteFile, reason string) {
+ log.Printf("Leaving %s for a later run: %s", f.path, reason)
+ r.report.addFile(fileReport{Key: f.path, RemotePath: f.path, Checks: strings.Join(f.checks, " "), Status: statusPending, Error: reason})
+}
+
+// stabilityConcurrency bounds the Stat requests in flight during the
+// stability check.
+const stabilityConcurrency = 8
+
+// stableFiles waits PULL_STABILITY_WAIT once for all files, stats each of
+// them again concurrently and returns those whose size did not change. The
+// others are reported as pending.
+func (r *transferRun) stableFiles(client sftpfs.FS, files []remoteFile) ([]remoteFile, error) {
+ log.Printf("Waiting %s to check %d remote file(s) are not growing", r.cfg.PullStabilityWait, len(files))
+ r.clock.Sleep(r.cfg.PullStabilityWait)
+
+ sizes := make([]int64, len(files))
+ errs := make([]error, len(files))
+ var wg sync.WaitGroup
+ sem := make(chan struct{}, stabilityConcurrency)
+ for i := range files {
+  wg.Add(1)
+  sem <- struct{}{}
+  go func(i int) {
+   defer wg.Done()
+   defer func() { <-sem }()
+   info, err := client.Stat(files[i].path)
+   if err == nil {
+    sizes[i] = info.Size()
+   }
+   errs[i] = err
+  }(i)
+ }
+ wg.Wait()
+
+ var stable []remoteFile
+ for i, f := range files {
+  if errs[i] != nil {
+   if errors.Is(errs[i], os.ErrNotExist) {
+    r.cfg.Debugf("Remote file %s disappeared during the stability check", f.path)
+    continue
+   }
+   return nil, withCategory(categoryConnection, fmt.Errorf("failed to stat %s: %w", f.path, errs[i]))
+  }
+  if sizes[i] != f.info.Size() {
+   f.checks = append(f.checks, "stability:growing")
+   r.leavePending(f, fmt.Sprintf("still growing: size changed from %d to %d bytes in %s", f.info.Size(), sizes[i], r.cfg.PullStabilityWait))
+   continue
+  }
+  f.checks = append(f.checks, "stability:ok")
+  stable = append(stable, f)
+ }
+ return stable, nil
+}
+
+// pullWalker collects the files to pull. Directories are read in name order
+// so runs are reproducible, down to PULL_MAX_DEPTH levels and until
+// PULL_MAX_ENTRIES entries have been seen. visited holds the real paths of
+// directories already read so symlinked directories cannot loop.
+type pullWalker struct {
+ run       *transferRun
+ client    sftpfs.FS
+ root      string
+ filter    *nameFilter
+ visited   map[string]bool
+ files     []remoteFile
+ entries   int
+ truncated bool
+}
+
+// walk reads dir, at depth levels below the pull directory. A subdirectory
+// the server denies access to is reported and skipped; any other failure is
+// returned.
+func (w *pullWalker) walk(dir, rel string, depth int) error {
+ r := w.run
+ entries, err := w.client.ReadDir(dir)
+ if err != nil {
+  if rel != "" && isPermissionDenied(err) {
+   log.Printf("Skipping remote directory %s: %v", dir, err)
+   r.report.addFile(fileReport{Key: dir, RemotePath: dir, Status: statusFailed, Category: string(categoryPermission), Error: err.Error()})
+   return nil
+  }
+  return withCategory(categoryConnection, fmt.Errorf("failed to list remote directory %s: %w", dir, err))
+ }
+ sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+ for _, entry := range entries {
+  if w.entries == r.cfg.PullMaxEntries {
+   if !w.truncated {
+    log.Printf("Stopped remote traversal at PULL_MAX_ENTRIES=%d; remaining entries are left for later runs", r.cfg.PullMaxEntries)
+   }
+   w.truncated = true
+   return nil
+  }
+  w.entries++
+  remotePath := remoteJoin(dir, entry.Name())
+  entryRel := path.Join(rel, entry.Name())
+  info, ok := r.resolvePullEntry(w.client, w.root, remotePath, entry)
+  if !ok {
+   continue
+  }
+  if !info.IsDir() {
+   if !w.filter.match(entryRel) {
+    r.cfg.Debugf("Skipping %s: excluded by PULL_INCLUDE/PULL_EXCLUDE", remotePath)
+    r.stats.Filtered++
+    r.stats.PatternFiltered++
+    continue
+   }
+   f := remoteFile{path: remotePath, rel: entryRel, info: info}
+   if r.cfg.PullMinAge > 0 {
+    if age := r.clock.Since(info.ModTime()); age < r.cfg.PullMinAge+r.cfg.PullClockSkew {
+     f.checks = append(f.checks, "age:too_new")
+     r.leavePending(f, fmt.Sprintf("too new: modified %s ago, PULL_MIN_AGE is %s", age.Round(time.Second), r.cfg.PullMinAge))
+     continue
+    }
+    f.checks = append(f.checks, "age:ok")
+   }
+   w.files = append(w.files, f)
+   continue
+  }
+  if r.cfg.PullMaxDepth > 0 && depth >= r.cfg.PullMaxDepth {
+   r.stats.Filtered++
+   continue
+  }
+  real, err := w.client.RealPath(remotePath)
+  real = config.NormalizeRemotePath(real)
+  if err != nil {
+   return withCategory(categoryConnection, fmt.Errorf("failed to resolve remote directory %s: %w", remotePath, err))
+  }
+  if w.visited[real] {
+   r.cfg.Debugf("Not descending into %s: %s was already read", remotePath, real)
+   continue
+  }
+  w.visited[real] = true
+  if err := w.walk(remotePath, entryRel, depth+1); err != nil {
+   return err
+  }
+ }
+ return nil
+}
+
+func isPermissionDenied(err error) bool {
+ var se *sftp.StatusError
+ return errors.As(err, &se) && se.FxCode() == sftp.ErrSSHFxPermissionDenied
+}
+
+// resolvePullEntry returns the file info a directory entry should be pulled
+// as. Entries that are not symlinks are returned as listed. Symlinks are
+// skipped unless FOLLOW_SYMLINKS is set, in which case the target is used
+// provided it exists and lies under root; dangling links and links leaving
+// root are skipped and reported without failing the run.
+func (r *transferRun) resolvePullEntry(client sftpfs.FS, root, remotePath string, entry os.FileInfo) (os.FileInfo, bool) {
+ if entry.Mode()&os.ModeSymlink == 0 {
+  return entry, true
+ }
+ skip := func(category errorCategory, reason string) (os.FileInfo, bool) {
+  log.Printf("Skipping symlink %s: %s", remotePath, reason)
+  r.report.addFile(fileReport{Key: remotePath, RemotePath: remotePath, Status: statusSkipped, Category: string(category), Error: reason})
+  r.metrics.add("SymlinksSkipped", unitCount, 1)
+  return nil, false
+ }
+ if !r.cfg.FollowSymlinks {
+  return skip(categorySymlink, "FOLLOW_SYMLINKS is off")
+ }
+ target, err := client.RealPath(remotePath)
+ target = config.NormalizeRemotePath(target)
+ if err != nil {
+  return skip(categoryDanglingSymlink, fmt.Sprintf("cannot resolve target: %v", err))
+ }
+ if target != root && !strings.HasPrefix(target, strings.TrimSuffix(root, "/")+"/") {
+  return skip(categorySymlink, fmt.Sprintf("target %s is outside %s", target, root))
+ }
+ info, err := client.Stat(remotePath)
+ if err != nil {
+  return skip(categoryDanglingSymlink, fmt.Sprintf("target %s does not exist", target))
+ }
+ r.cfg.Debugf("Following symlink %s to %s", remotePath, target)
+ return info, true
+}
+
+// pullKey returns the S3 key f is uploaded to. With PULL_KEY_TEMPLATE set
+// the template is expanded, with dates taken from now or the remote mtime as
+// PULL_KEY_TIME says; otherwise the key is PULL_PREFIX followed by the file
+// name, or by its relative path with PRESERVE_PATHS. The key may not start
+// with "/" or contain ".." segments.
+func (r *transferRun) pullKey(f remoteFile, now time.Time) (string, error) {
+ var key string
+ switch {
+ case r.cfg.PullKeyTemplate != "":
+  t := now
+  if r.cfg.PullKeyTime == config.PullKeyTimeMtime {
+   t = f.info.ModTime()
+  }
+  key = renderNameTemplate(r.cfg.PullKeyTemplate, t.UTC())
+  key = strings.NewReplacer("{remote_path}", f.rel, "{filename}", path.Base(f.rel)).Replace(key)
+ case r.cfg.PreservePaths:
+  key = r.cfg.PullPrefix + f.rel
+ default:
+  key = r.cfg.PullPrefix + path.Base(f.rel)
+ }
+ if strings.HasPrefix(key, "/") {
+  return "", fmt.Errorf("key %q for %s starts with \"/\"", key, f.path)
+ }
+ for _, segment := range strings.Split(key, "/") {
+  if segment == ".." {
+   return "", fmt.Errorf("key %q for %s contains \"..\"", key, f.path)
+  }
+ }
+ return key, nil
+}
+
+// User metadata keys set on pulled objects, returned by S3 as
+// x-amz-meta-source-mtime and so on. Downstream jobs rely on these names, so
+// they must not change.
+const (
+ // metaSourceMtime is the remote modification time in RFC 3339, UTC.
+ metaSourceMtime = "source-mtime"
+ // metaSourceSize is the remote size in bytes.
+ metaSourceSize = "source-size"
+ // metaSourcePath is the absolute remote path, percent-encoded where
+ // it is not printable ASCII.
+ metaSourcePath = "source-path"
+ // metaSourceMode is the remote permission bits in octal.
+ metaSourceMode = "source-mode"
+)
+
+// pulledMetadata describes the remote file f as S3 user metadata.
+func pulledMetadata(f remoteFile) map[string]string {
+ return map[string]string{
+  metaSourceMtime: f.info.ModTime().UTC().Format(time.RFC3339),
+  metaSourceSize:  strconv.FormatInt(f.info.Size(), 10),
+  metaSourcePath:  asciiMetadata(f.path),
+  metaSourceMode:  fmt.Sprintf("%04o", f.info.Mode().Perm()),
+ }
+}
+
+// asciiMetadata percent-encodes v when it holds characters S3 cannot carry
+// in a metadata header.
+func asciiMetadata(v string) string {
+ for i := 0; i < len(v); i++ {
+  if v[i] < 0x20 || v[i] > 0x7e {
+   return (&url.URL{Path: v}).EscapedPath()
+  }
+ }
+ return v
+}
+
+// uploadParts returns the part size and concurrency of the upload of a file
+// of size bytes. Files larger
+// than PULL_PART_SIZE are uploaded in parts, PULL_UPLOAD_CONCURRENCY at a
+// time, with the part size raised when the file would otherwise need more
+// than the 10,000 parts S3 allows.
+//
+// Parts in flight times the part size is the most memory an upload may
+// hold. Bodies that support ReadAt, as remote files do, are read part by
+// part without copying, but the envelope is kept within the pull memory
+// budget regardless by lowering the concurrency when the part size had to
+// be raised.
+func (r *transferRun) uploadParts(size int64) (partSize int64, concurrency int) {
+ partSize = r.cfg.PullPartSize
+ concurrency = r.cfg.PullUploadConcurrency
+ if size/partSize >= source.MaxUploadParts {
+  // Round up to whole MiB so every part but the last is the
+  // same size.
+  partSize = (size/source.MaxUploadParts/(1<<20) + 1) << 20
+  budget := r.cfg.PullMemoryBudget
+  if r.cfg.MaxInflightBytes > 0 && (budget == 0 || r.cfg.MaxInflightBytes < budget) {
+   budget = r.cfg.MaxInflightBytes
+  }
+  if budget > 0 && int64(concurrency)*partSize > budget {
+   concurrency = int(max(1, budget/partSize))
+  }
+  log.Printf("Raising part size to %d bytes with concurrency %d for a %d byte file", partSize, concurrency, size)
+ }
+ return partSize, concurrency
+}
+
+// pullFile streams one remote file into the bucket. The remote file supports
+// ReadAt, so the uploader reads each part straight from the server with its
+// own ranged reads, several in flight, rather than buffering the file.
+func (r *transferRun) pullFile(client sftpfs.FS, f remoteFile) error {
+ remotePath, info := f.path, f.info
+ key, err := r.pullKey(f, r.clock.Now())
+ entry := fileReport{Key: key, RemotePath: remotePath, Checks: strings.Join(f.checks, " "), Status: statusFailed}
+ defer func() { r.report.addFile(entry) }()
+ if err != nil {
+  err = withCategory(categoryConfig, err)
+  entry.Key = remotePath
+  entry.Category, entry.Error = string(categoryOf(err)), err.Error()
+  log.Printf("Failed to pull %s: %v", remotePath, err)
+  return err
+ }
+
+ log.Printf("Pulling %s to s3://%s/%s", remotePath, s3Bucket, key)
+ start := r.clock.Now()
+ src, err := client.Open(remotePath)
+ if err != nil {
+  err = withCategory(categoryConnection, fmt.Errorf("failed to open remote file: %w", err))
+  entry.Category, entry.Error = string(categoryOf(err)), err.Error()
+  return err
+ }
+ defer src.Close()
+ input := source.UploadInput{
+  Bucket:   s3Bucket,
+  Key:      key,
+  Body:     src,
+  Metadata: pulledMetadata(f),
+ }
+ if r.cfg.PullDetectContentType {
+  input.ContentType = r.pulledContentType(src, remotePath)
+ }
+ input.PartSize, input.Concurrency = r.uploadParts(info.Size())
+ release, err := r.inflight.acquire("pulling "+remotePath, input.PartSize*int64(input.Concurrency))
+ if err != nil {
+  entry.Category, entry.Error = string(categoryOf(err)), err.Error()
+  return err
+ }
+ defer release()
+ err = r.s3.Upload(input)
+ if err != nil {
+  err = classifyS3Error(fmt.Errorf("failed to upload pulled file: %w", err))
+  entry.Category, entry.Error = string(categoryOf(err)), err.Error()
+  return err
+ }
+ elapsed := r.clock.Since(start)
+ entry.Status = statusTransferred
+ entry.Bytes = info.Size()
+ entry.DurationMs = elapsed.Milliseconds()
+ entry.ThroughputMBps = throughputMBps(info.Size(), elapsed)
+ r.stats.BytesSent += info.Size()
+ r.metrics.add("BytesTransferred", unitBytes, float64(info.Size()))
+ log.Printf("Pulled %s to %s bytes=%d duration_ms=%d", remotePath, key, info.Size(), elapsed.Milliseconds())
+ return nil
+}
+
+// sniffLen is the number of leading bytes http.DetectContentType considers.
+const sniffLen = 512
+
+// pulledContentType returns the Content-Type for a pulled file: from
+// PULL_CONTENT_TYPES by the longest matching extension, then the system MIME
+// table, then by sniffing its first bytes. The bytes are read with ReadAt,
+// which leaves the file offset untouched, so the upload still streams the
+// file from the start. It returns "" when nothing matched and sniffing is
+// off or failed.
+func (r *transferRun) pulledContentType(src io.ReaderAt, remotePath string) string {
+ if _, ct, ok := matchExtension(path.Base(remotePath), r.cfg.PullContentTypes); ok {
+  return ct
+ }
+ if ct := mime.TypeByExtension(path.Ext(remotePath)); ct != "" {
+  return ct
+ }
+ if !r.cfg.PullSniffContentType {
+  return ""
+ }
+ buf := make([]byte, sniffLen)
+ n, err := src.ReadAt(buf, 0)
+ if err != nil && err != io.EOF {
+  r.cfg.Debugf("Not sniffing the Content-Type of %s: %v", remotePath, err)
+  return ""
+ }
+ return http.DetectContentType(buf[:n])
+}
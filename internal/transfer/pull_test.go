@@ -0,0 +1,106 @@
+package transfer
+
+import (
+ "crypto/sha256"
+ "io"
+ "runtime"
+ "runtime/debug"
+ "strings"
+ "sync"
+ "testing"
+ "time"
+)
+
+// patternReader reads as an endless file of a fixed byte pattern, for
+// synthetic remote files too large to hold.
+type patternReader struct{}
+
+func (patternReader) ReadAt(b []byte, off int64) (int, error) {
+ for i := range b {
+  o := off + int64(i)
+  b[i] = byte(o*7 + o>>16)
+ }
+ return len(b), nil
+}
+
+// heapPeak samples the live heap until stopped and returns the most seen.
+func heapPeak() (stop func() uint64) {
+ done := make(chan struct{})
+ var wg sync.WaitGroup
+ var peak uint64
+ wg.Add(1)
+ go func() {
+  defer wg.Done()
+  var ms runtime.MemStats
+  for {
+   runtime.ReadMemStats(&ms)
+   peak = max(peak, ms.HeapAlloc)
+   select {
+   case <-done:
+    return
+   case <-time.After(time.Millisecond):
+   }
+  }
+ }()
+ return func() uint64 {
+  close(done)
+  wg.Wait()
+  return peak
+ }
+}
+
+func TestPullStreamsLargeFile(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ const size, partSize = 100 << 20, 5 << 20
+ t.Setenv("PULL_MODE", "true")
+ t.Setenv("PULL_PART_SIZE", "5242880")
+ t.Setenv("PULL_UPLOAD_CONCURRENCY", "2")
+
+ var content patternReader
+ var want [][sha256.Size]byte
+ for off := int64(0); off < size; off += partSize {
+  h := sha256.New()
+  io.Copy(h, io.NewSectionReader(content, off, min(partSize, size-off)))
+  want = append(want, [sha256.Size]byte(h.Sum(nil)))
+ }
+ e.server.putLargeFile("/uploads/big.bin", content, size)
+
+ // Keep the collector close behind, so the peak is what the pull holds
+ // rather than garbage waiting to be collected.
+ defer debug.SetGCPercent(debug.SetGCPercent(10))
+ runtime.GC()
+ var ms runtime.MemStats
+ runtime.ReadMemStats(&ms)
+ baseline := ms.HeapAlloc
+ stop := heapPeak()
+ result, err := e.run("")
+ peak := stop()
+ if err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if result.Transferred != 1 || result.Bytes != size {
+  t.Fatalf("result = %+v, want the file pulled", result)
+ }
+
+ var key string
+ for _, k := range e.s3.keys(s3Bucket) {
+  if strings.HasSuffix(k, "big.bin") {
+   key = k
+  }
+ }
+ o := e.s3.object(s3Bucket, key)
+ if o == nil || o.size != size || len(o.parts) != len(want) {
+  t.Fatalf("uploaded object %q = %+v, want %d bytes in %d parts", key, o, size, len(want))
+ }
+ for i := range want {
+  if o.parts[i] != want[i] {
+   t.Fatalf("part %d differs from the remote file", i+1)
+  }
+ }
+ // Two 5 MB parts in flight, and the client's read buffers, are all
+ // the pull may hold; buffering the file would take 100 MB.
+ if grown := int64(peak) - int64(baseline); grown > 32<<20 {
+  t.Errorf("heap grew by %d MB while pulling, want at most 32 MB", grown>>20)
+ }
+ t.Logf("heap grew by %.1f MB while pulling %d MB", float64(int64(peak)-int64(baseline))/(1<<20), size>>20)
+}
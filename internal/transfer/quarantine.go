@@ -0,0 +1,176 @@
+package transfer
+
+import (
+ "errors"
+ "fmt"
+ "log"
+ "strings"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// User metadata set on quarantined objects, and removed again when they are
+// replayed.
+const (
+ // metaQuarantineReason is the integrity failure that quarantined the
+ // object, truncated to fit a metadata header.
+ metaQuarantineReason = "quarantine-reason"
+ // metaQuarantinedAt is when it was quarantined, in RFC 3339, UTC.
+ metaQuarantinedAt = "quarantined-at"
+ // metaQuarantineRequest is the request ID of the run that
+ // quarantined it.
+ metaQuarantineRequest = "quarantine-request-id"
+)
+
+// maxQuarantineReason bounds the reason kept in metadata, which S3 caps at
+// 2KB per object in total.
+const maxQuarantineReason = 1024
+
+// quarantineEntry records one object moved under QUARANTINE_PREFIX.
+type quarantineEntry struct {
+ Key        string `json:"key"`
+ Quarantine string `json:"quarantineKey"`
+ Category   string `json:"category"`
+ Reason     string `json:"reason"`
+ Error      string `json:"error,omitempty"`
+}
+
+// quarantineReport records the objects quarantined by the run and those
+// moved back by {"replayQuarantine":true}.
+type quarantineReport struct {
+ Prefix      string            `json:"prefix"`
+ Quarantined []quarantineEntry `json:"quarantined,omitempty"`
+ Replayed    []string          `json:"replayed,omitempty"`
+ Failed      int               `json:"failed,omitempty"`
+}
+
+// isIntegrityFailure reports whether err means the bytes read from S3 were
+// not the object's: a checksum or a size that did not match.
+func isIntegrityFailure(err error) bool {
+ var mismatch *sizeMismatchError
+ return categoryOf(err) == categoryChecksumMismatch || errors.As(err, &mismatch)
+}
+
+// quarantine moves key, which failed integrity verification on every
+// attempt, under QUARANTINE_PREFIX with the reason in its metadata, and
+// alerts QUARANTINE_TOPIC_ARN so someone investigates. A failed move is
+// logged and the object stays where it is, to fail again next run.
+func (r *transferRun) quarantine(key string, cause error) {
+ if r.report.Quarantine == nil {
+  r.report.Quarantine = &quarantineReport{Prefix: r.cfg.QuarantinePrefix}
+ }
+ entry := quarantineEntry{
+  Key:        key,
+  Quarantine: r.cfg.QuarantineKey(key),
+  Category:   string(categoryOf(cause)),
+  Reason:     cause.Error(),
+ }
+ if entry.Category == string(categoryTransient) {
+  entry.Category = "size_mismatch"
+ }
+ reason := entry.Reason
+ if len(reason) > maxQuarantineReason {
+  reason = reason[:maxQuarantineReason]
+ }
+ err := r.moveObject(key, entry.Quarantine, func(meta map[string]string) {
+  meta[metaQuarantineReason] = asciiMetadata(reason)
+  meta[metaQuarantinedAt] = r.clock.Now().UTC().Format(time.RFC3339)
+  meta[metaQuarantineRequest] = r.report.RequestID
+ })
+ if err != nil {
+  log.Printf("Failed to quarantine %s: %v", key, err)
+  entry.Error = err.Error()
+  r.report.Quarantine.Failed++
+  r.report.Quarantine.Quarantined = append(r.report.Quarantine.Quarantined, entry)
+  return
+ }
+ log.Printf("Quarantined %s as s3://%s/%s: %s", key, s3Bucket, entry.Quarantine, entry.Reason)
+ r.report.Quarantine.Quarantined = append(r.report.Quarantine.Quarantined, entry)
+ r.metrics.add("ObjectsQuarantined", unitCount, 1)
+ if err := r.publishQuarantineAlert(entry); err != nil {
+  log.Printf("Failed to publish quarantine alert for %s: %v", key, err)
+ }
+}
+
+// replayQuarantined moves every object quarantined from the source prefix
+// back to its original key, without the quarantine metadata, so the
+// listing that follows delivers it again. It is run by
+// {"replayQuarantine":true} once the objects have been fixed. A replayed
+// object is new as far as MIN_AGE is concerned.
+func (r *transferRun) replayQuarantined() error {
+ if r.report.Quarantine == nil {
+  r.report.Quarantine = &quarantineReport{Prefix: r.cfg.QuarantinePrefix}
+ }
+ prefix := r.cfg.QuarantineKey(r.cfg.SourcePrefix)
+ var keys []string
+ err := r.s3.List(source.ListInput{Bucket: s3Bucket, Prefix: prefix}, func(page source.Page) bool {
+  for _, obj := range page.Objects {
+   keys = append(keys, obj.Key)
+  }
+  return true
+ })
+ if err != nil {
+  return classifyS3Error(fmt.Errorf("failed to list quarantined objects under %s: %w", prefix, err))
+ }
+ log.Printf("Replaying %d quarantined object(s) from s3://%s/%s", len(keys), s3Bucket, prefix)
+ for _, qk := range keys {
+  key := strings.TrimPrefix(qk, r.cfg.QuarantinePrefix)
+  err := r.moveObject(qk, key, func(meta map[string]string) {
+   delete(meta, metaQuarantineReason)
+   delete(meta, metaQuarantinedAt)
+   delete(meta, metaQuarantineRequest)
+  })
+  if err != nil {
+   log.Printf("Failed to replay quarantined %s: %v", qk, err)
+   r.report.Quarantine.Failed++
+   continue
+  }
+  r.report.Quarantine.Replayed = append(r.report.Quarantine.Replayed, key)
+ }
+ r.metrics.add("QuarantineReplayed", unitCount, float64(len(r.report.Quarantine.Replayed)))
+ return nil
+}
+
+// moveObject copies from to to, with the metadata of from as changed by
+// edit, and then deletes from. CopyObject handles objects of up to 5GB.
+func (r *transferRun) moveObject(from, to string, edit func(map[string]string)) error {
+ head, err := r.s3.Head(s3Bucket, from)
+ if err != nil {
+  return classifyS3Error(fmt.Errorf("failed to read %s: %w", from, err))
+ }
+ meta := make(map[string]string, len(head.Metadata)+3)
+ for k, v := range head.Metadata {
+  meta[strings.ToLower(k)] = v
+ }
+ edit(meta)
+ err = r.s3.Copy(source.CopyInput{
+  Headers:  head.Headers,
+  Bucket:   s3Bucket,
+  Key:      to,
+  From:     from,
+  IfMatch:  head.ETag,
+  Metadata: meta,
+ })
+ if err != nil {
+  return classifyS3Error(fmt.Errorf("failed to copy %s to %s: %w", from, to, err))
+ }
+ if err := r.s3.Delete(s3Bucket, from); err != nil {
+  return classifyS3Error(fmt.Errorf("copied %s to %s but failed to delete it: %w", from, to, err))
+ }
+ return nil
+}
+
+func (r *transferRun) publishQuarantineAlert(e quarantineEntry) error {
+ if r.cfg.QuarantineTopicARN == "" {
+  return nil
+ }
+ subject := fmt.Sprintf("Quarantined a corrupt object for %s", r.cfg.DestinationName)
+ if len(subject) > 100 {
+  subject = subject[:100]
+ }
+ message := fmt.Sprintf("s3://%s/%s failed integrity verification (%s) on every attempt and was moved to s3://%s/%s.\n\n%s\n\n"+
+  "Once the object is fixed, invoke the function with {\"replayQuarantine\":true} to deliver it again.",
+  s3Bucket, e.Key, e.Category, s3Bucket, e.Quarantine, e.Reason)
+ return r.sess.Publish(r.cfg.QuarantineTopicARN, subject, message)
+}
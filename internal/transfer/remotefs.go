@@ -0,0 +1,101 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+ "os"
+ "strings"
+ "time"
+
+ "github.com/pkg/sftp"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// ensureRemoteDir creates dir on the server unless CREATE_REMOTE_DIRS is
+// off. Some servers reject mkdir even for a directory that already exists,
+// so a failed mkdir is forgiven when the directory turns out to be there.
+func (r *transferRun) ensureRemoteDir(client sftpfs.FS, dir string) error {
+ if !r.cfg.CreateRemoteDirs {
+  return nil
+ }
+ r.filef("Ensuring directory exists: %s", dir)
+ var err error
+ if r.conn != nil && r.conn.Windows {
+  err = mkdirAllWindows(client, dir)
+ } else {
+  err = client.MkdirAll(dir)
+ }
+ if err == nil {
+  return r.applyDirOwnership(client, dir)
+ }
+ if info, serr := client.Stat(dir); serr == nil && info.IsDir() {
+  log.Printf("Creating %s failed but the directory exists, continuing: %v", dir, err)
+  return nil
+ }
+ log.Printf("Failed to create remote directory: %v", err)
+ return fmt.Errorf("failed to create remote directory %s: %w", dir, err)
+}
+
+// fsyncExtension is the OpenSSH extension behind sftp.File.Sync.
+const fsyncExtension = "fsync@openssh.com"
+
+// writeOptions returns the options for writing a delivered file and its
+// companions. When REMOTE_FSYNC is on but the server lacks the fsync
+// extension, files are written without it, or the write fails when
+// REMOTE_FSYNC_STRICT is set.
+func (r *transferRun) writeOptions(client sftpfs.FS, syncTime *time.Duration) (writeOptions, error) {
+ opts := writeOptions{overwrite: r.cfg.OverwritePolicy != config.OverwriteSkip, syncTime: syncTime, clock: r.clock}
+ if !r.cfg.RemoteFsync {
+  return opts, nil
+ }
+ if _, ok := client.HasExtension(fsyncExtension); ok {
+  opts.fsync = true
+  return opts, nil
+ }
+ if r.cfg.RemoteFsyncStrict {
+  return opts, fmt.Errorf("REMOTE_FSYNC_STRICT is set but the SFTP server does not support %s", fsyncExtension)
+ }
+ if !r.fsyncWarned {
+  r.fsyncWarned = true
+  log.Printf("WARNING: REMOTE_FSYNC is set but the SFTP server does not support %s, files are not synced", fsyncExtension)
+ }
+ return opts, nil
+}
+
+// createRemoteFile creates or truncates remotePath. Some servers reject
+// Create on an existing path instead of truncating it, so when overwrite is
+// allowed and the path exists, opening it for truncation and then removing
+// and re-creating it are tried in turn.
+func createRemoteFile(client sftpfs.FS, remotePath string, overwrite bool) (*sftp.File, error) {
+ f, err := client.Create(remotePath)
+ if err == nil || !overwrite {
+  return f, err
+ }
+ if _, serr := client.Stat(remotePath); serr != nil {
+  return nil, err
+ }
+ attempts := []string{"create: " + err.Error()}
+
+ f, terr := client.OpenFile(remotePath, os.O_WRONLY|os.O_TRUNC)
+ if terr == nil {
+  log.Printf("Create of existing %s rejected, truncated it instead (%s)", remotePath, strings.Join(attempts, "; "))
+  return f, nil
+ }
+ attempts = append(attempts, "open O_TRUNC: "+terr.Error())
+
+ if rerr := client.Remove(remotePath); rerr != nil {
+  attempts = append(attempts, "remove: "+rerr.Error())
+  log.Printf("Could not replace existing %s: %s", remotePath, strings.Join(attempts, "; "))
+  return nil, err
+ }
+ f, cerr := client.Create(remotePath)
+ if cerr != nil {
+  attempts = append(attempts, "create after remove: "+cerr.Error())
+  log.Printf("Could not replace existing %s: %s", remotePath, strings.Join(attempts, "; "))
+  return nil, cerr
+ }
+ log.Printf("Create of existing %s rejected, removed and re-created it (%s)", remotePath, strings.Join(attempts, "; "))
+ return f, nil
+}
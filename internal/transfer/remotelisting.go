@@ -0,0 +1,121 @@
+package transfer
+
+import (
+ "errors"
+ "io/fs"
+ "path"
+ "sync"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// remoteListing caches the listing of each remote directory a run checks
+// for existing files under OVERWRITE_POLICY=skip or suffix, so a run over
+// many files issues one ReadDir per directory instead of a Stat per file.
+// Files the run writes are added as they are created, so later files of the
+// run see them. A listing older than REMOTE_LISTING_MAX_AGE, or a directory
+// that could not be listed, falls back to a Stat per file. Listings are kept
+// per SFTP client, as a run may deliver to several servers. It is safe for
+// concurrent use.
+type remoteListing struct {
+ maxAge time.Duration
+ clock  clock
+
+ mu   sync.RWMutex
+ dirs map[listingKey]*dirListing
+}
+
+type listingKey struct {
+ client sftpfs.FS
+ dir    string
+}
+
+// dirListing is one listed directory; entries is nil when listing it
+// failed.
+type dirListing struct {
+ listedAt time.Time
+ entries  map[string]remoteEntry
+}
+
+type remoteEntry struct {
+ size    int64
+ modTime time.Time
+ dir     bool
+}
+
+// newRemoteListing returns the listing cache of a run, or nil when
+// REMOTE_LISTING_CACHE is off or nothing checks for existing files.
+func newRemoteListing(cfg *Config, clk clock) *remoteListing {
+ if !cfg.RemoteListingCache || cfg.OverwritePolicy == config.OverwriteReplace {
+  return nil
+ }
+ return &remoteListing{maxAge: cfg.RemoteListingMaxAge, clock: clk, dirs: make(map[listingKey]*dirListing)}
+}
+
+// remoteExists reports whether p exists on the server behind client, from
+// the listing of its directory when that is cached and fresh.
+func (r *transferRun) remoteExists(client sftpfs.FS, p string) bool {
+ if entries, ok := r.listingOf(client, path.Dir(p)); ok {
+  _, found := entries[path.Base(p)]
+  return found
+ }
+ _, err := client.Stat(p)
+ return err == nil
+}
+
+// listingOf returns the cached entries of dir, listing it on first use. ok
+// is false when the caller must Stat instead.
+func (r *transferRun) listingOf(client sftpfs.FS, dir string) (map[string]remoteEntry, bool) {
+ l := r.listing
+ if l == nil {
+  return nil, false
+ }
+ key := listingKey{client, dir}
+ l.mu.RLock()
+ d := l.dirs[key]
+ l.mu.RUnlock()
+ if d == nil {
+  d = r.listDir(client, dir)
+  l.mu.Lock()
+  l.dirs[key] = d
+  l.mu.Unlock()
+ }
+ if d.entries == nil || l.clock.Since(d.listedAt) > l.maxAge {
+  return nil, false
+ }
+ return d.entries, true
+}
+
+// listDir reads dir into a dirListing. A directory that does not exist is
+// listed as empty.
+func (r *transferRun) listDir(client sftpfs.FS, dir string) *dirListing {
+ d := &dirListing{listedAt: r.clock.Now()}
+ infos, err := client.ReadDir(dir)
+ if err != nil && !errors.Is(err, fs.ErrNotExist) {
+  r.cfg.Debugf("Failed to list %s, checking its files one by one: %v", dir, err)
+  return d
+ }
+ d.entries = make(map[string]remoteEntry, len(infos))
+ for _, info := range infos {
+  d.entries[info.Name()] = remoteEntry{size: info.Size(), modTime: info.ModTime(), dir: info.IsDir()}
+ }
+ r.metrics.add("RemoteDirListings", unitCount, 1)
+ r.cfg.Debugf("Listed %s: %d entries", dir, len(infos))
+ return d
+}
+
+// recordRemote adds p, just written with size bytes, to the cached listing
+// of its directory.
+func (r *transferRun) recordRemote(client sftpfs.FS, p string, size int64) {
+ l := r.listing
+ if l == nil {
+  return
+ }
+ l.mu.Lock()
+ defer l.mu.Unlock()
+ if d := l.dirs[listingKey{client, path.Dir(p)}]; d != nil && d.entries != nil {
+  d.entries[path.Base(p)] = remoteEntry{size: size, modTime: l.clock.Now()}
+ }
+}
@@ -0,0 +1,58 @@
+package transfer
+
+import (
+ "os"
+ "path"
+ "strings"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// remoteJoin joins remote path elements with "/" after normalizing them.
+func remoteJoin(elem ...string) string {
+ for i, e := range elem {
+  elem[i] = config.NormalizeRemotePath(e)
+ }
+ return path.Join(elem...)
+}
+
+// resolveRemotePath resolves a relative remote path, or any remote path when
+// REMOTE_PATH_RELATIVE_TO_HOME is set, against the connection's initial
+// working directory. Without a known home the path is left for the server
+// to resolve.
+func (r *transferRun) resolveRemotePath(p string) string {
+ if strings.HasPrefix(p, "/") && !r.cfg.RemotePathRelativeToHome {
+  return p
+ }
+ if r.conn == nil || r.conn.Home == "" {
+  return p
+ }
+ return path.Join(r.conn.Home, strings.TrimPrefix(p, "/"))
+}
+
+// mkdirAllWindows creates dir and its parents one segment at a time below
+// the drive root. sftp.Client.MkdirAll stats "/C:" itself, which Windows
+// servers reject, so it cannot be used there.
+func mkdirAllWindows(client sftpfs.FS, dir string) error {
+ dir = config.NormalizeRemotePath(dir)
+ root := sftpfs.DriveRoot(dir)
+ current := root
+ for _, seg := range strings.Split(strings.TrimPrefix(dir, root), "/") {
+  if seg == "" {
+   continue
+  }
+  current += "/" + seg
+  info, err := client.Stat(current)
+  if err == nil {
+   if !info.IsDir() {
+    return &os.PathError{Op: "mkdir", Path: current, Err: os.ErrExist}
+   }
+   continue
+  }
+  if err := client.Mkdir(current); err != nil {
+   return err
+  }
+ }
+ return nil
+}
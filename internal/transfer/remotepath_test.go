@@ -0,0 +1,73 @@
+package transfer
+
+import (
+ "testing"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+func TestRemoteJoin(t *testing.T) {
+ tests := []struct {
+  elem []string
+  want string
+ }{
+  {[]string{"/uploads", "inbound", "a.csv"}, "/uploads/inbound/a.csv"},
+  {[]string{"/uploads/", "/inbound/", "a.csv"}, "/uploads/inbound/a.csv"},
+  {[]string{"/uploads", `2024\05`, "a.csv"}, "/uploads/2024/05/a.csv"},
+  {[]string{`C:\inetpub\ftproot`, "inbound", "a.csv"}, "/C:/inetpub/ftproot/inbound/a.csv"},
+  {[]string{"/C:/inetpub", `in\bound`}, "/C:/inetpub/in/bound"},
+ }
+ for _, tt := range tests {
+  if got := remoteJoin(append([]string(nil), tt.elem...)...); got != tt.want {
+   t.Errorf("remoteJoin(%q) = %q, want %q", tt.elem, got, tt.want)
+  }
+ }
+}
+
+func TestRemoteHomeDialects(t *testing.T) {
+ for _, tt := range []struct {
+  home    string
+  want    string
+  windows bool
+ }{
+  {"", "/", false},
+  {"/home/partner", "/home/partner", false},
+  {`C:\inetpub\ftproot`, "/C:/inetpub/ftproot", true},
+  {"/C:/inetpub/ftproot", "/C:/inetpub/ftproot", true},
+ } {
+  s := startSFTPServer(t, testServerConfig{home: tt.home})
+  conn, err := sftpfs.Dial(testConfig(t), s.sftpConfig())
+  if err != nil {
+   t.Fatal(err)
+  }
+  if conn.Home != tt.want || conn.Windows != tt.windows {
+   t.Errorf("home %q: got %q, windows %t, want %q, %t", tt.home, conn.Home, conn.Windows, tt.want, tt.windows)
+  }
+  conn.Close()
+ }
+}
+
+func TestDeliveryBelowHome(t *testing.T) {
+ for _, tt := range []struct {
+  home, want string
+ }{
+  {"/home/partner", "/home/partner/uploads/inbound/orders.csv"},
+  {`C:\inetpub\ftproot`, "/C:/inetpub/ftproot/uploads/inbound/orders.csv"},
+ } {
+  t.Run(tt.home, func(t *testing.T) {
+   e := newTestEnv(t, testServerConfig{password: "secret", home: tt.home})
+   if sftpfs.DriveRoot(config.NormalizeRemotePath(tt.home)) != "" {
+    e.server.mkdirAll("/C:")
+   }
+   t.Setenv("REMOTE_PATH_RELATIVE_TO_HOME", "true")
+   t.Setenv("REMOTE_DIR", `uploads\inbound`)
+   e.s3.put("test-poc/orders.csv", "id\n")
+
+   if _, err := e.run(""); err != nil {
+    t.Fatalf("run failed: %v", err)
+   }
+   e.wantFile(tt.want, "id\n")
+  })
+ }
+}
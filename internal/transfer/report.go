@@ -0,0 +1,410 @@
+package transfer
+
+import (
+ "bytes"
+ "encoding/csv"
+ "encoding/json"
+ "fmt"
+ "log"
+ "math"
+ "os"
+ "path"
+ "sort"
+ "strconv"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+ "github.com/vishalk7890/s3-sftp-lambda/schema"
+)
+
+const defaultReportPrefix = "transfer-reports/"
+
+// transferReport is the per-invocation record of what was delivered. It is
+// uploaded to REPORT_BUCKET when that variable is set so transfers can be
+// audited, and shared with the partner, after the fact.
+type transferReport struct {
+ RequestID   string             `json:"requestId"`
+ StartedAt   time.Time          `json:"startedAt"`
+ FinishedAt  time.Time          `json:"finishedAt"`
+ Bucket      string             `json:"bucket"`
+ Build       *schema.BuildInfo  `json:"build"`
+ Prefix      string             `json:"prefix"`
+ Destination string             `json:"destination"`
+ Error       string             `json:"error,omitempty"`
+ Connections []sftpfs.Timing    `json:"connections"`
+ Archive     *archiveReport     `json:"archive,omitempty"`
+ Concatenate *concatReport      `json:"concatenate,omitempty"`
+ Fanout      *fanoutReport      `json:"fanout,omitempty"`
+ Inventory   *inventoryReport   `json:"inventory,omitempty"`
+ Quarantine  *quarantineReport  `json:"quarantine,omitempty"`
+ BatchHook   *hookResult        `json:"batchHook,omitempty"`
+ Cleanup     *cleanupReport     `json:"cleanup,omitempty"`
+ Deferred    *deferredReport    `json:"deferred,omitempty"`
+ Restores    *restoreReport     `json:"restores,omitempty"`
+ Plan        *planReport        `json:"plan,omitempty"`
+ RetryBudget *retryBudgetReport `json:"retryBudget,omitempty"`
+ Throughput  *throughputStats   `json:"throughput,omitempty"`
+ // EmptyRun is set when the listing, after filters, had nothing to
+ // transfer.
+ EmptyRun             bool `json:"emptyRun"`
+ ConsecutiveEmptyRuns int  `json:"consecutiveEmptyRuns,omitempty"`
+ // DirectoriesCreated counts the remote directories created for
+ // folder-marker objects.
+ DirectoriesCreated int `json:"directoriesCreated,omitempty"`
+ // PeakInflightBytes is the most buffer memory the run held at once
+ // under MAX_INFLIGHT_BYTES.
+ PeakInflightBytes int64 `json:"peakInflightBytes,omitempty"`
+ // Profiles are the s3:// URIs of the profiles captured for the run.
+ Profiles []string `json:"profiles,omitempty"`
+ // Groups holds the outcome of each top-level folder under
+ // GROUP_BY_FOLDER.
+ Groups []groupReport `json:"groups,omitempty"`
+ Files  []fileReport  `json:"files"`
+}
+
+// throughputStats aggregates the transfer rate of the files delivered in a
+// run. Files smaller than MinBytes are left out because their rate is
+// dominated by per-file round trips rather than bandwidth.
+type throughputStats struct {
+ MinBytes int64   `json:"minBytes"`
+ Files    int     `json:"files"`
+ P50MBps  float64 `json:"p50MBps"`
+ P95MBps  float64 `json:"p95MBps"`
+ RunMBps  float64 `json:"runMBps"`
+}
+
+type fileReport struct {
+ Key        string `json:"key"`
+ Tenant     string `json:"tenant,omitempty"`
+ Member     string `json:"member,omitempty"`
+ RemotePath string `json:"remotePath,omitempty"`
+ // RenamedFrom is the remote path the file was routed to when
+ // OVERWRITE_POLICY=suffix delivered it under another name.
+ RenamedFrom string `json:"renamedFrom,omitempty"`
+ // RemoteEncoding and EncodingPolicy are the REMOTE_FILENAME_ENCODING
+ // the remote path was written in and the policy for runes it cannot
+ // represent. TranscodedFrom is the routed path when that policy
+ // changed it.
+ RemoteEncoding string `json:"remoteEncoding,omitempty"`
+ EncodingPolicy string `json:"encodingPolicy,omitempty"`
+ TranscodedFrom string `json:"transcodedFrom,omitempty"`
+ // Transform names the transforms that changed the file's content,
+ // joined by "+"; Bytes then counts the transformed bytes.
+ Transform  string `json:"transform,omitempty"`
+ PathSource string `json:"pathSource,omitempty"`
+ Route      string `json:"route,omitempty"`
+ // Checks lists the outcome of each readiness check a pulled file
+ // went through, e.g. "age:ok stability:growing".
+ Checks   string `json:"checks,omitempty"`
+ Parts    int    `json:"parts,omitempty"`
+ Checksum string `json:"checksum,omitempty"`
+ // SourceChecksum is the checksum S3 stored for the object, which the
+ // bytes read were verified against.
+ SourceChecksum string      `json:"sourceChecksum,omitempty"`
+ Hook           *hookResult `json:"hook,omitempty"`
+ Bytes          int64       `json:"bytes"`
+ DurationMs     int64       `json:"durationMs"`
+ SyncMs         int64       `json:"syncMs,omitempty"`
+ ThroughputMBps float64     `json:"throughputMBps"`
+ // ExpectedBytes and ReceivedBytes are set when the source body did
+ // not match its ContentLength, and Attempts when the file was fetched
+ // more than once.
+ ExpectedBytes int64  `json:"expectedBytes,omitempty"`
+ ReceivedBytes int64  `json:"receivedBytes,omitempty"`
+ Attempts      int    `json:"attempts,omitempty"`
+ Status        string `json:"status"`
+ Category      string `json:"category,omitempty"`
+ Error         string `json:"error,omitempty"`
+ // ETag is the source object's ETag, when it was read from S3.
+ ETag string `json:"etag,omitempty"`
+ // OwnerRequested is the "uid:gid" REMOTE_UID and REMOTE_GID asked
+ // for, and Owner the one the server reported afterwards.
+ OwnerRequested string `json:"ownerRequested,omitempty"`
+ Owner          string `json:"owner,omitempty"`
+
+ // at is when the outcome was recorded.
+ at time.Time
+}
+
+const (
+ statusTransferred = "transferred"
+ statusFailed      = "failed"
+ statusSkipped     = "skipped"
+ // statusPartial means the data file was delivered but a companion
+ // file, such as its checksum sidecar, was not.
+ statusPartial = "partial"
+ // statusDeferred means the file was left for a later run because
+ // the run reached MAX_BYTES_PER_RUN.
+ statusDeferred = "deferred"
+ // statusRestoring means the object is being restored from an
+ // archive storage class and is left for a later run.
+ statusRestoring = "restoring"
+ // statusPending means a remote file was left for a later pull
+ // because it may still be being written.
+ statusPending = "pending"
+)
+
+func newTransferReport(requestID string) *transferReport {
+ return &transferReport{
+  RequestID: requestID,
+  StartedAt: time.Now().UTC(),
+  Bucket:    s3Bucket,
+  Prefix:    s3FolderPrefix,
+  Build:     CurrentBuild(),
+ }
+}
+
+func (r *transferReport) addConnection(t sftpfs.Timing) {
+ r.Connections = append(r.Connections, t)
+}
+
+func (r *transferReport) addFile(f fileReport) {
+ f.at = time.Now().UTC()
+ r.Files = append(r.Files, f)
+}
+
+// Run level outcomes reported in the run result.
+const (
+ runSucceeded = schema.StatusSucceeded
+ runFailed    = schema.StatusFailed
+ runPartial   = schema.StatusPartial
+)
+
+// summary returns the run result.
+func (r *transferReport) summary() schema.ResultV1 {
+ s := schema.ResultV1{
+  SchemaVersion: schema.Version1,
+  RequestID:     r.RequestID,
+  Destination:   r.Destination,
+  Status:        runSucceeded,
+  StartedAt:     r.StartedAt,
+  FinishedAt:    r.FinishedAt,
+  DurationMs:    r.FinishedAt.Sub(r.StartedAt).Milliseconds(),
+  Transferred:   r.count(statusTransferred),
+  Failed:        r.count(statusFailed) + r.count(statusPartial),
+  Skipped:       r.count(statusSkipped),
+  Deferred:      r.count(statusDeferred),
+  Restoring:     r.count(statusRestoring),
+  Pending:       r.count(statusPending),
+  EmptyRun:      r.EmptyRun,
+  Error:         r.Error,
+
+  DirectoriesCreated: r.DirectoriesCreated,
+  Profiles:           r.Profiles,
+  Build:              r.Build,
+ }
+ for _, f := range r.Files {
+  s.Bytes += f.Bytes
+  if f.Status == statusSkipped && f.Category == string(categoryArchived) {
+   s.ArchivedSkipped++
+  }
+ }
+ if r.Restores != nil {
+  s.RestoresCompleted = r.Restores.Completed
+ }
+ for _, g := range r.Groups {
+  switch g.Outcome {
+  case groupComplete:
+   s.GroupsComplete++
+  case groupPartial:
+   s.GroupsPartial++
+  default:
+   s.GroupsFailed++
+  }
+ }
+ if r.RetryBudget != nil {
+  s.RetryBudgetExhausted = r.RetryBudget.Exhausted
+ }
+ if r.Fanout != nil {
+  s.FanoutChildren = r.Fanout.Children
+  s.FanoutFailed = r.Fanout.Failed
+ }
+ if r.Plan != nil {
+  s.PlanLocation = r.Plan.Location
+  s.DryRun = !r.Plan.Executed
+ }
+ if r.Throughput != nil {
+  s.P50MBps = r.Throughput.P50MBps
+  s.P95MBps = r.Throughput.P95MBps
+ }
+ if r.Error != "" {
+  s.Status = runFailed
+  if s.Transferred > 0 {
+   s.Status = runPartial
+  }
+ }
+ return s
+}
+
+// lastFile returns the most recent entry for key, or nil.
+func (r *transferReport) lastFile(key string) *fileReport {
+ for i := len(r.Files) - 1; i >= 0; i-- {
+  if r.Files[i].Key == key {
+   return &r.Files[i]
+  }
+ }
+ return nil
+}
+
+// dropLast removes the last entry for key, the failure of an attempt that
+// is about to be retried.
+func (r *transferReport) dropLast(key string) {
+ for i := len(r.Files) - 1; i >= 0; i-- {
+  if r.Files[i].Key == key {
+   r.Files = append(r.Files[:i], r.Files[i+1:]...)
+   return
+  }
+ }
+}
+
+// doneKeys reports, by key, whether every entry for the file shows it
+// delivered or skipped as not needing delivery. Files skipped because their
+// destination was unavailable are not done.
+func (r *transferReport) doneKeys() map[string]bool {
+ done := make(map[string]bool)
+ for _, f := range r.Files {
+  ok := f.Status == statusTransferred || f.Status == statusSkipped && f.Category != string(categoryDestinationUnavailable)
+  if prev, seen := done[f.Key]; seen {
+   ok = ok && prev
+  }
+  done[f.Key] = ok
+ }
+ return done
+}
+
+// count returns the number of file entries with the given status.
+func (r *transferReport) count(status string) int {
+ n := 0
+ for _, f := range r.Files {
+  if f.Status == status {
+   n++
+  }
+ }
+ return n
+}
+
+func (r *transferReport) finish(runErr error) {
+ r.FinishedAt = time.Now().UTC()
+ if runErr != nil {
+  r.Error = runErr.Error()
+ }
+}
+
+// computeThroughput sets the throughput statistics over the transferred files
+// of at least minBytes. It leaves them unset when no file qualifies.
+func (r *transferReport) computeThroughput(minBytes int64) {
+ var rates []float64
+ var bytes int64
+ var elapsed time.Duration
+ for _, f := range r.Files {
+  if f.Status != statusTransferred || f.Bytes < minBytes || f.DurationMs <= 0 {
+   continue
+  }
+  rates = append(rates, f.ThroughputMBps)
+  bytes += f.Bytes
+  elapsed += time.Duration(f.DurationMs) * time.Millisecond
+ }
+ if len(rates) == 0 {
+  return
+ }
+ sort.Float64s(rates)
+ r.Throughput = &throughputStats{
+  MinBytes: minBytes,
+  Files:    len(rates),
+  P50MBps:  percentile(rates, 50),
+  P95MBps:  percentile(rates, 95),
+  RunMBps:  throughputMBps(bytes, elapsed),
+ }
+}
+
+// percentile returns the nearest-rank percentile p of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+ rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+ if rank < 1 {
+  rank = 1
+ }
+ return sorted[rank-1]
+}
+
+// writeReport uploads the report as JSON under REPORT_PREFIX, partitioned by
+// date. It is a no-op when REPORT_BUCKET is not configured.
+func writeReport(svc source.Store, r *transferReport) error {
+ bucket := os.Getenv("REPORT_BUCKET")
+ if bucket == "" {
+  return nil
+ }
+ prefix := os.Getenv("REPORT_PREFIX")
+ if prefix == "" {
+  prefix = defaultReportPrefix
+ }
+
+ body, err := json.MarshalIndent(struct {
+  *transferReport
+  Result schema.ResultV1 `json:"result"`
+ }{r, r.summary()}, "", "  ")
+ if err != nil {
+  return fmt.Errorf("failed to marshal transfer report: %w", err)
+ }
+ csvBody, err := r.csv()
+ if err != nil {
+  return err
+ }
+
+ base := path.Join(prefix, r.StartedAt.Format("2006/01/02"), r.RequestID)
+ for _, obj := range []struct {
+  ext, contentType string
+  body             []byte
+ }{
+  {".json", "application/json", body},
+  {".csv", "text/csv", csvBody},
+ } {
+  key := base + obj.ext
+  log.Printf("Writing transfer report to s3://%s/%s", bucket, key)
+  err = svc.Put(source.PutInput{
+   Bucket:      bucket,
+   Key:         key,
+   Body:        bytes.NewReader(obj.body),
+   ContentType: obj.contentType,
+  })
+  if err != nil {
+   return fmt.Errorf("failed to write transfer report: %w", err)
+  }
+ }
+ return nil
+}
+
+// csvHeader is the column layout of the per-file CSV report. The same CSV is
+// written next to the JSON report and attached to report emails.
+var csvHeader = []string{
+ "key", "member", "remote_path", "status", "category", "bytes",
+ "duration_ms", "throughput_mbps", "checksum", "error",
+}
+
+func (r *transferReport) csv() ([]byte, error) {
+ var buf bytes.Buffer
+ w := csv.NewWriter(&buf)
+ w.Write(csvHeader)
+ for _, f := range r.Files {
+  w.Write([]string{
+   f.Key, f.Member, f.RemotePath, f.Status, f.Category,
+   strconv.FormatInt(f.Bytes, 10),
+   strconv.FormatInt(f.DurationMs, 10),
+   strconv.FormatFloat(f.ThroughputMBps, 'f', 2, 64),
+   f.Checksum, f.Error,
+  })
+ }
+ w.Flush()
+ if err := w.Error(); err != nil {
+  return nil, fmt.Errorf("failed to render CSV report: %w", err)
+ }
+ return buf.Bytes(), nil
+}
+
+// throughputMBps returns the transfer rate in megabytes per second.
+func throughputMBps(n int64, d time.Duration) float64 {
+ if d <= 0 {
+  return 0
+ }
+ return float64(n) / (1 << 20) / d.Seconds()
+}
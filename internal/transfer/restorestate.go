@@ -0,0 +1,109 @@
+package transfer
+
+import (
+ "bytes"
+ "encoding/json"
+ "fmt"
+ "log"
+ "strings"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// pendingRestores is the state object listing the archived keys this function
+// has requested a restore of and not yet delivered. It lets a later run tell
+// a restore that completed and then expired apart from one never requested.
+type pendingRestores struct {
+ Keys map[string]pendingRestore `json:"keys"`
+}
+
+type pendingRestore struct {
+ RequestedAt time.Time `json:"requestedAt"`
+ Tier        string    `json:"tier"`
+}
+
+// restoreReport counts the archived objects handled under the restore policy.
+type restoreReport struct {
+ // Pending are still being restored, Completed had a restored copy
+ // and were admitted for delivery, and Expired had their restored copy
+ // expire before delivery and were restored again.
+ Pending   int `json:"pending"`
+ Completed int `json:"completed"`
+ Expired   int `json:"expired"`
+}
+
+func (r *transferRun) restoreStateKey() string {
+ name := strings.Trim(strings.ReplaceAll(r.cfg.SourcePrefix, "/", "_"), "_")
+ return r.cfg.RestoreStatePrefix + r.cfg.DestinationName + "/" + name + ".json"
+}
+
+// loadPendingRestores reads the pending restore state on first use.
+func (r *transferRun) loadPendingRestores() (*pendingRestores, error) {
+ if r.restores != nil {
+  return r.restores, nil
+ }
+ state := &pendingRestores{Keys: make(map[string]pendingRestore)}
+ key := r.restoreStateKey()
+ out, err := r.s3.Get(source.GetInput{Bucket: s3Bucket, Key: key})
+ if err != nil {
+  if !source.IsNotFound(err) {
+   return nil, classifyS3Error(fmt.Errorf("failed to read restore state: %w", err))
+  }
+ } else {
+  defer out.Body.Close()
+  if err := json.NewDecoder(out.Body).Decode(state); err != nil {
+   return nil, withCategory(categoryConfig, fmt.Errorf("failed to decode restore state s3://%s/%s: %w", s3Bucket, key, err))
+  }
+  if state.Keys == nil {
+   state.Keys = make(map[string]pendingRestore)
+  }
+ }
+ r.restores = state
+ r.report.Restores = &restoreReport{}
+ return state, nil
+}
+
+// savePendingRestores clears the keys delivered by this run, and on a full
+// listing those no longer listed, then writes the state back. It is a no-op
+// when no archived object was handled under the restore policy.
+func (r *transferRun) savePendingRestores() error {
+ if r.restores == nil {
+  return nil
+ }
+ for _, f := range r.report.Files {
+  if _, ok := r.restores.Keys[f.Key]; ok && f.Status == statusTransferred {
+   log.Printf("Restored object %s delivered, clearing pending restore", f.Key)
+   delete(r.restores.Keys, f.Key)
+  }
+ }
+ if r.checkpoint == nil || r.fullListing {
+  listed := make(map[string]bool, len(r.listed))
+  for _, key := range r.listed {
+   listed[key] = true
+  }
+  for key := range r.restores.Keys {
+   if !listed[key] {
+    delete(r.restores.Keys, key)
+   }
+  }
+ }
+ r.report.Restores.Pending = len(r.restores.Keys)
+ r.metrics.add("RestoresPending", unitNone, float64(len(r.restores.Keys)))
+
+ body, err := json.Marshal(r.restores)
+ if err != nil {
+  return fmt.Errorf("failed to marshal restore state: %w", err)
+ }
+ key := r.restoreStateKey()
+ err = r.s3.Put(source.PutInput{
+  Bucket:      s3Bucket,
+  Key:         key,
+  Body:        bytes.NewReader(body),
+  ContentType: "application/json",
+ })
+ if err != nil {
+  return classifyS3Error(fmt.Errorf("failed to write restore state: %w", err))
+ }
+ return nil
+}
@@ -0,0 +1,215 @@
+package transfer
+
+import (
+ "bytes"
+ "crypto/sha256"
+ "encoding/hex"
+ "encoding/json"
+ "errors"
+ "fmt"
+ "io"
+ "log"
+ "os"
+ "time"
+
+ "github.com/pkg/sftp"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// errDeadline stops a resumable transfer when the invocation is about to
+// run out of time.
+var errDeadline = errors.New("invocation deadline reached")
+
+// resumeState is persisted when a large file is cut off by the invocation
+// deadline, so the next run can continue it with a ranged GET instead of
+// starting over.
+type resumeState struct {
+ Key        string    `json:"key"`
+ ETag       string    `json:"etag"`
+ RemoteTemp string    `json:"remoteTemp"`
+ Bytes      int64     `json:"bytes"`
+ Size       int64     `json:"size"`
+ UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// resumable reports whether item is delivered through the resumable path:
+// whole S3 objects of at least RESUME_MIN_BYTES, when RESUME_STATE_PREFIX is
+// set.
+func (r *transferRun) resumable(item *deliveryItem) bool {
+ // Converted files are never resumed, as their remote offsets no
+ // longer match the source's.
+ if r.cfg.ResumeStatePrefix == "" || item.member != "" || item.etag == "" || r.convertsText(item.name) {
+  return false
+ }
+ size := item.size
+ if item.resume != nil {
+  size = item.resume.Size
+ }
+ return size >= r.cfg.ResumeMinBytes
+}
+
+func (r *transferRun) resumeStateKey(key string) string {
+ sum := sha256.Sum256([]byte(key))
+ return r.cfg.ResumeStatePrefix + r.cfg.DestinationName + "/" + hex.EncodeToString(sum[:]) + ".json"
+}
+
+// loadResumeState returns the saved state for key, or nil when there is none.
+// State older than RESUME_STATE_TTL, or whose partial remote file is missing
+// or has the wrong size, is abandoned.
+func (r *transferRun) loadResumeState(client sftpfs.FS, key string) (*resumeState, error) {
+ stateKey := r.resumeStateKey(key)
+ out, err := r.s3.Get(source.GetInput{Bucket: s3Bucket, Key: stateKey})
+ if err != nil {
+  if source.IsNotFound(err) {
+   return nil, nil
+  }
+  return nil, classifyS3Error(fmt.Errorf("failed to read resume state: %w", err))
+ }
+ defer out.Body.Close()
+ var st resumeState
+ if err := json.NewDecoder(out.Body).Decode(&st); err != nil {
+  log.Printf("Discarding unreadable resume state for %s: %v", key, err)
+  r.deleteResumeState(key)
+  return nil, nil
+ }
+
+ if r.clock.Since(st.UpdatedAt) > r.cfg.ResumeStateTTL {
+  r.abandonResume(client, &st, "state expired")
+  return nil, nil
+ }
+ info, err := client.Stat(st.RemoteTemp)
+ if err != nil || info.Size() != st.Bytes {
+  r.abandonResume(client, &st, "partial remote file missing or changed")
+  return nil, nil
+ }
+ log.Printf("Resuming %s at byte %d of %d from %s", key, st.Bytes, st.Size, st.RemoteTemp)
+ return &st, nil
+}
+
+func (r *transferRun) saveResumeState(st *resumeState) error {
+ st.UpdatedAt = r.clock.Now().UTC()
+ body, err := json.Marshal(st)
+ if err != nil {
+  return fmt.Errorf("failed to marshal resume state: %w", err)
+ }
+ err = r.s3.Put(source.PutInput{
+  Bucket:      s3Bucket,
+  Key:         r.resumeStateKey(st.Key),
+  Body:        bytes.NewReader(body),
+  ContentType: "application/json",
+ })
+ if err != nil {
+  return classifyS3Error(fmt.Errorf("failed to write resume state: %w", err))
+ }
+ log.Printf("Saved resume state for %s at byte %d of %d", st.Key, st.Bytes, st.Size)
+ return nil
+}
+
+func (r *transferRun) deleteResumeState(key string) {
+ if err := r.s3.Delete(s3Bucket, r.resumeStateKey(key)); err != nil {
+  log.Printf("Failed to delete resume state for %s: %v", key, err)
+ }
+}
+
+// abandonResume discards a partial transfer so the file restarts from the
+// beginning.
+func (r *transferRun) abandonResume(client sftpfs.FS, st *resumeState, reason string) {
+ log.Printf("Abandoning partial transfer of %s (%s), restarting it", st.Key, reason)
+ if err := client.Remove(st.RemoteTemp); err != nil && !errors.Is(err, os.ErrNotExist) {
+  log.Printf("Failed to remove partial file %s: %v", st.RemoteTemp, err)
+ }
+ r.deleteResumeState(st.Key)
+}
+
+// writeResumable writes src to tmpPath starting at offset, stopping with
+// errDeadline when the invocation deadline is reached.
+func (r *transferRun) writeResumable(client sftpfs.FS, tmpPath string, src io.Reader, offset int64, opts writeOptions) (int64, error) {
+ var f *sftp.File
+ var err error
+ if offset > 0 {
+  if f, err = client.OpenFile(tmpPath, os.O_WRONLY); err == nil {
+   _, err = f.Seek(offset, io.SeekStart)
+  }
+ } else {
+  f, err = createRemoteFile(client, tmpPath, true)
+ }
+ if err != nil {
+  return 0, fmt.Errorf("failed to open remote file %s: %w", tmpPath, err)
+ }
+
+ n, err := io.Copy(f, &deadlineReader{src: src, deadline: r.deadline, clock: r.clock})
+ if err != nil {
+  f.Close()
+  return n, err
+ }
+ if opts.fsync {
+  start := r.clock.Now()
+  err = f.Sync()
+  if opts.syncTime != nil {
+   *opts.syncTime += r.clock.Since(start)
+  }
+  if err != nil {
+   f.Close()
+   return n, fmt.Errorf("failed to fsync remote file %s: %w", tmpPath, err)
+  }
+ }
+ // A write the server failed may only surface here.
+ if err := f.Close(); err != nil {
+  return n, fmt.Errorf("failed to close remote file %s: %w", tmpPath, err)
+ }
+ return n, nil
+}
+
+// deadlineReader fails with errDeadline once deadline has passed. A zero
+// deadline never expires.
+type deadlineReader struct {
+ src      io.Reader
+ deadline time.Time
+ clock    clock
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+ if !d.deadline.IsZero() && d.clock.Now().After(d.deadline) {
+  return 0, errDeadline
+ }
+ return d.src.Read(p)
+}
+
+// pastDeadline reports whether the run is too close to the invocation
+// deadline to start another file.
+func (r *transferRun) pastDeadline() bool {
+ return !r.deadline.IsZero() && r.clock.Now().After(r.deadline)
+}
+
+// deliverResumable writes item to a temporary file that survives the end of
+// the invocation. When the deadline cuts the transfer off, the progress is
+// saved and deferred is true so the next run can continue it. A completed
+// file is renamed into place and its state removed.
+func (r *transferRun) deliverResumable(client sftpfs.FS, item *deliveryItem, body io.Reader, remotePath string, opts writeOptions) (n int64, deferred bool, err error) {
+ st := item.resume
+ if st == nil {
+  st = &resumeState{Key: item.key, ETag: item.etag, RemoteTemp: remotePath + atomicTempSuffix, Size: item.size}
+ }
+ offset := st.Bytes
+ n, err = r.writeResumable(client, st.RemoteTemp, body, offset, opts)
+ if errors.Is(err, errDeadline) {
+  st.Bytes = offset + n
+  if err := r.saveResumeState(st); err != nil {
+   return n, false, err
+  }
+  r.metrics.add("TransfersSuspended", unitCount, 1)
+  return n, true, nil
+ }
+ if err != nil {
+  return n, false, err
+ }
+ if err := r.commitAtomic(client, st.RemoteTemp, remotePath, opts); err != nil {
+  return n, false, err
+ }
+ if item.resume != nil {
+  r.deleteResumeState(item.key)
+ }
+ return n, false, nil
+}
@@ -0,0 +1,72 @@
+package transfer
+
+import (
+ "log"
+ "sync"
+ "time"
+)
+
+// retryBudget caps the retries of a whole invocation, shared by every S3
+// request and presigned URL fetch of the run, so an outage fails the run
+// promptly instead of each file retrying in turn until the Lambda times
+// out. A zero limit is unlimited. It is safe for concurrent use.
+type retryBudget struct {
+ maxAttempts int
+ maxBackoff  time.Duration
+ metrics     *metrics
+
+ mu        sync.Mutex
+ attempts  int
+ backoff   time.Duration
+ exhausted bool
+}
+
+// retryBudgetReport records what the run spent of its retry budget.
+type retryBudgetReport struct {
+ Attempts  int   `json:"attempts"`
+ BackoffMs int64 `json:"backoffMs"`
+ Exhausted bool  `json:"exhausted"`
+}
+
+func newRetryBudget(cfg *Config, m *metrics) *retryBudget {
+ return &retryBudget{maxAttempts: cfg.RetryBudgetAttempts, maxBackoff: cfg.RetryBudgetBackoff, metrics: m}
+}
+
+// take reserves one retry of what, reporting false once the budget is spent.
+// The first refusal is logged.
+func (b *retryBudget) take(what string) bool {
+ b.mu.Lock()
+ defer b.mu.Unlock()
+ if !b.exhausted {
+  b.exhausted = b.maxAttempts > 0 && b.attempts >= b.maxAttempts ||
+   b.maxBackoff > 0 && b.backoff >= b.maxBackoff
+  if b.exhausted {
+   log.Printf("WARNING: retry budget exhausted after %d retries and %s of backoff, not retrying %s or anything else this run",
+    b.attempts, b.backoff.Round(time.Millisecond), what)
+   b.metrics.add("RetryBudgetExhausted", unitCount, 1)
+  }
+ }
+ if b.exhausted {
+  return false
+ }
+ b.attempts++
+ b.metrics.add("RetryAttempts", unitCount, 1)
+ return true
+}
+
+// spent records d of backoff before a retry.
+func (b *retryBudget) spent(d time.Duration) {
+ b.mu.Lock()
+ b.backoff += d
+ b.mu.Unlock()
+ b.metrics.addDuration("RetryBackoff", d)
+}
+
+func (b *retryBudget) report() *retryBudgetReport {
+ b.mu.Lock()
+ defer b.mu.Unlock()
+ if b.attempts == 0 && !b.exhausted {
+  return nil
+ }
+ return &retryBudgetReport{Attempts: b.attempts, BackoffMs: b.backoff.Milliseconds(), Exhausted: b.exhausted}
+}
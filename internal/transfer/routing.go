@@ -0,0 +1,118 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+ "path"
+ "strings"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// destinationMetadataKey is the user metadata key producers set on an object
+// (as x-amz-meta-sftp-destination) to choose its remote directory. The SDK
+// returns metadata keys in canonical header form.
+const destinationMetadataKey = "Sftp-Destination"
+
+// Sources of a file's remote path, recorded per file in logs and the report.
+const (
+ pathSourceConfig    = "config"
+ pathSourceMetadata  = "metadata"
+ pathSourceExtension = "extension"
+)
+
+// remoteName returns the name key is delivered under: its base name or,
+// with REMOTE_LAYOUT=preserve, its path below the source prefix. ".."
+// segments cannot climb out of the remote directory.
+func (r *transferRun) remoteName(key string) string {
+ if r.cfg.RemoteLayout != config.LayoutPreserve {
+  return path.Base(key)
+ }
+ rel := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(key, r.cfg.SourcePrefix)), "/")
+ if rel == "" {
+  return path.Base(key)
+ }
+ return rel
+}
+
+// route is the routing decision for one file.
+type route struct {
+ // path is the full remote path to write; empty when skip is set.
+ path string
+ // source is where path came from, one of the pathSource constants.
+ source string
+ // rule describes the decision for the audit trail, e.g. ".csv" for an
+ // extension match or "unmapped:skip".
+ rule string
+ skip bool
+}
+
+// route decides where item should be written on the SFTP server. An object's
+// sftp-destination metadata wins when metadata routing is enabled and the
+// destination passes sanitization; otherwise extension routes are consulted,
+// then the configured remote directory.
+func (r *transferRun) route(item *deliveryItem) (route, error) {
+ name := item.name
+ if action, ok := r.planned[item.key]; ok && item.member == "" {
+  return route{path: action.RemotePath, source: pathSourcePlan, rule: action.Rule}, nil
+ }
+ if r.cfg.MetadataRouting {
+  if dest, ok := item.metadata[destinationMetadataKey]; ok {
+   dir, err := sanitizeRemoteDir(dest, r.cfg.RemoteAllowedRoot)
+   if err == nil {
+    return route{path: remoteJoin(dir, name), source: pathSourceMetadata, rule: "metadata"}, nil
+   }
+   log.Printf("Ignoring sftp-destination metadata on %s: %v", item.key, err)
+  }
+ }
+
+ if len(r.cfg.ExtensionRoutes) == 0 {
+  return route{path: remoteJoin(r.cfg.RemoteDir, name), source: pathSourceConfig}, nil
+ }
+ if ext, dir, ok := matchExtension(name, r.cfg.ExtensionRoutes); ok {
+  return route{path: remoteJoin(dir, name), source: pathSourceExtension, rule: ext}, nil
+ }
+ switch r.cfg.UnmappedExtension {
+ case config.UnmappedSkip:
+  return route{source: pathSourceExtension, rule: "unmapped:" + config.UnmappedSkip, skip: true}, nil
+ case config.UnmappedFail:
+  return route{}, fmt.Errorf("no extension route matches %s", name)
+ }
+ return route{path: remoteJoin(r.cfg.RemoteDir, name), source: pathSourceConfig, rule: "unmapped:" + config.UnmappedDefault}, nil
+}
+
+// matchExtension finds the longest extension in routes that name ends with,
+// case-insensitively, so ".csv.gz" takes precedence over ".gz".
+func matchExtension(name string, routes map[string]string) (string, string, bool) {
+ lower := strings.ToLower(name)
+ best := ""
+ for ext := range routes {
+  if len(ext) > len(best) && strings.HasSuffix(lower, ext) {
+   best = ext
+  }
+ }
+ if best == "" {
+  return "", "", false
+ }
+ return best, routes[best], true
+}
+
+// sanitizeRemoteDir validates a producer-supplied remote directory: it must be
+// absolute, must not contain ".." segments and must resolve to root or a
+// directory beneath it.
+func sanitizeRemoteDir(dir, root string) (string, error) {
+ if !strings.HasPrefix(dir, "/") {
+  return "", fmt.Errorf("destination %q is not an absolute path", dir)
+ }
+ for _, segment := range strings.Split(dir, "/") {
+  if segment == ".." {
+   return "", fmt.Errorf("destination %q contains \"..\"", dir)
+  }
+ }
+ cleaned := path.Clean(dir)
+ root = path.Clean(root)
+ if cleaned != root && !strings.HasPrefix(cleaned, strings.TrimSuffix(root, "/")+"/") {
+  return "", fmt.Errorf("destination %q is outside the allowed root %s", dir, root)
+ }
+ return cleaned, nil
+}
@@ -0,0 +1,163 @@
+package transfer
+
+import (
+ "encoding/json"
+ "fmt"
+ "io"
+ "os"
+ "time"
+)
+
+// runLogVersion is the schema version of runLogRecord. Bump it whenever a
+// field is renamed or removed so dashboards can tell old records apart.
+const runLogVersion = 1
+
+// maxFailedKeySample bounds the number of failed keys listed in the run log
+// record.
+const maxFailedKeySample = 10
+
+// Delivery modes reported in runLogRecord.Mode.
+const (
+ modeFiles       = "files"
+ modeArchive     = "archive"
+ modeExplode     = "explode"
+ modeConcatenate = "concatenate"
+ modePull        = "pull"
+ modeFanout      = "fanout"
+)
+
+// runStats are the measurements taken while a run executes that are not
+// otherwise part of the transfer report.
+type runStats struct {
+ Found    int
+ Filtered int
+ // PatternFiltered counts the files, included in Filtered, that the
+ // include and exclude patterns left out.
+ PatternFiltered int
+ Host            string
+ List            time.Duration
+ Connect         time.Duration
+ Transfer        time.Duration
+ // BytesSent counts the bytes written to the server, including those
+ // of failed transfers, for MAX_BYTES_PER_RUN accounting.
+ BytesSent int64
+}
+
+// runLogRecord is the single line logged at the end of every invocation for
+// CloudWatch Logs Insights queries. Its field names are part of the schema
+// identified by Version.
+type runLogRecord struct {
+ Type                 string                    `json:"type"`
+ Version              int                       `json:"version"`
+ RequestID            string                    `json:"requestId"`
+ Status               string                    `json:"status"`
+ Mode                 string                    `json:"mode"`
+ Destination          string                    `json:"destination"`
+ Bucket               string                    `json:"bucket"`
+ Prefix               string                    `json:"prefix"`
+ Host                 string                    `json:"host"`
+ MaxPacketBytes       int                       `json:"maxPacketBytes"`
+ Found                int                       `json:"found"`
+ Filtered             int                       `json:"filtered"`
+ PatternFiltered      int                       `json:"patternFiltered,omitempty"`
+ Skipped              int                       `json:"skipped"`
+ Transferred          int                       `json:"transferred"`
+ Failed               int                       `json:"failed"`
+ Deferred             int                       `json:"deferred"`
+ EmptyRun             bool                      `json:"emptyRun"`
+ RetryBudgetExhausted bool                      `json:"retryBudgetExhausted,omitempty"`
+ Bytes                int64                     `json:"bytes"`
+ P50MBps              float64                   `json:"p50MBps"`
+ P95MBps              float64                   `json:"p95MBps"`
+ ListMs               int64                     `json:"listMs"`
+ ConnectMs            int64                     `json:"connectMs"`
+ TransferMs           int64                     `json:"transferMs"`
+ TotalMs              int64                     `json:"totalMs"`
+ Tenants              map[string]*tenantSummary `json:"tenants,omitempty"`
+ FailedKeys           []string                  `json:"failedKeys,omitempty"`
+ FailedKeysTruncated  bool                      `json:"failedKeysTruncated,omitempty"`
+ Error                string                    `json:"error,omitempty"`
+}
+
+func newRunLogRecord(report *transferReport, run *transferRun, runErr error) runLogRecord {
+ s := report.summary()
+ rec := runLogRecord{
+  Type:        "run_summary",
+  Version:     runLogVersion,
+  RequestID:   report.RequestID,
+  Status:      s.Status,
+  Mode:        modeFiles,
+  Destination: report.Destination,
+  Bucket:      report.Bucket,
+  Prefix:      report.Prefix,
+  Skipped:     s.Skipped,
+  Transferred: s.Transferred,
+  Failed:      s.Failed,
+  Deferred:    s.Deferred,
+  EmptyRun:    s.EmptyRun,
+  Bytes:       s.Bytes,
+  P50MBps:     s.P50MBps,
+  P95MBps:     s.P95MBps,
+  TotalMs:     time.Since(report.StartedAt).Milliseconds(),
+  Tenants:     report.tenantSummaries(),
+
+  RetryBudgetExhausted: s.RetryBudgetExhausted,
+ }
+ rec.Error = s.Error
+ if runErr != nil {
+  if rec.Status == runSucceeded {
+   rec.Status = runFailed
+  }
+  rec.Error = runErr.Error()
+ }
+ if run != nil {
+  switch {
+  case run.cfg.PullMode:
+   rec.Mode = modePull
+  case run.cfg.ArchiveMode != "":
+   rec.Mode = modeArchive
+  case run.cfg.ExplodeArchives:
+   rec.Mode = modeExplode
+  case run.cfg.Concatenate:
+   rec.Mode = modeConcatenate
+  case run.cfg.Fanout:
+   rec.Mode = modeFanout
+  }
+  rec.Host = run.stats.Host
+  rec.MaxPacketBytes = run.cfg.SFTPMaxPacket
+  rec.Found = run.stats.Found
+  rec.Filtered = run.stats.Filtered
+  rec.PatternFiltered = run.stats.PatternFiltered
+  rec.ListMs = run.stats.List.Milliseconds()
+  rec.ConnectMs = run.stats.Connect.Milliseconds()
+  rec.TransferMs = run.stats.Transfer.Milliseconds()
+ }
+
+ seen := make(map[string]bool)
+ for _, f := range report.Files {
+  if f.Status != statusFailed && f.Status != statusPartial || seen[f.Key] {
+   continue
+  }
+  seen[f.Key] = true
+  if len(rec.FailedKeys) == maxFailedKeySample {
+   rec.FailedKeysTruncated = true
+   break
+  }
+  rec.FailedKeys = append(rec.FailedKeys, f.Key)
+ }
+ return rec
+}
+
+// runLogOutput receives the run log records, stdout outside of tests.
+var runLogOutput io.Writer = os.Stdout
+
+// logRunSummary writes the run log record as a bare JSON line so Logs
+// Insights discovers its fields without a parse expression.
+func logRunSummary(report *transferReport, run *transferRun, runErr error) {
+ line, err := json.Marshal(newRunLogRecord(report, run, runErr))
+ if err != nil {
+  fmt.Fprintf(os.Stderr, "failed to marshal run summary: %v\n", err)
+  return
+ }
+ fmt.Fprintln(runLogOutput, string(line))
+}
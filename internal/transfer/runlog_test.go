@@ -0,0 +1,101 @@
+package transfer
+
+import (
+ "bufio"
+ "bytes"
+ "encoding/json"
+ "errors"
+ "fmt"
+ "os"
+ "strings"
+ "testing"
+)
+
+// captureRunLog collects the run log records written until the end of the
+// test.
+func captureRunLog(t *testing.T) *bytes.Buffer {
+ var buf bytes.Buffer
+ runLogOutput = &buf
+ t.Cleanup(func() { runLogOutput = os.Stdout })
+ return &buf
+}
+
+// runLogRecords decodes every record in out, rejecting fields that are not
+// part of runLogRecord.
+func runLogRecords(t *testing.T, out *bytes.Buffer) []runLogRecord {
+ t.Helper()
+ var records []runLogRecord
+ scanner := bufio.NewScanner(out)
+ for scanner.Scan() {
+  dec := json.NewDecoder(strings.NewReader(scanner.Text()))
+  dec.DisallowUnknownFields()
+  var rec runLogRecord
+  if err := dec.Decode(&rec); err != nil {
+   t.Fatalf("run log line %s does not decode into runLogRecord: %v", scanner.Text(), err)
+  }
+  records = append(records, rec)
+ }
+ return records
+}
+
+func TestRunSummaryLine(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ out := captureRunLog(t)
+ e.s3.put("test-poc/orders.csv", "id,total\n")
+ e.s3.put("test-poc/notes.txt", "hello\n")
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ records := runLogRecords(t, out)
+ if len(records) != 1 {
+  t.Fatalf("got %d run summary lines, want exactly one", len(records))
+ }
+ rec := records[0]
+ want := runLogRecord{
+  Type:        "run_summary",
+  Version:     runLogVersion,
+  RequestID:   "test-request",
+  Status:      runSucceeded,
+  Mode:        modeFiles,
+  Destination: rec.Destination,
+  Bucket:      s3Bucket,
+  Prefix:      s3FolderPrefix,
+  Host:        e.server.host + ":" + e.server.port,
+  Found:       2,
+  Transferred: 2,
+  Bytes:       int64(len("id,total\n") + len("hello\n")),
+ }
+ // Timings and throughput vary; everything else is fixed.
+ rec.MaxPacketBytes, rec.P50MBps, rec.P95MBps = 0, 0, 0
+ rec.ListMs, rec.ConnectMs, rec.TransferMs, rec.TotalMs = 0, 0, 0, 0
+ if fmt.Sprintf("%+v", rec) != fmt.Sprintf("%+v", want) {
+  t.Errorf("run summary = %+v\nwant %+v", rec, want)
+ }
+}
+
+func TestRunSummaryFailedKeySample(t *testing.T) {
+ out := captureRunLog(t)
+ report := newTransferReport("req")
+ for i := range maxFailedKeySample + 3 {
+  key := fmt.Sprintf("test-poc/bad-%02d.csv", i)
+  report.addFile(fileReport{Key: key, Status: statusFailed, Error: "boom"})
+ }
+ report.finish(errors.New("13 files failed"))
+ logRunSummary(report, nil, errors.New("13 files failed"))
+
+ records := runLogRecords(t, out)
+ if len(records) != 1 {
+  t.Fatalf("got %d run summary lines, want one", len(records))
+ }
+ rec := records[0]
+ if len(rec.FailedKeys) != maxFailedKeySample || !rec.FailedKeysTruncated {
+  t.Errorf("failed keys = %q truncated=%t, want %d keys truncated", rec.FailedKeys, rec.FailedKeysTruncated, maxFailedKeySample)
+ }
+ if rec.FailedKeys[0] != "test-poc/bad-00.csv" || rec.FailedKeys[1] != "test-poc/bad-01.csv" {
+  t.Errorf("failed keys = %q, want them in order", rec.FailedKeys)
+ }
+ if rec.Status != runFailed || rec.Failed != maxFailedKeySample+3 || rec.Error != "13 files failed" {
+  t.Errorf("status=%s failed=%d error=%q", rec.Status, rec.Failed, rec.Error)
+ }
+}
@@ -0,0 +1,49 @@
+package transfer
+
+import (
+ "crypto/sha256"
+ "encoding/base64"
+ "fmt"
+ "hash"
+ "io"
+ "strings"
+)
+
+// categoryChecksumMismatch marks files whose content did not match the
+// checksum S3 stored for them.
+const categoryChecksumMismatch errorCategory = "checksum_mismatch"
+
+// s3ChecksumReader hashes an object's body as it is read and, at the end,
+// compares the digest with the ChecksumSHA256 S3 stored for the object.
+type s3ChecksumReader struct {
+ src    io.Reader
+ key    string
+ stored string
+ h      hash.Hash
+}
+
+// verifiedBody wraps body to check it against stored, the base64
+// ChecksumSHA256 S3 returned for key. Objects without one, and multipart
+// objects whose checksum is a composite of their parts ("<base64>-<parts>"),
+// are not checked.
+func (r *transferRun) verifiedBody(key string, body io.Reader, stored string) (io.Reader, bool) {
+ if stored == "" {
+  return body, false
+ }
+ if strings.Contains(stored, "-") {
+  r.cfg.Debugf("Not verifying %s: its ChecksumSHA256 %s is a composite of its parts, not of the whole object", key, stored)
+  return body, false
+ }
+ return &s3ChecksumReader{src: body, key: key, stored: stored, h: sha256.New()}, true
+}
+
+func (c *s3ChecksumReader) Read(p []byte) (int, error) {
+ n, err := c.src.Read(p)
+ c.h.Write(p[:n])
+ if err == io.EOF {
+  if got := base64.StdEncoding.EncodeToString(c.h.Sum(nil)); got != c.stored {
+   return n, withCategory(categoryChecksumMismatch, fmt.Errorf("SHA-256 of %s read as %s, but S3 stored %s", c.key, got, c.stored))
+  }
+ }
+ return n, err
+}
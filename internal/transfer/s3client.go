@@ -0,0 +1,32 @@
+package transfer
+
+import (
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// newS3Client builds the S3 client with its own retry policy and request
+// timeout, independent of the per-file transfer handling. Throttled requests
+// are counted in the S3Throttled metric so S3, rather than SFTP, can be
+// identified as the limiter, and every retry is drawn from budget. The
+// adaptive limiter waits on clk.
+func newS3Client(sess *cloud.Session, cfg *Config, m *metrics, budget *retryBudget, clk clock) *source.Client {
+ return source.New(sess, source.Options{
+  MaxAttempts:    cfg.S3MaxAttempts,
+  RequestTimeout: cfg.S3RequestTimeout,
+  Adaptive:       cfg.S3RetryMode == config.RetryModeAdaptive,
+  Clock:          clk,
+  Throttled:      func() { m.add("S3Throttled", unitCount, 1) },
+  Retry:          budget.take,
+  Waited:         budget.spent,
+ })
+}
+
+// classifyS3Error marks S3 throttling errors with categoryThrottling.
+func classifyS3Error(err error) error {
+ if source.IsThrottle(err) {
+  return withCategory(categoryThrottling, err)
+ }
+ return err
+}
@@ -0,0 +1,210 @@
+package transfer
+
+import (
+ "context"
+ "errors"
+ "fmt"
+ "log"
+ "net/http"
+ "os"
+ "os/signal"
+ "sync/atomic"
+ "syscall"
+ "time"
+
+ "github.com/aws/aws-lambda-go/lambdacontext"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// RunModeServe is the RUN_MODE that runs the function as a long-lived
+// service instead of under Lambda.
+const RunModeServe = "serve"
+
+const (
+ defaultServeHealthAddr        = ":8080"
+ defaultServeVisibilityTimeout = 15 * time.Minute
+ defaultServeServiceName       = "s3-sftp-lambda"
+ // serveWait is the SQS long poll, the longest SQS allows.
+ serveWait = 20 * time.Second
+)
+
+// serviceName stands in for the Lambda function name, in metrics and
+// elsewhere, when running as a service.
+var serviceName string
+
+// functionName returns the Lambda function name, or SERVE_SERVICE_NAME when
+// running as a service.
+func functionName() string {
+ if name := os.Getenv("AWS_LAMBDA_FUNCTION_NAME"); name != "" {
+  return name
+ }
+ return serviceName
+}
+
+type shutdownKey struct{}
+
+// withShutdown returns ctx carrying stop, which is closed when the service is
+// asked to shut down.
+func withShutdown(ctx context.Context, stop <-chan struct{}) context.Context {
+ return context.WithValue(ctx, shutdownKey{}, stop)
+}
+
+// shutdownSignal returns the shutdown channel of ctx, or nil, which is never
+// ready, under Lambda.
+func shutdownSignal(ctx context.Context) <-chan struct{} {
+ stop, _ := ctx.Value(shutdownKey{}).(<-chan struct{})
+ return stop
+}
+
+// stopping reports whether the service is shutting down, in which case no
+// further file is started.
+func (r *transferRun) stopping() bool {
+ select {
+ case <-r.stop:
+  return true
+ default:
+  return false
+ }
+}
+
+// Serve runs the function as a container service with RUN_MODE=serve. It
+// long-polls SERVE_QUEUE_URL for messages whose bodies are invocation
+// payloads, running each through the same handler as a Lambda invocation,
+// and answers /healthz on SERVE_HEALTH_ADDR. On SIGTERM or SIGINT the file in
+// flight is finished, the rest of its run deferred and its message returned
+// to the queue.
+func Serve() error {
+ queueURL := os.Getenv("SERVE_QUEUE_URL")
+ if queueURL == "" {
+  return fmt.Errorf("SERVE_QUEUE_URL is required with RUN_MODE=serve")
+ }
+ visibility, err := config.EnvDuration("SERVE_VISIBILITY_TIMEOUT", defaultServeVisibilityTimeout)
+ if err != nil {
+  return err
+ }
+ if visibility < time.Minute || visibility > 12*time.Hour {
+  return fmt.Errorf("invalid SERVE_VISIBILITY_TIMEOUT %s: must be between 1m and 12h", visibility)
+ }
+ serviceName = config.EnvString("SERVE_SERVICE_NAME", defaultServeServiceName)
+ cfg, err := config.Load()
+ if err != nil {
+  return fmt.Errorf("invalid configuration: %w", err)
+ }
+ sess, err := cloud.NewSession(cfg.FIPSMode)
+ if err != nil {
+  return fmt.Errorf("failed to create AWS session: %w", err)
+ }
+ queue := sess.Queue(queueURL)
+
+ stop := make(chan struct{})
+ signals := make(chan os.Signal, 1)
+ signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+ go func() {
+  sig := <-signals
+  log.Printf("Received %s, finishing the file in flight before shutting down", sig)
+  close(stop)
+ }()
+
+ var healthy atomic.Bool
+ healthy.Store(true)
+ mux := http.NewServeMux()
+ mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+  if !healthy.Load() {
+   http.Error(w, "shutting down", http.StatusServiceUnavailable)
+   return
+  }
+  fmt.Fprintln(w, "ok")
+ })
+ health := &http.Server{Addr: config.EnvString("SERVE_HEALTH_ADDR", defaultServeHealthAddr), Handler: mux}
+ go func() {
+  if err := health.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+   log.Printf("Health endpoint failed: %v", err)
+  }
+ }()
+ defer health.Close()
+
+ // Polls are cancelled on shutdown; runs are stopped between files
+ // instead, through the shutdown signal.
+ pollCtx, cancel := context.WithCancel(context.Background())
+ defer cancel()
+ go func() {
+  <-stop
+  healthy.Store(false)
+  cancel()
+ }()
+
+ log.Printf("Serving transfer requests from %s", queueURL)
+ for {
+  msgs, err := queue.Receive(pollCtx, []string{tenantAttribute}, serveWait, visibility)
+  select {
+  case <-stop:
+   log.Println("Shut down")
+   return nil
+  default:
+  }
+  if err != nil {
+   log.Printf("Failed to receive from %s, retrying: %v", queueURL, err)
+   time.Sleep(5 * time.Second)
+   continue
+  }
+  for _, msg := range msgs {
+   serveMessage(queue, msg, visibility, stop)
+  }
+ }
+}
+
+// serveMessage runs the transfer requested by msg. The message is deleted
+// once the run returns without an error, and otherwise left to become
+// visible again so SQS redelivers it, or moves it to the queue's dead-letter
+// queue. A run cut short by shutdown returns its message at once.
+func serveMessage(queue *cloud.Queue, msg cloud.Message, visibility time.Duration, stop <-chan struct{}) {
+ id := msg.ID
+ log.Printf("Received transfer request %s", id)
+ ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: id})
+ ctx = withShutdown(ctx, stop)
+
+ // Keep the message hidden for as long as the run takes.
+ done := make(chan struct{})
+ defer close(done)
+ go func() {
+  ticker := time.NewTicker(visibility / 2)
+  defer ticker.Stop()
+  for {
+   select {
+   case <-done:
+    return
+   case <-ticker.C:
+    if err := queue.SetVisibility(msg, visibility); err != nil {
+     log.Printf("Failed to extend visibility of %s: %v", id, err)
+    }
+   }
+  }
+ }()
+
+ payload, err := withTenantAttribute(msg.Body, msg.Attributes[tenantAttribute])
+ if err != nil {
+  log.Printf("Transfer request %s failed, leaving it for redelivery: %v", id, err)
+  return
+ }
+ result, err := lambdaHandler(ctx, payload)
+ select {
+ case <-stop:
+  if result != nil && result.Deferred > 0 {
+   log.Printf("Returning transfer request %s to the queue: shut down with %d file(s) deferred", id, result.Deferred)
+   if verr := queue.SetVisibility(msg, 0); verr != nil {
+    log.Printf("Failed to return %s to the queue: %v", id, verr)
+   }
+   return
+  }
+ default:
+ }
+ if err != nil {
+  log.Printf("Transfer request %s failed, leaving it for redelivery: %v", id, err)
+  return
+ }
+ if err := queue.Delete(msg); err != nil {
+  log.Printf("Failed to delete transfer request %s: %v", id, err)
+ }
+}
@@ -0,0 +1,526 @@
+package transfer
+
+import (
+ "bytes"
+ "crypto/ed25519"
+ "crypto/rand"
+ "encoding/binary"
+ "errors"
+ "io"
+ "net"
+ "os"
+ "path"
+ "slices"
+ "sync"
+ "testing"
+
+ "github.com/pkg/sftp"
+ "golang.org/x/crypto/ssh"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// testServerConfig sets up a testSFTPServer. A zero config accepts any
+// password.
+type testServerConfig struct {
+ // password is the only password accepted, and authorizedKey the only
+ // public key. Leaving both unset accepts any password; setting just
+ // one of them turns the other method off.
+ password      string
+ authorizedKey ssh.PublicKey
+ // partialPassword makes a correct password only partly authenticate
+ // the client, which is then asked for a second factor it cannot give.
+ partialPassword bool
+ // noPosixRename stops the server advertising posix-rename@openssh.com.
+ noPosixRename bool
+ // noRename also rejects plain renames as unsupported, as some
+ // appliances do.
+ noRename bool
+ // home is what the server reports as the session's working
+ // directory, such as a Windows path; "/" when empty.
+ home string
+ // exec, when set, runs the commands of exec requests, returning their
+ // combined output and exit status. Without it exec is refused.
+ exec func(command string) (string, int)
+}
+
+// testSFTPServer is an SSH server on a loopback port running the SFTP
+// subsystem over an in-memory filesystem, for tests to deliver to.
+type testSFTPServer struct {
+ t       *testing.T
+ cfg     testServerConfig
+ host    string
+ port    string
+ hostKey ssh.Signer
+ mem     sftp.Handlers
+ ln      net.Listener
+
+ mu    sync.Mutex
+ conns []net.Conn
+ // logins counts accepted SSH connections and methods the methods
+ // clients authenticated with.
+ logins  int
+ methods []string
+ // failMkdir lists directories whose creation fails with a permission
+ // error.
+ failMkdir map[string]bool
+ // stall, when set, holds up path resolution requests, on which the
+ // client's liveness check waits, until it is closed.
+ stall chan struct{}
+ // open counts the files open for writing, and peakOpen the most
+ // that were at once.
+ open, peakOpen int
+ // failClose lists files whose close fails, like a write the server
+ // only finds over quota once the file is closed.
+ failClose map[string]bool
+ // readers serves the reads of the files put by putLargeFile.
+ readers map[string]io.ReaderAt
+ // dropAfter, when positive, makes the server drop every connection
+ // once that many bytes have been written to files in total.
+ dropAfter int64
+ written   int64
+ // renames records the rename requests served, "rename" or
+ // "posix-rename" each.
+ renames []string
+ // commands records the commands of exec requests, in order.
+ commands []string
+}
+
+// startSFTPServer starts a server for the duration of the test.
+func startSFTPServer(t *testing.T, cfg testServerConfig) *testSFTPServer {
+ t.Helper()
+ _, priv, err := ed25519.GenerateKey(rand.Reader)
+ if err != nil {
+  t.Fatal(err)
+ }
+ hostKey, err := ssh.NewSignerFromKey(priv)
+ if err != nil {
+  t.Fatal(err)
+ }
+ ln, err := net.Listen("tcp", "127.0.0.1:0")
+ if err != nil {
+  t.Fatal(err)
+ }
+ host, port, _ := net.SplitHostPort(ln.Addr().String())
+ s := &testSFTPServer{
+  t:         t,
+  cfg:       cfg,
+  host:      host,
+  port:      port,
+  hostKey:   hostKey,
+  mem:       sftp.InMemHandler(),
+  ln:        ln,
+  failMkdir: make(map[string]bool),
+  failClose: make(map[string]bool),
+  readers:   make(map[string]io.ReaderAt),
+ }
+ if cfg.noPosixRename || cfg.noRename {
+  // The advertised extensions are global to pkg/sftp.
+  sftp.SetSFTPExtensions("hardlink@openssh.com", "statvfs@openssh.com")
+  t.Cleanup(func() {
+   sftp.SetSFTPExtensions("hardlink@openssh.com", "posix-rename@openssh.com", "statvfs@openssh.com")
+  })
+ }
+ go s.serve()
+ t.Cleanup(s.close)
+ return s
+}
+
+func (s *testSFTPServer) close() {
+ s.ln.Close()
+ s.dropConnections()
+}
+
+// dropConnections closes every connection the server has accepted.
+func (s *testSFTPServer) dropConnections() {
+ s.mu.Lock()
+ defer s.mu.Unlock()
+ for _, c := range s.conns {
+  c.Close()
+ }
+ s.conns = nil
+}
+
+// fingerprint is the server's host key fingerprint, for pinning it in
+// sftpHostKeys.
+func (s *testSFTPServer) fingerprint() string {
+ return ssh.FingerprintSHA256(s.hostKey.PublicKey())
+}
+
+// sftpConfig returns the config of a secret for the server, with its host
+// key pinned and the password "secret".
+func (s *testSFTPServer) sftpConfig() *SFTPConfig {
+ return &SFTPConfig{
+  SFTPHost:     s.host,
+  SFTPPort:     s.port,
+  SFTPUsername: "partner",
+  SFTPPassword: "secret",
+  SFTPHostKeys: map[string]string{s.host: s.fingerprint()},
+  SecretName:   "test-secret",
+  Version:      "1",
+ }
+}
+
+// testSigner returns a new private key for client authentication.
+func testSigner(t *testing.T) ssh.Signer {
+ t.Helper()
+ _, priv, err := ed25519.GenerateKey(rand.Reader)
+ if err != nil {
+  t.Fatal(err)
+ }
+ signer, err := ssh.NewSignerFromKey(priv)
+ if err != nil {
+  t.Fatal(err)
+ }
+ return signer
+}
+
+// testConfig loads the configuration from the environment, as set with
+// t.Setenv, failing the test when it is invalid.
+func testConfig(t *testing.T) *Config {
+ t.Helper()
+ cfg, err := config.Load()
+ if err != nil {
+  t.Fatalf("loading the configuration: %v", err)
+ }
+ return cfg
+}
+
+func (s *testSFTPServer) serverConfig() *ssh.ServerConfig {
+ conf := &ssh.ServerConfig{}
+ accepted := func(method string) {
+  s.mu.Lock()
+  s.methods = append(s.methods, method)
+  s.mu.Unlock()
+ }
+ anyPassword := s.cfg.password == "" && s.cfg.authorizedKey == nil
+ if anyPassword || s.cfg.password != "" {
+  conf.PasswordCallback = func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+   if !anyPassword && string(password) != s.cfg.password {
+    return nil, errors.New("wrong password")
+   }
+   if s.cfg.partialPassword {
+    return nil, &ssh.PartialSuccessError{Next: ssh.ServerAuthCallbacks{
+     KeyboardInteractiveCallback: func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+      return nil, errors.New("no second factor")
+     },
+    }}
+   }
+   accepted(config.AuthPassword)
+   return nil, nil
+  }
+ }
+ if s.cfg.authorizedKey != nil {
+  conf.PublicKeyCallback = func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+   if !bytes.Equal(key.Marshal(), s.cfg.authorizedKey.Marshal()) {
+    return nil, errors.New("unknown key")
+   }
+   accepted(config.AuthPublicKey)
+   return nil, nil
+  }
+ }
+ conf.AddHostKey(s.hostKey)
+ return conf
+}
+
+func (s *testSFTPServer) serve() {
+ for {
+  nc, err := s.ln.Accept()
+  if err != nil {
+   return
+  }
+  s.mu.Lock()
+  s.conns = append(s.conns, nc)
+  s.mu.Unlock()
+  go s.handle(nc)
+ }
+}
+
+func (s *testSFTPServer) handle(nc net.Conn) {
+ defer nc.Close()
+ conn, chans, reqs, err := ssh.NewServerConn(nc, s.serverConfig())
+ if err != nil {
+  return
+ }
+ defer conn.Close()
+ s.mu.Lock()
+ s.logins++
+ s.mu.Unlock()
+ go ssh.DiscardRequests(reqs)
+ for nch := range chans {
+  if nch.ChannelType() != "session" {
+   nch.Reject(ssh.UnknownChannelType, "only sessions are supported")
+   continue
+  }
+  ch, requests, err := nch.Accept()
+  if err != nil {
+   return
+  }
+  go func() {
+   for req := range requests {
+    if req.Type == "exec" && s.cfg.exec != nil {
+     var exec struct{ Command string }
+     if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+      req.Reply(false, nil)
+      continue
+     }
+     req.Reply(true, nil)
+     s.mu.Lock()
+     s.commands = append(s.commands, exec.Command)
+     s.mu.Unlock()
+     out, status := s.cfg.exec(exec.Command)
+     io.WriteString(ch, out)
+     ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+     ch.Close()
+     return
+    }
+    // The payload of a subsystem request is the
+    // length-prefixed subsystem name.
+    ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+    req.Reply(ok, nil)
+    if !ok {
+     continue
+    }
+    server := sftp.NewRequestServer(ch, sftp.Handlers{FileGet: s, FilePut: s, FileCmd: s, FileList: s})
+    server.Serve()
+    server.Close()
+    return
+   }
+  }()
+ }
+}
+
+// accepted returns the number of logins the server accepted and the methods
+// they authenticated with.
+func (s *testSFTPServer) accepted() (int, []string) {
+ s.mu.Lock()
+ defer s.mu.Unlock()
+ return s.logins, slices.Clone(s.methods)
+}
+
+// file returns the content of the file at p, and false when there is none.
+func (s *testSFTPServer) file(p string) ([]byte, bool) {
+ s.t.Helper()
+ req := sftp.NewRequest("Get", p)
+ req.Flags = 0x1 // SSH_FXF_READ
+ r, err := s.mem.FileGet.Fileread(req)
+ if errors.Is(err, os.ErrNotExist) {
+  return nil, false
+ }
+ if err != nil {
+  s.t.Fatalf("reading %s from the test server: %v", p, err)
+ }
+ var buf bytes.Buffer
+ if _, err := io.Copy(&buf, io.NewSectionReader(r, 0, 1<<40)); err != nil {
+  s.t.Fatalf("reading %s from the test server: %v", p, err)
+ }
+ return buf.Bytes(), true
+}
+
+// exists reports whether there is a file or directory at p.
+func (s *testSFTPServer) exists(p string) bool {
+ _, err := s.mem.FileList.Filelist(sftp.NewRequest("Stat", p))
+ return err == nil
+}
+
+// names lists the names in dir, sorted.
+func (s *testSFTPServer) names(dir string) []string {
+ s.t.Helper()
+ l, err := s.mem.FileList.Filelist(sftp.NewRequest("List", dir))
+ if err != nil {
+  s.t.Fatalf("listing %s on the test server: %v", dir, err)
+ }
+ entries := make([]os.FileInfo, 1024)
+ n, err := l.ListAt(entries, 0)
+ if err != nil && err != io.EOF {
+  s.t.Fatalf("listing %s on the test server: %v", dir, err)
+ }
+ var names []string
+ for _, fi := range entries[:n] {
+  names = append(names, fi.Name())
+ }
+ slices.Sort(names)
+ return names
+}
+
+// putLargeFile creates the file at p, size bytes long, whose reads are
+// served by content. The in-memory filesystem delays every write by a
+// microsecond a byte, so large files are only sized there.
+func (s *testSFTPServer) putLargeFile(p string, content io.ReaderAt, size int64) {
+ s.t.Helper()
+ s.putFile(p, nil)
+ req := sftp.NewRequest("Setstat", p)
+ req.Flags = 0x1 // SSH_FILEXFER_ATTR_SIZE
+ req.Attrs = binary.BigEndian.AppendUint64(nil, uint64(size))
+ if err := s.mem.FileCmd.Filecmd(req); err != nil {
+  s.t.Fatalf("sizing %s on the test server: %v", p, err)
+ }
+ s.mu.Lock()
+ s.readers[p] = content
+ s.mu.Unlock()
+}
+
+// putFile creates the file at p, and its parent directories, with data.
+func (s *testSFTPServer) putFile(p string, data []byte) {
+ s.t.Helper()
+ s.mkdirAll(path.Dir(p))
+ req := sftp.NewRequest("Put", p)
+ req.Flags = 0x2 | 0x8 | 0x10 // SSH_FXF_WRITE|SSH_FXF_CREAT|SSH_FXF_TRUNC
+ w, err := s.mem.FilePut.Filewrite(req)
+ if err == nil {
+  _, err = w.WriteAt(data, 0)
+ }
+ if err != nil {
+  s.t.Fatalf("writing %s to the test server: %v", p, err)
+ }
+}
+
+func (s *testSFTPServer) mkdirAll(dir string) {
+ s.t.Helper()
+ if dir == "/" || dir == "." {
+  return
+ }
+ s.mkdirAll(path.Dir(dir))
+ err := s.mem.FileCmd.Filecmd(sftp.NewRequest("Mkdir", dir))
+ if err != nil && !errors.Is(err, os.ErrExist) {
+  s.t.Fatalf("creating %s on the test server: %v", dir, err)
+ }
+}
+
+// Fileread, Filewrite, OpenFile, Filecmd, PosixRename, Filelist, Lstat and
+// RealPath serve the in-memory filesystem with the configured failures
+// injected.
+
+func (s *testSFTPServer) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+ s.mu.Lock()
+ content := s.readers[r.Filepath]
+ s.mu.Unlock()
+ if content != nil {
+  return content, nil
+ }
+ return s.mem.FileGet.Fileread(r)
+}
+
+func (s *testSFTPServer) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+ w, err := s.mem.FilePut.Filewrite(r)
+ if err != nil {
+  return nil, err
+ }
+ return s.openWriter(w, r.Filepath), nil
+}
+
+func (s *testSFTPServer) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+ f, err := s.mem.FilePut.(sftp.OpenFileWriter).OpenFile(r)
+ if err != nil {
+  return nil, err
+ }
+ return struct {
+  *droppingWriter
+  io.ReaderAt
+ }{s.openWriter(f, r.Filepath), f}, nil
+}
+
+func (s *testSFTPServer) openWriter(w io.WriterAt, p string) *droppingWriter {
+ s.mu.Lock()
+ defer s.mu.Unlock()
+ s.open++
+ s.peakOpen = max(s.peakOpen, s.open)
+ return &droppingWriter{WriterAt: w, s: s, path: p}
+}
+
+// peakOpenFiles returns the most files that were open for writing at once.
+func (s *testSFTPServer) peakOpenFiles() int {
+ s.mu.Lock()
+ defer s.mu.Unlock()
+ return s.peakOpen
+}
+
+func (s *testSFTPServer) Filecmd(r *sftp.Request) error {
+ s.mu.Lock()
+ fail := r.Method == "Mkdir" && s.failMkdir[r.Filepath]
+ if r.Method == "Rename" {
+  s.renames = append(s.renames, "rename")
+ }
+ s.mu.Unlock()
+ if fail {
+  return os.ErrPermission
+ }
+ if r.Method == "Rename" && s.cfg.noRename {
+  return sftp.ErrSSHFxOpUnsupported
+ }
+ return s.mem.FileCmd.Filecmd(r)
+}
+
+func (s *testSFTPServer) PosixRename(r *sftp.Request) error {
+ s.mu.Lock()
+ s.renames = append(s.renames, "posix-rename")
+ s.mu.Unlock()
+ return s.mem.FileCmd.(sftp.PosixRenameFileCmder).PosixRename(r)
+}
+
+// renameRequests returns the rename requests served so far.
+func (s *testSFTPServer) renameRequests() []string {
+ s.mu.Lock()
+ defer s.mu.Unlock()
+ return slices.Clone(s.renames)
+}
+
+// execCommands returns the commands the server was asked to run.
+func (s *testSFTPServer) execCommands() []string {
+ s.mu.Lock()
+ defer s.mu.Unlock()
+ return slices.Clone(s.commands)
+}
+
+func (s *testSFTPServer) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+ return s.mem.FileList.Filelist(r)
+}
+
+func (s *testSFTPServer) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+ return s.mem.FileList.(sftp.LstatFileLister).Lstat(r)
+}
+
+func (s *testSFTPServer) RealPath(p string) (string, error) {
+ s.mu.Lock()
+ stall := s.stall
+ s.mu.Unlock()
+ if stall != nil {
+  <-stall
+ }
+ if s.cfg.home != "" && (p == "" || p == ".") {
+  return s.cfg.home, nil
+ }
+ return path.Join("/", p), nil
+}
+
+// droppingWriter counts the bytes written to the server and drops its
+// connections once dropAfter is reached. Closing it fails for the paths in
+// failClose.
+type droppingWriter struct {
+ io.WriterAt
+ s    *testSFTPServer
+ path string
+}
+
+func (w *droppingWriter) Close() error {
+ w.s.mu.Lock()
+ w.s.open--
+ fail := w.s.failClose[w.path]
+ w.s.mu.Unlock()
+ if fail {
+  return errors.New("disk quota exceeded")
+ }
+ return nil
+}
+
+func (w *droppingWriter) WriteAt(p []byte, off int64) (int, error) {
+ w.s.mu.Lock()
+ w.s.written += int64(len(p))
+ drop := w.s.dropAfter > 0 && w.s.written >= w.s.dropAfter
+ w.s.mu.Unlock()
+ if drop {
+  w.s.dropConnections()
+  return 0, errors.New("connection dropped")
+ }
+ return w.WriterAt.WriteAt(p, off)
+}
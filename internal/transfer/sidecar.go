@@ -0,0 +1,60 @@
+package transfer
+
+import (
+ "bytes"
+ "crypto/md5"
+ "crypto/sha256"
+ "encoding/json"
+ "fmt"
+ "hash"
+ "log"
+ "path"
+ "strings"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+func newDigest(algorithm string) hash.Hash {
+ if algorithm == config.ChecksumMD5 {
+  return md5.New()
+ }
+ return sha256.New()
+}
+
+// writeChecksumSidecar writes <remotePath>.<algorithm> containing the digest
+// in coreutils format ("<hex>  <filename>\n"), so the partner can verify the
+// delivery with sha256sum -c or md5sum -c.
+func writeChecksumSidecar(client sftpfs.FS, remotePath, algorithm, digest string, opts writeOptions) error {
+ sidecarPath := remotePath + "." + algorithm
+ content := fmt.Sprintf("%s  %s\n", digest, path.Base(remotePath))
+ if _, err := writeRemoteFile(client, sidecarPath, strings.NewReader(content), opts); err != nil {
+  return fmt.Errorf("failed to write checksum sidecar %s: %w", sidecarPath, err)
+ }
+ log.Printf("Wrote checksum sidecar %s", sidecarPath)
+ return nil
+}
+
+// metadataSidecarSuffix is appended to the remote path of a delivered file
+// to name its metadata sidecar.
+const metadataSidecarSuffix = ".meta.json"
+
+// writeMetadataSidecar writes <remotePath>.meta.json describing where the
+// delivered file came from. values is keyed by sidecar field; fields without
+// a value, such as the member of a plain object, are left out.
+func writeMetadataSidecar(client sftpfs.FS, remotePath string, names map[string]string, values map[string]interface{}, opts writeOptions) error {
+ doc := make(map[string]interface{}, len(values))
+ for field, v := range values {
+  doc[names[field]] = v
+ }
+ body, err := json.MarshalIndent(doc, "", "  ")
+ if err != nil {
+  return fmt.Errorf("failed to marshal metadata sidecar: %w", err)
+ }
+ sidecarPath := remotePath + metadataSidecarSuffix
+ if _, err := writeRemoteFile(client, sidecarPath, bytes.NewReader(append(body, '\n')), opts); err != nil {
+  return fmt.Errorf("failed to write metadata sidecar %s: %w", sidecarPath, err)
+ }
+ log.Printf("Wrote metadata sidecar %s", sidecarPath)
+ return nil
+}
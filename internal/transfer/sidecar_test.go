@@ -0,0 +1,134 @@
+package transfer
+
+import (
+ "crypto/md5"
+ "crypto/sha256"
+ "encoding/hex"
+ "encoding/json"
+ "strings"
+ "testing"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/schema"
+)
+
+func TestChecksumSidecar(t *testing.T) {
+ const body = "id,total\n1,10\n"
+ sha := sha256.Sum256([]byte(body))
+ md := md5.Sum([]byte(body))
+ for _, tc := range []struct {
+  algorithm, digest string
+ }{
+  {config.ChecksumSHA256, hex.EncodeToString(sha[:])},
+  {config.ChecksumMD5, hex.EncodeToString(md[:])},
+ } {
+  t.Run(tc.algorithm, func(t *testing.T) {
+   e := newTestEnv(t, testServerConfig{password: "secret"})
+   t.Setenv("CHECKSUM_SIDECAR", tc.algorithm)
+   e.s3.put("test-poc/2024/orders.csv", body)
+
+   if _, err := e.run(""); err != nil {
+    t.Fatalf("run failed: %v", err)
+   }
+   e.wantFile("/uploads/orders.csv", body)
+   // coreutils format, naming the file without its directory.
+   e.wantFile("/uploads/orders.csv."+tc.algorithm, tc.digest+"  orders.csv\n")
+  })
+ }
+}
+
+func TestChecksumSidecarAtomicUpload(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ t.Setenv("CHECKSUM_SIDECAR", config.ChecksumSHA256)
+ t.Setenv("ATOMIC_UPLOAD", "true")
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ sum := sha256.Sum256([]byte("id\n"))
+ e.wantFile("/uploads/orders.csv.sha256", hex.EncodeToString(sum[:])+"  orders.csv\n")
+ // The sidecar names the final file, never the temporary one.
+ for _, name := range e.server.names("/uploads") {
+  if name != "orders.csv" && name != "orders.csv.sha256" {
+   t.Errorf("unexpected %s left in /uploads", name)
+  }
+ }
+}
+
+func TestChecksumSidecarFailureIsPartial(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ t.Setenv("CHECKSUM_SIDECAR", config.ChecksumSHA256)
+ e.s3.put("test-poc/orders.csv", "id\n")
+ e.server.failClose["/uploads/orders.csv.sha256"] = true
+
+ result, err := e.run("")
+ if err == nil && result.Status == schema.StatusSucceeded {
+  t.Fatal("run succeeded although the sidecar could not be written")
+ }
+ // The data file is there, but the delivery is not complete.
+ e.wantFile("/uploads/orders.csv", "id\n")
+ if result != nil && (result.Transferred != 0 || result.Failed != 1) {
+  t.Errorf("result = %+v, want the file partially delivered", result)
+ }
+}
+
+func TestChecksumSidecarSkipExisting(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ t.Setenv("CHECKSUM_SIDECAR", config.ChecksumSHA256)
+ t.Setenv("OVERWRITE_POLICY", "skip")
+ e.s3.put("test-poc/orders.csv", "new\n")
+ e.server.putFile("/uploads/orders.csv", []byte("old\n"))
+ // A stale sidecar left without its file does not count as the file.
+ e.s3.put("test-poc/fresh.csv", "fresh\n")
+ e.server.putFile("/uploads/fresh.csv.sha256", []byte("stale  fresh.csv\n"))
+
+ result, err := e.run("")
+ if err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if result.Transferred != 1 || result.Skipped != 1 {
+  t.Fatalf("result = %+v, want 1 transferred and 1 skipped", result)
+ }
+ e.wantFile("/uploads/orders.csv", "old\n")
+ if e.server.exists("/uploads/orders.csv.sha256") {
+  t.Error("sidecar written for a skipped file")
+ }
+ sum := sha256.Sum256([]byte("fresh\n"))
+ e.wantFile("/uploads/fresh.csv.sha256", hex.EncodeToString(sum[:])+"  fresh.csv\n")
+}
+
+func TestMetadataSidecar(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ t.Setenv("METADATA_SIDECAR", "true")
+ t.Setenv("METADATA_SIDECAR_FIELDS", `{"sourceKey":"object_key"}`)
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ data, ok := e.server.file("/uploads/orders.csv" + metadataSidecarSuffix)
+ if !ok {
+  t.Fatal("metadata sidecar was not written")
+ }
+ var doc map[string]any
+ if err := json.Unmarshal(data, &doc); err != nil {
+  t.Fatal(err)
+ }
+ if doc["object_key"] != "test-poc/orders.csv" || doc[config.SidecarSourceBucket] != s3Bucket || doc[config.SidecarSize] != float64(3) {
+  t.Errorf("sidecar = %v", doc)
+ }
+ if _, ok := doc[config.SidecarSourceKey]; ok {
+  t.Errorf("sidecar = %v, want sourceKey renamed", doc)
+ }
+}
+
+func TestParseSidecarFields(t *testing.T) {
+ for _, v := range []string{`{"size":""}`, `{"bogus":"x"}`, `not json`} {
+  if _, err := config.ParseSidecarFields(v); err == nil {
+   t.Errorf("parseSidecarFields(%s) succeeded", v)
+  } else if !strings.Contains(err.Error(), "METADATA_SIDECAR_FIELDS") {
+   t.Errorf("parseSidecarFields(%s) = %v, want the knob named", v, err)
+  }
+ }
+}
@@ -0,0 +1,161 @@
+package transfer
+
+import (
+ "bytes"
+ "context"
+ "encoding/json"
+ "fmt"
+ "log"
+ "net/http"
+ "strconv"
+ "strings"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/schema"
+)
+
+const (
+ slackAttempts      = 3
+ slackMaxRetryAfter = 30 * time.Second
+ // slackMaxFailedKeys limits how many failed keys are listed in a message.
+ slackMaxFailedKeys = 20
+)
+
+// sendSlack posts a Block Kit run summary to the Slack incoming webhook whose
+// URL is stored in SLACK_WEBHOOK_SECRET_NAME. Failures are logged and never
+// change the result of the run.
+func sendSlack(ctx context.Context, cfg *Config, sess *cloud.Session, report *transferReport, clk clock) {
+ if cfg.SlackWebhookSecretName == "" {
+  return
+ }
+ summary := report.summary()
+ if cfg.SlackNotify == config.SlackNotifyFailure && summary.Status == runSucceeded {
+  return
+ }
+ if err := postSlack(ctx, cfg, sess, report, summary, clk); err != nil {
+  log.Printf("Slack notification failed: %v", err)
+ }
+}
+
+func postSlack(ctx context.Context, cfg *Config, sess *cloud.Session, report *transferReport, summary schema.ResultV1, clk clock) error {
+ url, err := config.SecretString(sess, cfg, cfg.SlackWebhookSecretName)
+ if err != nil {
+  return fmt.Errorf("failed to get Slack webhook URL: %w", err)
+ }
+ body, err := json.Marshal(slackMessage(cfg.DestinationName, report, summary))
+ if err != nil {
+  return fmt.Errorf("failed to marshal Slack message: %w", err)
+ }
+
+ client := &http.Client{Timeout: webhookTimeout}
+ for attempt := 1; ; attempt++ {
+  req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+  if err != nil {
+   return fmt.Errorf("invalid Slack request: %w", err)
+  }
+  req.Header.Set("Content-Type", "application/json")
+  resp, err := client.Do(req)
+  if err != nil {
+   // Don't log err itself: it contains the webhook URL, which
+   // is a credential.
+   return fmt.Errorf("failed to post to Slack")
+  }
+  resp.Body.Close()
+  if resp.StatusCode == http.StatusTooManyRequests && attempt < slackAttempts {
+   delay := retryAfter(resp.Header.Get("Retry-After"))
+   log.Printf("Slack rate limited the notification, retrying in %s", delay)
+   select {
+   case <-clk.After(delay):
+    continue
+   case <-ctx.Done():
+    return ctx.Err()
+   }
+  }
+  if resp.StatusCode >= 300 {
+   return fmt.Errorf("slack returned %s", resp.Status)
+  }
+  log.Println("Slack notification sent")
+  return nil
+ }
+}
+
+// retryAfter parses a Retry-After header given in seconds, capped so a
+// misbehaving response cannot stall the invocation.
+func retryAfter(v string) time.Duration {
+ secs, err := strconv.Atoi(v)
+ if err != nil || secs < 1 {
+  return time.Second
+ }
+ d := time.Duration(secs) * time.Second
+ if d > slackMaxRetryAfter {
+  d = slackMaxRetryAfter
+ }
+ return d
+}
+
+func slackMessage(destination string, report *transferReport, s schema.ResultV1) map[string]interface{} {
+ duration := time.Duration(s.DurationMs) * time.Millisecond
+ var text string
+ if s.Status == runSucceeded {
+  text = fmt.Sprintf(":white_check_mark: %d files (%s) delivered to %s in %s",
+   s.Transferred, humanBytes(s.Bytes), destination, duration.Round(time.Second))
+ } else if s.Status == runPartial {
+  text = fmt.Sprintf(":warning: Transfer to %s partially failed after %s: %d delivered, %d failed",
+   destination, duration.Round(time.Second), s.Transferred, s.Failed)
+ } else {
+  text = fmt.Sprintf(":x: Transfer to %s failed after %s: %d delivered, %d failed",
+   destination, duration.Round(time.Second), s.Transferred, s.Failed)
+ }
+
+ blocks := []map[string]interface{}{{
+  "type": "section",
+  "text": map[string]string{"type": "mrkdwn", "text": text},
+ }}
+ if s.Status != runSucceeded {
+  var failed []string
+  for _, f := range report.Files {
+   if f.Status != statusFailed && f.Status != statusPartial {
+    continue
+   }
+   if len(failed) == slackMaxFailedKeys {
+    failed = append(failed, fmt.Sprintf("…and %d more", s.Failed-slackMaxFailedKeys))
+    break
+   }
+   failed = append(failed, "• `"+f.Key+"`")
+  }
+  detail := s.Error
+  if len(failed) > 0 {
+   detail = "*Failed keys:*\n" + strings.Join(failed, "\n")
+  }
+  if detail != "" {
+   blocks = append(blocks, map[string]interface{}{
+    "type": "section",
+    "text": map[string]string{"type": "mrkdwn", "text": detail},
+   })
+  }
+ }
+ blocks = append(blocks, map[string]interface{}{
+  "type": "context",
+  "elements": []map[string]string{{
+   "type": "mrkdwn",
+   "text": "Request " + s.RequestID,
+  }},
+ })
+ return map[string]interface{}{"text": text, "blocks": blocks}
+}
+
+// humanBytes formats n using binary units, e.g. "1.3 GB".
+func humanBytes(n int64) string {
+ const unit = 1024
+ if n < unit {
+  return fmt.Sprintf("%d B", n)
+ }
+ div, exp := int64(unit), 0
+ for m := n / unit; m >= unit; m /= unit {
+  div *= unit
+  exp++
+ }
+ return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,33 @@
+package transfer
+
+import (
+ "net/http"
+ "reflect"
+ "testing"
+ "time"
+)
+
+func TestSlackWaitsRetryAfterOnRunClock(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ clk := installFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+ hook := startTestEndpoint(t, func(n int, w http.ResponseWriter) int {
+  if n == 1 {
+   w.Header().Set("Retry-After", "7")
+   return http.StatusTooManyRequests
+  }
+  return http.StatusOK
+ })
+ e.secrets.set("slack-hook", hook.URL)
+ t.Setenv("SLACK_WEBHOOK_SECRET_NAME", "slack-hook")
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if hook.count() != 2 {
+  t.Errorf("Slack got %d request(s), want 2", hook.count())
+ }
+ if want := []time.Duration{7 * time.Second}; !reflect.DeepEqual(clk.Sleeps(), want) {
+  t.Errorf("slept %v, want %v", clk.Sleeps(), want)
+ }
+}
@@ -0,0 +1,68 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// statvfsExtension is the OpenSSH extension behind sftp.Client.StatVFS.
+const statvfsExtension = "statvfs@openssh.com"
+
+// categoryRemoteSpace marks files deferred because the remote filesystem
+// did not have room for them.
+const categoryRemoteSpace errorCategory = "insufficient_remote_space"
+
+// remoteSpace tracks the free space on the filesystem holding REMOTE_DIR.
+// After the first query it is decremented by the bytes sent, so it stays a
+// conservative estimate between re-checks.
+type remoteSpace struct {
+ known bool
+ free  int64
+}
+
+// checkRemoteSpace queries the free space available to the user under dir.
+// Servers without the statvfs extension skip the check.
+func (r *transferRun) checkRemoteSpace(client sftpfs.FS, dir string) error {
+ if !r.cfg.RemoteSpaceCheck {
+  return nil
+ }
+ if _, ok := client.HasExtension(statvfsExtension); !ok {
+  r.cfg.Debugf("SFTP server does not support %s, not checking remote free space", statvfsExtension)
+  return nil
+ }
+ st, err := client.StatVFS(dir)
+ if err != nil {
+  return fmt.Errorf("failed to query free space under %s: %w", dir, err)
+ }
+ r.space = remoteSpace{known: true, free: int64(st.Bavail * st.Frsize)}
+ r.cfg.Debugf("Remote free space under %s is %d bytes", dir, r.space.free)
+ return nil
+}
+
+// fitsRemoteSpace reports whether a file of size bytes fits in the remote
+// free space, re-querying it first for files of at least
+// REMOTE_SPACE_RECHECK_BYTES. When the free space is unknown every file fits.
+func (r *transferRun) fitsRemoteSpace(client sftpfs.FS, dir string, size int64) bool {
+ if r.space.known && r.cfg.RemoteSpaceRecheckBytes > 0 && size >= r.cfg.RemoteSpaceRecheckBytes {
+  if err := r.checkRemoteSpace(client, dir); err != nil {
+   r.cfg.Debugf("Keeping the previous free space estimate: %v", err)
+  }
+ }
+ return !r.space.known || size <= r.space.free
+}
+
+// deferForSpace records key as deferred because it would not fit on the
+// server.
+func (r *transferRun) deferForSpace(key string) {
+ size := r.sizes[key]
+ r.metrics.add("RemoteSpaceDeferred", unitCount, 1)
+ r.report.addFile(fileReport{
+  Key:      key,
+  Status:   statusDeferred,
+  Category: string(categoryRemoteSpace),
+  Error:    fmt.Sprintf("insufficient remote space: %d bytes needed, %d free", size, r.space.free),
+ })
+ log.Printf("Deferring %s: %d bytes needed but only %d free on the server", key, size, r.space.free)
+}
@@ -0,0 +1,88 @@
+package transfer
+
+import (
+ "bytes"
+ "crypto/sha256"
+ "encoding/hex"
+ "encoding/json"
+ "fmt"
+ "io"
+ "log"
+ "path"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// partsManifest is written as <name>.parts after every part of a split file
+// has been delivered, so the partner can reassemble and verify it.
+type partsManifest struct {
+ File       string         `json:"file"`
+ TotalBytes int64          `json:"totalBytes"`
+ Parts      []manifestPart `json:"parts"`
+}
+
+type manifestPart struct {
+ Name   string `json:"name"`
+ Bytes  int64  `json:"bytes"`
+ SHA256 string `json:"sha256"`
+}
+
+// uploadParts streams body into sequential remote files <remotePath>.part001,
+// .part002, ... of at most partSize bytes each, then writes the .parts
+// manifest. If any part fails, every part already written is removed so the
+// partner never sees an incomplete set.
+func uploadParts(client sftpfs.FS, remotePath string, body io.Reader, partSize int64, opts writeOptions) (int, int64, error) {
+ manifest := partsManifest{File: path.Base(remotePath)}
+ var written []string
+ cleanup := func() {
+  for _, p := range written {
+   if err := client.Remove(p); err != nil {
+    log.Printf("Failed to remove partial part %s: %v", p, err)
+   }
+  }
+ }
+
+ for i := 1; ; i++ {
+  // Peek one byte so an object that is an exact multiple of
+  // partSize does not produce a trailing empty part.
+  var peek [1]byte
+  if n, err := io.ReadFull(body, peek[:]); n == 0 {
+   if err != nil && err != io.EOF {
+    cleanup()
+    return 0, 0, fmt.Errorf("failed to read source for part %d: %w", i, err)
+   }
+   break
+  }
+
+  partPath := fmt.Sprintf("%s.part%03d", remotePath, i)
+  hash := sha256.New()
+  src := io.MultiReader(bytes.NewReader(peek[:]), io.LimitReader(body, partSize-1))
+  n, err := writeRemoteFile(client, partPath, io.TeeReader(src, hash), opts)
+  written = append(written, partPath)
+  if err != nil {
+   cleanup()
+   return 0, 0, fmt.Errorf("part %d: %w", i, err)
+  }
+  log.Printf("Wrote part %s bytes=%d", partPath, n)
+  manifest.Parts = append(manifest.Parts, manifestPart{
+   Name:   path.Base(partPath),
+   Bytes:  n,
+   SHA256: hex.EncodeToString(hash.Sum(nil)),
+  })
+  manifest.TotalBytes += n
+ }
+
+ data, err := json.MarshalIndent(manifest, "", "  ")
+ if err != nil {
+  cleanup()
+  return 0, 0, fmt.Errorf("failed to marshal parts manifest: %w", err)
+ }
+ manifestPath := remotePath + ".parts"
+ if _, err := writeRemoteFile(client, manifestPath, bytes.NewReader(data), opts); err != nil {
+  cleanup()
+  client.Remove(manifestPath)
+  return 0, 0, fmt.Errorf("failed to write parts manifest: %w", err)
+ }
+ log.Printf("Wrote parts manifest %s parts=%d", manifestPath, len(manifest.Parts))
+ return len(manifest.Parts), manifest.TotalBytes, nil
+}
@@ -0,0 +1,86 @@
+package transfer
+
+import (
+ "crypto/sha256"
+ "encoding/hex"
+ "encoding/json"
+ "fmt"
+ "reflect"
+ "testing"
+)
+
+// wantParts checks the parts of remotePath and their manifest.
+func (e *testEnv) wantParts(remotePath string, parts ...string) {
+ e.t.Helper()
+ var want partsManifest
+ want.File = remotePath[len("/uploads/"):]
+ for i, p := range parts {
+  name := fmt.Sprintf("%s.part%03d", remotePath, i+1)
+  e.wantFile(name, p)
+  sum := sha256.Sum256([]byte(p))
+  want.Parts = append(want.Parts, manifestPart{Name: fmt.Sprintf("%s.part%03d", want.File, i+1), Bytes: int64(len(p)), SHA256: hex.EncodeToString(sum[:])})
+  want.TotalBytes += int64(len(p))
+ }
+ if name := fmt.Sprintf("%s.part%03d", remotePath, len(parts)+1); e.server.exists(name) {
+  e.t.Errorf("%s written, want %d part(s)", name, len(parts))
+ }
+ data, ok := e.server.file(remotePath + ".parts")
+ if !ok {
+  e.t.Fatalf("%s.parts was not written", remotePath)
+ }
+ var got partsManifest
+ if err := json.Unmarshal(data, &got); err != nil {
+  e.t.Fatal(err)
+ }
+ if !reflect.DeepEqual(got, want) {
+  e.t.Errorf("manifest = %+v, want %+v", got, want)
+ }
+ if e.server.exists(remotePath) {
+  e.t.Errorf("%s delivered whole as well as split", remotePath)
+ }
+}
+
+func TestSplitParts(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ t.Setenv("SPLIT_SIZE_BYTES", "4")
+ e.s3.put("test-poc/digits.txt", "0123456789")
+ e.s3.put("test-poc/even.txt", "abcdefgh")
+ e.s3.put("test-poc/small.txt", "abcd")
+
+ result, err := e.run("")
+ if err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if result.Transferred != 3 || result.Bytes != 22 {
+  t.Fatalf("result = %+v, want 3 files of 22 bytes in all", result)
+ }
+ e.wantParts("/uploads/digits.txt", "0123", "4567", "89")
+ // A multiple of the part size has no empty trailing part.
+ e.wantParts("/uploads/even.txt", "abcd", "efgh")
+ // Files no larger than a part are delivered whole.
+ e.wantFile("/uploads/small.txt", "abcd")
+ if e.server.exists("/uploads/small.txt.parts") {
+  t.Error("small.txt split")
+ }
+}
+
+func TestSplitPartFailureRemovesParts(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ t.Setenv("SPLIT_SIZE_BYTES", "4")
+ e.s3.put("test-poc/digits.txt", "0123456789")
+ e.server.failClose["/uploads/digits.txt.part002"] = true
+
+ result, err := e.run("")
+ if err == nil {
+  t.Fatal("run succeeded although a part failed")
+ }
+ if result != nil && result.Failed != 1 {
+  t.Errorf("result = %+v, want the file failed", result)
+ }
+ // The partner never sees an incomplete set.
+ for _, p := range []string{".part001", ".part002", ".part003", ".parts"} {
+  if e.server.exists("/uploads/digits.txt" + p) {
+   t.Errorf("digits.txt%s left behind", p)
+  }
+ }
+}
@@ -0,0 +1,108 @@
+package transfer
+
+import (
+ "fmt"
+ "log"
+ "os"
+ "path/filepath"
+ "syscall"
+ "time"
+)
+
+// categorySpoolSpace marks files that would not fit in the free space left
+// on SPOOL_DIR.
+const categorySpoolSpace errorCategory = "insufficient_spool_space"
+
+// prepareSpool creates the run's own directory under SPOOL_DIR, named by the
+// request ID so concurrent runs sharing the mount never collide, after
+// removing directories left by runs that died more than SPOOL_STALE_AGE ago.
+// Without SPOOL_DIR files are spooled to the default temporary directory, as
+// before.
+func (r *transferRun) prepareSpool(requestID string) error {
+ if r.cfg.SpoolDir == "" {
+  return nil
+ }
+ info, err := os.Stat(r.cfg.SpoolDir)
+ if err != nil {
+  return withCategory(categoryConfig, fmt.Errorf("SPOOL_DIR %s is not available; is the file system mounted? %w", r.cfg.SpoolDir, err))
+ }
+ if !info.IsDir() {
+  return withCategory(categoryConfig, fmt.Errorf("SPOOL_DIR %s is not a directory", r.cfg.SpoolDir))
+ }
+ r.cleanSpool()
+ if requestID == "" {
+  requestID = fmt.Sprintf("run-%d", r.clock.Now().UnixNano())
+ }
+ dir := filepath.Join(r.cfg.SpoolDir, requestID)
+ if err := os.MkdirAll(dir, 0o700); err != nil {
+  return fmt.Errorf("failed to create spool directory %s: %w", dir, err)
+ }
+ r.spoolDir = dir
+ r.cfg.Debugf("Spooling to %s", dir)
+ return nil
+}
+
+// removeSpool removes the run's spool directory and anything left in it.
+func (r *transferRun) removeSpool() {
+ if r.spoolDir == "" {
+  return
+ }
+ if err := os.RemoveAll(r.spoolDir); err != nil {
+  log.Printf("Failed to remove spool directory %s: %v", r.spoolDir, err)
+ }
+}
+
+// cleanSpool removes the directories under SPOOL_DIR last modified more
+// than SPOOL_STALE_AGE ago. They belong to runs that were killed before
+// removing their own. Failures are logged; they never fail the run.
+func (r *transferRun) cleanSpool() {
+ entries, err := os.ReadDir(r.cfg.SpoolDir)
+ if err != nil {
+  log.Printf("Failed to list SPOOL_DIR %s: %v", r.cfg.SpoolDir, err)
+  return
+ }
+ cutoff := r.clock.Now().Add(-r.cfg.SpoolStaleAge)
+ var removed int
+ for _, e := range entries {
+  info, err := e.Info()
+  if err != nil || !e.IsDir() || !info.ModTime().Before(cutoff) {
+   continue
+  }
+  p := filepath.Join(r.cfg.SpoolDir, e.Name())
+  if err := os.RemoveAll(p); err != nil {
+   log.Printf("Failed to remove stale spool directory %s: %v", p, err)
+   continue
+  }
+  log.Printf("Removed stale spool directory %s, last modified %s", p, info.ModTime().UTC().Format(time.RFC3339))
+  removed++
+ }
+ r.metrics.add("SpoolDirsRemoved", unitCount, float64(removed))
+}
+
+// checkSpoolSpace fails when size bytes would not fit in the space free on
+// the file system holding SPOOL_DIR. Without SPOOL_DIR nothing is checked.
+func (r *transferRun) checkSpoolSpace(what string, size int64) error {
+ if r.spoolDir == "" || size <= 0 {
+  return nil
+ }
+ var st syscall.Statfs_t
+ if err := syscall.Statfs(r.spoolDir, &st); err != nil {
+  r.cfg.Debugf("Not checking free space under %s: %v", r.spoolDir, err)
+  return nil
+ }
+ if free := int64(st.Bavail) * int64(st.Bsize); size > free {
+  return withCategory(categorySpoolSpace, fmt.Errorf("%s needs %d bytes of spool space, but only %d are free under %s", what, size, free, r.spoolDir))
+ }
+ return nil
+}
+
+// recordSpool records the time taken to spool n bytes. A slow network file
+// system shows up as a long SpoolDuration next to the TransferDuration of
+// the same files.
+func (r *transferRun) recordSpool(what string, n int64, elapsed time.Duration) {
+ r.metrics.addDuration("SpoolDuration", elapsed)
+ r.metrics.add("SpoolBytes", unitBytes, float64(n))
+ if secs := elapsed.Seconds(); secs > 0 {
+  r.cfg.Debugf("Spooled %s: %d bytes in %s (%.1f MiB/s)", what, n, elapsed.Round(time.Millisecond), float64(n)/secs/(1<<20))
+ }
+}
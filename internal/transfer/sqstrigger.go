@@ -0,0 +1,176 @@
+package transfer
+
+import (
+ "context"
+ "encoding/json"
+ "fmt"
+ "log"
+ "sort"
+ "strings"
+ "sync"
+
+ "github.com/aws/aws-lambda-go/events"
+ "github.com/aws/aws-lambda-go/lambdacontext"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+const defaultSQSConcurrency = 1
+
+// tenantAttribute is the SQS message attribute naming the tenant a message
+// is delivered for, like the payload's tenant field.
+const tenantAttribute = "tenant"
+
+// parseSQSEvent reports whether event is a batch from an SQS event source
+// mapping.
+func parseSQSEvent(event json.RawMessage) (*events.SQSEvent, bool) {
+ ev := &events.SQSEvent{}
+ if err := json.Unmarshal(event, ev); err != nil || len(ev.Records) == 0 || ev.Records[0].EventSource != "aws:sqs" {
+  return nil, false
+ }
+ return ev, true
+}
+
+// isFIFORecord reports whether msg came from a FIFO queue, whose ARN ends in
+// .fifo and whose messages carry a MessageGroupId.
+func isFIFORecord(msg *events.SQSMessage) bool {
+ return strings.HasSuffix(msg.EventSourceARN, ".fifo") || msg.Attributes["MessageGroupId"] != ""
+}
+
+// handleSQSBatch runs each record of an SQS batch, whose body is an
+// invocation payload, through the same handler as any other invocation, as
+// serve does for the messages it receives. Up to SQS_CONCURRENCY (default 1)
+// records run at once. Records of a FIFO queue are grouped by
+// MessageGroupId, and each group runs strictly in sequence number order, so
+// only different groups run side by side. Failed records are reported as
+// batch item failures, which needs ReportBatchItemFailures on the event
+// source mapping. Once a record of a FIFO group fails, the later records of
+// the group are failed without running, so they are redelivered after it
+// and the group's order holds.
+func handleSQSBatch(ctx context.Context, ev *events.SQSEvent) (*events.SQSEventResponse, error) {
+ concurrency, err := config.EnvInt("SQS_CONCURRENCY", defaultSQSConcurrency)
+ if err != nil {
+  return nil, err
+ }
+ if concurrency < 1 {
+  return nil, fmt.Errorf("invalid SQS_CONCURRENCY %d: must be at least 1", concurrency)
+ }
+
+ // Standard queue records each form a group of their own.
+ var order []string
+ groups := make(map[string][]*events.SQSMessage)
+ for i := range ev.Records {
+  msg := &ev.Records[i]
+  group := "\x00" + msg.MessageId
+  if isFIFORecord(msg) {
+   group = msg.Attributes["MessageGroupId"]
+  }
+  if _, ok := groups[group]; !ok {
+   order = append(order, group)
+  }
+  groups[group] = append(groups[group], msg)
+ }
+ log.Printf("SQS batch of %d record(s) in %d group(s), %d at a time", len(ev.Records), len(order), concurrency)
+
+ var (
+  mu       sync.Mutex
+  failures []events.SQSBatchItemFailure
+  wg       sync.WaitGroup
+ )
+ sem := make(chan struct{}, concurrency)
+ for _, group := range order {
+  msgs := groups[group]
+  sort.SliceStable(msgs, func(i, j int) bool {
+   return lessSequenceNumber(msgs[i].Attributes["SequenceNumber"], msgs[j].Attributes["SequenceNumber"])
+  })
+  wg.Add(1)
+  sem <- struct{}{}
+  go func() {
+   defer wg.Done()
+   defer func() { <-sem }()
+   failed := runSQSGroup(ctx, msgs)
+   mu.Lock()
+   failures = append(failures, failed...)
+   mu.Unlock()
+  }()
+ }
+ wg.Wait()
+ return &events.SQSEventResponse{BatchItemFailures: failures}, nil
+}
+
+// runSQSGroup runs the records of one group in order, returning those that
+// failed and, after the first failure, those after it.
+func runSQSGroup(ctx context.Context, msgs []*events.SQSMessage) []events.SQSBatchItemFailure {
+ var failures []events.SQSBatchItemFailure
+ for i, msg := range msgs {
+  if err := runSQSRecord(ctx, msg); err != nil {
+   log.Printf("SQS record %s failed, reporting it for redelivery: %v", msg.MessageId, err)
+   for _, rest := range msgs[i:] {
+    if rest != msg {
+     log.Printf("SQS record %s follows failed record %s in group %s, reporting it for redelivery without running it",
+      rest.MessageId, msg.MessageId, msg.Attributes["MessageGroupId"])
+    }
+    failures = append(failures, events.SQSBatchItemFailure{ItemIdentifier: rest.MessageId})
+   }
+   break
+  }
+ }
+ return failures
+}
+
+// runSQSRecord delivers one record. Its run is named by the message ID, as
+// under serve.
+func runSQSRecord(ctx context.Context, msg *events.SQSMessage) error {
+ lc := &lambdacontext.LambdaContext{AwsRequestID: msg.MessageId}
+ if parent, ok := lambdacontext.FromContext(ctx); ok {
+  copied := *parent
+  copied.AwsRequestID = msg.MessageId
+  lc = &copied
+ }
+ log.Printf("Running SQS record %s", msg.MessageId)
+ var tenant string
+ if a, ok := msg.MessageAttributes[tenantAttribute]; ok && a.StringValue != nil {
+  tenant = *a.StringValue
+ }
+ payload, err := withTenantAttribute(msg.Body, tenant)
+ if err != nil {
+  return err
+ }
+ _, err = lambdaHandler(lambdacontext.NewContext(ctx, lc), payload)
+ return err
+}
+
+// withTenantAttribute sets the tenant field of the payload body to the
+// tenant attribute of its message. A body naming another tenant is
+// rejected, rather than delivered with either tenant's secret.
+func withTenantAttribute(body, tenant string) (json.RawMessage, error) {
+ if tenant == "" {
+  return json.RawMessage(body), nil
+ }
+ var fields map[string]json.RawMessage
+ if strings.TrimSpace(body) != "" {
+  if err := json.Unmarshal([]byte(body), &fields); err != nil {
+   return nil, fmt.Errorf("invalid invocation payload: %w", err)
+  }
+ }
+ if fields == nil {
+  fields = make(map[string]json.RawMessage)
+ }
+ if raw, ok := fields["tenant"]; ok {
+  var set string
+  if err := json.Unmarshal(raw, &set); err != nil || set != tenant {
+   return nil, fmt.Errorf("payload tenant %s does not match the %s message attribute %q", raw, tenantAttribute, tenant)
+  }
+ }
+ fields["tenant"], _ = json.Marshal(tenant)
+ return json.Marshal(fields)
+}
+
+// lessSequenceNumber orders FIFO sequence numbers, decimal strings of up to
+// 128 bits.
+func lessSequenceNumber(a, b string) bool {
+ if len(a) != len(b) {
+  return len(a) < len(b)
+ }
+ return a < b
+}
@@ -0,0 +1,102 @@
+package transfer
+
+import (
+ "fmt"
+ "io"
+ "log"
+ "path"
+ "strings"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// categoryStagingMove marks files that were uploaded to STAGING_DIR but
+// could not be moved into their final directory.
+const categoryStagingMove errorCategory = "staging_move"
+
+// stagingPath returns where remotePath is uploaded before being moved into
+// place: the same path below STAGING_DIR as remotePath has below REMOTE_DIR,
+// or its base name for files routed outside REMOTE_DIR. Under ATOMIC_UPLOAD
+// the staged name also carries the temporary suffix.
+func (r *transferRun) stagingPath(remotePath string) string {
+ staging := r.resolveRemotePath(r.cfg.StagingDir)
+ rel := path.Base(remotePath)
+ if dir := r.resolveRemotePath(r.cfg.RemoteDir); strings.HasPrefix(remotePath, dir+"/") {
+  rel = strings.TrimPrefix(remotePath, dir+"/")
+ }
+ p := path.Join(staging, rel)
+ if r.cfg.AtomicUpload {
+  p += atomicTempSuffix
+ }
+ return p
+}
+
+// deliverStaged uploads body to the staging path of remotePath and then
+// renames it into place, so the final directory only ever holds complete
+// files. It returns the bytes written and the staged path.
+func (r *transferRun) deliverStaged(client sftpfs.FS, body io.Reader, remotePath string, opts writeOptions) (int64, string, error) {
+ staged := r.stagingPath(remotePath)
+ if err := r.ensureRemoteDir(client, path.Dir(staged)); err != nil {
+  return 0, staged, err
+ }
+ stagedOpts := opts
+ stagedOpts.overwrite = true
+ n, err := writeRemoteFile(client, staged, body, stagedOpts)
+ if err != nil {
+  client.Remove(staged)
+  return n, staged, err
+ }
+ if err := moveFromStaging(client, staged, remotePath, opts.overwrite); err != nil {
+  client.Remove(staged)
+  return n, staged, err
+ }
+ return n, staged, nil
+}
+
+// moveFromStaging renames staged to remotePath, replacing an existing file
+// only when overwrite is set.
+func moveFromStaging(client sftpfs.FS, staged, remotePath string, overwrite bool) error {
+ var err error
+ if overwrite {
+  err = renameOver(client, staged, remotePath)
+ } else {
+  err = client.Rename(staged, remotePath)
+ }
+ switch {
+ case err == nil:
+  return nil
+ case isRenameUnsupported(err):
+  return withCategory(categoryStagingMove, fmt.Errorf(
+   "SFTP server does not support rename, which STAGING_DIR needs to move %s to %s: %w", staged, remotePath, err))
+ }
+ return withCategory(categoryStagingMove, fmt.Errorf(
+  "failed to move %s to %s; the server may not allow renames across directories, which STAGING_DIR needs: %w", staged, remotePath, err))
+}
+
+// cleanStaging removes files left in STAGING_DIR by runs that died before
+// moving them, once they are older than STAGING_ORPHAN_AGE. Failures are
+// logged; they never fail the run.
+func (r *transferRun) cleanStaging(client sftpfs.FS) {
+ dir := r.resolveRemotePath(r.cfg.StagingDir)
+ cutoff := r.clock.Now().Add(-r.cfg.StagingOrphanAge)
+ var removed int
+ walker := client.Walk(dir)
+ for walker.Step() {
+  if err := walker.Err(); err != nil {
+   r.cfg.Debugf("Not cleaning %s: %v", walker.Path(), err)
+   continue
+  }
+  info := walker.Stat()
+  if info.IsDir() || !info.ModTime().Before(cutoff) {
+   continue
+  }
+  if err := client.Remove(walker.Path()); err != nil {
+   log.Printf("Failed to remove orphaned staging file %s: %v", walker.Path(), err)
+   continue
+  }
+  log.Printf("Removed orphaned staging file %s, last modified %s", walker.Path(), info.ModTime().UTC().Format(time.RFC3339))
+  removed++
+ }
+ r.metrics.add("StagingOrphansRemoved", unitCount, float64(removed))
+}
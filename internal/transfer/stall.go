@@ -0,0 +1,121 @@
+package transfer
+
+import (
+ "errors"
+ "io"
+ "log"
+ "os"
+ "sync"
+ "sync/atomic"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// errTransferStalled is returned for a file whose transfer was aborted
+// because no bytes moved for STALL_TIMEOUT.
+var errTransferStalled = errors.New("transfer stalled")
+
+// stallWatch wraps the source of a transfer and records when bytes last
+// moved through it. If nothing moves for timeout it calls abort, which must
+// unblock the transfer, by tearing down the connection. Any progress at all
+// resets the timer, so slow transfers are never aborted.
+type stallWatch struct {
+ src      io.Reader
+ timeout  time.Duration
+ abort    func()
+ last     atomic.Int64
+ stalled  atomic.Bool
+ done     chan struct{}
+ stopOnce sync.Once
+}
+
+func newStallWatch(src io.Reader, timeout time.Duration, abort func()) *stallWatch {
+ w := &stallWatch{src: src, timeout: timeout, abort: abort, done: make(chan struct{})}
+ w.last.Store(time.Now().UnixNano())
+ go w.run()
+ return w
+}
+
+func (w *stallWatch) Read(p []byte) (int, error) {
+ n, err := w.src.Read(p)
+ if n > 0 {
+  w.last.Store(time.Now().UnixNano())
+ }
+ return n, err
+}
+
+func (w *stallWatch) run() {
+ interval := w.timeout / 4
+ if interval < time.Second {
+  interval = time.Second
+ }
+ ticker := time.NewTicker(interval)
+ defer ticker.Stop()
+ for {
+  select {
+  case <-w.done:
+   return
+  case <-ticker.C:
+   idle := time.Since(time.Unix(0, w.last.Load()))
+   if idle < w.timeout {
+    continue
+   }
+   log.Printf("No bytes transferred for %s, aborting stalled transfer", idle.Round(time.Second))
+   w.stalled.Store(true)
+   w.abort()
+   return
+  }
+ }
+}
+
+// stop ends the watch and reports whether the transfer was aborted.
+func (w *stallWatch) stop() bool {
+ w.stopOnce.Do(func() { close(w.done) })
+ return w.stalled.Load()
+}
+
+// watchStalls wraps body in a stallWatch that closes the run's connection
+// and source, the stream body reads from, when the transfer stops making
+// progress. It returns body unchanged and a no-op stop when STALL_TIMEOUT is
+// zero.
+func (r *transferRun) watchStalls(body, source io.Reader) (io.Reader, func() bool) {
+ if r.cfg.StallTimeout <= 0 || r.conn == nil {
+  return body, func() bool { return false }
+ }
+ conn := r.conn
+ w := newStallWatch(body, r.cfg.StallTimeout, func() {
+  conn.SSH.Close()
+  if c, ok := source.(io.Closer); ok {
+   c.Close()
+  }
+ })
+ return w, w.stop
+}
+
+// removeAfterStall removes the partial files a stalled transfer left behind.
+// The run's connection was torn down to abort the transfer, so a fresh one
+// is dialed for the cleanup.
+func (r *transferRun) removeAfterStall(paths ...string) {
+ conn, err := sftpfs.Dial(r.cfg, r.sftpConfig)
+ if err != nil {
+  log.Printf("Failed to connect to remove partial files %v: %v", paths, err)
+  return
+ }
+ defer conn.Close()
+ r.removePartial(conn.SFTP, paths...)
+}
+
+// removePartial removes the partial files a failed transfer left behind.
+// Files already gone are ignored.
+func (r *transferRun) removePartial(client sftpfs.FS, paths ...string) {
+ for _, p := range paths {
+  if err := client.Remove(p); err != nil {
+   if !errors.Is(err, os.ErrNotExist) {
+    log.Printf("Failed to remove partial file %s: %v", p, err)
+   }
+   continue
+  }
+  log.Printf("Removed partial file %s", p)
+ }
+}
@@ -0,0 +1,463 @@
+package transfer
+
+import (
+ "bytes"
+ "crypto/rand"
+ "encoding/hex"
+ "encoding/json"
+ "fmt"
+ "log"
+ "math"
+ "net/http"
+ "net/url"
+ "os"
+ "sort"
+ "strconv"
+ "strings"
+ "sync"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+)
+
+// otlpScope names the instrumentation in exported spans and metrics.
+const otlpScope = "github.com/vishalk7890/s3-sftp-lambda"
+
+const defaultOTLPTimeout = 10 * time.Second
+
+// otlpSpanBatchSize is the number of finished spans exported together while
+// a run goes on, and otlpMaxQueuedSpans the most held at once, waiting or
+// being exported; spans beyond it are dropped. These are the defaults of the
+// OpenTelemetry batch span processor.
+const (
+ otlpSpanBatchSize  = 512
+ otlpMaxQueuedSpans = 2048
+)
+
+// OTLP span kinds and status codes.
+const (
+ otlpSpanKindInternal = 1
+ otlpSpanKindServer   = 2
+ otlpStatusOK         = 1
+ otlpStatusError      = 2
+ // otlpDelta is AGGREGATION_TEMPORALITY_DELTA: each export holds
+ // only the values of one invocation.
+ otlpDelta = 1
+)
+
+// otlpExporter sends spans and metrics to an OpenTelemetry collector over
+// OTLP/HTTP with JSON encoding, which collectors accept on the same paths as
+// protobuf. A signal left nil is not exported.
+type otlpExporter struct {
+ traces   *otlpSignal
+ metrics  *otlpSignal
+ resource []otlpAttribute
+}
+
+// otlpSignal is where one signal is exported to and how.
+type otlpSignal struct {
+ url     string
+ headers map[string]string
+ client  *http.Client
+}
+
+// otlp is the exporter configured by the standard OTEL_* variables, or nil
+// when no OTLP endpoint is set, in which case tracing and metric export do
+// nothing.
+var otlp = sync.OnceValue(newOTLPExporter)
+
+// newOTLPExporter reads OTEL_EXPORTER_OTLP_ENDPOINT, _HEADERS and _TIMEOUT,
+// each of which the signal-specific _TRACES_ and _METRICS_ variants
+// override, along with OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES.
+// OTEL_SDK_DISABLED=true, or OTEL_TRACES_EXPORTER / OTEL_METRICS_EXPORTER set
+// to none, turn export off. Only the HTTP protocols are supported.
+func newOTLPExporter() *otlpExporter {
+ if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+  return nil
+ }
+ e := &otlpExporter{
+  traces:  newOTLPSignal("TRACES", "v1/traces", os.Getenv("OTEL_TRACES_EXPORTER")),
+  metrics: newOTLPSignal("METRICS", "v1/metrics", os.Getenv("OTEL_METRICS_EXPORTER")),
+ }
+ if e.traces == nil && e.metrics == nil {
+  return nil
+ }
+ if p := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); p == "grpc" {
+  log.Printf("WARNING: OTEL_EXPORTER_OTLP_PROTOCOL=grpc is not supported, use http/protobuf or http/json; not exporting telemetry")
+  return nil
+ }
+
+ service := functionName()
+ if service == "" {
+  service = defaultServeServiceName
+ }
+ attrs := map[string]any{
+  "service.name":    service,
+  "service.version": CurrentBuild().Version,
+  "cloud.provider":  "aws",
+  "cloud.region":    cloud.Region,
+ }
+ if name := os.Getenv("AWS_LAMBDA_FUNCTION_NAME"); name != "" {
+  attrs["faas.name"] = name
+ }
+ for k, v := range parseOTLPHeaders(os.Getenv("OTEL_RESOURCE_ATTRIBUTES")) {
+  attrs[k] = v
+ }
+ // OTEL_SERVICE_NAME wins over a service.name in the attributes.
+ if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+  attrs["service.name"] = name
+ }
+ e.resource = otlpAttributes(attrs)
+ log.Printf("Exporting OpenTelemetry traces to %q and metrics to %q", e.traces.target(), e.metrics.target())
+ return e
+}
+
+// newOTLPSignal returns how a signal is exported, or nil when it has no
+// endpoint. Its own _HEADERS and _TIMEOUT variables, when set, are used in
+// place of the general ones.
+func newOTLPSignal(signal, path, exporter string) *otlpSignal {
+ u := otlpSignalURL(signal, path, exporter)
+ if u == "" {
+  return nil
+ }
+ headers := os.Getenv("OTEL_EXPORTER_OTLP_" + signal + "_HEADERS")
+ if headers == "" {
+  headers = os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")
+ }
+ timeout := defaultOTLPTimeout
+ for _, name := range []string{"OTEL_EXPORTER_OTLP_" + signal + "_TIMEOUT", "OTEL_EXPORTER_OTLP_TIMEOUT"} {
+  if ms, err := strconv.Atoi(os.Getenv(name)); err == nil && ms > 0 {
+   timeout = time.Duration(ms) * time.Millisecond
+   break
+  }
+ }
+ return &otlpSignal{url: u, headers: parseOTLPHeaders(headers), client: &http.Client{Timeout: timeout}}
+}
+
+// target is the URL s exports to, "" when the signal is not exported.
+func (s *otlpSignal) target() string {
+ if s == nil {
+  return ""
+ }
+ return s.url
+}
+
+// otlpSignalURL returns the URL a signal is exported to: its own endpoint
+// variable as given, or the general endpoint with path appended.
+func otlpSignalURL(signal, path, exporter string) string {
+ if exporter == "none" {
+  return ""
+ }
+ if u := os.Getenv("OTEL_EXPORTER_OTLP_" + signal + "_ENDPOINT"); u != "" {
+  return u
+ }
+ if u := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); u != "" {
+  return strings.TrimSuffix(u, "/") + "/" + path
+ }
+ return ""
+}
+
+// parseOTLPHeaders parses the "key1=value1,key2=value2" lists the OTEL_*
+// variables use, with percent-encoded values.
+func parseOTLPHeaders(v string) map[string]string {
+ headers := make(map[string]string)
+ for _, pair := range strings.Split(v, ",") {
+  k, val, ok := strings.Cut(pair, "=")
+  if !ok || strings.TrimSpace(k) == "" {
+   continue
+  }
+  if decoded, err := url.QueryUnescape(strings.TrimSpace(val)); err == nil {
+   val = decoded
+  }
+  headers[strings.TrimSpace(k)] = val
+ }
+ return headers
+}
+
+// post sends one OTLP export request. Failures are logged; telemetry never
+// changes the outcome of a run.
+func (s *otlpSignal) post(what string, body any) {
+ payload, err := json.Marshal(body)
+ if err != nil {
+  log.Printf("Failed to encode OTLP %s: %v", what, err)
+  return
+ }
+ req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(payload))
+ if err != nil {
+  log.Printf("Failed to export OTLP %s: %v", what, err)
+  return
+ }
+ req.Header.Set("Content-Type", "application/json")
+ for k, v := range s.headers {
+  req.Header.Set(k, v)
+ }
+ resp, err := s.client.Do(req)
+ if err != nil {
+  log.Printf("Failed to export OTLP %s to %s: %v", what, s.url, err)
+  return
+ }
+ resp.Body.Close()
+ if resp.StatusCode/100 != 2 {
+  log.Printf("Failed to export OTLP %s to %s: %s", what, s.url, resp.Status)
+ }
+}
+
+type otlpAttribute struct {
+ Key   string         `json:"key"`
+ Value map[string]any `json:"value"`
+}
+
+// otlpAttributes encodes attrs as OTLP key-values, in key order.
+func otlpAttributes(attrs map[string]any) []otlpAttribute {
+ out := make([]otlpAttribute, 0, len(attrs))
+ for _, k := range sortedKeys(attrs) {
+  var v map[string]any
+  switch x := attrs[k].(type) {
+  case bool:
+   v = map[string]any{"boolValue": x}
+  case int:
+   v = map[string]any{"intValue": strconv.Itoa(x)}
+  case int64:
+   v = map[string]any{"intValue": strconv.FormatInt(x, 10)}
+  case float64:
+   v = map[string]any{"doubleValue": x}
+  default:
+   v = map[string]any{"stringValue": fmt.Sprint(x)}
+  }
+  out = append(out, otlpAttribute{Key: k, Value: v})
+ }
+ return out
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+ keys := make([]string, 0, len(m))
+ for k := range m {
+  keys = append(keys, k)
+ }
+ sort.Strings(keys)
+ return keys
+}
+
+func unixNano(t time.Time) string {
+ return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func randomHex(n int) string {
+ b := make([]byte, n)
+ rand.Read(b)
+ return hex.EncodeToString(b)
+}
+
+// runTrace holds the finished spans of one run. They are exported in
+// batches of otlpSpanBatchSize as the run goes on, and the rest by flush at
+// its end. A nil runTrace, as returned when tracing is off, and the nil spans
+// it starts, do nothing.
+type runTrace struct {
+ exp     *otlpExporter
+ traceID string
+
+ mu    sync.Mutex
+ spans []map[string]any
+ // queued counts the spans held, waiting in spans or being exported,
+ // and dropped those refused for being above otlpMaxQueuedSpans.
+ queued  int
+ dropped int
+ exports sync.WaitGroup
+}
+
+// traceSpan is a span being timed. Attributes set before end are exported
+// with it.
+type traceSpan struct {
+ trace  *runTrace
+ id     string
+ parent string
+ name   string
+ kind   int
+ start  time.Time
+ attrs  map[string]any
+}
+
+func newRunTrace() *runTrace {
+ exp := otlp()
+ if exp == nil || exp.traces == nil {
+  return nil
+ }
+ return &runTrace{exp: exp, traceID: randomHex(16)}
+}
+
+// start begins a span named name under parent, or the root span of the run
+// when parent is nil.
+func (t *runTrace) start(name string, parent *traceSpan) *traceSpan {
+ if t == nil {
+  return nil
+ }
+ s := &traceSpan{trace: t, id: randomHex(8), name: name, kind: otlpSpanKindInternal, start: time.Now(), attrs: map[string]any{}}
+ if parent != nil {
+  s.parent = parent.id
+ } else {
+  s.kind = otlpSpanKindServer
+ }
+ return s
+}
+
+func (s *traceSpan) set(key string, v any) {
+ if s == nil {
+  return
+ }
+ s.attrs[key] = v
+}
+
+// end finishes the span, marked as an error when err is set.
+func (s *traceSpan) end(err error) {
+ if s == nil {
+  return
+ }
+ status := map[string]any{"code": otlpStatusOK}
+ if err != nil {
+  status = map[string]any{"code": otlpStatusError, "message": err.Error()}
+  if c := categoryOf(err); c != "" {
+   s.attrs["error.type"] = string(c)
+  }
+ }
+ span := map[string]any{
+  "traceId":           s.trace.traceID,
+  "spanId":            s.id,
+  "name":              s.name,
+  "kind":              s.kind,
+  "startTimeUnixNano": unixNano(s.start),
+  "endTimeUnixNano":   unixNano(time.Now()),
+  "attributes":        otlpAttributes(s.attrs),
+  "status":            status,
+ }
+ if s.parent != "" {
+  span["parentSpanId"] = s.parent
+ }
+ s.trace.add(span)
+}
+
+// add queues a finished span, starting the export of a batch once
+// otlpSpanBatchSize are waiting.
+func (t *runTrace) add(span map[string]any) {
+ t.mu.Lock()
+ defer t.mu.Unlock()
+ if t.queued >= otlpMaxQueuedSpans {
+  t.dropped++
+  return
+ }
+ t.queued++
+ t.spans = append(t.spans, span)
+ if len(t.spans) < otlpSpanBatchSize {
+  return
+ }
+ batch := t.spans
+ t.spans = nil
+ t.exports.Add(1)
+ go func() {
+  defer t.exports.Done()
+  t.export(batch)
+ }()
+}
+
+func (t *runTrace) export(spans []map[string]any) {
+ t.exp.traces.post("spans", map[string]any{
+  "resourceSpans": []any{map[string]any{
+   "resource":   map[string]any{"attributes": t.exp.resource},
+   "scopeSpans": []any{map[string]any{"scope": map[string]any{"name": otlpScope}, "spans": spans}},
+  }},
+ })
+ t.mu.Lock()
+ t.queued -= len(spans)
+ t.mu.Unlock()
+}
+
+// flush waits for the batches being exported and exports the spans left. It
+// runs before the handler returns, as the environment may be frozen, or
+// never thawed, afterwards.
+func (t *runTrace) flush() {
+ if t == nil {
+  return
+ }
+ t.exports.Wait()
+ t.mu.Lock()
+ spans, dropped := t.spans, t.dropped
+ t.spans, t.dropped = nil, 0
+ t.mu.Unlock()
+ if dropped > 0 {
+  log.Printf("WARNING: dropped %d span(s) above the %d a run may hold", dropped, otlpMaxQueuedSpans)
+ }
+ if len(spans) > 0 {
+  t.export(spans)
+ }
+}
+
+// otlpUnits maps EMF units to the UCUM units OTLP uses.
+var otlpUnits = map[string]string{
+ unitMilliseconds: "ms",
+ unitBytes:        "By",
+ unitMBPerSecond:  "MBy/s",
+ unitCount:        "1",
+ unitNone:         "1",
+}
+
+// exportOTLP sends the collected values to exp as OTLP metrics named as in
+// EMF: counts as delta sums and everything else, plain numbers included, as
+// delta histograms, each with the destination as an attribute when one is
+// set. It is called by flush with m.mu held.
+func (m *metrics) exportOTLP(exp *otlpExporter) {
+ if exp == nil || exp.metrics == nil || len(m.values) == 0 {
+  return
+ }
+ now := unixNano(time.Now())
+ start := unixNano(m.started)
+ byName := make(map[string][]metricKey)
+ for key := range m.values {
+  byName[key.name] = append(byName[key.name], key)
+ }
+ var out []any
+ for _, name := range sortedKeys(byName) {
+  unit := m.units[name]
+  var points []any
+  for _, key := range byName[name] {
+   attrs := map[string]any{"faas.name": m.function}
+   if key.destination != "" {
+    attrs["destination"] = key.destination
+   }
+   values := m.values[key]
+   sum, lo, hi := 0.0, math.Inf(1), math.Inf(-1)
+   for _, v := range values {
+    sum += v
+    lo, hi = math.Min(lo, v), math.Max(hi, v)
+   }
+   point := map[string]any{
+    "attributes":        otlpAttributes(attrs),
+    "startTimeUnixNano": start,
+    "timeUnixNano":      now,
+   }
+   if unit == unitCount {
+    point["asDouble"] = sum
+   } else {
+    count := strconv.Itoa(len(values))
+    point["count"] = count
+    point["sum"] = sum
+    point["min"] = lo
+    point["max"] = hi
+    point["bucketCounts"] = []string{count}
+    point["explicitBounds"] = []float64{}
+   }
+   points = append(points, point)
+  }
+  metric := map[string]any{"name": name, "unit": otlpUnits[unit]}
+  if unit == unitCount {
+   metric["sum"] = map[string]any{"dataPoints": points, "aggregationTemporality": otlpDelta, "isMonotonic": true}
+  } else {
+   metric["histogram"] = map[string]any{"dataPoints": points, "aggregationTemporality": otlpDelta}
+  }
+  out = append(out, metric)
+ }
+ exp.metrics.post("metrics", map[string]any{
+  "resourceMetrics": []any{map[string]any{
+   "resource":     map[string]any{"attributes": exp.resource},
+   "scopeMetrics": []any{map[string]any{"scope": map[string]any{"name": otlpScope}, "metrics": out}},
+  }},
+ })
+}
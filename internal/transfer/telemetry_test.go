@@ -0,0 +1,162 @@
+package transfer
+
+import (
+ "encoding/json"
+ "net/http"
+ "net/http/httptest"
+ "reflect"
+ "sort"
+ "sync"
+ "testing"
+ "time"
+)
+
+// testCollector is an OTLP/HTTP collector recording the requests it gets.
+// Requests wait for release when it is set.
+type testCollector struct {
+ srv     *httptest.Server
+ release chan struct{}
+
+ mu     sync.Mutex
+ bodies []map[string]any
+}
+
+func startCollector(t *testing.T, release chan struct{}) *testCollector {
+ c := &testCollector{release: release}
+ c.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+  if c.release != nil {
+   <-c.release
+  }
+  var body map[string]any
+  if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+   t.Errorf("collector: %v", err)
+  }
+  c.mu.Lock()
+  c.bodies = append(c.bodies, body)
+  c.mu.Unlock()
+ }))
+ t.Cleanup(c.srv.Close)
+ return c
+}
+
+func (c *testCollector) signal() *otlpSignal {
+ return &otlpSignal{url: c.srv.URL, client: c.srv.Client()}
+}
+
+// spanCounts returns the number of spans in each request, smallest first.
+func (c *testCollector) spanCounts() []int {
+ c.mu.Lock()
+ defer c.mu.Unlock()
+ var counts []int
+ for _, body := range c.bodies {
+  rs := body["resourceSpans"].([]any)[0].(map[string]any)
+  ss := rs["scopeSpans"].([]any)[0].(map[string]any)
+  counts = append(counts, len(ss["spans"].([]any)))
+ }
+ sort.Ints(counts)
+ return counts
+}
+
+func TestOTLPSignalVariablesOverrideGeneralOnes(t *testing.T) {
+ t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318/")
+ t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "x-team=transfers")
+ t.Setenv("OTEL_EXPORTER_OTLP_TIMEOUT", "2000")
+ t.Setenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS", "authorization=Bearer%20abc")
+ t.Setenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", "http://metrics:4318/custom")
+ t.Setenv("OTEL_EXPORTER_OTLP_METRICS_TIMEOUT", "500")
+ e := newOTLPExporter()
+ if e == nil {
+  t.Fatal("no exporter")
+ }
+ tests := []struct {
+  name    string
+  s       *otlpSignal
+  url     string
+  headers map[string]string
+  timeout time.Duration
+ }{
+  {"traces", e.traces, "http://collector:4318/v1/traces", map[string]string{"authorization": "Bearer abc"}, 2 * time.Second},
+  {"metrics", e.metrics, "http://metrics:4318/custom", map[string]string{"x-team": "transfers"}, 500 * time.Millisecond},
+ }
+ for _, tt := range tests {
+  if tt.s.url != tt.url || !reflect.DeepEqual(tt.s.headers, tt.headers) || tt.s.client.Timeout != tt.timeout {
+   t.Errorf("%s: url %q, headers %v, timeout %s, want %q, %v, %s", tt.name, tt.s.url, tt.s.headers, tt.s.client.Timeout, tt.url, tt.headers, tt.timeout)
+  }
+ }
+
+ t.Setenv("OTEL_METRICS_EXPORTER", "none")
+ if e := newOTLPExporter(); e.metrics != nil || e.traces == nil {
+  t.Errorf("OTEL_METRICS_EXPORTER=none: traces %v, metrics %v", e.traces, e.metrics)
+ }
+}
+
+func TestRunTraceExportsInBatches(t *testing.T) {
+ c := startCollector(t, nil)
+ tr := &runTrace{exp: &otlpExporter{traces: c.signal()}, traceID: randomHex(16)}
+ root := tr.start("run", nil)
+ for i := 0; i < 2*otlpSpanBatchSize+100; i++ {
+  tr.start("deliver", root).end(nil)
+ }
+ root.end(nil)
+ tr.flush()
+ if got, want := c.spanCounts(), []int{101, otlpSpanBatchSize, otlpSpanBatchSize}; !reflect.DeepEqual(got, want) {
+  t.Errorf("exported batches of %v spans, want %v", got, want)
+ }
+}
+
+func TestRunTraceDropsSpansAboveQueueLimit(t *testing.T) {
+ release := make(chan struct{})
+ c := startCollector(t, release)
+ tr := &runTrace{exp: &otlpExporter{traces: c.signal()}, traceID: randomHex(16)}
+ // While the collector holds the exports, the run keeps no more than
+ // otlpMaxQueuedSpans spans.
+ for i := 0; i < otlpMaxQueuedSpans+300; i++ {
+  tr.start("deliver", nil).end(nil)
+ }
+ tr.mu.Lock()
+ queued, dropped := tr.queued, tr.dropped
+ tr.mu.Unlock()
+ if queued != otlpMaxQueuedSpans || dropped != 300 {
+  t.Errorf("queued %d and dropped %d span(s), want %d and 300", queued, dropped, otlpMaxQueuedSpans)
+ }
+ close(release)
+ tr.flush()
+ total := 0
+ for _, n := range c.spanCounts() {
+  total += n
+ }
+ if total != otlpMaxQueuedSpans {
+  t.Errorf("exported %d span(s), want %d", total, otlpMaxQueuedSpans)
+ }
+}
+
+func TestOTLPMetricsSumOnlyCounts(t *testing.T) {
+ c := startCollector(t, nil)
+ m := newMetrics()
+ m.add("FilesTransferred", unitCount, 3)
+ m.add("EndpointIndex", unitNone, 1)
+ m.add("ConnectionReused", unitNone, 0)
+ m.add("ConnectionReused", unitNone, 1)
+ m.mu.Lock()
+ m.exportOTLP(&otlpExporter{metrics: c.signal()})
+ m.mu.Unlock()
+
+ if len(c.bodies) != 1 {
+  t.Fatalf("got %d export(s)", len(c.bodies))
+ }
+ rm := c.bodies[0]["resourceMetrics"].([]any)[0].(map[string]any)
+ sm := rm["scopeMetrics"].([]any)[0].(map[string]any)
+ kinds := make(map[string]string)
+ for _, metric := range sm["metrics"].([]any) {
+  metric := metric.(map[string]any)
+  for _, kind := range []string{"sum", "histogram", "gauge"} {
+   if _, ok := metric[kind]; ok {
+    kinds[metric["name"].(string)] = kind
+   }
+  }
+ }
+ want := map[string]string{"FilesTransferred": "sum", "EndpointIndex": "histogram", "ConnectionReused": "histogram"}
+ if !reflect.DeepEqual(kinds, want) {
+  t.Errorf("exported %v, want %v", kinds, want)
+ }
+}
@@ -0,0 +1,316 @@
+package transfer
+
+import (
+ "errors"
+ "fmt"
+ "log"
+ "strings"
+ "sync"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/dest/sftpfs"
+)
+
+// tenantBatchSize is the most files a worker delivers for a tenant before it
+// goes back to the scheduler, so a tenant with a long backlog cannot keep
+// every worker while the others wait.
+const tenantBatchSize = 20
+
+// tenantQueue holds the batches of one tenant waiting to be delivered.
+type tenantQueue struct {
+ tenant     string
+ sftpConfig *SFTPConfig
+ batches    [][]string
+ running    int
+ limit      int
+ conns      *tenantConns
+ errs       []error
+}
+
+// depth is the number of files waiting in q.
+func (q *tenantQueue) depth() int {
+ n := 0
+ for _, b := range q.batches {
+  n += len(b)
+ }
+ return n
+}
+
+// deliverTenantsConcurrently delivers the tenants' keys with up to
+// TENANT_WORKERS batches in flight, each over a run forked from r whose
+// outcome is merged back once the batch is done. It returns the error of
+// each tenant whose delivery failed.
+func (r *transferRun) deliverTenantsConcurrently(tenants []string, groups map[string][]string) []error {
+ var errs []error
+ var queues []*tenantQueue
+ for _, tenant := range tenants {
+  keys := groups[tenant]
+  secret := r.cfg.TenantSecrets[tenant]
+  sftpConfig, err := getSFTPConfig(r.sess, r.cfg, secret, r.clock)
+  if err != nil {
+   err = withCategory(categoryConfig, fmt.Errorf("failed to get SFTP config: %w", err))
+   for _, key := range keys {
+    r.report.addFile(fileReport{Key: key, Tenant: tenant, Status: statusFailed, Category: string(categoryConfig), Error: err.Error()})
+   }
+   errs = append(errs, fmt.Errorf("tenant %s: %w", tenant, err))
+   continue
+  }
+  // Each batch only sees its own keys, so collisions between batches
+  // are looked for up front.
+  if err := r.checkCollisions(keys); err != nil {
+   r.report.addFile(fileReport{Key: keys[0], Tenant: tenant, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+   errs = append(errs, fmt.Errorf("tenant %s: %w", tenant, err))
+   continue
+  }
+  concurrency, connections := r.cfg.Limits(tenant)
+  q := &tenantQueue{tenant: tenant, sftpConfig: sftpConfig, limit: concurrency, conns: &tenantConns{max: connections}}
+  for start := 0; start < len(keys); start += tenantBatchSize {
+   q.batches = append(q.batches, keys[start:min(start+tenantBatchSize, len(keys))])
+  }
+  log.Printf("Delivering %d file(s) for tenant %s with secret %s in %d batch(es), %d at a time over up to %d connection(s)",
+   len(keys), tenant, secret, len(q.batches), concurrency, connections)
+  queues = append(queues, q)
+ }
+
+ var mu sync.Mutex
+ runTenantBatches(queues, r.cfg.TenantWorkers, &mu, r.cfg.Debugf, func(q *tenantQueue, batch []string) bool {
+  reason := "Invocation deadline reached"
+  if r.stopping() {
+   reason = "Shutting down"
+  } else if !r.pastDeadline() {
+   return true
+  }
+  // Defer every batch not started yet, adding those deferred by
+  // batches already done.
+  keys := batch
+  for _, q := range queues {
+   for _, b := range q.batches {
+    keys = append(keys, b...)
+   }
+   q.batches = nil
+  }
+  prev := r.report.Deferred
+  r.deferRemaining(keys, "", reason)
+  if prev != nil {
+   r.addDeferred(prev)
+  }
+  return false
+ }, func(q *tenantQueue, batch []string) error {
+  mu.Lock()
+  f := r.forkTenant(q)
+  mu.Unlock()
+  err := f.deliverKeys(q.sftpConfig, batch)
+  mu.Lock()
+  defer mu.Unlock()
+  r.mergeFork(f, q.tenant)
+  return err
+ })
+
+ for _, q := range queues {
+  q.conns.close()
+  if len(q.errs) > 0 {
+   err := errors.Join(q.errs...)
+   log.Printf("Delivery for tenant %s failed: %v", q.tenant, err)
+   errs = append(errs, fmt.Errorf("tenant %s: %w", q.tenant, err))
+  }
+ }
+ return errs
+}
+
+// runTenantBatches runs deliver on the batches of queues with at most
+// workers of them, and at most each queue's limit of its own, running at
+// once. Queues are served round-robin: each free worker takes the next batch
+// of the next queue below its limit, so every tenant keeps getting workers
+// however long the others' backlogs are. start is called, under mu, before a
+// batch is handed out and may refuse it, taking the queued batches along if
+// need be. A queue whose batch fails gets no further batches, as a
+// sequential delivery stops at its first failure. mu is held while
+// scheduling, so deliver must take it to touch shared state.
+func runTenantBatches(queues []*tenantQueue, workers int, mu *sync.Mutex, debugf func(string, ...any),
+ start func(q *tenantQueue, batch []string) bool, deliver func(q *tenantQueue, batch []string) error) {
+ done := sync.NewCond(mu)
+ var wg sync.WaitGroup
+ running, next := 0, 0
+
+ mu.Lock()
+ for {
+  var q *tenantQueue
+  if running < workers {
+   for i := range queues {
+    c := queues[(next+i)%len(queues)]
+    if len(c.batches) > 0 && c.running < c.limit {
+     q = c
+     next = (next + i + 1) % len(queues)
+     break
+    }
+   }
+  }
+  if q == nil {
+   if running == 0 {
+    break
+   }
+   done.Wait()
+   continue
+  }
+  batch := q.batches[0]
+  q.batches = q.batches[1:]
+  if !start(q, batch) {
+   continue
+  }
+  q.running++
+  running++
+  debugf("Dispatching %d file(s) for tenant %s, %d of %d worker(s) busy, queued: %s",
+   len(batch), q.tenant, running, workers, queueDepths(queues))
+
+  wg.Add(1)
+  go func() {
+   defer wg.Done()
+   err := deliver(q, batch)
+   mu.Lock()
+   defer mu.Unlock()
+   q.running--
+   running--
+   if err != nil {
+    q.errs = append(q.errs, err)
+    if n := len(q.batches); n > 0 {
+     log.Printf("Delivery for tenant %s failed, not starting its %d remaining batch(es)", q.tenant, n)
+     q.batches = nil
+    }
+   }
+   done.Broadcast()
+  }()
+ }
+ mu.Unlock()
+ wg.Wait()
+}
+
+// queueDepths lists the files waiting per tenant, such as "a=40 b=0".
+func queueDepths(queues []*tenantQueue) string {
+ depths := make([]string, len(queues))
+ for i, q := range queues {
+  depths[i] = fmt.Sprintf("%s=%d", q.tenant, q.depth())
+ }
+ return strings.Join(depths, " ")
+}
+
+// forkTenant returns a run delivering a batch of q on its own: it shares the
+// configuration, budgets and caches of r, but records into its own report,
+// stats and metrics, and connects through q's shared connections.
+func (r *transferRun) forkTenant(q *tenantQueue) *transferRun {
+ f := *r
+ f.report = newTransferReport(r.report.RequestID)
+ f.metrics = r.metrics.fork(r.cfg.MetricDestination(q.tenant))
+ f.stats = runStats{}
+ f.conn, f.sftpConfig = nil, nil
+ f.claimed, f.routed, f.breakers = nil, nil, nil
+ f.tenantConns = q.conns
+ return &f
+}
+
+// mergeFork adds the outcome of the forked run f to r. The caller holds the
+// lock serializing merges.
+func (r *transferRun) mergeFork(f *transferRun, tenant string) {
+ for _, file := range f.report.Files {
+  file.Tenant = tenant
+  r.report.Files = append(r.report.Files, file)
+ }
+ r.report.Connections = append(r.report.Connections, f.report.Connections...)
+ if q := f.report.Quarantine; q != nil {
+  if r.report.Quarantine == nil {
+   r.report.Quarantine = &quarantineReport{Prefix: q.Prefix}
+  }
+  r.report.Quarantine.Quarantined = append(r.report.Quarantine.Quarantined, q.Quarantined...)
+  r.report.Quarantine.Failed += q.Failed
+ }
+ if d := f.report.Deferred; d != nil {
+  r.addDeferred(d)
+ }
+ r.stats.BytesSent += f.stats.BytesSent
+ r.stats.Connect = max(r.stats.Connect, f.stats.Connect)
+ if f.stats.Host != "" {
+  r.stats.Host = f.stats.Host
+ }
+ r.metrics.merge(f.metrics)
+}
+
+// addDeferred adds the files of d to those the run deferred. Batches defer
+// independently, so no single continuation token covers them.
+func (r *transferRun) addDeferred(d *deferredReport) {
+ if r.report.Deferred == nil {
+  r.report.Deferred = &deferredReport{}
+ }
+ r.report.Deferred.Files += d.Files
+ r.report.Deferred.Bytes += d.Bytes
+ r.report.Deferred.ContinuationToken = ""
+}
+
+// tenantConns shares up to max SFTP connections among the batches of one
+// tenant running at once. A batch gets a new connection while fewer than max
+// are open and every open one is busy, and otherwise shares the one with the
+// fewest users; pkg/sftp clients are safe for concurrent use.
+type tenantConns struct {
+ mu    sync.Mutex
+ max   int
+ conns []*tenantConn
+}
+
+type tenantConn struct {
+ conn    *sftpfs.Conn
+ release func(broken bool)
+ users   int
+ broken  bool
+}
+
+// acquire returns a connection for a batch of r. The lock is held while
+// dialing, so batches of the tenant never open more than max connections.
+func (c *tenantConns) acquire(r *transferRun, sftpConfig *SFTPConfig) (*sftpfs.Conn, func(broken bool), error) {
+ c.mu.Lock()
+ defer c.mu.Unlock()
+ var best *tenantConn
+ for _, tc := range c.conns {
+  if !tc.broken && (best == nil || tc.users < best.users) {
+   best = tc
+  }
+ }
+ if best == nil || best.users > 0 && len(c.conns) < c.max {
+  conn, release, err := r.openConnection(sftpConfig)
+  if err != nil {
+   return nil, nil, err
+  }
+  best = &tenantConn{conn: conn, release: release}
+  c.conns = append(c.conns, best)
+ }
+ best.users++
+ return best.conn, c.releaseFunc(best), nil
+}
+
+// releaseFunc returns the function a batch hands tc back with. A connection
+// reported broken is given no new users and discarded once the last lets go
+// of it.
+func (c *tenantConns) releaseFunc(tc *tenantConn) func(broken bool) {
+ return func(broken bool) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  tc.users--
+  tc.broken = tc.broken || broken
+  if !tc.broken || tc.users > 0 {
+   return
+  }
+  tc.release(true)
+  for i, e := range c.conns {
+   if e == tc {
+    c.conns = append(c.conns[:i], c.conns[i+1:]...)
+    break
+   }
+  }
+ }
+}
+
+// close hands the connections back to the pool once the tenant is done.
+func (c *tenantConns) close() {
+ c.mu.Lock()
+ defer c.mu.Unlock()
+ for _, tc := range c.conns {
+  tc.release(false)
+ }
+ c.conns = nil
+}
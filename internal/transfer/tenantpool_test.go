@@ -0,0 +1,285 @@
+package transfer
+
+import (
+ "errors"
+ "fmt"
+ "reflect"
+ "strings"
+ "sync"
+ "testing"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// testQueues returns a queue per tenant of name=batches and limit, each
+// batch holding one key named after its tenant and position.
+func testQueues(spec map[string][2]int, order ...string) []*tenantQueue {
+ var queues []*tenantQueue
+ for _, tenant := range order {
+  q := &tenantQueue{tenant: tenant, limit: spec[tenant][1]}
+  for i := 0; i < spec[tenant][0]; i++ {
+   q.batches = append(q.batches, []string{fmt.Sprintf("%s/%d", tenant, i)})
+  }
+  queues = append(queues, q)
+ }
+ return queues
+}
+
+func allowBatch(*tenantQueue, []string) bool { return true }
+
+func noDebug(string, ...any) {}
+
+func TestRunTenantBatchesLimits(t *testing.T) {
+ queues := testQueues(map[string][2]int{"a": {12, 2}, "b": {6, 1}, "c": {4, 3}}, "a", "b", "c")
+ var (
+  mu                sync.Mutex
+  running, peak     int
+  perTenant, peakOf = map[string]int{}, map[string]int{}
+  delivered         []string
+ )
+ var schedMu sync.Mutex
+ runTenantBatches(queues, 3, &schedMu, noDebug, allowBatch, func(q *tenantQueue, batch []string) error {
+  mu.Lock()
+  running++
+  perTenant[q.tenant]++
+  peak = max(peak, running)
+  peakOf[q.tenant] = max(peakOf[q.tenant], perTenant[q.tenant])
+  mu.Unlock()
+  time.Sleep(2 * time.Millisecond)
+  mu.Lock()
+  running--
+  perTenant[q.tenant]--
+  delivered = append(delivered, batch...)
+  mu.Unlock()
+  return nil
+ })
+
+ if len(delivered) != 22 {
+  t.Errorf("delivered %d batch(es), want 22", len(delivered))
+ }
+ seen := make(map[string]bool)
+ for _, key := range delivered {
+  if seen[key] {
+   t.Errorf("%s delivered twice", key)
+  }
+  seen[key] = true
+ }
+ if peak > 3 {
+  t.Errorf("%d batches ran at once, above the 3 workers", peak)
+ }
+ for tenant, limit := range map[string]int{"a": 2, "b": 1, "c": 3} {
+  if peakOf[tenant] > limit {
+   t.Errorf("tenant %s ran %d batches at once, above its limit of %d", tenant, peakOf[tenant], limit)
+  }
+ }
+}
+
+func TestRunTenantBatchesRoundRobin(t *testing.T) {
+ queues := testQueues(map[string][2]int{"a": {4, 1}, "b": {1, 1}, "c": {2, 1}}, "a", "b", "c")
+ var order []string
+ var mu sync.Mutex
+ runTenantBatches(queues, 1, &mu, noDebug, allowBatch, func(q *tenantQueue, batch []string) error {
+  order = append(order, batch[0])
+  return nil
+ })
+ // With one worker the tenants take turns, a's backlog only running
+ // alone once the others are done.
+ want := []string{"a/0", "b/0", "c/0", "a/1", "c/1", "a/2", "a/3"}
+ if !reflect.DeepEqual(order, want) {
+  t.Errorf("order = %q, want %q", order, want)
+ }
+}
+
+func TestRunTenantBatchesStopsFailedTenant(t *testing.T) {
+ queues := testQueues(map[string][2]int{"a": {3, 1}, "b": {3, 1}}, "a", "b")
+ var delivered []string
+ var mu sync.Mutex
+ runTenantBatches(queues, 1, &mu, noDebug, allowBatch, func(q *tenantQueue, batch []string) error {
+  delivered = append(delivered, batch[0])
+  if batch[0] == "a/0" {
+   return errors.New("connection lost")
+  }
+  return nil
+ })
+ want := []string{"a/0", "b/0", "b/1", "b/2"}
+ if !reflect.DeepEqual(delivered, want) {
+  t.Errorf("delivered %q, want %q", delivered, want)
+ }
+ if len(queues[0].errs) != 1 || len(queues[1].errs) != 0 {
+  t.Errorf("errors = %v and %v, want only a's", queues[0].errs, queues[1].errs)
+ }
+}
+
+func TestRunTenantBatchesStartRefuses(t *testing.T) {
+ queues := testQueues(map[string][2]int{"a": {3, 2}, "b": {2, 2}}, "a", "b")
+ var refused [][]string
+ var delivered int
+ var mu sync.Mutex
+ runTenantBatches(queues, 2, &mu, noDebug, func(q *tenantQueue, batch []string) bool {
+  if len(refused) == 0 && delivered < 2 {
+   return true
+  }
+  refused = append(refused, batch)
+  for _, q := range queues {
+   refused = append(refused, q.batches...)
+   q.batches = nil
+  }
+  return false
+ }, func(q *tenantQueue, batch []string) error {
+  mu.Lock()
+  delivered++
+  mu.Unlock()
+  return nil
+ })
+ var n int
+ for _, b := range refused {
+  n += len(b)
+ }
+ if delivered+n != 5 {
+  t.Errorf("delivered %d and refused %d of 5 batches", delivered, n)
+ }
+}
+
+func TestTenantLimitsAreBoundedByWorkers(t *testing.T) {
+ cfg := &Config{TenantWorkers: 4, TenantLimits: map[string]config.TenantLimits{
+  "a": {MaxConcurrency: 8, MaxConnections: 2},
+  "b": {MaxConcurrency: 2},
+  "c": {MaxConnections: 3},
+  "d": {MaxConcurrency: 2, MaxConnections: 5},
+ }}
+ tests := []struct {
+  tenant                   string
+  concurrency, connections int
+ }{
+  {"a", 4, 2},
+  {"b", 2, 2},
+  {"c", 4, 3},
+  {"d", 2, 2},
+  {"unlimited", 4, 4},
+ }
+ for _, tt := range tests {
+  concurrency, connections := cfg.Limits(tt.tenant)
+  if concurrency != tt.concurrency || connections != tt.connections {
+   t.Errorf("limits(%s) = %d, %d, want %d, %d", tt.tenant, concurrency, connections, tt.concurrency, tt.connections)
+  }
+ }
+}
+
+func TestTenantWorkersRejectsRunWideState(t *testing.T) {
+ for _, env := range [][2]string{
+  {"GROUP_BY_FOLDER", "true"},
+  {"POST_BATCH_COMMAND", "echo {count}"},
+  {"MAX_BYTES_PER_RUN", "1000"},
+  {"OVERWRITE_POLICY", "suffix"},
+  {"CIRCUIT_BREAKER_THRESHOLD", "3"},
+ } {
+  t.Run(env[0], func(t *testing.T) {
+   t.Setenv("TENANT_SECRETS", `{"a":"sftp-a"}`)
+   t.Setenv("TENANT_WORKERS", "2")
+   t.Setenv("REMOTE_LAYOUT", "preserve")
+   t.Setenv(env[0], env[1])
+   if _, err := config.Load(); err == nil || !strings.Contains(err.Error(), "TENANT_WORKERS") {
+    t.Errorf("loadConfig = %v, want TENANT_WORKERS rejected with %s", err, env[0])
+   }
+   t.Setenv("TENANT_WORKERS", "1")
+   if _, err := config.Load(); err != nil {
+    t.Errorf("loadConfig rejected %s with TENANT_WORKERS=1: %v", env[0], err)
+   }
+  })
+ }
+ t.Setenv("TENANT_WORKERS", "0")
+ if _, err := config.Load(); err == nil {
+  t.Error("loadConfig accepted TENANT_WORKERS=0")
+ }
+}
+
+func TestTenantsDeliveredConcurrently(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ alpha, beta := e.addTenant("alpha"), e.addTenant("beta")
+ t.Setenv("TENANT_SECRETS", `{"alpha":{"secretName":"sftp-alpha","maxConcurrency":2,"maxConnections":1},"beta":"sftp-beta"}`)
+ t.Setenv("TENANT_WORKERS", "4")
+ t.Setenv("POOL_SIZE", "8")
+ t.Setenv("LOG_LEVEL", "debug")
+ out := captureRunLog(t)
+ for i := 0; i < 3*tenantBatchSize; i++ {
+  e.s3.put(fmt.Sprintf("test-poc/alpha/a%03d.csv", i), "a\n")
+ }
+ for i := 0; i < tenantBatchSize+5; i++ {
+  e.s3.put(fmt.Sprintf("test-poc/beta/b%03d.csv", i), "bb\n")
+ }
+
+ result, err := e.run("")
+ if err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if want := 4*tenantBatchSize + 5; result.Transferred != want || result.Failed != 0 {
+  t.Fatalf("result = %+v, want %d transferred", result, want)
+ }
+ for i := 0; i < 3*tenantBatchSize; i++ {
+  if got, _ := alpha.file(fmt.Sprintf("/uploads/a%03d.csv", i)); string(got) != "a\n" {
+   t.Fatalf("alpha a%03d.csv = %q", i, got)
+  }
+ }
+ if _, ok := beta.file("/uploads/a000.csv"); ok {
+  t.Error("alpha's file was delivered to beta")
+ }
+ // alpha's two batches at a time shared its single connection.
+ if logins, _ := alpha.accepted(); logins != 1 {
+  t.Errorf("alpha accepted %d connections, want 1", logins)
+ }
+ if peak := alpha.peakOpenFiles(); peak > 2 {
+  t.Errorf("alpha had %d files open at once, above its maxConcurrency of 2", peak)
+ }
+ if logins, _ := beta.accepted(); logins > 2 {
+  t.Errorf("beta accepted %d connections for its 2 batches", logins)
+ }
+
+ records := runLogRecords(t, out)
+ if len(records) != 1 {
+  t.Fatalf("got %d run summary lines", len(records))
+ }
+ want := map[string]*tenantSummary{
+  "alpha": {Transferred: 3 * tenantBatchSize, Bytes: 2 * 3 * tenantBatchSize},
+  "beta":  {Transferred: tenantBatchSize + 5, Bytes: 3 * (tenantBatchSize + 5)},
+ }
+ if !reflect.DeepEqual(records[0].Tenants, want) {
+  t.Errorf("tenants = %s", mustJSON(t, records[0].Tenants))
+ }
+ if records[0].Bytes != int64(2*3*tenantBatchSize+3*(tenantBatchSize+5)) {
+  t.Errorf("bytes = %d", records[0].Bytes)
+ }
+}
+
+func TestTenantsAtomicUploadWithoutRename(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ alpha := e.addTenantServer("alpha", testServerConfig{password: "secret", noRename: true})
+ t.Setenv("TENANT_SECRETS", `{"alpha":{"secretName":"sftp-alpha","maxConcurrency":3,"maxConnections":1}}`)
+ t.Setenv("TENANT_WORKERS", "3")
+ t.Setenv("ATOMIC_UPLOAD", "true")
+ for i := 0; i < 3*tenantBatchSize; i++ {
+  e.s3.put(fmt.Sprintf("test-poc/alpha/a%03d.csv", i), "a\n")
+ }
+
+ // The batches share one connection, each finding out on its own that
+ // the server cannot rename.
+ result, err := e.run("")
+ if err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if want := 3 * tenantBatchSize; result.Transferred != want || result.Failed != 0 {
+  t.Fatalf("result = %+v, want %d transferred", result, want)
+ }
+ for i := 0; i < 3*tenantBatchSize; i++ {
+  name := fmt.Sprintf("/uploads/a%03d.csv", i)
+  if got, _ := alpha.file(name); string(got) != "a\n" {
+   t.Fatalf("%s = %q", name, got)
+  }
+  if alpha.exists(name + atomicTempSuffix) {
+   t.Errorf("temporary file of %s left behind", name)
+  }
+ }
+ if logins, _ := alpha.accepted(); logins != 1 {
+  t.Errorf("alpha accepted %d connections, want 1", logins)
+ }
+}
@@ -0,0 +1,128 @@
+package transfer
+
+import (
+ "errors"
+ "fmt"
+ "log"
+ "sort"
+ "strings"
+)
+
+// tenantOf returns the tenant of key: the tenant the run was invoked for,
+// or else the first path segment after the source prefix.
+func (r *transferRun) tenantOf(key string) string {
+ if r.cfg.Tenant != "" {
+  return r.cfg.Tenant
+ }
+ rest := strings.TrimPrefix(strings.TrimPrefix(key, r.cfg.SourcePrefix), "/")
+ if i := strings.Index(rest, "/"); i >= 0 {
+  return rest[:i]
+ }
+ return ""
+}
+
+// transferTenants delivers keys grouped by tenant, each with the SFTP secret
+// TENANT_SECRETS maps it to and over its own connections. Keys of an unmapped
+// tenant, or a tenant whose delivery fails, fail without stopping the other
+// tenants. With TENANT_WORKERS above 1 the tenants are delivered side by
+// side, within each tenant's own limits.
+func (r *transferRun) transferTenants(keys []string) error {
+ groups := make(map[string][]string)
+ for _, key := range keys {
+  tenant := r.tenantOf(key)
+  if _, ok := r.cfg.TenantSecrets[tenant]; !ok {
+   err := withCategory(categoryConfig, fmt.Errorf("no TENANT_SECRETS entry for tenant %q", tenant))
+   log.Printf("Failed to route %s: %v", key, err)
+   r.report.addFile(fileReport{Key: key, Tenant: tenant, Status: statusFailed, Category: string(categoryConfig), Error: err.Error()})
+   continue
+  }
+  groups[tenant] = append(groups[tenant], key)
+ }
+ tenants := make([]string, 0, len(groups))
+ for tenant := range groups {
+  tenants = append(tenants, tenant)
+ }
+ sort.Strings(tenants)
+
+ var errs []error
+ if r.cfg.TenantWorkers > 1 {
+  errs = r.deliverTenantsConcurrently(tenants, groups)
+ } else {
+  errs = r.deliverTenantsInTurn(tenants, groups)
+ }
+ if len(errs) > 0 {
+  return errors.Join(errs...)
+ }
+ if r.report.count(statusFailed) > 0 {
+  return fmt.Errorf("%d file(s) had no tenant mapping", r.report.count(statusFailed))
+ }
+ log.Println("Files transferred successfully!")
+ return nil
+}
+
+// deliverTenantsInTurn delivers the tenants' keys one tenant after another,
+// returning the error of each tenant whose delivery failed.
+func (r *transferRun) deliverTenantsInTurn(tenants []string, groups map[string][]string) []error {
+ var errs []error
+ for _, tenant := range tenants {
+  tenantKeys := groups[tenant]
+  secret := r.cfg.TenantSecrets[tenant]
+  log.Printf("Delivering %d file(s) for tenant %s with secret %s", len(tenantKeys), tenant, secret)
+  first := len(r.report.Files)
+  err := r.deliverTenant(tenant, secret, tenantKeys)
+  for i := first; i < len(r.report.Files); i++ {
+   r.report.Files[i].Tenant = tenant
+  }
+  if err != nil {
+   log.Printf("Delivery for tenant %s failed: %v", tenant, err)
+   errs = append(errs, fmt.Errorf("tenant %s: %w", tenant, err))
+  }
+ }
+ return errs
+}
+
+func (r *transferRun) deliverTenant(tenant, secret string, keys []string) error {
+ sftpConfig, err := getSFTPConfig(r.sess, r.cfg, secret, r.clock)
+ if err != nil {
+  err = withCategory(categoryConfig, fmt.Errorf("failed to get SFTP config: %w", err))
+  for _, key := range keys {
+   r.report.addFile(fileReport{Key: key, Status: statusFailed, Category: string(categoryConfig), Error: err.Error()})
+  }
+  return err
+ }
+ r.metrics.setDestination(r.cfg.MetricDestination(tenant))
+ defer r.metrics.setDestination(r.cfg.MetricDestination(r.cfg.DestinationName))
+ return r.deliverKeys(sftpConfig, keys)
+}
+
+// tenantSummary is the per-tenant breakdown in the run log record.
+type tenantSummary struct {
+ Transferred int   `json:"transferred"`
+ Failed      int   `json:"failed"`
+ Bytes       int64 `json:"bytes"`
+}
+
+func (r *transferReport) tenantSummaries() map[string]*tenantSummary {
+ var out map[string]*tenantSummary
+ for _, f := range r.Files {
+  if f.Tenant == "" {
+   continue
+  }
+  if out == nil {
+   out = make(map[string]*tenantSummary)
+  }
+  s := out[f.Tenant]
+  if s == nil {
+   s = &tenantSummary{}
+   out[f.Tenant] = s
+  }
+  switch f.Status {
+  case statusTransferred:
+   s.Transferred++
+  case statusFailed, statusPartial:
+   s.Failed++
+  }
+  s.Bytes += f.Bytes
+ }
+ return out
+}
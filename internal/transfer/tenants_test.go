@@ -0,0 +1,193 @@
+package transfer
+
+import (
+ "context"
+ "encoding/json"
+ "reflect"
+ "testing"
+
+ "github.com/aws/aws-lambda-go/events"
+ "github.com/aws/aws-lambda-go/lambdacontext"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/schema"
+)
+
+// addTenant starts a server for tenant and stores its secret as
+// sftp-<tenant>, returning the server.
+func (e *testEnv) addTenant(tenant string) *testSFTPServer {
+ e.t.Helper()
+ return e.addTenantServer(tenant, testServerConfig{password: "secret"})
+}
+
+// addTenantServer is addTenant with a server started with cfg, which must
+// accept the password "secret".
+func (e *testEnv) addTenantServer(tenant string, cfg testServerConfig) *testSFTPServer {
+ e.t.Helper()
+ s := startSFTPServer(e.t, cfg)
+ value, err := json.Marshal(map[string]any{
+  "sftpHost":     s.host,
+  "sftpPort":     s.port,
+  "sftpUsername": tenant,
+  "sftpPassword": "secret",
+  "sftpHostKeys": map[string]string{s.host: s.fingerprint()},
+ })
+ if err != nil {
+  e.t.Fatal(err)
+ }
+ e.secrets.set("sftp-"+tenant, string(value))
+ return s
+}
+
+func TestTenantsByKeyPrefix(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ alpha, beta := e.addTenant("alpha"), e.addTenant("beta")
+ t.Setenv("TENANT_SECRETS", `{"alpha":"sftp-alpha","beta":"sftp-beta"}`)
+ out := captureRunLog(t)
+ e.s3.put("test-poc/alpha/a.csv", "a\n")
+ e.s3.put("test-poc/beta/b.csv", "b\n")
+ e.s3.put("test-poc/gamma/c.csv", "c\n")
+
+ // The unmapped tenant's file fails on its own, leaving the run
+ // partial rather than failed.
+ result, err := e.run("")
+ if err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if result.Status != schema.StatusPartial || result.Transferred != 2 || result.Failed != 1 {
+  t.Fatalf("result = %+v, want 2 transferred and the unmapped tenant's file failed", result)
+ }
+ if got, _ := alpha.file("/uploads/a.csv"); string(got) != "a\n" {
+  t.Errorf("alpha got %q", got)
+ }
+ if got, _ := beta.file("/uploads/b.csv"); string(got) != "b\n" {
+  t.Errorf("beta got %q", got)
+ }
+ if _, ok := alpha.file("/uploads/b.csv"); ok {
+  t.Error("beta's file was delivered to alpha")
+ }
+ if logins, _ := e.server.accepted(); logins != 0 {
+  t.Errorf("the default secret's server accepted %d login(s)", logins)
+ }
+
+ records := runLogRecords(t, out)
+ if len(records) != 1 {
+  t.Fatalf("got %d run summary lines", len(records))
+ }
+ want := map[string]*tenantSummary{
+  "alpha": {Transferred: 1, Bytes: 2},
+  "beta":  {Transferred: 1, Bytes: 2},
+  "gamma": {Failed: 1},
+ }
+ if !reflect.DeepEqual(records[0].Tenants, want) {
+  t.Errorf("tenants = %s", mustJSON(t, records[0].Tenants))
+ }
+}
+
+func TestTenantFromPayload(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ beta := e.addTenant("beta")
+ t.Setenv("TENANT_SECRETS", `{"alpha":"sftp-alpha","beta":"sftp-beta"}`)
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ if _, err := e.run(`{"tenant":"beta"}`); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if got, _ := beta.file("/uploads/orders.csv"); string(got) != "id\n" {
+  t.Errorf("beta got %q", got)
+ }
+
+ result, err := e.run(`{"tenant":"gamma"}`)
+ if err == nil {
+  t.Fatal("run succeeded for an unmapped tenant")
+ }
+ if result == nil || result.Failed != 1 {
+  t.Errorf("result = %+v, want the file failed", result)
+ }
+}
+
+func TestTenantPayloadNeedsTenantSecrets(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ e.s3.put("test-poc/orders.csv", "id\n")
+ if _, err := e.run(`{"tenant":"beta"}`); err == nil {
+  t.Fatal("run accepted a tenant without TENANT_SECRETS")
+ }
+ if _, ok := e.server.file("/uploads/orders.csv"); ok {
+  t.Error("file delivered although the payload was rejected")
+ }
+}
+
+func TestTenantFromSQSAttribute(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ beta := e.addTenant("beta")
+ t.Setenv("TENANT_SECRETS", `{"alpha":"sftp-alpha","beta":"sftp-beta"}`)
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ tenant := "beta"
+ event, err := json.Marshal(events.SQSEvent{Records: []events.SQSMessage{{
+  MessageId:         "msg-1",
+  EventSource:       "aws:sqs",
+  Body:              `{"prefix":"test-poc"}`,
+  MessageAttributes: map[string]events.SQSMessageAttribute{"tenant": {StringValue: &tenant, DataType: "String"}},
+ }}})
+ if err != nil {
+  t.Fatal(err)
+ }
+ ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "test-request"})
+ out, err := HandleInvocation(ctx, event)
+ if err != nil {
+  t.Fatalf("batch failed: %v", err)
+ }
+ if resp := out.(*events.SQSEventResponse); len(resp.BatchItemFailures) != 0 {
+  t.Fatalf("failed records: %+v", resp.BatchItemFailures)
+ }
+ if got, _ := beta.file("/uploads/orders.csv"); string(got) != "id\n" {
+  t.Errorf("beta got %q", got)
+ }
+}
+
+func TestWithTenantAttribute(t *testing.T) {
+ tests := []struct {
+  body, tenant string
+  want         string
+  wantErr      bool
+ }{
+  {body: `{"prefix":"a"}`, tenant: "", want: `{"prefix":"a"}`},
+  {body: `{"prefix":"a"}`, tenant: "beta", want: `{"prefix":"a","tenant":"beta"}`},
+  {body: ``, tenant: "beta", want: `{"tenant":"beta"}`},
+  {body: `null`, tenant: "beta", want: `{"tenant":"beta"}`},
+  {body: `{"tenant":"beta"}`, tenant: "beta", want: `{"tenant":"beta"}`},
+  {body: `{"tenant":"alpha"}`, tenant: "beta", wantErr: true},
+  {body: `{"tenant":1}`, tenant: "beta", wantErr: true},
+  {body: `[1]`, tenant: "beta", wantErr: true},
+ }
+ for _, tt := range tests {
+  got, err := withTenantAttribute(tt.body, tt.tenant)
+  if tt.wantErr {
+   if err == nil {
+    t.Errorf("withTenantAttribute(%q, %q) = %s, want an error", tt.body, tt.tenant, got)
+   }
+   continue
+  }
+  if err != nil || string(got) != tt.want {
+   t.Errorf("withTenantAttribute(%q, %q) = %s, %v, want %s", tt.body, tt.tenant, got, err, tt.want)
+  }
+ }
+}
+
+func TestTenantSecretsRejectsArchiveMode(t *testing.T) {
+ t.Setenv("TENANT_SECRETS", `{"alpha":"sftp-alpha"}`)
+ t.Setenv("ARCHIVE_MODE", "zip")
+ if _, err := config.Load(); err == nil {
+  t.Fatal("loadConfig accepted TENANT_SECRETS with ARCHIVE_MODE")
+ }
+}
+
+func mustJSON(t *testing.T, v any) string {
+ t.Helper()
+ b, err := json.Marshal(v)
+ if err != nil {
+  t.Fatal(err)
+ }
+ return string(b)
+}
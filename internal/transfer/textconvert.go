@@ -0,0 +1,74 @@
+package transfer
+
+import (
+ "io"
+ "strings"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// convertsText reports whether name has one of TEXT_CONVERT_EXTENSIONS and
+// is rewritten on the way to the server. Every other file passes through
+// byte for byte.
+func (r *transferRun) convertsText(name string) bool {
+ if r.cfg.TextConvert == "" {
+  return false
+ }
+ lower := strings.ToLower(name)
+ for _, ext := range r.cfg.TextConvertExtensions {
+  if strings.HasSuffix(lower, ext) {
+   return true
+  }
+ }
+ return false
+}
+
+// crlfTransform is the TEXT_CONVERT=crlf transform.
+type crlfTransform struct{}
+
+func (crlfTransform) Name() string { return config.TextConvertCRLF }
+
+func (crlfTransform) Stage() transformStage { return stageText }
+
+func (crlfTransform) Wrap(r io.Reader) (io.Reader, error) { return newCRLFReader(r), nil }
+
+func (crlfTransform) RemoteName(name string) string { return name }
+
+// crlfReader rewrites every LF not already preceded by CR to CRLF as it
+// streams, so converting a file that already has CRLF endings changes
+// nothing. Whether the previous byte was a CR is carried across reads, so a
+// CRLF split between two reads is kept as it is.
+type crlfReader struct {
+ r       io.Reader
+ buf     []byte
+ out     []byte
+ pending []byte
+ prevCR  bool
+ err     error
+}
+
+func newCRLFReader(r io.Reader) *crlfReader {
+ return &crlfReader{r: r, buf: make([]byte, config.TextBufferBytes)}
+}
+
+func (c *crlfReader) Read(p []byte) (int, error) {
+ for len(c.pending) == 0 {
+  if c.err != nil {
+   return 0, c.err
+  }
+  var n int
+  n, c.err = c.r.Read(c.buf)
+  c.out = c.out[:0]
+  for _, b := range c.buf[:n] {
+   if b == '\n' && !c.prevCR {
+    c.out = append(c.out, '\r')
+   }
+   c.out = append(c.out, b)
+   c.prevCR = b == '\r'
+  }
+  c.pending = c.out
+ }
+ n := copy(p, c.pending)
+ c.pending = c.pending[n:]
+ return n, nil
+}
@@ -0,0 +1,110 @@
+package transfer
+
+import (
+ "bytes"
+ "io"
+ "strings"
+ "testing"
+ "testing/iotest"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// chunkReader returns the chunks one per Read.
+type chunkReader struct{ chunks []string }
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+ if len(c.chunks) == 0 {
+  return 0, io.EOF
+ }
+ n := copy(p, c.chunks[0])
+ if c.chunks[0] = c.chunks[0][n:]; c.chunks[0] == "" {
+  c.chunks = c.chunks[1:]
+ }
+ return n, nil
+}
+
+func convertCRLF(t *testing.T, r io.Reader) string {
+ t.Helper()
+ out, err := io.ReadAll(newCRLFReader(r))
+ if err != nil {
+  t.Fatal(err)
+ }
+ return string(out)
+}
+
+func TestCRLFReader(t *testing.T) {
+ tests := []struct{ name, in, want string }{
+  {"empty", "", ""},
+  {"no line ending", "id,total", "id,total"},
+  {"lf", "id\n1\n2\n", "id\r\n1\r\n2\r\n"},
+  {"already crlf", "id\r\n1\r\n", "id\r\n1\r\n"},
+  {"mixed", "id\r\n1\n2\r\n3\n", "id\r\n1\r\n2\r\n3\r\n"},
+  {"blank lines", "\n\n\r\n\n", "\r\n\r\n\r\n\r\n"},
+  {"lone cr kept", "a\rb\n", "a\rb\r\n"},
+  {"cr at end", "a\r", "a\r"},
+ }
+ for _, tt := range tests {
+  t.Run(tt.name, func(t *testing.T) {
+   if got := convertCRLF(t, strings.NewReader(tt.in)); got != tt.want {
+    t.Errorf("got %q, want %q", got, tt.want)
+   }
+   // A byte at a time puts a read boundary between every CR and LF.
+   if got := convertCRLF(t, iotest.OneByteReader(strings.NewReader(tt.in))); got != tt.want {
+    t.Errorf("one byte at a time: got %q, want %q", got, tt.want)
+   }
+   if got := convertCRLF(t, strings.NewReader(tt.want)); got != tt.want {
+    t.Errorf("converting again changed %q to %q", tt.want, got)
+   }
+  })
+ }
+}
+
+func TestCRLFReaderSplitAcrossReads(t *testing.T) {
+ for _, chunks := range [][]string{
+  {"id\r", "\n1\n"},
+  {"id\r", "", "\n1\n"},
+  {"id", "\r", "\n", "1", "\n"},
+  {"id\r\n1\r", "\r\n"},
+ } {
+  want := strings.ReplaceAll(strings.ReplaceAll(strings.Join(chunks, ""), "\r\n", "\n"), "\n", "\r\n")
+  if got := convertCRLF(t, &chunkReader{chunks: append([]string(nil), chunks...)}); got != want {
+   t.Errorf("chunks %q: got %q, want %q", chunks, got, want)
+  }
+ }
+}
+
+func TestCRLFReaderSmallReads(t *testing.T) {
+ // Lines spanning several internal buffers, read through a small buffer
+ // so the converted output is handed out over several calls.
+ in := strings.Repeat(strings.Repeat("x", 1000)+"\n", 3*config.TextBufferBytes/1000)
+ r := newCRLFReader(strings.NewReader(in))
+ var out bytes.Buffer
+ buf := make([]byte, 7)
+ for {
+  n, err := r.Read(buf)
+  out.Write(buf[:n])
+  if err == io.EOF {
+   break
+  }
+  if err != nil {
+   t.Fatal(err)
+  }
+ }
+ if want := strings.ReplaceAll(in, "\n", "\r\n"); out.String() != want {
+  t.Errorf("got %d bytes, want %d", out.Len(), len(want))
+ }
+}
+
+func TestHandlerConvertsTextFiles(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ t.Setenv("TEXT_CONVERT", "crlf")
+ e.s3.put("test-poc/orders.csv", "id\n1\r\n2\n")
+ e.s3.put("test-poc/image.bin", "\x89PNG\n\x1a\n")
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ e.wantFile("/uploads/orders.csv", "id\r\n1\r\n2\r\n")
+ e.wantFile("/uploads/image.bin", "\x89PNG\n\x1a\n")
+}
@@ -0,0 +1,124 @@
+package transfer
+
+import (
+ "fmt"
+ "hash"
+ "io"
+ "sort"
+ "strings"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// transformStage orders the transforms of a pipeline. Content is converted
+// first, then compressed, then encrypted, and digests are taken last so
+// checksums describe the bytes the partner receives.
+type transformStage int
+
+const (
+ stageText transformStage = iota
+ stageCompress
+ stageEncrypt
+ stageDigest
+)
+
+// contentTransform is one step of the copy pipeline.
+type contentTransform interface {
+ // Name identifies the transform in logs and the report.
+ Name() string
+ Stage() transformStage
+ // Wrap returns a reader yielding r transformed.
+ Wrap(r io.Reader) (io.Reader, error)
+ // RemoteName maps the remote file name, e.g. adding an extension.
+ RemoteName(name string) string
+}
+
+// transformPipeline is a set of transforms applied in stage order. Transforms
+// of the same stage keep the order they were added in.
+type transformPipeline []contentTransform
+
+func newTransformPipeline(transforms ...contentTransform) transformPipeline {
+ p := transformPipeline(transforms)
+ sort.SliceStable(p, func(i, j int) bool { return p[i].Stage() < p[j].Stage() })
+ return p
+}
+
+// wrap applies every transform to r in order. The first failure stops the
+// pipeline and is returned with the name of the transform that failed.
+func (p transformPipeline) wrap(r io.Reader) (io.Reader, error) {
+ for _, t := range p {
+  var err error
+  if r, err = t.Wrap(r); err != nil {
+   return nil, fmt.Errorf("transform %s failed: %w", t.Name(), err)
+  }
+ }
+ return r, nil
+}
+
+// remoteName maps name through every transform in order.
+func (p transformPipeline) remoteName(name string) string {
+ for _, t := range p {
+  name = t.RemoteName(name)
+ }
+ return name
+}
+
+// contentNames returns the names of the transforms that change the content,
+// joined by "+", for the report.
+func (p transformPipeline) contentNames() string {
+ var names []string
+ for _, t := range p {
+  if t.Stage() < stageDigest {
+   names = append(names, t.Name())
+  }
+ }
+ return strings.Join(names, "+")
+}
+
+// digest returns the hash of the pipeline's digest transform for algorithm,
+// or nil when there is none.
+func (p transformPipeline) digest(algorithm string) hash.Hash {
+ for _, t := range p {
+  if d, ok := t.(*digestTransform); ok && d.algorithm == algorithm {
+   return d.h
+  }
+ }
+ return nil
+}
+
+// digestTransform hashes the content as it passes, leaving it unchanged.
+type digestTransform struct {
+ algorithm string
+ h         hash.Hash
+}
+
+func newDigestTransform(algorithm string) *digestTransform {
+ return &digestTransform{algorithm: algorithm, h: newDigest(algorithm)}
+}
+
+func (d *digestTransform) Name() string { return d.algorithm }
+
+func (d *digestTransform) Stage() transformStage { return stageDigest }
+
+func (d *digestTransform) Wrap(r io.Reader) (io.Reader, error) { return io.TeeReader(r, d.h), nil }
+
+func (d *digestTransform) RemoteName(name string) string { return name }
+
+// transforms builds the pipeline item is copied through.
+func (r *transferRun) transforms(item *deliveryItem) transformPipeline {
+ var ts []contentTransform
+ if r.convertsText(item.name) {
+  ts = append(ts, crlfTransform{})
+ }
+ // Only the resumed part of a file passes through the run, so no
+ // digest of the whole file can be taken.
+ if item.resume == nil {
+  if r.cfg.ChecksumSidecar != "" {
+   ts = append(ts, newDigestTransform(r.cfg.ChecksumSidecar))
+  }
+  if r.cfg.MetadataSidecar && r.cfg.ChecksumSidecar != config.ChecksumSHA256 {
+   ts = append(ts, newDigestTransform(config.ChecksumSHA256))
+  }
+ }
+ return newTransformPipeline(ts...)
+}
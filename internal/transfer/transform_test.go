@@ -0,0 +1,131 @@
+package transfer
+
+import (
+ "crypto/sha256"
+ "errors"
+ "io"
+ "strings"
+ "testing"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// tagTransform brackets the content and the remote name with its name, so
+// the output shows the order transforms ran in.
+type tagTransform struct {
+ name    string
+ stage   transformStage
+ err     error
+ wrapped *[]string
+}
+
+func (t tagTransform) Name() string { return t.name }
+
+func (t tagTransform) Stage() transformStage { return t.stage }
+
+func (t tagTransform) Wrap(r io.Reader) (io.Reader, error) {
+ *t.wrapped = append(*t.wrapped, t.name)
+ if t.err != nil {
+  return nil, t.err
+ }
+ return io.MultiReader(strings.NewReader(t.name+"("), r, strings.NewReader(")")), nil
+}
+
+func (t tagTransform) RemoteName(name string) string { return name + "." + t.name }
+
+func TestTransformPipelineOrder(t *testing.T) {
+ var wrapped []string
+ tag := func(name string, stage transformStage) tagTransform {
+  return tagTransform{name: name, stage: stage, wrapped: &wrapped}
+ }
+ digest := newDigestTransform(config.ChecksumSHA256)
+ // Added out of order; transforms of a stage keep the order they came in.
+ p := newTransformPipeline(
+  digest,
+  tag("pgp", stageEncrypt),
+  tag("gzip", stageCompress),
+  tag("crlf", stageText),
+  tag("trim", stageText),
+ )
+
+ r, err := p.wrap(strings.NewReader("data"))
+ if err != nil {
+  t.Fatal(err)
+ }
+ out, err := io.ReadAll(r)
+ if err != nil {
+  t.Fatal(err)
+ }
+ if want := "crlf,trim,gzip,pgp"; strings.Join(wrapped, ",") != want {
+  t.Errorf("wrapped %v, want %s", wrapped, want)
+ }
+ const want = "pgp(gzip(trim(crlf(data))))"
+ if string(out) != want {
+  t.Errorf("content = %q, want %q", out, want)
+ }
+ // The digest runs last, over the bytes the partner receives.
+ if got, want := p.digest(config.ChecksumSHA256).Sum(nil), sha256.Sum256([]byte(want)); string(got) != string(want[:]) {
+  t.Errorf("digest %x, want %x", got, want)
+ }
+ if p.digest(config.ChecksumMD5) != nil {
+  t.Error("pipeline has an md5 digest it was not given")
+ }
+ if got, want := p.remoteName("orders.csv"), "orders.csv.crlf.trim.gzip.pgp"; got != want {
+  t.Errorf("remoteName = %q, want %q", got, want)
+ }
+ if got, want := p.contentNames(), "crlf+trim+gzip+pgp"; got != want {
+  t.Errorf("contentNames = %q, want %q", got, want)
+ }
+}
+
+func TestTransformPipelineStopsAtFailure(t *testing.T) {
+ var wrapped []string
+ errKey := errors.New("no recipient key")
+ p := newTransformPipeline(
+  tagTransform{name: "crlf", stage: stageText, wrapped: &wrapped},
+  tagTransform{name: "pgp", stage: stageEncrypt, err: errKey, wrapped: &wrapped},
+  tagTransform{name: "sha256", stage: stageDigest, wrapped: &wrapped},
+ )
+
+ r, err := p.wrap(strings.NewReader("data"))
+ if !errors.Is(err, errKey) {
+  t.Fatalf("err = %v, want %v", err, errKey)
+ }
+ if r != nil {
+  t.Error("wrap returned a reader along with its error")
+ }
+ if !strings.Contains(err.Error(), "transform pgp failed") {
+  t.Errorf("err = %q, want it to name the failing transform", err)
+ }
+ if want := "crlf,pgp"; strings.Join(wrapped, ",") != want {
+  t.Errorf("wrapped %v, want %s", wrapped, want)
+ }
+}
+
+func TestRunTransforms(t *testing.T) {
+ cfg := &Config{
+  TextConvert:           config.TextConvertCRLF,
+  TextConvertExtensions: []string{".csv"},
+  ChecksumSidecar:       config.ChecksumMD5,
+  MetadataSidecar:       true,
+ }
+ r := testRun(cfg, nil)
+ tests := []struct {
+  item  *deliveryItem
+  names []string
+ }{
+  {&deliveryItem{name: "orders.csv"}, []string{"crlf", "md5", "sha256"}},
+  {&deliveryItem{name: "image.bin"}, []string{"md5", "sha256"}},
+  // A resumed file only passes its tail through the run.
+  {&deliveryItem{name: "orders.csv", resume: &resumeState{}}, []string{"crlf"}},
+ }
+ for _, tt := range tests {
+  var names []string
+  for _, tr := range r.transforms(tt.item) {
+   names = append(names, tr.Name())
+  }
+  if strings.Join(names, ",") != strings.Join(tt.names, ",") {
+   t.Errorf("transforms(%s, resumed %t) = %v, want %v", tt.item.name, tt.item.resume != nil, names, tt.names)
+  }
+ }
+}
@@ -0,0 +1,144 @@
+package transfer
+
+import (
+ "bytes"
+ "fmt"
+ "io"
+ "log"
+ "path"
+ "strings"
+ "unicode/utf8"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/source"
+)
+
+// categoryValidation marks files rejected by the pre-transfer checks.
+const categoryValidation errorCategory = "validation"
+
+// validationPrefixBytes is how much of an object is read to check its type.
+const validationPrefixBytes = 512
+
+// textExtensions are checked to hold printable text under
+// VALIDATE_CONTENT_TYPE.
+var textExtensions = map[string]bool{".csv": true, ".tsv": true, ".txt": true, ".json": true, ".xml": true}
+
+// magicPrefixes are the leading bytes files with these extensions must start
+// with under VALIDATE_CONTENT_TYPE.
+var magicPrefixes = map[string][]string{
+ ".pdf": {"%PDF"},
+ ".zip": {"PK"},
+ ".gz":  {"\x1f\x8b"},
+}
+
+// validateObject runs the pre-transfer checks on key before anything is
+// sent: that its file name matches VALIDATE_NAME_PATTERN, that it is not
+// empty under VALIDATE_NON_EMPTY, and under VALIDATE_CONTENT_TYPE that its
+// first bytes, fetched with a ranged GET, fit its extension. A rejected file
+// is reported with category validation and, with VALIDATE_QUARANTINE, moved
+// under QUARANTINE_PREFIX.
+func (r *transferRun) validateObject(key string) error {
+ if !r.cfg.ValidationEnabled() {
+  return nil
+ }
+ problem, err := r.checkObject(key)
+ if err != nil {
+  // Not a verdict on the file, so not a validation failure.
+  r.report.addFile(fileReport{Key: key, Status: statusFailed, Category: string(categoryOf(err)), Error: err.Error()})
+  return err
+ }
+ if problem == "" {
+  return nil
+ }
+ log.Printf("Not delivering %s: %s", key, problem)
+ r.metrics.add("ValidationFailed", unitCount, 1)
+ err = withCategory(categoryValidation, fmt.Errorf("validation failed for %s: %s", key, problem))
+ r.report.addFile(fileReport{Key: key, Status: statusFailed, Category: string(categoryValidation), Error: err.Error()})
+ if r.cfg.ValidateQuarantine {
+  r.quarantine(key, err)
+ }
+ return err
+}
+
+// checkObject returns what is wrong with key, or "" when it passes. The
+// prefix is only fetched when a check needs it: to match the content to the
+// extension, or to tell whether a key missing from the listing is empty.
+func (r *transferRun) checkObject(key string) (string, error) {
+ name := path.Base(key)
+ if re := r.cfg.ValidateNamePattern; re != nil && !re.MatchString(name) {
+  return fmt.Sprintf("file name %q does not match VALIDATE_NAME_PATTERN %s", name, re), nil
+ }
+ size, listed := r.sizes[key]
+ if r.cfg.ValidateNonEmpty && listed && size == 0 {
+  return "the file is empty", nil
+ }
+ ext := strings.ToLower(path.Ext(name))
+ typed := textExtensions[ext] || len(magicPrefixes[ext]) > 0
+ if !(r.cfg.ValidateContentType && typed) && !(r.cfg.ValidateNonEmpty && !listed) {
+  return "", nil
+ }
+ head, err := r.readPrefix(key)
+ if err != nil {
+  return "", err
+ }
+ switch {
+ case len(head) == 0:
+  if r.cfg.ValidateNonEmpty {
+   return "the file is empty", nil
+  }
+ case !r.cfg.ValidateContentType:
+ case textExtensions[ext]:
+  if i := binaryIndex(head); i >= 0 {
+   return fmt.Sprintf("the file is named %s but is not text: byte 0x%02x at offset %d", ext, head[i], i), nil
+  }
+ case len(magicPrefixes[ext]) > 0:
+  for _, magic := range magicPrefixes[ext] {
+   if bytes.HasPrefix(head, []byte(magic)) {
+    return "", nil
+   }
+  }
+  return fmt.Sprintf("the file is named %s but starts with %q, not %q", ext, head[:min(len(head), 8)], magicPrefixes[ext][0]), nil
+ }
+ return "", nil
+}
+
+// readPrefix fetches the first validationPrefixBytes of key. An empty object
+// has no first byte to range over and reads as empty.
+func (r *transferRun) readPrefix(key string) ([]byte, error) {
+ out, err := r.s3.Get(source.GetInput{
+  Bucket: s3Bucket,
+  Key:    key,
+  Range:  fmt.Sprintf("bytes=0-%d", validationPrefixBytes-1),
+ })
+ if source.IsInvalidRange(err) {
+  return nil, nil
+ }
+ if err != nil {
+  return nil, classifyS3Error(fmt.Errorf("failed to read the start of %s for validation: %w", key, err))
+ }
+ defer out.Body.Close()
+ return io.ReadAll(io.LimitReader(out.Body, validationPrefixBytes))
+}
+
+// binaryIndex returns the offset of the first byte in head that cannot be
+// part of printable UTF-8 text, or -1. A rune cut off at the end of the
+// prefix is not held against it.
+func binaryIndex(head []byte) int {
+ i := 0
+ if bytes.HasPrefix(head, []byte("\xef\xbb\xbf")) {
+  i = 3
+ }
+ for i < len(head) {
+  c, size := utf8.DecodeRune(head[i:])
+  if c == utf8.RuneError && size <= 1 {
+   if !utf8.FullRune(head[i:]) {
+    return -1
+   }
+   return i
+  }
+  if c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f' || c == 0x7f {
+   return i
+  }
+  i += size
+ }
+ return -1
+}
@@ -0,0 +1,70 @@
+package transfer
+
+import (
+ "encoding/json"
+ "runtime"
+ "runtime/debug"
+ "sync"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/schema"
+)
+
+// Build metadata, set at build time with
+//
+//	go build -ldflags "-X $pkg.version=v1.2.3 -X $pkg.commit=$(git rev-parse HEAD) -X $pkg.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/lambda
+//
+// with pkg=github.com/vishalk7890/s3-sftp-lambda/internal/transfer.
+//
+// Whatever is left unset is taken from the build info the toolchain embeds.
+var (
+ version   string
+ commit    string
+ buildDate string
+)
+
+var buildInfoOnce = sync.OnceValue(readBuildInfo)
+
+// readBuildInfo assembles the build metadata from the ldflags variables and
+// the toolchain's build info.
+func readBuildInfo() *schema.BuildInfo {
+ b := &schema.BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+ if bi, ok := debug.ReadBuildInfo(); ok {
+  if b.Version == "" {
+   b.Version = bi.Main.Version
+  }
+  for _, s := range bi.Settings {
+   switch s.Key {
+   case "vcs.revision":
+    if b.Commit == "" {
+     b.Commit = s.Value
+    }
+   case "vcs.time":
+    if b.BuildDate == "" {
+     b.BuildDate = s.Value
+    }
+   case "vcs.modified":
+    b.Modified = s.Value == "true"
+   }
+  }
+ }
+ if b.Version == "" {
+  b.Version = "unknown"
+ }
+ return b
+}
+
+// CurrentBuild returns the build metadata of the running binary.
+func CurrentBuild() *schema.BuildInfo {
+ return buildInfoOnce()
+}
+
+// isVersionRequest reports whether event is {"mode":"version"}, which is
+// answered with the build metadata without loading the configuration or
+// doing any work.
+func isVersionRequest(event json.RawMessage) bool {
+ var p struct {
+  Mode string `json:"mode"`
+ }
+ return json.Unmarshal(event, &p) == nil && p.Mode == config.PayloadModeVersion
+}
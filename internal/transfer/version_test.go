@@ -0,0 +1,83 @@
+package transfer
+
+import (
+ "context"
+ "encoding/json"
+ "runtime"
+ "strings"
+ "testing"
+
+ "github.com/vishalk7890/s3-sftp-lambda/schema"
+)
+
+func TestReadBuildInfoPrefersLdflags(t *testing.T) {
+ saved := [3]string{version, commit, buildDate}
+ t.Cleanup(func() { version, commit, buildDate = saved[0], saved[1], saved[2] })
+ version, commit, buildDate = "v1.2.3", "0123abc", "2026-10-14T12:00:00Z"
+
+ b := readBuildInfo()
+ if b.Version != "v1.2.3" || b.Commit != "0123abc" || b.BuildDate != "2026-10-14T12:00:00Z" {
+  t.Errorf("build = %+v, want the ldflags values", b)
+ }
+ if b.GoVersion != runtime.Version() {
+  t.Errorf("GoVersion = %q, want %q", b.GoVersion, runtime.Version())
+ }
+
+ // Unset, the version still names something.
+ version, commit, buildDate = "", "", ""
+ if b := readBuildInfo(); b.Version == "" || b.GoVersion == "" {
+  t.Errorf("build = %+v, want a version and Go version", b)
+ }
+}
+
+func TestResultIncludesBuild(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ t.Setenv("REPORT_BUCKET", "reports")
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ result, err := e.run("")
+ if err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ want := CurrentBuild()
+ if result.Build == nil || *result.Build != *want {
+  t.Fatalf("result.Build = %+v, want %+v", result.Build, want)
+ }
+ if result.Build.Version == "" || result.Build.GoVersion != runtime.Version() {
+  t.Errorf("result.Build = %+v, want the version and Go version set", result.Build)
+ }
+
+ var report struct {
+  Build  *schema.BuildInfo `json:"build"`
+  Result schema.ResultV1   `json:"result"`
+ }
+ for _, key := range e.s3.keys("reports") {
+  if strings.HasSuffix(key, ".json") {
+   if err := json.Unmarshal(e.s3.object("reports", key).body, &report); err != nil {
+    t.Fatal(err)
+   }
+  }
+ }
+ if report.Build == nil || *report.Build != *want || report.Result.Build == nil || *report.Result.Build != *want {
+  t.Errorf("report build = %+v, result build = %+v, want %+v", report.Build, report.Result.Build, want)
+ }
+}
+
+func TestVersionRequest(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ out, err := HandleInvocation(context.Background(), json.RawMessage(`{"mode":"version"}`))
+ if err != nil {
+  t.Fatal(err)
+ }
+ if b, ok := out.(*schema.BuildInfo); !ok || *b != *CurrentBuild() {
+  t.Fatalf("response = %#v, want the build metadata", out)
+ }
+ if e.s3.listCalls != 0 {
+  t.Errorf("%d list call(s), want no work done", e.s3.listCalls)
+ }
+ if logins, _ := e.server.accepted(); logins != 0 {
+  t.Errorf("server accepted %d login(s), want no work done", logins)
+ }
+}
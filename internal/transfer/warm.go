@@ -0,0 +1,94 @@
+package transfer
+
+import (
+ "log"
+ "strings"
+ "sync"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// processStart is when the execution environment started, for cold start
+// timing.
+var processStart = time.Now()
+
+// initState records what the init phase prepared, for the first invocation
+// to log how warm it found the environment.
+var initState struct {
+ took     time.Duration
+ prepared []string
+ firstRun sync.Once
+}
+
+// Prewarm runs during the init phase, before the function takes its first
+// invocation. It validates the configuration, creates the AWS session and,
+// with PREWARM_SECRET or PREWARM_CONNECTION set, fetches the SFTP secret
+// into secretCache and leaves a dialed connection in connPool. A step that
+// fails is logged and left to the invocation, which then reports the same
+// error as a cold environment would, instead of the init phase crashing and
+// Lambda retrying it in a loop.
+func Prewarm() {
+ start := time.Now()
+ defer func() {
+  initState.took = time.Since(start)
+  log.Printf("Init phase took %s (init type %s), prepared: %s", initState.took.Round(time.Millisecond),
+   config.EnvString("AWS_LAMBDA_INITIALIZATION_TYPE", "unknown"), preparedList())
+ }()
+
+ cfg, err := config.Load()
+ if err != nil {
+  log.Printf("Invalid configuration at init, invocations will fail until it is fixed: %v", err)
+  return
+ }
+ initState.prepared = append(initState.prepared, "config")
+ sess, err := cloud.NewSession(cfg.FIPSMode)
+ if err != nil {
+  log.Printf("WARNING: failed to create AWS session at init: %v", err)
+  return
+ }
+ initState.prepared = append(initState.prepared, "session")
+ if !cfg.PrewarmSecret || cfg.SecretName == "" {
+  return
+ }
+
+ step := time.Now()
+ sftpConfig, err := getSFTPConfig(sess, cfg, cfg.SecretName, runClock())
+ if err != nil {
+  log.Printf("WARNING: failed to prewarm SFTP secret %s: %v", cfg.SecretName, err)
+  return
+ }
+ initState.prepared = append(initState.prepared, "secret")
+ cfg.Debugf("Prewarmed SFTP secret %s in %s", cfg.SecretName, time.Since(step))
+ if !cfg.PrewarmConnection {
+  return
+ }
+
+ step = time.Now()
+ conn, _, release, err := acquireConnection(cfg, sftpConfig)
+ if err != nil {
+  log.Printf("WARNING: failed to prewarm SFTP connection: %v", err)
+  return
+ }
+ release(false)
+ initState.prepared = append(initState.prepared, "connection")
+ log.Printf("Prewarmed SFTP connection to %s in %s", conn.Timing.Address, time.Since(step).Round(time.Millisecond))
+}
+
+func preparedList() string {
+ if len(initState.prepared) == 0 {
+  return "nothing"
+ }
+ return strings.Join(initState.prepared, ", ")
+}
+
+// logFirstInvocation logs, on the first invocation of the environment, how
+// long after start-up it arrived and what the init phase had prepared for
+// it, so cold starts with and without prewarming can be compared.
+func logFirstInvocation() {
+ initState.firstRun.Do(func() {
+  log.Printf("First invocation of this environment, %s after start-up; init phase took %s and prepared: %s",
+   time.Since(processStart).Round(time.Millisecond), initState.took.Round(time.Millisecond), preparedList())
+ })
+}
@@ -0,0 +1,146 @@
+package transfer
+
+import (
+ "bytes"
+ "context"
+ "crypto/hmac"
+ "crypto/sha256"
+ "encoding/hex"
+ "encoding/json"
+ "fmt"
+ "log"
+ "net/http"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/cloud"
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+ "github.com/vishalk7890/s3-sftp-lambda/schema"
+)
+
+const (
+ webhookAttempts = 3
+ webhookTimeout  = 10 * time.Second
+)
+
+// webhookPayload is the JSON body POSTed to WEBHOOK_URL at the end of a run.
+type webhookPayload struct {
+ schema.ResultV1
+ Files []webhookFile `json:"files"`
+ // Truncated is set when Files was cut short to respect WEBHOOK_MAX_BYTES.
+ Truncated bool `json:"truncated"`
+}
+
+type webhookFile struct {
+ Key        string `json:"key"`
+ Member     string `json:"member,omitempty"`
+ RemotePath string `json:"remotePath,omitempty"`
+ Status     string `json:"status"`
+ Bytes      int64  `json:"bytes"`
+ Error      string `json:"error,omitempty"`
+}
+
+// sendWebhook POSTs the run outcome to WEBHOOK_URL, signed with the HMAC key
+// from WEBHOOK_SECRET_NAME. Failures are logged and never change the result
+// of the run.
+func sendWebhook(ctx context.Context, cfg *Config, sess *cloud.Session, report *transferReport, clk clock) {
+ if cfg.WebhookURL == "" {
+  return
+ }
+ if err := postWebhook(ctx, cfg, sess, report, clk); err != nil {
+  log.Printf("Webhook notification failed: %v", err)
+ }
+}
+
+func postWebhook(ctx context.Context, cfg *Config, sess *cloud.Session, report *transferReport, clk clock) error {
+ var key []byte
+ if cfg.WebhookSecretName != "" {
+  secret, err := config.SecretString(sess, cfg, cfg.WebhookSecretName)
+  if err != nil {
+   return fmt.Errorf("failed to get webhook signing secret: %w", err)
+  }
+  key = []byte(secret)
+ }
+
+ body, err := buildWebhookBody(report, cfg.WebhookMaxBytes)
+ if err != nil {
+  return err
+ }
+
+ client := &http.Client{Timeout: webhookTimeout}
+ backoff := time.Second
+ for attempt := 1; ; attempt++ {
+  retry, err := deliverWebhook(ctx, client, cfg.WebhookURL, body, key)
+  if err == nil {
+   log.Printf("Webhook delivered to %s bytes=%d", cfg.WebhookURL, len(body))
+   return nil
+  }
+  if !retry || attempt == webhookAttempts {
+   return err
+  }
+  log.Printf("Webhook attempt %d failed, retrying in %s: %v", attempt, backoff, err)
+  select {
+  case <-clk.After(backoff):
+  case <-ctx.Done():
+   return ctx.Err()
+  }
+  backoff *= 2
+ }
+}
+
+// buildWebhookBody marshals the payload, dropping per-file entries from the
+// end until it fits in maxBytes.
+func buildWebhookBody(report *transferReport, maxBytes int) ([]byte, error) {
+ payload := webhookPayload{ResultV1: report.summary()}
+ for _, f := range report.Files {
+  payload.Files = append(payload.Files, webhookFile{
+   Key:        f.Key,
+   Member:     f.Member,
+   RemotePath: f.RemotePath,
+   Status:     f.Status,
+   Bytes:      f.Bytes,
+   Error:      f.Error,
+  })
+ }
+
+ for {
+  body, err := json.Marshal(payload)
+  if err != nil {
+   return nil, fmt.Errorf("failed to marshal webhook payload: %w", err)
+  }
+  if len(body) <= maxBytes || len(payload.Files) == 0 {
+   return body, nil
+  }
+  // Halve rather than drop one at a time; large runs have many
+  // thousands of entries.
+  payload.Files = payload.Files[:len(payload.Files)/2]
+  payload.Truncated = true
+ }
+}
+
+// deliverWebhook makes a single POST attempt and reports whether a failure is
+// worth retrying (timeouts, connection errors and 5xx responses).
+func deliverWebhook(ctx context.Context, client *http.Client, url string, body, key []byte) (bool, error) {
+ req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+ if err != nil {
+  return false, fmt.Errorf("invalid webhook request: %w", err)
+ }
+ req.Header.Set("Content-Type", "application/json")
+ if key != nil {
+  mac := hmac.New(sha256.New, key)
+  mac.Write(body)
+  req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+ }
+
+ resp, err := client.Do(req)
+ if err != nil {
+  return true, err
+ }
+ resp.Body.Close()
+ switch {
+ case resp.StatusCode >= 500:
+  return true, fmt.Errorf("webhook returned %s", resp.Status)
+ case resp.StatusCode >= 300:
+  return false, fmt.Errorf("webhook returned %s", resp.Status)
+ }
+ return false, nil
+}
@@ -0,0 +1,217 @@
+package transfer
+
+import (
+ "crypto/hmac"
+ "crypto/sha256"
+ "encoding/hex"
+ "encoding/json"
+ "io"
+ "net/http"
+ "net/http/httptest"
+ "reflect"
+ "strings"
+ "sync"
+ "testing"
+ "time"
+
+ "github.com/vishalk7890/s3-sftp-lambda/internal/config"
+)
+
+// testEndpoint serves the requests of a test with status(n) for the nth,
+// counting from 1, and records them.
+type testEndpoint struct {
+ *httptest.Server
+ mu       sync.Mutex
+ requests []testRequest
+}
+
+type testRequest struct {
+ header http.Header
+ body   []byte
+}
+
+func startTestEndpoint(t *testing.T, status func(n int, w http.ResponseWriter) int) *testEndpoint {
+ e := &testEndpoint{}
+ e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  body, _ := io.ReadAll(r.Body)
+  e.mu.Lock()
+  e.requests = append(e.requests, testRequest{header: r.Header.Clone(), body: body})
+  n := len(e.requests)
+  e.mu.Unlock()
+  w.WriteHeader(status(n, w))
+ }))
+ t.Cleanup(e.Close)
+ return e
+}
+
+func (e *testEndpoint) count() int {
+ e.mu.Lock()
+ defer e.mu.Unlock()
+ return len(e.requests)
+}
+
+// received returns the requests served so far.
+func (e *testEndpoint) received() []testRequest {
+ e.mu.Lock()
+ defer e.mu.Unlock()
+ return append([]testRequest(nil), e.requests...)
+}
+
+func alwaysOK(int, http.ResponseWriter) int { return http.StatusOK }
+
+func TestWebhookBacksOffOnRunClock(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ clk := installFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+ hook := startTestEndpoint(t, func(n int, _ http.ResponseWriter) int {
+  if n < webhookAttempts {
+   return http.StatusServiceUnavailable
+  }
+  return http.StatusOK
+ })
+ t.Setenv("WEBHOOK_URL", hook.URL)
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if hook.count() != webhookAttempts {
+  t.Errorf("webhook got %d request(s), want %d", hook.count(), webhookAttempts)
+ }
+ if want := []time.Duration{time.Second, 2 * time.Second}; !reflect.DeepEqual(clk.Sleeps(), want) {
+  t.Errorf("slept %v, want %v", clk.Sleeps(), want)
+ }
+}
+
+// signature is the X-Signature of body under key.
+func signature(key, body []byte) string {
+ mac := hmac.New(sha256.New, key)
+ mac.Write(body)
+ return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookSigned(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ hook := startTestEndpoint(t, alwaysOK)
+ e.secrets.set("webhook-key", "hmac-key")
+ t.Setenv("WEBHOOK_URL", hook.URL)
+ t.Setenv("WEBHOOK_SECRET_NAME", "webhook-key")
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ reqs := hook.received()
+ if len(reqs) != 1 {
+  t.Fatalf("webhook got %d request(s), want 1", len(reqs))
+ }
+ req := reqs[0]
+ got := req.header.Get("X-Signature")
+ if want := signature([]byte("hmac-key"), req.body); !hmac.Equal([]byte(got), []byte(want)) {
+  t.Errorf("X-Signature = %q, want %q", got, want)
+ }
+ // The signature covers the exact bytes sent: any change breaks it, as
+ // does another key.
+ tampered := strings.Replace(string(req.body), `"transferred":1`, `"transferred":2`, 1)
+ if tampered == string(req.body) {
+  t.Fatalf("body %s has no transferred count", req.body)
+ }
+ if got == signature([]byte("hmac-key"), []byte(tampered)) || got == signature([]byte("other-key"), req.body) {
+  t.Error("signature does not depend on the body and key")
+ }
+ var payload webhookPayload
+ if err := json.Unmarshal(req.body, &payload); err != nil {
+  t.Fatal(err)
+ }
+ if payload.Transferred != 1 || len(payload.Files) != 1 || payload.Files[0].Key != "test-poc/orders.csv" {
+  t.Errorf("payload = %s", req.body)
+ }
+ if ct := req.header.Get("Content-Type"); ct != "application/json" {
+  t.Errorf("Content-Type = %q", ct)
+ }
+}
+
+func TestWebhookUnsignedWithoutSecret(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ hook := startTestEndpoint(t, alwaysOK)
+ t.Setenv("WEBHOOK_URL", hook.URL)
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if reqs := hook.received(); len(reqs) != 1 || reqs[0].header.Get("X-Signature") != "" {
+  t.Errorf("requests = %+v, want one without X-Signature", reqs)
+ }
+}
+
+func TestWebhookRetriesKeepSignature(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ installFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+ hook := startTestEndpoint(t, func(n int, _ http.ResponseWriter) int {
+  if n == 1 {
+   return http.StatusBadGateway
+  }
+  return http.StatusOK
+ })
+ e.secrets.set("webhook-key", "hmac-key")
+ t.Setenv("WEBHOOK_URL", hook.URL)
+ t.Setenv("WEBHOOK_SECRET_NAME", "webhook-key")
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ reqs := hook.received()
+ if len(reqs) != 2 {
+  t.Fatalf("webhook got %d request(s), want 2", len(reqs))
+ }
+ for i, req := range reqs {
+  if got, want := req.header.Get("X-Signature"), signature([]byte("hmac-key"), req.body); got != want {
+   t.Errorf("attempt %d: X-Signature = %q, want %q", i+1, got, want)
+  }
+ }
+ if string(reqs[0].body) != string(reqs[1].body) {
+  t.Error("retry sent a different body")
+ }
+}
+
+func TestWebhookRejectedIsNotRetried(t *testing.T) {
+ e := newTestEnv(t, testServerConfig{password: "secret"})
+ clk := installFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+ hook := startTestEndpoint(t, func(int, http.ResponseWriter) int { return http.StatusUnauthorized })
+ t.Setenv("WEBHOOK_URL", hook.URL)
+ e.s3.put("test-poc/orders.csv", "id\n")
+
+ // A webhook failure never fails the run.
+ if _, err := e.run(""); err != nil {
+  t.Fatalf("run failed: %v", err)
+ }
+ if hook.count() != 1 || len(clk.Sleeps()) != 0 {
+  t.Errorf("webhook got %d request(s) after %v, want 1 and no retry", hook.count(), clk.Sleeps())
+ }
+}
+
+func TestBuildWebhookBodyTruncates(t *testing.T) {
+ report := newTransferReport("test-request")
+ for i := 0; i < 100; i++ {
+  report.addFile(fileReport{Key: strings.Repeat("k", 50) + string(rune('a'+i%26)), Status: statusTransferred, Bytes: 1})
+ }
+ full, err := buildWebhookBody(report, config.DefaultWebhookBytes)
+ if err != nil {
+  t.Fatal(err)
+ }
+ body, err := buildWebhookBody(report, len(full)/3)
+ if err != nil {
+  t.Fatal(err)
+ }
+ var payload webhookPayload
+ if err := json.Unmarshal(body, &payload); err != nil {
+  t.Fatal(err)
+ }
+ if len(body) > len(full)/3 || !payload.Truncated || len(payload.Files) == 0 || len(payload.Files) >= 100 {
+  t.Errorf("body of %d bytes holds %d file(s), truncated %t; want at most %d bytes", len(body), len(payload.Files), payload.Truncated, len(full)/3)
+ }
+ if payload.Transferred != 100 {
+  t.Errorf("transferred = %d, want the count of the whole run", payload.Transferred)
+ }
+}
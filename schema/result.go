@@ -0,0 +1,88 @@
+// Package schema defines the machine-readable result of a delivery run that
+// is shared with downstream consumers: the handler return value, the
+// webhook body and the S3 transfer report all carry a ResultV1.
+//
+// Changes to ResultV1 must be additive: a field may be added, with
+// omitempty when it is not always meaningful, but never renamed, removed or
+// given a different type or meaning. Anything else requires a new ResultV2
+// alongside it and a new SchemaVersion value.
+package schema
+
+import "time"
+
+// Version1 is the SchemaVersion of ResultV1.
+const Version1 = 1
+
+// Run level outcomes reported in ResultV1.Status.
+const (
+ StatusSucceeded = "succeeded"
+ StatusFailed    = "failed"
+ // StatusPartial is a failed run that still delivered some files.
+ StatusPartial = "partial"
+)
+
+// ResultV1 is the condensed outcome of a run.
+type ResultV1 struct {
+ SchemaVersion int       `json:"schemaVersion"`
+ RequestID     string    `json:"requestId"`
+ Status        string    `json:"status"`
+ Destination   string    `json:"destination"`
+ StartedAt     time.Time `json:"startedAt"`
+ FinishedAt    time.Time `json:"finishedAt"`
+ DurationMs    int64     `json:"durationMs"`
+ Transferred   int       `json:"transferred"`
+ Failed        int       `json:"failed"`
+ Skipped       int       `json:"skipped"`
+ Deferred      int       `json:"deferred"`
+ Bytes         int64     `json:"bytes"`
+ P50MBps       float64   `json:"p50MBps,omitempty"`
+ P95MBps       float64   `json:"p95MBps,omitempty"`
+ EmptyRun      bool      `json:"emptyRun"`
+ Error         string    `json:"error,omitempty"`
+ // Restoring counts objects left for a later run while they are
+ // restored from an archive storage class, and ArchivedSkipped those
+ // skipped because they were archived.
+ Restoring       int `json:"restoring,omitempty"`
+ ArchivedSkipped int `json:"archivedSkipped,omitempty"`
+ // RestoresCompleted counts archived objects whose restore had
+ // completed and that were admitted for delivery.
+ RestoresCompleted int `json:"restoresCompleted,omitempty"`
+ // Pending counts remote files left for a later pull because they
+ // may still be being written.
+ Pending int `json:"pending,omitempty"`
+ // PlanLocation is the s3:// URI of the plan a dry run wrote, with
+ // DryRun set, or of the plan the run executed.
+ PlanLocation string `json:"planLocation,omitempty"`
+ DryRun       bool   `json:"dryRun,omitempty"`
+ // RetryBudgetExhausted is set when the run stopped retrying because
+ // its retry budget was spent.
+ RetryBudgetExhausted bool `json:"retryBudgetExhausted,omitempty"`
+ // DirectoriesCreated counts the remote directories created for
+ // empty S3 folders.
+ DirectoriesCreated int `json:"directoriesCreated,omitempty"`
+ // GroupsComplete, GroupsPartial and GroupsFailed count the top-level
+ // folders whose files were all, some or none delivered when files are
+ // grouped by folder.
+ GroupsComplete int `json:"groupsComplete,omitempty"`
+ GroupsPartial  int `json:"groupsPartial,omitempty"`
+ GroupsFailed   int `json:"groupsFailed,omitempty"`
+ // Profiles are the s3:// URIs of the CPU and heap profiles captured
+ // when the run was invoked with profiling on.
+ Profiles []string `json:"profiles,omitempty"`
+ // FanoutChildren counts the child invocations a fan-out coordinator
+ // started, and FanoutFailed the chunks it failed to dispatch.
+ FanoutChildren int `json:"fanoutChildren,omitempty"`
+ FanoutFailed   int `json:"fanoutFailed,omitempty"`
+ // Build identifies the build of the function that ran.
+ Build *BuildInfo `json:"build,omitempty"`
+}
+
+// BuildInfo identifies a build of the function. Modified is set when it was
+// built from a tree with uncommitted changes.
+type BuildInfo struct {
+ Version   string `json:"version"`
+ Commit    string `json:"commit,omitempty"`
+ BuildDate string `json:"buildDate,omitempty"`
+ GoVersion string `json:"goVersion"`
+ Modified  bool   `json:"modified,omitempty"`
+}
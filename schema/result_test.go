@@ -0,0 +1,124 @@
+package schema
+
+import (
+ "bytes"
+ "encoding/json"
+ "flag"
+ "os"
+ "path/filepath"
+ "reflect"
+ "testing"
+ "time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+var (
+ started  = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+ finished = started.Add(90 * time.Second)
+)
+
+// goldenResults are the results whose encoding consumers rely on. A field
+// added to ResultV1 belongs in "full", whose golden file must only change by
+// gaining it; run go test -update to rewrite it.
+var goldenResults = map[string]ResultV1{
+ "minimal": {
+  SchemaVersion: Version1,
+  RequestID:     "req-1",
+  Status:        StatusSucceeded,
+  Destination:   "sftp-poc",
+  StartedAt:     started,
+  FinishedAt:    started,
+  EmptyRun:      true,
+ },
+ "full": {
+  SchemaVersion:        Version1,
+  RequestID:            "req-2",
+  Status:               StatusPartial,
+  Destination:          "partner",
+  StartedAt:            started,
+  FinishedAt:           finished,
+  DurationMs:           90000,
+  Transferred:          40,
+  Failed:               2,
+  Skipped:              3,
+  Deferred:             5,
+  Bytes:                1 << 30,
+  P50MBps:              12.5,
+  P95MBps:              48.25,
+  Error:                "2 file(s) failed",
+  Restoring:            1,
+  ArchivedSkipped:      2,
+  RestoresCompleted:    3,
+  Pending:              4,
+  PlanLocation:         "s3://bucket/plans/req-2.json",
+  DryRun:               true,
+  RetryBudgetExhausted: true,
+  DirectoriesCreated:   6,
+  GroupsComplete:       7,
+  GroupsPartial:        8,
+  GroupsFailed:         9,
+  Profiles:             []string{"s3://bucket/profiles/req-2.cpu.pprof", "s3://bucket/profiles/req-2.heap.pprof"},
+  FanoutChildren:       10,
+  FanoutFailed:         1,
+  Build: &BuildInfo{
+   Version:   "v1.4.0",
+   Commit:    "0123456789abcdef",
+   BuildDate: "2024-04-30T08:00:00Z",
+   GoVersion: "go1.22.3",
+   Modified:  true,
+  },
+ },
+}
+
+func TestResultV1Golden(t *testing.T) {
+ for name, result := range goldenResults {
+  t.Run(name, func(t *testing.T) {
+   got, err := json.MarshalIndent(result, "", "  ")
+   if err != nil {
+    t.Fatal(err)
+   }
+   got = append(got, '\n')
+   golden := filepath.Join("testdata", "result_v1_"+name+".json")
+   if *update {
+    if err := os.WriteFile(golden, got, 0o644); err != nil {
+     t.Fatal(err)
+    }
+   }
+   want, err := os.ReadFile(golden)
+   if err != nil {
+    t.Fatal(err)
+   }
+   if !bytes.Equal(got, want) {
+    t.Errorf("encoding of %s changed; ResultV1 changes must be additive.\ngot:\n%s\nwant:\n%s", name, got, want)
+   }
+
+   // What consumers stored decodes back to the same result, and has
+   // no field ResultV1 lost.
+   dec := json.NewDecoder(bytes.NewReader(want))
+   dec.DisallowUnknownFields()
+   var decoded ResultV1
+   if err := dec.Decode(&decoded); err != nil {
+    t.Fatalf("decoding %s: %v", golden, err)
+   }
+   if !reflect.DeepEqual(decoded, result) {
+    t.Errorf("%s decodes to %+v, want %+v", golden, decoded, result)
+   }
+  })
+ }
+}
+
+// TestResultV1GoldenSetsEveryField keeps the golden results covering any
+// field added to ResultV1.
+func TestResultV1GoldenSetsEveryField(t *testing.T) {
+ typ := reflect.TypeOf(ResultV1{})
+ for i := 0; i < typ.NumField(); i++ {
+  set := false
+  for _, result := range goldenResults {
+   set = set || !reflect.ValueOf(result).Field(i).IsZero()
+  }
+  if !set {
+   t.Errorf("no golden result sets %s", typ.Field(i).Name)
+  }
+ }
+}